@@ -0,0 +1,165 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/jf87/giles2/common"
+)
+
+// Aggregate functions combine all streams matched by a data query into one
+// series, e.g.
+//
+//	select sum(data in (now -1d, now)) where Metadata/Type = 'Meter'
+//	select max(window(15min) data in (now -1d, now)) where Metadata/Type = 'Meter'
+//
+// The streams are aligned on a common time grid first. Raw readings are
+// aligned on the timestamps of all streams, and at each timestamp every stream
+// contributes its most recent reading, so a meter that reported a minute ago
+// still counts towards the total. Windows are aligned already, and every
+// stream contributes the mean of its window (or the minimum or maximum for
+// min and max). count returns the number of streams at each point.
+
+type aggregateFunc func(values []float64) float64
+
+var aggregates = map[string]aggregateFunc{
+	"sum":   sumValues,
+	"avg":   meanValues,
+	"mean":  meanValues,
+	"min":   minValues,
+	"max":   maxValues,
+	"count": func(values []float64) float64 { return float64(len(values)) },
+}
+
+func sumValues(values []float64) (sum float64) {
+	for _, v := range values {
+		sum += v
+	}
+	return
+}
+
+func meanValues(values []float64) float64 {
+	return sumValues(values) / float64(len(values))
+}
+
+func minValues(values []float64) float64 {
+	min := math.Inf(1)
+	for _, v := range values {
+		min = math.Min(min, v)
+	}
+	return min
+}
+
+func maxValues(values []float64) float64 {
+	max := math.Inf(-1)
+	for _, v := range values {
+		max = math.Max(max, v)
+	}
+	return max
+}
+
+// selects data for the matching streams within the range given by Begin/End
+// and combines them with the aggregate function in params.Functions. Any
+// functions inside the aggregate have to be transforms, which are applied to
+// each stream first
+func (a *Archiver) SelectAggregateData(ctx context.Context, params *common.DataParams) (result common.SmapMessageList, err error) {
+	fn := params.Functions[len(params.Functions)-1]
+	aggregate, found := aggregates[fn.Name]
+	if !found {
+		return result, fmt.Errorf("Unknown function %v", fn.Name)
+	}
+	if len(fn.Args) > 0 {
+		return result, fmt.Errorf("%v takes no arguments", fn.Name)
+	}
+	fns, err := lookupTransforms(params.Functions[:len(params.Functions)-1])
+	if err != nil {
+		return
+	}
+	if err = a.prepareDataParams(ctx, params); err != nil {
+		return
+	}
+	// switch order so its consistent
+	if params.End < params.Begin {
+		params.Begin, params.End = params.End, params.Begin
+	}
+	// aggregates are only defined for numeric streams
+	numeric, _, err := a.splitByStreamType(ctx, params.UUIDs)
+	if err != nil {
+		return
+	}
+	readings, err := a.numericSeries(ctx, numeric, params, fn.Name)
+	if err != nil {
+		return
+	}
+	var series = make([][]*common.SmapNumberReading, len(readings))
+	for i, resp := range readings {
+		series[i] = applyTransforms(fns, resp.Readings)
+	}
+
+	// windows are aligned already, raw readings are held until the next one
+	hold := !params.IsStatistical && !params.IsWindow
+	aggregated := common.SmapNumbersResponse{Readings: aggregateSeries(series, hold, aggregate)}
+	result = a.packResults(params, []common.SmapNumbersResponse{aggregated})
+	for _, msg := range result {
+		msg.Metadata = common.Dict{"Aggregate": fn.Name}
+	}
+	return
+}
+
+// picks the value of each window that the aggregate function combines
+func windowSeries(name string, stats []common.StatisticalNumbersResponse) [][]*common.SmapNumberReading {
+	var series = make([][]*common.SmapNumberReading, len(stats))
+	for i, resp := range stats {
+		for _, window := range resp.Readings {
+			if window.Count == 0 {
+				continue
+			}
+			rdg := &common.SmapNumberReading{Time: window.Time, UoT: common.UOT_NS, Value: window.Mean}
+			switch name {
+			case "min":
+				rdg.Value = window.Min
+			case "max":
+				rdg.Value = window.Max
+			}
+			series[i] = append(series[i], rdg)
+		}
+	}
+	return series
+}
+
+// Combines the time-ordered series into one series with a point at every
+// timestamp of any of the series. If hold is true, each series contributes its
+// most recent value to every point, otherwise only values at that exact time
+func aggregateSeries(series [][]*common.SmapNumberReading, hold bool, aggregate aggregateFunc) []*common.SmapNumberReading {
+	var (
+		// index of the next reading of each series
+		next   = make([]int, len(series))
+		values = make([]float64, 0, len(series))
+		ret    = []*common.SmapNumberReading{}
+	)
+	for {
+		var (
+			now   uint64
+			found bool
+		)
+		for i, readings := range series {
+			if next[i] < len(readings) && (!found || readings[next[i]].Time < now) {
+				now, found = readings[next[i]].Time, true
+			}
+		}
+		if !found {
+			return ret
+		}
+		values = values[:0]
+		for i, readings := range series {
+			for next[i] < len(readings) && readings[next[i]].Time <= now {
+				next[i] += 1
+			}
+			if next[i] > 0 && (hold || readings[next[i]-1].Time == now) {
+				values = append(values, readings[next[i]-1].Value)
+			}
+		}
+		ret = append(ret, &common.SmapNumberReading{Time: now, UoT: common.UOT_NS, Value: aggregate(values)})
+	}
+}
@@ -0,0 +1,45 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestAggregateQueries(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	base, minute := uint64(1451606400000000000), uint64(time.Minute)
+	// one meter reports on even minutes, the other on odd minutes
+	for i, times := range [][]uint64{{base, base + 2*minute, base + 4*minute}, {base + minute, base + 3*minute}} {
+		msg := &common.SmapMessage{UUID: common.NewUUID(), Path: fmt.Sprintf("/meter%d", i), Metadata: common.Dict{"Type": "Meter"}}
+		for j, t := range times {
+			msg.Readings = append(msg.Readings, &common.SmapNumberReading{Time: t, UoT: common.UOT_NS, Value: float64((j + 1) * (1 + 9*i))})
+		}
+		if err := a.AddData(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		query  string
+		values []float64
+	}{
+		// every stream contributes its most recent reading
+		{"select sum(data in (1451606400, 1451606700) as ns) where Metadata/Type = 'Meter'", []float64{1, 11, 12, 22, 23}},
+		{"select avg(data) in (1451606400, 1451606700) as ns where Metadata/Type = 'Meter'", []float64{1, 5.5, 6, 11, 11.5}},
+		{"select count(data in (1451606400, 1451606700) as ns) where Metadata/Type = 'Meter'", []float64{1, 2, 2, 2, 2}},
+		// windows are combined by their maximum
+		{"select max(window(2min) data in (1451606400, 1451606700) as ns) where Metadata/Type = 'Meter'", []float64{10, 20, 3}},
+		{"select min(window(2min) data in (1451606400, 1451606700) as ns) where Metadata/Type = 'Meter'", []float64{1, 2, 3}},
+	} {
+		checkSeries(t, a, test.query, base, nil, test.values)
+	}
+
+	if _, err := a.HandleQuery(context.Background(), "select median(data in (1451606400, 1451606700)) where Metadata/Type = 'Meter'"); err == nil {
+		t.Error("Unknown functions should be rejected")
+	}
+}
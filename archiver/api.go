@@ -1,15 +1,32 @@
 package archiver
 
 import (
+	"context"
+	"fmt"
+	"math/bits"
+	"sort"
+
 	"github.com/jf87/giles2/common"
 )
 
-func (a *Archiver) SelectTags(params *common.TagParams) (QueryResult, error) {
-	return a.mdStore.GetTags(params.Tags, params.Where.ToBson())
+func (a *Archiver) SelectTags(ctx context.Context, params *common.TagParams) (QueryResult, error) {
+	md, where, err := a.metadataAsOf(ctx, params.AsOf, params.Where)
+	if err != nil {
+		return nil, err
+	}
+	if params.Limit > 0 || params.Offset > 0 || params.OrderBy != nil {
+		res, _, err := md.GetTagsPage(ctx, params.Tags, where.ToBson(), params.OrderBy, params.Offset, params.Limit)
+		return res, err
+	}
+	return md.GetTags(ctx, params.Tags, where.ToBson())
 }
 
-func (a *Archiver) DistinctTag(params *common.DistinctParams) (QueryResult, error) {
-	return a.mdStore.GetDistinct(params.Tag, params.Where.ToBson())
+func (a *Archiver) DistinctTag(ctx context.Context, params *common.DistinctParams) (QueryResult, error) {
+	md, where, err := a.metadataAsOf(ctx, params.AsOf, params.Where)
+	if err != nil {
+		return nil, err
+	}
+	return md.GetDistinct(ctx, params.Tag, where.ToBson())
 }
 
 //check for user/password
@@ -17,116 +34,357 @@ func (a *Archiver) GetUser(params *common.UserParams) (string, error) {
 	return a.mdStore.GetUser(params.Where.ToBson())
 }
 
+// the streams whose tag has the same value
+type StreamGroup struct {
+	Value string
+	UUIDs []common.UUID
+}
+
+// groups the streams matching the where clause by the distinct values of the
+// tag. Streams without the tag do not belong to any group
+func (a *Archiver) GroupUUIDs(ctx context.Context, tag string, where common.Dict) ([]StreamGroup, error) {
+	return groupUUIDs(ctx, a.mdStore, tag, where)
+}
+
+func groupUUIDs(ctx context.Context, md MetadataStore, tag string, where common.Dict) ([]StreamGroup, error) {
+	values, err := md.GetDistinct(ctx, tag, where.ToBson())
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(values)
+	var groups = make([]StreamGroup, len(values))
+	for i, value := range values {
+		groupWhere := common.Dict{"$and": []common.Dict{where, common.Dict{common.FixMongoKey(tag): groupValue(value)}}}
+		groups[i].Value = value
+		if groups[i].UUIDs, err = md.GetUUIDs(ctx, groupWhere.ToBson()); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+// GetDistinct formats numbers as strings, so the group of the value "4" also
+// holds the streams whose tag is the number 4
+func groupValue(value string) interface{} {
+	if n, ok := common.NumericValue(value); ok && fmt.Sprintf("%v", n) == value {
+		return common.Dict{"$in": []interface{}{value, n}}
+	}
+	return value
+}
+
 // selects data for the matching streams within the range given
 // by Begin/End
-func (a *Archiver) SelectDataRange(params *common.DataParams) (common.SmapMessageList, error) {
+func (a *Archiver) SelectDataRange(ctx context.Context, params *common.DataParams) (common.SmapMessageList, error) {
+	result, _, err := a.selectDataRange(ctx, params)
+	return result, err
+}
+
+// like SelectDataRange, but also returns the cursor to the next page if
+// the streamlimit or the limit truncated the result
+func (a *Archiver) selectDataRange(ctx context.Context, params *common.DataParams) (common.SmapMessageList, *queryCursor, error) {
 	var (
 		err      error
 		result   = common.SmapMessageList{}
 		readings []common.SmapNumbersResponse
+		objects  []common.SmapObjectResponse
+		next     *queryCursor
 	)
-	if err = a.prepareDataParams(params); err != nil {
-		return result, err
+	// one more stream tells whether there is another page of streams
+	streamLimit := params.StreamLimit
+	if streamLimit > 0 {
+		params.StreamLimit += 1
 	}
+	err = a.prepareDataParams(ctx, params)
+	params.StreamLimit = streamLimit
+	if err != nil {
+		return result, next, err
+	}
+	moreStreams := streamLimit > 0 && len(params.UUIDs) > streamLimit
+	if moreStreams {
+		params.UUIDs = params.UUIDs[:streamLimit]
+		// the extra stream is not part of the page
+		traceOf(ctx).resolved(-1)
+	}
+	params.UUIDs = resumedUUIDs(params.UUIDs, params)
 
 	// switch order so its consistent
 	if params.End < params.Begin {
 		params.Begin, params.End = params.End, params.Begin
 	}
 
-	// fetch readings
-	readings, err = a.tsStore.GetData(params.UUIDs, params.Begin, params.End)
+	numeric, objectStreams, err := a.splitByStreamType(ctx, params.UUIDs)
+	if err != nil {
+		return result, next, err
+	}
+
+	// fetch readings. One more reading than the limit tells whether the
+	// stream continues on another page
+	var pageLimit int
+	if params.DataLimit > 0 {
+		pageLimit = params.DataLimit + 1
+	}
+	readings, err = a.getDataPage(ctx, numeric, params, pageLimit)
 	if err != nil {
-		return result, err
+		return result, next, err
+	}
+	if len(objectStreams) > 0 {
+		objects, err = a.getResumedObjects(ctx, objectStreams, params)
+		if err != nil {
+			return result, next, err
+		}
+	}
+
+	// streams cut off by the limit continue at their first reading left out
+	var resume = make(map[common.UUID]uint64)
+	if params.DataLimit > 0 {
+		for _, resp := range readings {
+			if len(resp.Readings) > params.DataLimit {
+				resume[resp.UUID] = resp.Readings[params.DataLimit].Time
+			}
+		}
+		for _, resp := range objects {
+			if len(resp.Readings) > params.DataLimit {
+				resume[resp.UUID] = resp.Readings[params.DataLimit].Time
+			}
+		}
+	}
+	if len(resume) > 0 {
+		next = &queryCursor{Offset: params.StreamOffset, Resume: resume}
+	} else if moreStreams {
+		next = &queryCursor{Offset: params.StreamOffset + streamLimit}
 	}
 
 	// convert readings into the correct unit of time
 	result = a.packResults(params, readings)
+	result = append(result, a.packObjectResults(params, objects)...)
 
-	return result, nil
+	return result, next, nil
 }
 
 // selects the data point most immediately before the Start parameter for all matching streams
-func (a *Archiver) SelectDataBefore(params *common.DataParams) (result common.SmapMessageList, err error) {
-	var readings []common.SmapNumbersResponse
-	if err = a.prepareDataParams(params); err != nil {
+func (a *Archiver) SelectDataBefore(ctx context.Context, params *common.DataParams) (result common.SmapMessageList, err error) {
+	var (
+		readings []common.SmapNumbersResponse
+		objects  []common.SmapObjectResponse
+	)
+	if err = a.prepareDataParams(ctx, params); err != nil {
 		return
 	}
-	readings, err = a.tsStore.Prev(params.UUIDs, params.Begin)
+	numeric, objectStreams, err := a.splitByStreamType(ctx, params.UUIDs)
+	if err != nil {
+		return
+	}
+	if readings, err = a.prevData(ctx, numeric, params.Begin); err != nil {
+		return
+	}
+	if len(objectStreams) > 0 {
+		if objects, err = a.objStore.PrevObjects(ctx, objectStreams, params.Begin); err != nil {
+			return
+		}
+		traceOf(ctx).fetched("PrevObjects")
+	}
 	result = a.packResults(params, readings)
+	result = append(result, a.packObjectResults(params, objects)...)
 	return
 }
 
 // selects the data point most immediately after the Start parameter for all matching streams
-func (a *Archiver) SelectDataAfter(params *common.DataParams) (result common.SmapMessageList, err error) {
-	var readings []common.SmapNumbersResponse
-	if err = a.prepareDataParams(params); err != nil {
+func (a *Archiver) SelectDataAfter(ctx context.Context, params *common.DataParams) (result common.SmapMessageList, err error) {
+	var (
+		readings []common.SmapNumbersResponse
+		objects  []common.SmapObjectResponse
+	)
+	if err = a.prepareDataParams(ctx, params); err != nil {
+		return
+	}
+	numeric, objectStreams, err := a.splitByStreamType(ctx, params.UUIDs)
+	if err != nil {
+		return
+	}
+	if readings, err = a.nextData(ctx, numeric, params.Begin); err != nil {
 		return
 	}
-	readings, err = a.tsStore.Next(params.UUIDs, params.Begin)
+	if len(objectStreams) > 0 {
+		if objects, err = a.objStore.NextObjects(ctx, objectStreams, params.Begin); err != nil {
+			return
+		}
+		traceOf(ctx).fetched("NextObjects")
+	}
 	result = a.packResults(params, readings)
+	result = append(result, a.packObjectResults(params, objects)...)
 	return
 }
 
-func (a *Archiver) SelectStatisticalData(params *common.DataParams) (result common.SmapMessageList, err error) {
+// statistics are only defined for numeric streams, so object streams are skipped
+func (a *Archiver) SelectStatisticalData(ctx context.Context, params *common.DataParams) (result common.SmapMessageList, err error) {
 	var readings []common.StatisticalNumbersResponse
-	if err = a.prepareDataParams(params); err != nil {
+	if err = a.prepareDataParams(ctx, params); err != nil {
 		return
 	}
 	// switch order so its consistent
 	if params.End < params.Begin {
 		params.Begin, params.End = params.End, params.Begin
 	}
-	if params.IsStatistical {
-		readings, err = a.tsStore.StatisticalData(params.UUIDs, params.PointWidth, params.Begin, params.End)
-	} else if params.IsWindow {
-		readings, err = a.tsStore.WindowData(params.UUIDs, params.Width, params.Begin, params.End)
+	numeric, _, err := a.splitByStreamType(ctx, params.UUIDs)
+	if err != nil {
+		return
+	}
+	if params.IsStatistical || params.IsWindow {
+		readings, err = a.statisticalData(ctx, numeric, params)
 	}
 	result = a.packStatsResults(params, readings)
 	return
 }
 
-func (a *Archiver) DeleteData(params *common.DataParams) (err error) {
-	if err = a.prepareDataParams(params); err != nil {
+// Removes the readings in [Begin, End) from the matching streams and reports
+// how many there were. A dry run only counts the readings that would be
+// removed. Readings that arrive while the streams are deleted from are not
+// counted
+func (a *Archiver) DeleteData(ctx context.Context, params *common.DataParams) (result common.ChangeResult, err error) {
+	if err = a.prepareDataParams(ctx, params); err != nil {
 		return
 	}
 	// switch order so its consistent
 	if params.End < params.Begin {
 		params.Begin, params.End = params.End, params.Begin
 	}
-	return a.tsStore.DeleteData(params.UUIDs, params.Begin, params.End)
+	result = common.ChangeResult{DryRun: params.DryRun, UUIDs: params.UUIDs}
+	numeric, objectStreams, err := a.splitByStreamType(ctx, params.UUIDs)
+	if err != nil {
+		return
+	}
+	if result.Readings, err = a.countReadingsInRange(ctx, numeric, objectStreams, params.Begin, params.End); err != nil || params.DryRun {
+		return
+	}
+	// a query that timed out while its streams were resolved or counted
+	// deletes nothing. Once started, the delete is not given up on halfway
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if len(objectStreams) > 0 {
+		if err = a.objStore.DeleteObjects(objectStreams, params.Begin, params.End); err != nil {
+			return
+		}
+	}
+	err = a.tsStore.DeleteData(numeric, params.Begin, params.End)
+	return
 }
 
-func (a *Archiver) DeleteTags(params *common.TagParams) (err error) {
+// counts the readings in [start, end) of the numeric and object streams
+func (a *Archiver) countReadingsInRange(ctx context.Context, numeric, objectStreams []common.UUID, start, end uint64) (count uint64, err error) {
+	// about 65536 statistical windows over the range
+	pw := bits.Len64((end - start) >> 16)
+	for _, uuid := range numeric {
+		var n uint64
+		if n, err = countReadings(ctx, a.tsStore, uuid, start, end, pw); err != nil {
+			return
+		}
+		count += n
+	}
+	if len(objectStreams) > 0 {
+		var n uint64
+		if n, err = a.objStore.CountObjects(ctx, objectStreams, start, end); err != nil {
+			return
+		}
+		count += n
+	}
+	return
+}
+
+// Removes the given tags from the matching streams, or the whole metadata
+// documents if no tags are given. A dry run only reports the matching streams
+func (a *Archiver) DeleteTags(ctx context.Context, params *common.TagParams) (result common.ChangeResult, err error) {
+	result.DryRun = params.DryRun
+	where := params.Where.ToBson()
+	if result.UUIDs, err = a.mdStore.GetUUIDs(ctx, where); err != nil {
+		return
+	}
+	traceOf(ctx).resolved(len(result.UUIDs))
+	if params.DryRun {
+		result.Documents = len(result.UUIDs)
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
 	if len(params.Tags) > 0 {
 		log.Debugf("Removing tags %v docs where %v", params.Tags, params.Where)
-		return a.mdStore.RemoveTags(params.Tags, params.Where.ToBson())
+		result.Documents, err = a.mdStore.RemoveTags(params.Tags, where)
+	} else {
+		log.Debugf("Removing all docs where %v", params.Where)
+		result.Documents, err = a.mdStore.RemoveDocs(where)
+	}
+	if err != nil {
+		return
 	}
-	log.Debugf("Removing all docs where %v", params.Where)
-	return a.mdStore.RemoveDocs(params.Where.ToBson())
+	err = a.recordVersions(result.UUIDs, params.Writer)
+	return
 }
 
-func (a *Archiver) SetTags(params *common.SetParams) (err error) {
+// Applies the updates to the matching streams. A dry run only reports the
+// matching streams
+func (a *Archiver) SetTags(ctx context.Context, params *common.SetParams) (result common.ChangeResult, err error) {
 	log.Debugf("Apply updates %v where %v", params.Set, params.Where)
+	result.DryRun = params.DryRun
 	if len(params.Set) == 0 {
-		return nil
+		return
+	}
+	where := params.Where.ToBson()
+	if result.UUIDs, err = a.mdStore.GetUUIDs(ctx, where); err != nil {
+		return
+	}
+	traceOf(ctx).resolved(len(result.UUIDs))
+	if params.DryRun {
+		result.Documents = len(result.UUIDs)
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if result.Documents, err = a.mdStore.UpdateDocs(params.Set.ToBson(), where); err != nil {
+		return
 	}
-	return a.mdStore.UpdateDocs(params.Set.ToBson(), params.Where.ToBson())
+	err = a.recordVersions(result.UUIDs, params.Writer)
+	return
 }
 
-func (a *Archiver) prepareDataParams(params *common.DataParams) (err error) {
+func (a *Archiver) prepareDataParams(ctx context.Context, params *common.DataParams) (err error) {
 	// parse and evaluate the where clause if we need to
 	if len(params.Where) > 0 {
-		params.UUIDs, err = a.mdStore.GetUUIDs(params.Where.ToBson())
+		var (
+			md    MetadataStore
+			where common.Dict
+		)
+		if md, where, err = a.metadataAsOf(ctx, params.AsOf, params.Where); err != nil {
+			return err
+		}
+		if params.OrderBy != nil {
+			params.UUIDs, err = orderedUUIDs(ctx, md, where, params.OrderBy)
+		} else {
+			params.UUIDs, err = md.GetUUIDs(ctx, where.ToBson())
+		}
 		if err != nil {
 			return err
 		}
 	}
 
+	// unless they are ordered by a tag, pages of streams are taken in
+	// order of their UUID
+	if params.OrderBy == nil && (params.StreamOffset > 0 || params.StreamLimit > 0) {
+		sortUUIDs(params.UUIDs)
+	}
+	if params.StreamOffset > 0 {
+		if params.StreamOffset > len(params.UUIDs) {
+			params.StreamOffset = len(params.UUIDs)
+		}
+		params.UUIDs = params.UUIDs[params.StreamOffset:]
+	}
+
 	// apply the streamlimit if it exists
 	if params.StreamLimit > 0 && len(params.UUIDs) > params.StreamLimit {
 		params.UUIDs = params.UUIDs[:params.StreamLimit]
 	}
+	traceOf(ctx).resolved(len(params.UUIDs))
 
 	// make sure that Begin/End are both in nanoseconds
 	if begin_uot := common.GuessTimeUnit(params.Begin); begin_uot != common.UOT_NS {
@@ -144,6 +402,27 @@ func (a *Archiver) prepareDataParams(params *common.DataParams) (err error) {
 	return nil
 }
 
+// separates the given streams into numeric streams, which live in the
+// timeseries store, and object streams, which live in the object store. If
+// there is no object store, all streams are treated as numeric
+func (a *Archiver) splitByStreamType(ctx context.Context, uuids []common.UUID) (numeric, objects []common.UUID, err error) {
+	if a.objStore == nil {
+		return uuids, nil, nil
+	}
+	for _, uuid := range uuids {
+		var st common.StreamType
+		if st, err = a.mdStore.GetStreamType(ctx, uuid); err != nil {
+			return
+		}
+		if st == common.OBJECT_STREAM {
+			objects = append(objects, uuid)
+		} else {
+			numeric = append(numeric, uuid)
+		}
+	}
+	return
+}
+
 func (a *Archiver) packResults(params *common.DataParams, readings []common.SmapNumbersResponse) common.SmapMessageList {
 	var result = common.SmapMessageList{}
 	for _, resp := range readings {
@@ -183,3 +462,23 @@ func (a *Archiver) packStatsResults(params *common.DataParams, readings []common
 	log.Debugf("Returning %d readings", len(result))
 	return result
 }
+
+func (a *Archiver) packObjectResults(params *common.DataParams, readings []common.SmapObjectResponse) common.SmapMessageList {
+	var result = common.SmapMessageList{}
+	for _, resp := range readings {
+		if len(resp.Readings) > 0 {
+			msg := &common.SmapMessage{UUID: resp.UUID}
+			for _, rdg := range resp.Readings {
+				rdg.ConvertTime(common.UnitOfTime(params.ConvertToUnit))
+				msg.Readings = append(msg.Readings, rdg)
+			}
+			// apply data limit if exists
+			if params.DataLimit > 0 && len(msg.Readings) > params.DataLimit {
+				msg.Readings = msg.Readings[:params.DataLimit]
+			}
+			result = append(result, msg)
+		}
+	}
+	log.Debugf("Returning %d object readings", len(result))
+	return result
+}
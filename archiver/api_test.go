@@ -0,0 +1,218 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/common"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDeleteQueries(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	base, hour := uint64(1451606400000000000), uint64(time.Hour)
+	soda, cory := common.NewUUID(), common.NewUUID()
+	for uuid, building := range map[common.UUID]string{soda: "Soda", cory: "Cory"} {
+		msg := embeddedTestMessage(uuid, base, base+hour, base+2*hour)
+		msg.Path = "/" + building
+		msg.Metadata = common.Dict{"Building": building}
+		if err := a.AddData(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	change := func(query string) common.ChangeResult {
+		res, err := a.HandleQuery(context.Background(), query)
+		if err != nil {
+			t.Fatalf("%v: %v", query, err)
+		}
+		return res.(common.ChangeResult)
+	}
+
+	// deleting is refused unless allowed, but dry runs change nothing
+	if _, err := a.HandleQuery(context.Background(), "delete where Metadata/Building = 'Soda'"); err == nil {
+		t.Error("DELETE should be refused unless AllowDelete is set")
+	}
+	if res := change("delete data in (1451606400, 1451610000) where Metadata/Building = 'Soda' dry run"); !res.DryRun || len(res.UUIDs) != 1 || res.Readings != 1 {
+		t.Errorf("Expected a dry run removing 1 reading from 1 stream, got %+v", res)
+	}
+	if data, _ := a.tsStore.GetData(context.Background(), []common.UUID{soda}, base, base+3*hour); len(data[0].Readings) != 3 {
+		t.Errorf("Dry run removed readings: %v", data[0].Readings)
+	}
+
+	a.Config.Archiver.AllowDelete = true
+	if res := change("delete data in (1451606400, 1451610000) where Metadata/Building = 'Soda'"); res.DryRun || len(res.UUIDs) != 1 || res.Readings != 1 {
+		t.Errorf("Expected 1 reading removed from 1 stream, got %+v", res)
+	}
+	if data, _ := a.tsStore.GetData(context.Background(), []common.UUID{soda}, base, base+3*hour); len(data[0].Readings) != 2 {
+		t.Errorf("Expected 2 remaining readings, got %v", data[0].Readings)
+	}
+
+	if res := change("set Metadata/Floor = '4' where Metadata/Building = 'Cory' dry run"); res.Documents != 1 || res.UUIDs[0] != cory {
+		t.Errorf("Expected a dry run updating %v, got %+v", cory, res)
+	}
+	if found, _ := a.mdStore.GetUUIDs(context.Background(), common.Dict{"Metadata.Floor": "4"}.ToBson()); len(found) != 0 {
+		t.Errorf("Dry run updated %v", found)
+	}
+	if res := change("set Metadata/Floor = '4' where Metadata/Building = 'Cory'"); res.Documents != 1 {
+		t.Errorf("Expected 1 updated document, got %+v", res)
+	}
+	if res := change("delete Metadata/Floor where Metadata/Building = 'Cory'"); res.Documents != 1 {
+		t.Errorf("Expected 1 document with a removed tag, got %+v", res)
+	}
+	if res := change("delete where Metadata/Building = 'Soda'"); res.Documents != 1 {
+		t.Errorf("Expected 1 removed document, got %+v", res)
+	}
+	if found, _ := a.mdStore.GetUUIDs(context.Background(), nil); len(found) != 1 || found[0] != cory {
+		t.Errorf("Expected only %v to remain, got %v", cory, found)
+	}
+}
+
+// cancels the query once its where clause is resolved, as if it timed out
+// right then
+type cancellingStore struct {
+	MetadataStore
+	cancel context.CancelFunc
+}
+
+func (c *cancellingStore) GetUUIDs(ctx context.Context, where bson.M) ([]common.UUID, error) {
+	defer c.cancel()
+	return c.MetadataStore.GetUUIDs(ctx, where)
+}
+
+func TestTimedOutChanges(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	a.Config.Archiver.AllowDelete = true
+	base := uint64(1451606400000000000)
+	sensor := common.NewUUID()
+	msg := embeddedTestMessage(sensor, base)
+	msg.Path = "/sensor"
+	msg.Metadata = common.Dict{"Building": "Soda"}
+	if err := a.AddData(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stores do not give up on writes, so queries that time out before
+	// they start changing anything change nothing
+	for _, query := range []string{
+		"delete data in (1451606400, 1451610000) where Metadata/Building = 'Soda'",
+		"set Metadata/Floor = '4' where Metadata/Building = 'Soda'",
+		"delete Metadata/Building where Metadata/Building = 'Soda'",
+		"delete where Metadata/Building = 'Soda'",
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		a.mdStore = &cancellingStore{MetadataStore: a.mdStore, cancel: cancel}
+		if _, err := a.HandleQuery(ctx, query); err != context.Canceled {
+			t.Errorf("%v: expected %v, got %v", query, context.Canceled, err)
+		}
+		a.mdStore = a.mdStore.(*cancellingStore).MetadataStore
+	}
+	if data, _ := a.tsStore.GetData(context.Background(), []common.UUID{sensor}, base, base+1); len(data) != 1 || len(data[0].Readings) != 1 {
+		t.Errorf("Expected the reading to be kept, got %v", data)
+	}
+	res, err := a.mdStore.GetTags(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Metadata["Building"] != "Soda" || res[0].Metadata["Floor"] != nil {
+		t.Errorf("Expected the document to be unchanged, got %v", res)
+	}
+}
+
+func TestGroupByQueries(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	base, hour := uint64(1451606400000000000), uint64(time.Hour)
+	for i, building := range []string{"Soda", "Soda", "Cory", ""} {
+		msg := embeddedTestMessage(common.NewUUID(), base, base+hour)
+		msg.Path = fmt.Sprintf("/meter%d", i)
+		msg.Metadata = common.Dict{"Type": "Meter"}
+		if building != "" {
+			msg.Metadata["Building"] = building
+		}
+		if err := a.AddData(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one series per building, streams without a building are left out
+	res, err := a.HandleQuery(context.Background(), "select sum(data in (1451606400, 1451613600)) where Metadata/Type = 'Meter' group by Metadata/Building")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := res.(common.SmapMessageList)
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 groups, got %v", result)
+	}
+	for i, expected := range []struct {
+		building string
+		sum      float64
+	}{{"Cory", 1}, {"Soda", 2}} {
+		if building := result[i].Group["Metadata.Building"]; building != expected.building {
+			t.Errorf("Expected group %v, got %v", expected.building, result[i].Group)
+		}
+		if sum := result[i].Readings[1].(*common.SmapNumberReading).Value; sum != expected.sum {
+			t.Errorf("Expected sum %v for %v, got %v", expected.sum, expected.building, sum)
+		}
+	}
+
+	// without an aggregate, every stream is labeled with its group
+	res, err = a.HandleQuery(context.Background(), "select data in (1451606400, 1451613600) where Metadata/Type = 'Meter' group by Metadata/Building")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result = res.(common.SmapMessageList); len(result) != 3 || result[2].Group["Metadata.Building"] != "Soda" {
+		t.Errorf("Expected 3 labeled streams, got %v", result)
+	}
+}
+
+func TestGroupNumericValues(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	floors := map[common.UUID]interface{}{common.NewUUID(): 4, common.NewUUID(): "4", common.NewUUID(): 10.5}
+	for uuid, floor := range floors {
+		if _, err := a.mdStore.SaveTags(&common.SmapMessage{UUID: uuid, Path: "/" + string(uuid), Metadata: common.Dict{"Type": "Room", "Floor": floor}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	groups, err := a.GroupUUIDs(context.Background(), "Metadata/Floor", common.Dict{"Metadata.Type": "Room"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || groups[0].Value != "10.5" || len(groups[0].UUIDs) != 1 || groups[1].Value != "4" || len(groups[1].UUIDs) != 2 {
+		t.Errorf("Expected floor 4 with 2 streams and floor 10.5 with 1, got %+v", groups)
+	}
+}
+
+func TestDeletePermission(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	a.Config.Archiver.AllowDelete = true
+	a.Config.Authentication.Enabled = true
+	a.mdStore.(*memoryStore).users = []bson.M{
+		{"_id": "alice", "password": "x", "permissions": []interface{}{"delete"}},
+		{"_id": "bob", "password": "x"},
+	}
+	msg := embeddedTestMessage(common.NewUUID(), 1451606400000000000)
+	msg.Path = "/sensor"
+	msg.Metadata = common.Dict{"Building": "Soda"}
+	if err := a.AddData(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	query := "delete data in (1451606400, 1451610000) where Metadata/Building = 'Soda'"
+	for _, writer := range []string{"bob", "mallory", "127.0.0.1:4000"} {
+		if _, err := a.HandleQueryBy(context.Background(), query, writer); err == nil {
+			t.Errorf("%v should not be allowed to DELETE", writer)
+		}
+	}
+	if _, err := a.HandleQueryBy(context.Background(), query+" dry run", "bob"); err != nil {
+		t.Errorf("Dry runs should be allowed for everyone (%v)", err)
+	}
+	if _, err := a.HandleQueryBy(context.Background(), query, "alice"); err != nil {
+		t.Errorf("alice should be allowed to DELETE (%v)", err)
+	}
+}
@@ -2,7 +2,9 @@
 package archiver
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"time"
@@ -31,7 +33,13 @@ type Archiver struct {
 	tsStore TimeseriesStore
 	// metadata store
 	mdStore MetadataStore
-	// transaction coalescer
+	// object store, nil if objects are not configured
+	objStore ObjectStore
+	// transaction coalescer, nil if writes are not coalesced
+	coalescer *coalescer
+	// cached virtual stream definitions
+	virtual virtualCache
+	// query processor
 	qp *querylang.QueryProcessor
 	// broker
 	broker *Broker
@@ -45,14 +53,138 @@ type Archiver struct {
 // program if there is an error in setting up connections to databases or reading
 // the config file
 func NewArchiver(c *Config) (a *Archiver) {
-	var (
-		mdStore MetadataStore
-		tsStore TimeseriesStore
-	)
+	var tsStore TimeseriesStore
 
 	a = &Archiver{}
 
-	switch *c.Archiver.MetadataStore {
+	a.mdStore = newMetadataStore(*c.Archiver.MetadataStore, c)
+
+	tsStore = newTimeseriesStore(*c.Archiver.TimeseriesStore, c, a.mdStore)
+
+	a.metrics = make(metricMap)
+	a.metrics.addMetric("adds")
+
+	// mirrors receive a copy of every write, but reads are only served
+	// by the primary store
+	if len(c.Mirror) > 0 {
+		config := &fanoutConfig{
+			primary: tsStore,
+			mirrors: make(map[string]TimeseriesStore),
+			metrics: a.metrics,
+		}
+		if c.Archiver.MirrorQueueSize != nil {
+			config.queueSize = *c.Archiver.MirrorQueueSize
+		}
+		for name, mirror := range c.Mirror {
+			config.mirrors[name] = newMirrorStore(name, mirror, c, a.mdStore)
+		}
+		tsStore = newFanoutStore(config)
+	}
+
+	if c.Spool.Enabled {
+		config := &spoolConfig{
+			dir:     *c.Spool.Directory,
+			retry:   5 * time.Second,
+			metrics: a.metrics,
+		}
+		if c.Spool.MaxSize != nil {
+			config.maxBytes = int64(*c.Spool.MaxSize) * 1024 * 1024
+		}
+		if c.Spool.RetryInterval != nil {
+			config.retry = time.Duration(*c.Spool.RetryInterval) * time.Second
+		}
+		tsStore = newSpoolStore(tsStore, config)
+	}
+
+	// reads are traced for EXPLAIN
+	a.tsStore = &tracedStore{tsStore}
+
+	if c.Coalescer.Enabled {
+		config := &coalescerConfig{
+			store:       a.tsStore,
+			interval:    time.Second,
+			maxReadings: 100,
+		}
+		if c.Coalescer.Interval != nil {
+			config.interval = time.Duration(*c.Coalescer.Interval) * time.Millisecond
+		}
+		if c.Coalescer.MaxReadings != nil {
+			config.maxReadings = *c.Coalescer.MaxReadings
+		}
+		a.coalescer = newCoalescer(config)
+	}
+
+	if c.Archiver.Objects != nil {
+		switch *c.Archiver.Objects {
+		case "mongo":
+			mongoaddr, err := net.ResolveTCPAddr("tcp4", *c.Mongo.Address+":"+*c.Mongo.Port)
+			if err != nil {
+				log.Fatalf("Error parsing Mongo address: %v", err)
+			}
+			a.objStore = newMongoObjectStore(&mongoConfig{address: mongoaddr})
+		case "embedded":
+			a.objStore = newEmbeddedObjectDB(&embeddedConfig{dir: *c.Embedded.Directory})
+		case "", "none":
+		default:
+			log.Fatalf(*c.Archiver.Objects, " is not a recognized object store")
+		}
+	}
+
+	var cacheSize int
+	if c.Archiver.QueryCacheSize != nil {
+		cacheSize = *c.Archiver.QueryCacheSize
+	}
+	location := time.Local
+	if c.Archiver.Timezone != nil && *c.Archiver.Timezone != "" {
+		loaded, err := time.LoadLocation(*c.Archiver.Timezone)
+		if err != nil {
+			log.Fatalf("Could not load time zone %v (%v)", *c.Archiver.Timezone, err)
+		}
+		location = loaded
+	}
+	a.qp = querylang.NewQueryProcessor(cacheSize, location)
+
+	a.broker = NewBroker(a)
+
+	if c.Retention.Interval != nil && *c.Retention.Interval > 0 {
+		a.startRetention(time.Duration(*c.Retention.Interval) * time.Minute)
+	}
+
+	if c.Rollup.Interval != nil && *c.Rollup.Interval > 0 {
+		a.startRollups(time.Duration(*c.Rollup.Interval) * time.Minute)
+	}
+
+	a.Config = c
+
+	if c.Archiver.PeriodicReport {
+		a.startReport()
+	}
+
+	return
+}
+
+// Writes out everything that is still buffered before giles exits: first the
+// coalesced readings, which then pass through the spool, and then the stores
+func (a *Archiver) Close() {
+	if a.coalescer != nil {
+		a.coalescer.Close()
+	}
+	if closer, ok := a.tsStore.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Errorf("Error closing timeseries store: %v", err)
+		}
+	}
+	if closer, ok := a.mdStore.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Errorf("Error closing metadata store: %v", err)
+		}
+	}
+}
+
+// Returns the metadata store with the given name. Will Fatal out of the
+// program if the store is unknown or cannot be reached
+func newMetadataStore(name string, c *Config) MetadataStore {
+	switch name {
 	case "mongo":
 		mongoaddr, err := net.ResolveTCPAddr("tcp4", *c.Mongo.Address+":"+*c.Mongo.Port)
 		if err != nil {
@@ -61,14 +193,26 @@ func NewArchiver(c *Config) (a *Archiver) {
 		config := &mongoConfig{
 			address: mongoaddr,
 		}
-		mdStore = newMongoStore(config)
+		return newMongoStore(config)
+	case "memory":
+		config := &memoryConfig{}
+		if c.Memory.Snapshot != nil {
+			config.snapshot = *c.Memory.Snapshot
+		}
+		if c.Memory.SnapshotInterval != nil {
+			config.interval = time.Duration(*c.Memory.SnapshotInterval) * time.Second
+		}
+		return newMemoryStore(config)
 	default:
-		log.Fatalf(*c.Archiver.MetadataStore, " is not a recognized metadata store")
+		log.Fatalf(name, " is not a recognized metadata store")
 	}
+	return nil
+}
 
-	a.mdStore = mdStore
-
-	switch *c.Archiver.TimeseriesStore {
+// Returns the timeseries store with the given name. Will Fatal out of the
+// program if the store is unknown or cannot be reached
+func newTimeseriesStore(name string, c *Config, mdStore MetadataStore) TimeseriesStore {
+	switch name {
 	case "quasar":
 		qsraddr, err := net.ResolveTCPAddr("tcp4", *c.Quasar.Address+":"+*c.Quasar.Port)
 		if err != nil {
@@ -76,9 +220,9 @@ func NewArchiver(c *Config) (a *Archiver) {
 		}
 		config := &quasarConfig{
 			addr:    qsraddr,
-			mdStore: a.mdStore,
+			mdStore: mdStore,
 		}
-		tsStore = newQuasarDB(config)
+		return newQuasarDB(config)
 	case "btrdb":
 		btrdbaddr, err := net.ResolveTCPAddr("tcp4", *c.BtrDB.Address+":"+*c.BtrDB.Port)
 		if err != nil {
@@ -86,28 +230,43 @@ func NewArchiver(c *Config) (a *Archiver) {
 		}
 		config := &btrdbConfig{
 			addr:    btrdbaddr,
-			mdStore: a.mdStore,
+			mdStore: mdStore,
 		}
-		tsStore = newBtrIface(config)
+		return newBtrIface(config)
+	case "embedded":
+		config := &embeddedConfig{
+			dir: *c.Embedded.Directory,
+		}
+		return newEmbeddedDB(config)
 	default:
-		log.Fatalf(*c.Archiver.TimeseriesStore, " is not a recognized timeseries store")
+		log.Fatalf(name, " is not a recognized timeseries store")
 	}
+	return nil
+}
 
-	a.tsStore = tsStore
-
-	a.qp = querylang.NewQueryProcessor()
-
-	a.broker = NewBroker(a)
-
-	a.metrics = make(metricMap)
-	a.metrics.addMetric("adds")
-
-	if c.Archiver.PeriodicReport {
-		a.startReport()
+// creates the store for a [Mirror "name"] section. Address, Port and
+// Directory, where given, replace those of the store's own section, so that
+// e.g. two BtrDB clusters can be mirrored side by side
+func newMirrorStore(name string, m *MirrorConfig, c *Config, mdStore MetadataStore) TimeseriesStore {
+	if m.TimeseriesStore == nil {
+		log.Fatalf("Mirror %v has no TimeseriesStore", name)
 	}
-	a.Config = c
-
-	return
+	mc := *c
+	if m.Address != nil {
+		mc.BtrDB.Address = m.Address
+		mc.Quasar.Address = m.Address
+	}
+	if m.Port != nil {
+		mc.BtrDB.Port = m.Port
+		mc.Quasar.Port = m.Port
+	}
+	if m.Directory != nil {
+		mc.Embedded.Directory = m.Directory
+	}
+	if *m.TimeseriesStore == *c.Archiver.TimeseriesStore && m.Address == nil && m.Port == nil && m.Directory == nil {
+		log.Fatalf("Mirror %v is the same store as TimeseriesStore", name)
+	}
+	return newTimeseriesStore(*m.TimeseriesStore, &mc, mdStore)
 }
 
 func (a *Archiver) startReport() {
@@ -115,6 +274,17 @@ func (a *Archiver) startReport() {
 		t := time.NewTicker(5 * time.Second)
 		for {
 			log.Infof("Adds:%d", a.metrics["adds"].GetAndReset())
+			if depth, found := a.metrics["spoolDepth"]; found {
+				log.Infof("Spooled:%d Replayed:%d Backlog:%d", a.metrics["spooled"].GetAndReset(), a.metrics["replayed"].GetAndReset(), depth.Get())
+			}
+			for mirror := range a.Config.Mirror {
+				if errs := a.metrics["mirrorErrors."+mirror].GetAndReset(); errs > 0 {
+					log.Warningf("Mirror %v failed %d writes", mirror, errs)
+				}
+				if dropped := a.metrics["mirrorDropped."+mirror].GetAndReset(); dropped > 0 {
+					log.Warningf("Mirror %v fell behind and dropped %d writes", mirror, dropped)
+				}
+			}
 			<-t.C
 		}
 	}()
@@ -124,103 +294,294 @@ func (a *Archiver) startReport() {
 //  - Checks the incoming message against the ApiKey to verify it is valid to write
 //  - Saves the attached metadata (if any) to the metadata store
 //  - Reevaluates any dynamic subscriptions and pushes to republish clients
-//  - Saves the attached readings (if any) to the timeseries database
-func (a *Archiver) AddData(msg *common.SmapMessage) (err error) {
-	// save metadata
-	err = a.mdStore.SaveTags(msg)
-	if err != nil {
-		return err
+//  - Saves the attached readings (if any) to the timeseries database, or to
+//    the object store if they are object readings
+func (a *Archiver) AddData(msg *common.SmapMessage) error {
+	_, err := a.AddDataFlushed(msg)
+	return err
+}
+
+// Same as AddData, but also returns a channel that receives the result of
+// writing the numeric readings to the timeseries store. If writes are
+// coalesced, this happens some time after AddDataFlushed has returned
+func (a *Archiver) AddDataFlushed(msg *common.SmapMessage) (flushed <-chan error, err error) {
+	return a.AddDataFlushedBy(msg, "")
+}
+
+// Same as AddDataFlushed, but records the writer with any change to the
+// metadata of the stream
+func (a *Archiver) AddDataFlushedBy(msg *common.SmapMessage, writer string) (flushed <-chan error, err error) {
+	// save metadata. Only changed documents get a new version
+	var changed, saved bool
+	if changed, err = a.mdStore.SaveTags(msg); err != nil {
+		return
 	}
 
-	// fix inconsistencies
+	// fix inconsistencies. Like the writes, these lookups are not given up on
 	var (
-		uot common.UnitOfTime
-		uom string
+		ctx        = context.Background()
+		uot        common.UnitOfTime
+		uom        string
+		st         common.StreamType
+		streamType = common.NUMERIC_STREAM
 	)
-	if uot, err = a.mdStore.GetUnitOfTime(msg.UUID); uot == 0 && err == nil {
+	if len(msg.Readings) > 0 && msg.Readings[0].IsObject() {
+		streamType = common.OBJECT_STREAM
+	}
+	if uot, err = a.mdStore.GetUnitOfTime(ctx, msg.UUID); uot == 0 && err == nil {
 		if len(msg.Readings) > 0 {
 			uot = common.GuessTimeUnit(msg.Readings[0].GetTime())
 		}
 	} else if err != nil {
-		return err
+		return
 	}
 	for _, rdg := range msg.Readings {
 		rdg.SetUOT(uot)
 	}
 
-	if uom, err = a.mdStore.GetUnitOfMeasure(msg.UUID); uom == "" && err == nil {
+	if uom, err = a.mdStore.GetUnitOfMeasure(ctx, msg.UUID); uom == "" && err == nil {
 		if msg.Properties == nil {
-			msg.Properties = &common.SmapProperties{StreamType: common.NUMERIC_STREAM}
+			msg.Properties = &common.SmapProperties{StreamType: streamType}
 		}
 		msg.Properties.UnitOfMeasure = "n/a"
-		err = a.mdStore.SaveTags(msg)
-		if err != nil {
-			return err
+		uom = msg.Properties.UnitOfMeasure
+		if saved, err = a.mdStore.SaveTags(msg); err != nil {
+			return
 		}
+		changed = changed || saved
 	} else if err != nil {
-		return err
+		return
+	}
+
+	// object streams have to be marked as such so that queries know to
+	// look for their readings in the object store
+	if streamType == common.OBJECT_STREAM {
+		if st, err = a.mdStore.GetStreamType(ctx, msg.UUID); err != nil {
+			return
+		} else if st != common.OBJECT_STREAM {
+			msg.Properties = &common.SmapProperties{UnitOfTime: uot, UnitOfMeasure: uom, StreamType: common.OBJECT_STREAM}
+			if saved, err = a.mdStore.SaveTags(msg); err != nil {
+				return
+			}
+			changed = changed || saved
+		}
+	}
+	if changed {
+		if err = a.recordVersions([]common.UUID{msg.UUID}, writer); err != nil {
+			return
+		}
 	}
 
 	//save timeseries data
 	a.metrics["adds"].Mark(1)
-	a.tsStore.AddMessage(msg)
+	if flushed, err = a.addReadings(msg); err != nil {
+		return
+	}
 	a.broker.HandleMessage(msg)
-	return err
+	return
+}
+
+// splits the readings in the message between the timeseries store and the
+// object store
+func (a *Archiver) addReadings(msg *common.SmapMessage) (<-chan error, error) {
+	var numbers, objects []common.Reading
+	for _, rdg := range msg.Readings {
+		if rdg.IsObject() {
+			objects = append(objects, rdg)
+		} else {
+			numbers = append(numbers, rdg)
+		}
+	}
+	if len(objects) > 0 {
+		if a.objStore == nil {
+			return nil, fmt.Errorf("Cannot save object readings for %v: no object store configured", msg.UUID)
+		}
+		objMsg := &common.SmapMessage{UUID: msg.UUID, Readings: objects}
+		if err := a.objStore.AddObjects(objMsg); err != nil {
+			return nil, err
+		}
+	}
+	var flushed = make(chan error, 1)
+	if len(numbers) > 0 {
+		numMsg := &common.SmapMessage{UUID: msg.UUID, Readings: numbers}
+		if a.coalescer != nil {
+			return a.coalescer.add(numMsg), nil
+		}
+		if err := a.tsStore.AddMessage(numMsg); err != nil {
+			return nil, err
+		}
+	}
+	flushed <- nil
+	return flushed, nil
 }
 
 // Need to think about how to transfer the results of these queries to the handlers that are
 // asking for them and need to transform them into their own internal representations (e.g.
 // JSON, MsgPack, etc). What are the data patterns we are seeing?
 // Basically everything fits into common.SmapMessageList
-func (a *Archiver) HandleQuery(querystring string) (QueryResult, error) {
+func (a *Archiver) HandleQuery(ctx context.Context, querystring string) (QueryResult, error) {
+	return a.HandleQueryBy(ctx, querystring, "")
+}
+
+// Same as HandleQuery, but records the writer with any change the query
+// makes to the metadata
+func (a *Archiver) HandleQueryBy(ctx context.Context, querystring, writer string) (QueryResult, error) {
 	var result QueryResult
 	// parse the query
+	start := time.Now()
 	parsed := a.qp.Parse(querystring)
 	if parsed.Err != nil {
 		return result, fmt.Errorf("Error (%v) in query \"%v\" (error at %v)\n", parsed.Err, querystring, parsed.ErrPos)
 	}
-	return a.evaluateQuery(parsed)
+	parsed.Writer = writer
+	return a.evaluateQuery(traceQuery(ctx, parsed, start), parsed)
+}
+
+// bounds the evaluation of a query by the QueryTimeout of the configuration.
+// The context of the caller still cancels it, e.g. once the client that sent
+// the query disconnects
+func (a *Archiver) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := a.Config.Archiver.QueryTimeout; timeout != nil && *timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(*timeout)*time.Second)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Anything that removes readings or documents, i.e. DELETE queries and
+// retention rules, is refused unless AllowDelete is set. If requests are
+// authenticated, the writer is the user who sent the request, who must also
+// have the "delete" permission in their user document
+func (a *Archiver) checkDeletePermission(writer string) error {
+	if !a.Config.Archiver.AllowDelete {
+		return errors.New("Deleting is not allowed (see AllowDelete in the [Archiver] configuration)")
+	}
+	if !a.Config.Authentication.Enabled {
+		return nil
+	}
+	permissions, err := a.mdStore.GetPermissions(writer)
+	if err != nil {
+		return fmt.Errorf("Deleting is not allowed for %v (%v)", writer, err)
+	}
+	for _, permission := range permissions {
+		if permission == "delete" {
+			return nil
+		}
+	}
+	return fmt.Errorf("User %v is not allowed to delete", writer)
 }
 
 // FIXME
-func (a *Archiver) evaluateQuery(parsed *querylang.ParsedQuery) (QueryResult, error) {
+func (a *Archiver) evaluateQuery(ctx context.Context, parsed *querylang.ParsedQuery) (QueryResult, error) {
 	var result QueryResult
+	ctx, cancel := a.queryContext(ctx)
+	defer cancel()
+	if parsed.Explain {
+		return a.explainQuery(ctx, parsed)
+	}
 	switch parsed.QueryType {
 	case querylang.SELECT_TYPE:
 		if parsed.Distinct {
 			params := parsed.GetParams().(*common.DistinctParams)
-			return a.DistinctTag(params)
+			return a.DistinctTag(ctx, params)
 		}
 		params := parsed.GetParams().(*common.TagParams)
-		return a.SelectTags(params)
+		return a.selectTagsPage(ctx, parsed, params)
 	case querylang.DELETE_TYPE:
-		return result, errors.New("Invalid DELETE type") //FIXME
+		// dry runs do not change anything, so they are always allowed
+		if !parsed.DryRun {
+			if err := a.checkDeletePermission(parsed.Writer); err != nil {
+				return result, err
+			}
+		}
 		params := parsed.GetParams()
 		switch t := params.(type) {
 		case *common.TagParams:
-			return result, a.DeleteTags(t)
+			return a.DeleteTags(ctx, t)
 		case *common.DataParams:
-			return result, a.DeleteData(t)
+			return a.DeleteData(ctx, t)
 		default:
 			return result, errors.New("Invalid DELETE type")
 		}
 	case querylang.SET_TYPE:
 		params := parsed.GetParams().(*common.SetParams)
-		return result, a.SetTags(params)
+		return a.SetTags(ctx, params)
 	case querylang.DATA_TYPE:
 		params := parsed.GetParams().(*common.DataParams)
-		if params.IsStatistical || params.IsWindow {
-			return a.SelectStatisticalData(params)
+		if params.GroupBy != "" {
+			return a.selectGroupedData(ctx, params, parsed.Data.Dtype)
+		}
+		if isPagedData(params, parsed.Data.Dtype) {
+			return a.selectDataPage(ctx, parsed, params)
 		}
-		switch parsed.Data.Dtype {
-		case querylang.IN_TYPE:
-			return a.SelectDataRange(params)
-		case querylang.BEFORE_TYPE:
-			return a.SelectDataBefore(params)
-		case querylang.AFTER_TYPE:
-			return a.SelectDataAfter(params)
+		return a.selectData(ctx, params, parsed.Data.Dtype)
+	case querylang.APPLY_TYPE:
+		if parsed.Data.Dtype != querylang.IN_TYPE {
+			return result, errors.New("APPLY needs data in a time range")
 		}
+		params := parsed.GetParams().(*common.DataParams)
+		return a.ApplyOperators(ctx, params)
+	}
+	return result, nil
+}
 
+func (a *Archiver) selectData(ctx context.Context, params *common.DataParams, dtype querylang.DataQueryType) (common.SmapMessageList, error) {
+	if params.Expression != "" {
+		if dtype != querylang.IN_TYPE {
+			return nil, fmt.Errorf("Expressions can only be evaluated over data in a time range")
+		}
+		return a.SelectExpressionData(ctx, params)
+	}
+	if len(params.Functions) > 0 {
+		if dtype != querylang.IN_TYPE {
+			return nil, fmt.Errorf("Functions can only be applied to data in a time range")
+		}
+		outermost := params.Functions[len(params.Functions)-1].Name
+		if _, found := aggregates[outermost]; found {
+			return a.SelectAggregateData(ctx, params)
+		}
+		if isDistribution(outermost) {
+			return a.SelectDistributionData(ctx, params)
+		}
+		return a.SelectTransformedData(ctx, params)
+	}
+	if params.IsStatistical || params.IsWindow {
+		return a.SelectStatisticalData(ctx, params)
+	}
+	switch dtype {
+	case querylang.IN_TYPE:
+		return a.SelectDataRange(ctx, params)
+	case querylang.BEFORE_TYPE:
+		return a.SelectDataBefore(ctx, params)
+	case querylang.AFTER_TYPE:
+		return a.SelectDataAfter(ctx, params)
+	}
+	return nil, nil
+}
+
+// evaluates the data query separately for each group of streams, and labels
+// the resulting series with their group
+func (a *Archiver) selectGroupedData(ctx context.Context, params *common.DataParams, dtype querylang.DataQueryType) (common.SmapMessageList, error) {
+	var result = common.SmapMessageList{}
+	md, where, err := a.metadataAsOf(ctx, params.AsOf, params.Where)
+	if err != nil {
+		return result, err
+	}
+	groups, err := groupUUIDs(ctx, md, params.GroupBy, where)
+	if err != nil {
+		return result, err
+	}
+	for _, group := range groups {
+		groupParams := *params
+		groupParams.Where = nil
+		groupParams.UUIDs = group.UUIDs
+		res, err := a.selectData(ctx, &groupParams, dtype)
+		if err != nil {
+			return result, err
+		}
+		for _, msg := range res {
+			msg.Group = common.Dict{params.GroupBy: group.Value}
+		}
+		result = append(result, res...)
 	}
 	return result, nil
 }
@@ -1,6 +1,7 @@
 package archiver
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
@@ -81,123 +82,207 @@ func (bdb *btrIface) AddMessage(msg *common.SmapMessage) error {
 	}
 	client := bdb.getClient()
 	c, err := client.InsertValues(parsed_uuid, records, false)
-	<-c // wait for response
-	return err
+	if err != nil {
+		return err
+	}
+	return waitForStatus(c)
 }
 
-func (bdb *btrIface) numberResponseFromChan(c chan btrdb.StandardValue) common.SmapNumbersResponse {
+// how long a write waits for BtrDB to acknowledge it
+const btrdbWriteTimeout = 30 * time.Second
+
+// waits for the status BtrDB sends once it has processed a write, so that
+// writes the server rejects are returned as errors (and spooled)
+func waitForStatus(c chan string) error {
+	select {
+	case status, ok := <-c:
+		if !ok {
+			return fmt.Errorf("BtrDB closed the connection before acknowledging the write")
+		}
+		if status != "ok" {
+			return fmt.Errorf("BtrDB rejected the write (%v)", status)
+		}
+		return nil
+	case <-time.After(btrdbWriteTimeout):
+		return fmt.Errorf("BtrDB did not acknowledge the write within %v", btrdbWriteTimeout)
+	}
+}
+
+// collects the values of one stream until the channel is closed, or the
+// query is given up on
+// reads the values from the channel, but stops after limit values if limit is
+// positive and discards the rest
+func (bdb *btrIface) numberResponseFromChan(ctx context.Context, c chan btrdb.StandardValue, limit int) (common.SmapNumbersResponse, error) {
 	var sr = common.SmapNumbersResponse{
 		Readings: []*common.SmapNumberReading{},
 	}
-	for val := range c {
-		sr.Readings = append(sr.Readings, &common.SmapNumberReading{Time: uint64(val.Time), Value: val.Value, UoT: common.UOT_NS})
+	for {
+		select {
+		case val, ok := <-c:
+			if !ok {
+				return sr, nil
+			}
+			sr.Readings = append(sr.Readings, &common.SmapNumberReading{Time: uint64(val.Time), Value: val.Value, UoT: common.UOT_NS})
+			if limit > 0 && len(sr.Readings) >= limit {
+				discardValues([]chan btrdb.StandardValue{c})
+				return sr, nil
+			}
+		case <-ctx.Done():
+			return sr, ctx.Err()
+		}
 	}
-	return sr
 }
 
-func (bdb *btrIface) statisticalResponseFromChan(c chan btrdb.StatisticalValue) common.StatisticalNumbersResponse {
+func (bdb *btrIface) statisticalResponseFromChan(ctx context.Context, c chan btrdb.StatisticalValue) (common.StatisticalNumbersResponse, error) {
 	var sr = common.StatisticalNumbersResponse{
 		Readings: []*common.StatisticalNumberReading{},
 	}
-	for val := range c {
-		sr.Readings = append(sr.Readings, &common.StatisticalNumberReading{Time: uint64(val.Time), Count: val.Count, Min: val.Min, Max: val.Max, Mean: val.Mean, UoT: common.UOT_NS})
-	}
-	return sr
-}
-
-func (bdb *btrIface) queryNearestValue(uuids []common.UUID, start uint64, backwards bool) ([]common.SmapNumbersResponse, error) {
-	var ret = make([]common.SmapNumbersResponse, len(uuids))
-	var results []chan btrdb.StandardValue
-	client := bdb.getClient()
-	for _, uu := range uuids {
-		uuid := uuid.Parse(string(uu))
-		values, _, _, err := client.QueryNearestValue(uuid, int64(start), backwards, 0)
-		if err != nil {
-			return ret, err
+	for {
+		select {
+		case val, ok := <-c:
+			if !ok {
+				return sr, nil
+			}
+			sr.Readings = append(sr.Readings, &common.StatisticalNumberReading{Time: uint64(val.Time), Count: val.Count, Min: val.Min, Max: val.Max, Mean: val.Mean, UoT: common.UOT_NS})
+		case <-ctx.Done():
+			return sr, ctx.Err()
 		}
-		results = append(results, values)
 	}
-	for i, c := range results {
-		sr := bdb.numberResponseFromChan(c)
-		sr.UUID = uuids[i]
-		ret[i] = sr
-	}
-	return ret, nil
 }
 
-func (bdb *btrIface) Prev(uuids []common.UUID, start uint64) ([]common.SmapNumbersResponse, error) {
-	return bdb.queryNearestValue(uuids, start, true)
+// BtrDB keeps sending the values of a query that was given up on, so they
+// are read and dropped in the background
+func discardValues(results []chan btrdb.StandardValue) {
+	for _, c := range results {
+		go func(c chan btrdb.StandardValue) {
+			for range c {
+			}
+		}(c)
+	}
 }
 
-func (bdb *btrIface) Next(uuids []common.UUID, start uint64) ([]common.SmapNumbersResponse, error) {
-	return bdb.queryNearestValue(uuids, start, false)
+func discardStatisticalValues(results []chan btrdb.StatisticalValue) {
+	for _, c := range results {
+		go func(c chan btrdb.StatisticalValue) {
+			for range c {
+			}
+		}(c)
+	}
 }
 
-func (bdb *btrIface) GetData(uuids []common.UUID, start, end uint64) ([]common.SmapNumbersResponse, error) {
+// sends a query for each stream, then collects their values, at most limit
+// of each stream if limit is positive
+func (bdb *btrIface) queryValues(ctx context.Context, uuids []common.UUID, limit int, query func(int, uuid.UUID) (chan btrdb.StandardValue, error)) ([]common.SmapNumbersResponse, error) {
 	var ret = make([]common.SmapNumbersResponse, len(uuids))
 	var results []chan btrdb.StandardValue
-	client := bdb.getClient()
-	for _, uu := range uuids {
-		uuid := uuid.Parse(string(uu))
-		values, _, _, err := client.QueryStandardValues(uuid, int64(start), int64(end), 0)
+	for i, uu := range uuids {
+		if err := ctx.Err(); err != nil {
+			discardValues(results)
+			return ret, err
+		}
+		values, err := query(i, uuid.Parse(string(uu)))
 		if err != nil {
+			discardValues(results)
 			return ret, err
 		}
 		results = append(results, values)
 	}
 	for i, c := range results {
-		sr := bdb.numberResponseFromChan(c)
+		sr, err := bdb.numberResponseFromChan(ctx, c, limit)
+		if err != nil {
+			discardValues(results[i:])
+			return ret, err
+		}
 		sr.UUID = uuids[i]
 		ret[i] = sr
 	}
 	return ret, nil
 }
 
-func (bdb *btrIface) StatisticalData(uuids []common.UUID, pointWidth int, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
+func (bdb *btrIface) queryStatisticalValues(ctx context.Context, uuids []common.UUID, query func(uuid.UUID) (chan btrdb.StatisticalValue, error)) ([]common.StatisticalNumbersResponse, error) {
 	var ret = make([]common.StatisticalNumbersResponse, len(uuids))
 	var results []chan btrdb.StatisticalValue
-	client := bdb.getClient()
 	for _, uu := range uuids {
-		uuid := uuid.Parse(string(uu))
-		values, _, _, err := client.QueryStatisticalValues(uuid, int64(start), int64(end), uint8(pointWidth), 0)
+		if err := ctx.Err(); err != nil {
+			discardStatisticalValues(results)
+			return ret, err
+		}
+		values, err := query(uuid.Parse(string(uu)))
 		if err != nil {
+			discardStatisticalValues(results)
 			return ret, err
 		}
 		results = append(results, values)
 	}
 	for i, c := range results {
-		sr := bdb.statisticalResponseFromChan(c)
+		sr, err := bdb.statisticalResponseFromChan(ctx, c)
+		if err != nil {
+			discardStatisticalValues(results[i:])
+			return ret, err
+		}
 		sr.UUID = uuids[i]
 		ret[i] = sr
 	}
 	return ret, nil
 }
 
-func (bdb *btrIface) WindowData(uuids []common.UUID, width, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
-	var ret = make([]common.StatisticalNumbersResponse, len(uuids))
-	var results []chan btrdb.StatisticalValue
+func (bdb *btrIface) queryNearestValue(ctx context.Context, uuids []common.UUID, start uint64, backwards bool) ([]common.SmapNumbersResponse, error) {
 	client := bdb.getClient()
-	for _, uu := range uuids {
-		uuid := uuid.Parse(string(uu))
+	return bdb.queryValues(ctx, uuids, 0, func(_ int, uuid uuid.UUID) (chan btrdb.StandardValue, error) {
+		values, _, _, err := client.QueryNearestValue(uuid, int64(start), backwards, 0)
+		return values, err
+	})
+}
+
+func (bdb *btrIface) Prev(ctx context.Context, uuids []common.UUID, start uint64) ([]common.SmapNumbersResponse, error) {
+	return bdb.queryNearestValue(ctx, uuids, start, true)
+}
+
+func (bdb *btrIface) Next(ctx context.Context, uuids []common.UUID, start uint64) ([]common.SmapNumbersResponse, error) {
+	return bdb.queryNearestValue(ctx, uuids, start, false)
+}
+
+func (bdb *btrIface) GetData(ctx context.Context, uuids []common.UUID, start, end uint64) ([]common.SmapNumbersResponse, error) {
+	client := bdb.getClient()
+	return bdb.queryValues(ctx, uuids, 0, func(_ int, uuid uuid.UUID) (chan btrdb.StandardValue, error) {
+		values, _, _, err := client.QueryStandardValues(uuid, int64(start), int64(end), 0)
+		return values, err
+	})
+}
+
+func (bdb *btrIface) GetDataPage(ctx context.Context, uuids []common.UUID, starts []uint64, end uint64, limit int) ([]common.SmapNumbersResponse, error) {
+	client := bdb.getClient()
+	return bdb.queryValues(ctx, uuids, limit, func(i int, uuid uuid.UUID) (chan btrdb.StandardValue, error) {
+		values, _, _, err := client.QueryStandardValues(uuid, int64(starts[i]), int64(end), 0)
+		return values, err
+	})
+}
+
+func (bdb *btrIface) StatisticalData(ctx context.Context, uuids []common.UUID, pointWidth int, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
+	client := bdb.getClient()
+	return bdb.queryStatisticalValues(ctx, uuids, func(uuid uuid.UUID) (chan btrdb.StatisticalValue, error) {
+		values, _, _, err := client.QueryStatisticalValues(uuid, int64(start), int64(end), uint8(pointWidth), 0)
+		return values, err
+	})
+}
+
+func (bdb *btrIface) WindowData(ctx context.Context, uuids []common.UUID, width, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
+	client := bdb.getClient()
+	return bdb.queryStatisticalValues(ctx, uuids, func(uuid uuid.UUID) (chan btrdb.StatisticalValue, error) {
 		values, _, _, err := client.QueryWindowValues(uuid, int64(start), int64(end), width, 0, 0)
-		if err != nil {
-			return ret, err
-		}
-		results = append(results, values)
-	}
-	for i, c := range results {
-		sr := bdb.statisticalResponseFromChan(c)
-		sr.UUID = uuids[i]
-		ret[i] = sr
-	}
-	return ret, nil
+		return values, err
+	})
 }
 
 func (bdb *btrIface) DeleteData(uuids []common.UUID, start uint64, end uint64) error {
 	client := bdb.getClient()
 	for _, uu := range uuids {
 		uuid := uuid.Parse(string(uu))
-		if _, err := client.DeleteValues(uuid, int64(start), int64(end)); err != nil {
+		c, err := client.DeleteValues(uuid, int64(start), int64(end))
+		if err != nil {
+			return err
+		}
+		if err = waitForStatus(c); err != nil {
 			return err
 		}
 	}
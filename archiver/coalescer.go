@@ -0,0 +1,189 @@
+package archiver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+// The coalescer buffers incoming numeric readings per stream and writes them
+// to the timeseries store as one insert, instead of doing a round trip to the
+// store for every message. A stream's buffer is flushed once it holds
+// maxReadings readings, or interval after the first reading was buffered,
+// whichever comes first.
+//
+// Each call to add returns a channel that receives the result of the insert
+// the readings ended up in. The channel is buffered, so callers that do not
+// care about the acknowledgement can ignore it. A stream's buffer is dropped
+// once it has been flushed and is empty, so only streams that are being
+// written to take up memory.
+
+// Locks are taken in the order streamBuffer, then coalescer.
+
+type coalescerConfig struct {
+	store       TimeseriesStore
+	interval    time.Duration
+	maxReadings int
+}
+
+type coalescer struct {
+	store       TimeseriesStore
+	interval    time.Duration
+	maxReadings int
+	streams     map[common.UUID]*streamBuffer
+	// once closed, readings are written straight to the store
+	closed bool
+	sync.Mutex
+}
+
+type streamBuffer struct {
+	uuid     common.UUID
+	readings []common.Reading
+	waiting  []chan error
+	timer    *time.Timer
+	// held while inserting so that flushes of the same stream happen in order
+	flushing sync.Mutex
+	// set once the buffer is dropped from the coalescer; readings have to
+	// go to the stream's new buffer then
+	removed bool
+	sync.Mutex
+}
+
+func newCoalescer(c *coalescerConfig) *coalescer {
+	log.Noticef("Coalescing writes for up to %v or %d readings per stream", c.interval, c.maxReadings)
+	return &coalescer{
+		store:       c.store,
+		interval:    c.interval,
+		maxReadings: c.maxReadings,
+		streams:     make(map[common.UUID]*streamBuffer),
+	}
+}
+
+func (c *coalescer) getBuffer(uuid common.UUID) *streamBuffer {
+	c.Lock()
+	defer c.Unlock()
+	buf, found := c.streams[uuid]
+	if !found {
+		buf = &streamBuffer{uuid: uuid}
+		c.streams[uuid] = buf
+	}
+	return buf
+}
+
+// buffers the readings in the message. The returned channel receives nil once
+// they have been written, or the error the store returned
+func (c *coalescer) add(msg *common.SmapMessage) <-chan error {
+	var (
+		ack = make(chan error, 1)
+		buf *streamBuffer
+	)
+	for {
+		buf = c.getBuffer(msg.UUID)
+		buf.Lock()
+		if !buf.removed {
+			break
+		}
+		buf.Unlock()
+	}
+	if c.isClosed() {
+		buf.Unlock()
+		ack <- c.store.AddMessage(msg)
+		return ack
+	}
+	for _, rdg := range msg.Readings {
+		// the message is handed on to the broker, so keep our own copy of
+		// readings whose time the store will convert
+		if num, ok := rdg.(*common.SmapNumberReading); ok {
+			copied := *num
+			rdg = &copied
+		}
+		buf.readings = append(buf.readings, rdg)
+	}
+	buf.waiting = append(buf.waiting, ack)
+	full := c.maxReadings > 0 && len(buf.readings) >= c.maxReadings
+	if !full && buf.timer == nil {
+		buf.timer = time.AfterFunc(c.interval, func() { c.flush(buf) })
+	}
+	buf.Unlock()
+
+	if full {
+		go c.flush(buf)
+	}
+	return ack
+}
+
+// writes out everything buffered for the stream and acknowledges the callers
+func (c *coalescer) flush(buf *streamBuffer) {
+	buf.flushing.Lock()
+	defer buf.flushing.Unlock()
+
+	buf.Lock()
+	readings, waiting := buf.readings, buf.waiting
+	buf.readings, buf.waiting = nil, nil
+	if buf.timer != nil {
+		buf.timer.Stop()
+		buf.timer = nil
+	}
+	buf.Unlock()
+
+	if len(waiting) == 0 {
+		c.release(buf)
+		return
+	}
+	var err error
+	if len(readings) > 0 {
+		err = c.store.AddMessage(&common.SmapMessage{UUID: buf.uuid, Readings: readings})
+		if err != nil {
+			log.Errorf("Could not write %d readings for %v (%v)", len(readings), buf.uuid, err)
+		}
+	}
+	c.release(buf)
+	for _, ack := range waiting {
+		ack <- err
+	}
+}
+
+// drops the buffer of the stream unless readings were buffered while it was
+// flushed
+func (c *coalescer) release(buf *streamBuffer) {
+	buf.Lock()
+	defer buf.Unlock()
+	if len(buf.readings) > 0 || buf.removed {
+		return
+	}
+	c.Lock()
+	if c.streams[buf.uuid] == buf {
+		delete(c.streams, buf.uuid)
+	}
+	c.Unlock()
+	buf.removed = true
+}
+
+func (c *coalescer) isClosed() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.closed
+}
+
+// writes out everything that is buffered before shutting down. Readings added
+// afterwards are not buffered anymore
+func (c *coalescer) Close() {
+	c.Lock()
+	c.closed = true
+	c.Unlock()
+	c.flushAll()
+}
+
+// flushes all streams
+func (c *coalescer) flushAll() {
+	c.Lock()
+	buffers := make([]*streamBuffer, 0, len(c.streams))
+	for _, buf := range c.streams {
+		buffers = append(buffers, buf)
+	}
+	c.Unlock()
+	for _, buf := range buffers {
+		c.flush(buf)
+	}
+}
@@ -0,0 +1,107 @@
+package archiver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+// counts the inserts that reach the wrapped store
+type countingStore struct {
+	*embeddedDB
+	inserts chan int
+}
+
+func (c *countingStore) AddMessage(msg *common.SmapMessage) error {
+	c.inserts <- len(msg.Readings)
+	return c.embeddedDB.AddMessage(msg)
+}
+
+func TestCoalescerMaxReadings(t *testing.T) {
+	db, cleanup := newTestEmbeddedDB(t)
+	defer cleanup()
+	store := &countingStore{embeddedDB: db, inserts: make(chan int, 10)}
+	c := newCoalescer(&coalescerConfig{store: store, interval: time.Hour, maxReadings: 3})
+	uuid := common.NewUUID()
+	base := uint64(1451606400000000000)
+
+	first := c.add(embeddedTestMessage(uuid, base, base+1))
+	second := c.add(embeddedTestMessage(uuid, base+2))
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	if n := <-store.inserts; n != 3 {
+		t.Errorf("Expected one insert of 3 readings, got %d", n)
+	}
+	if res, _ := db.GetData(context.Background(), []common.UUID{uuid}, base, base+10); len(res[0].Readings) != 3 {
+		t.Errorf("Expected 3 readings in store, got %v", res[0].Readings)
+	}
+	// the flushed buffer is dropped, and a new one is made for the next
+	// readings
+	c.Lock()
+	buffered := len(c.streams)
+	c.Unlock()
+	if buffered != 0 {
+		t.Errorf("Expected the flushed buffer to be dropped, %d buffers are left", buffered)
+	}
+	if err := <-c.add(embeddedTestMessage(uuid, base+3, base+4, base+5)); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := db.GetData(context.Background(), []common.UUID{uuid}, base, base+10); len(res[0].Readings) != 6 {
+		t.Errorf("Expected 6 readings in store, got %v", res[0].Readings)
+	}
+}
+
+func TestCoalescerInterval(t *testing.T) {
+	db, cleanup := newTestEmbeddedDB(t)
+	defer cleanup()
+	store := &countingStore{embeddedDB: db, inserts: make(chan int, 10)}
+	c := newCoalescer(&coalescerConfig{store: store, interval: 10 * time.Millisecond, maxReadings: 100})
+	uuid := common.NewUUID()
+	base := uint64(1451606400000000000)
+
+	c.add(embeddedTestMessage(uuid, base))
+	ack := c.add(embeddedTestMessage(uuid, base+1))
+	select {
+	case err := <-ack:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Readings were not flushed after the interval")
+	}
+	if n := <-store.inserts; n != 2 {
+		t.Errorf("Expected one insert of 2 readings, got %d", n)
+	}
+}
+
+func TestCoalescerClose(t *testing.T) {
+	db, cleanup := newTestEmbeddedDB(t)
+	defer cleanup()
+	store := &countingStore{embeddedDB: db, inserts: make(chan int, 10)}
+	c := newCoalescer(&coalescerConfig{store: store, interval: time.Hour, maxReadings: 100})
+	uuid := common.NewUUID()
+	base := uint64(1451606400000000000)
+
+	ack := c.add(embeddedTestMessage(uuid, base, base+1))
+	c.Close()
+	if err := <-ack; err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := db.GetData(context.Background(), []common.UUID{uuid}, base, base+10); len(res[0].Readings) != 2 {
+		t.Errorf("Expected the buffered readings to be written on close, got %v", res[0].Readings)
+	}
+
+	// not buffered after closing
+	if err := <-c.add(embeddedTestMessage(uuid, base+2)); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := db.GetData(context.Background(), []common.UUID{uuid}, base, base+10); len(res[0].Readings) != 3 {
+		t.Errorf("Expected readings added after close to be written, got %v", res[0].Readings)
+	}
+}
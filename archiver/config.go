@@ -21,6 +21,13 @@ type Config struct {
 		Objects         *string
 		LogLevel        *string
 		PeriodicReport  bool
+		AllowDelete     bool
+		QueryTimeout    *int
+		QueryCacheSize  *int
+		DataPageSize    *int
+		Timezone        *string
+		// how many writes may wait for each mirror before they are dropped
+		MirrorQueueSize *int
 	}
 
 	ReadingDB struct {
@@ -38,12 +45,46 @@ type Config struct {
 		Address *string
 	}
 
+	Embedded struct {
+		Directory *string
+	}
+
+	// additional timeseries stores that receive a copy of every write, by
+	// name
+	Mirror map[string]*MirrorConfig
+
+	Spool struct {
+		Enabled       bool
+		Directory     *string
+		MaxSize       *int
+		RetryInterval *int
+	}
+
+	Coalescer struct {
+		Enabled     bool
+		Interval    *int
+		MaxReadings *int
+	}
+
 	Mongo struct {
 		Port           *string
 		Address        *string
 		UpdateInterval *int
 	}
 
+	Memory struct {
+		Snapshot         *string
+		SnapshotInterval *int
+	}
+
+	Retention struct {
+		Interval *int
+	}
+
+	Rollup struct {
+		Interval *int
+	}
+
 	HTTP struct {
 		Enabled bool
 		Port    *int
@@ -87,6 +128,15 @@ type Config struct {
 	}
 }
 
+type MirrorConfig struct {
+	// quasar, btrdb or embedded
+	TimeseriesStore *string
+	// override the settings of the store's own section
+	Address   *string
+	Port      *string
+	Directory *string
+}
+
 func LoadConfig(filename string) *Config {
 	var configuration Config
 	err := gcfg.ReadFileInto(&configuration, filename)
@@ -106,13 +156,48 @@ func LoadConfig(filename string) *Config {
 
 func PrintConfig(c *Config) {
 	fmt.Println("Giles Configuration")
-	fmt.Println("Connecting to Mongo at", *c.Mongo.Address, ":", *c.Mongo.Port, "with update interval", *c.Mongo.UpdateInterval, "seconds")
+	switch *c.Archiver.MetadataStore {
+	case "mongo":
+		fmt.Println("Connecting to Mongo at", *c.Mongo.Address, ":", *c.Mongo.Port, "with update interval", *c.Mongo.UpdateInterval, "seconds")
+	case "memory":
+		fmt.Println("Using in-memory metadata store")
+	}
 	fmt.Println("Using Timeseries DB", *c.Archiver.TimeseriesStore)
 	switch *c.Archiver.TimeseriesStore {
 	case "readingdb":
 		fmt.Println("	at address", *c.ReadingDB.Address, ":", *c.ReadingDB.Port)
 	case "quasar":
 		fmt.Println("	at address", *c.Quasar.Address, ":", *c.Quasar.Port)
+	case "btrdb":
+		fmt.Println("	at address", *c.BtrDB.Address, ":", *c.BtrDB.Port)
+	case "embedded":
+		fmt.Println("	in directory", *c.Embedded.Directory)
+	}
+	for name, mirror := range c.Mirror {
+		fmt.Println("Mirroring writes to Timeseries DB", *mirror.TimeseriesStore, "as", name)
+	}
+	if c.Archiver.AllowDelete {
+		fmt.Println("DELETE queries are allowed")
+	}
+	if c.Archiver.QueryTimeout != nil && *c.Archiver.QueryTimeout > 0 {
+		fmt.Println("Queries time out after", *c.Archiver.QueryTimeout, "seconds")
+	}
+	if c.Archiver.QueryCacheSize != nil && *c.Archiver.QueryCacheSize > 0 {
+		fmt.Println("Caching up to", *c.Archiver.QueryCacheSize, "parsed queries")
+	}
+	if c.Archiver.DataPageSize != nil && *c.Archiver.DataPageSize > 0 {
+		fmt.Println("Paging data queries without a limit by", *c.Archiver.DataPageSize, "readings")
+	}
+	if c.Archiver.Timezone != nil && *c.Archiver.Timezone != "" {
+		fmt.Println("Times in queries are in", *c.Archiver.Timezone)
+	}
+
+	if c.Spool.Enabled {
+		fmt.Println("Spooling failed writes to", *c.Spool.Directory)
+	}
+
+	if c.Coalescer.Enabled {
+		fmt.Println("Coalescing writes")
 	}
 
 	if c.Profile.Enabled {
@@ -1,6 +1,7 @@
 package archiver
 
 import (
+	"context"
 	"sync"
 
 	"github.com/jf87/giles2/archiver/internal/querylang"
@@ -114,14 +115,14 @@ func (b *Broker) GetQuery(pq *querylang.ParsedQuery) (*Query, error) {
 	// it hasn't been evaluated. So, we evaluate it to get
 	// the initial UUIDs
 	q = NewQuery(pq)
-	uuids, err := b.a.mdStore.GetUUIDs(q.WhereClause.ToBson())
+	uuids, err := b.a.mdStore.GetUUIDs(context.Background(), q.WhereClause.ToBson())
 	if err != nil {
 		return q, err
 	}
 	q.changeUUIDs(uuids)
 
 	// also get initial result for query and cache it
-	result, evalErr := b.a.evaluateQuery(pq)
+	result, evalErr := b.a.evaluateQuery(context.Background(), pq)
 	if evalErr != nil {
 		return q, nil
 	}
@@ -223,7 +224,7 @@ func (b *Broker) reevaluateQuery(q *Query) {
 		found bool
 	)
 	log.Debugf("reevalute %v", q)
-	uuids, err := b.a.mdStore.GetUUIDs(q.WhereClause.ToBson())
+	uuids, err := b.a.mdStore.GetUUIDs(context.Background(), q.WhereClause.ToBson())
 	if err != nil {
 		log.Criticalf("Error fetching UUIDs for (%v) from metadata store (%v)", q.WhereClause, err)
 		return
@@ -0,0 +1,262 @@
+package archiver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/jf87/giles2/archiver/internal/querylang"
+	"github.com/jf87/giles2/common"
+)
+
+// Large results can be fetched one page at a time. Metadata queries take a
+// LIMIT and OFFSET, e.g.
+//
+//	select * where Metadata/Type = 'Meter' limit 1000 offset 2000
+//
+// and data in a time range is split into pages by its limit and streamlimit:
+//
+//	select data in (now -1d, now) limit 10000 streamlimit 100 where Metadata/Type = 'Meter'
+//
+// returns at most 10000 readings for each of the first 100 streams. Queries
+// without a limit are paged by the DataPageSize of the configuration. Whenever
+// a result is truncated, it is returned as a common.ResultPage whose Next
+// cursor continues the query (see HandleCursor): first with the remaining
+// readings of the truncated streams, each from where its page stopped, and
+// then with the next 100 streams. Streams are paged in order of their UUID,
+// unless the query orders them by a tag (see sortDocs).
+//
+// Cursors are opaque to clients; they contain the query and its position.
+// As clients can send any cursor, only queries that can be paged are
+// continued from a cursor.
+
+// the page size of data queries without a limit, unless configured otherwise
+const defaultDataPageSize = 10000
+
+// the position of a paged query
+type queryCursor struct {
+	Query string `json:"q"`
+	// documents, or streams for data queries, to skip
+	Offset int `json:"o,omitempty"`
+	// for data queries: the streams still to be continued, and the time
+	// (in nanoseconds) each of them continues from
+	Resume map[common.UUID]uint64 `json:"r,omitempty"`
+	// the values bound to the parameters of a prepared query
+	Params []interface{} `json:"p,omitempty"`
+}
+
+func (c queryCursor) encode() string {
+	bytes, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+func decodeCursor(cursor string) (*queryCursor, error) {
+	var c = new(queryCursor)
+	encoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		// numbers are kept as they were bound, instead of as floats
+		decoder := json.NewDecoder(bytes.NewReader(encoded))
+		decoder.UseNumber()
+		err = decoder.Decode(c)
+	}
+	if err != nil || c.Query == "" || c.Offset < 0 {
+		return nil, fmt.Errorf("Invalid cursor \"%v\"", cursor)
+	}
+	return c, nil
+}
+
+// Continues the query of the cursor returned with a previous page
+func (a *Archiver) HandleCursor(ctx context.Context, cursor string) (QueryResult, error) {
+	return a.HandleCursorBy(ctx, cursor, "")
+}
+
+// Same as HandleCursor, but evaluates the query on behalf of the writer
+func (a *Archiver) HandleCursorBy(ctx context.Context, cursor, writer string) (QueryResult, error) {
+	var result QueryResult
+	c, err := decodeCursor(cursor)
+	if err != nil {
+		return result, err
+	}
+	parsed := a.qp.ParseWith(c.Query, c.Params)
+	if parsed.Err != nil {
+		return result, fmt.Errorf("Error (%v) in query \"%v\" of cursor (error at %v)", parsed.Err, c.Query, parsed.ErrPos)
+	}
+	if !isPagedQuery(parsed) {
+		return result, fmt.Errorf("Query \"%v\" of cursor cannot be paged", c.Query)
+	}
+	parsed.Offset, parsed.Resume = c.Offset, c.Resume
+	parsed.Writer = writer
+	return a.evaluateQuery(ctx, parsed)
+}
+
+// whether the query returns its results in pages: a metadata SELECT or a
+// selection of raw data in a time range
+func isPagedQuery(parsed *querylang.ParsedQuery) bool {
+	if parsed.Explain {
+		return false
+	}
+	switch parsed.QueryType {
+	case querylang.SELECT_TYPE:
+		return !parsed.Distinct
+	case querylang.DATA_TYPE:
+		return isPagedData(parsed.GetParams().(*common.DataParams), parsed.Data.Dtype)
+	}
+	return false
+}
+
+// returns the results, or a page of them with the cursor to the next page
+// if the cursor is not nil
+func newResultPage(parsed *querylang.ParsedQuery, results common.SmapMessageList, next *queryCursor) QueryResult {
+	if next == nil {
+		return results
+	}
+	next.Query, next.Params = parsed.Querystring, parsed.Params
+	return common.ResultPage{Results: results, Next: next.encode()}
+}
+
+// selects a page of documents for a metadata query
+func (a *Archiver) selectTagsPage(ctx context.Context, parsed *querylang.ParsedQuery, params *common.TagParams) (QueryResult, error) {
+	md, where, err := a.metadataAsOf(ctx, params.AsOf, params.Where)
+	if err != nil {
+		return nil, err
+	}
+	res, more, err := md.GetTagsPage(ctx, params.Tags, where.ToBson(), params.OrderBy, params.Offset, params.Limit)
+	if err != nil || !more {
+		return res, err
+	}
+	return newResultPage(parsed, res, &queryCursor{Offset: params.Offset + params.Limit}), nil
+}
+
+// whether the data query selects raw data in a time range, which is the
+// kind of data query that can be paged
+func isPagedData(params *common.DataParams, dtype querylang.DataQueryType) bool {
+	return dtype == querylang.IN_TYPE && params.GroupBy == "" && params.Expression == "" &&
+		len(params.Functions) == 0 && !params.IsStatistical && !params.IsWindow
+}
+
+// selects a page of data in a time range
+func (a *Archiver) selectDataPage(ctx context.Context, parsed *querylang.ParsedQuery, params *common.DataParams) (QueryResult, error) {
+	if params.DataLimit <= 0 {
+		params.DataLimit = a.dataPageSize()
+	}
+	res, next, err := a.selectDataRange(ctx, params)
+	if err != nil {
+		return res, err
+	}
+	return newResultPage(parsed, res, next), nil
+}
+
+// the limit of data queries without one, 0 for no limit
+func (a *Archiver) dataPageSize() int {
+	if size := a.Config.Archiver.DataPageSize; size != nil {
+		return *size
+	}
+	return defaultDataPageSize
+}
+
+// sorts the streams so that pages of them are always taken in the same order
+func sortUUIDs(uuids []common.UUID) {
+	sort.Slice(uuids, func(i, j int) bool { return uuids[i] < uuids[j] })
+}
+
+// keeps the streams that are continued from params.Resume, if any
+func resumedUUIDs(uuids []common.UUID, params *common.DataParams) []common.UUID {
+	if params.Resume == nil {
+		return uuids
+	}
+	var ret []common.UUID
+	for _, uuid := range uuids {
+		if _, found := params.Resume[uuid]; found {
+			ret = append(ret, uuid)
+		}
+	}
+	return ret
+}
+
+// the time the stream starts from: Begin, or its time in params.Resume
+func resumedBegin(uuid common.UUID, params *common.DataParams) uint64 {
+	if resume := params.Resume[uuid]; resume > params.Begin {
+		return resume
+	}
+	return params.Begin
+}
+
+// Fetches a page of readings: each stream starts from resumedBegin, and only
+// its first limit readings are fetched if limit is positive
+func (a *Archiver) getDataPage(ctx context.Context, uuids []common.UUID, params *common.DataParams, limit int) ([]common.SmapNumbersResponse, error) {
+	if params.Resample != nil {
+		return a.getResampledPage(ctx, uuids, params)
+	}
+	return a.withVirtual(ctx, uuids, func(stored []common.UUID) ([]common.SmapNumbersResponse, error) {
+		var starts = make([]uint64, len(stored))
+		for i, uuid := range stored {
+			starts[i] = resumedBegin(uuid, params)
+		}
+		return a.tsStore.GetDataPage(ctx, stored, starts, params.End, limit)
+	}, func(vs *virtualStream) ([]*common.SmapNumberReading, error) {
+		readings, err := a.evaluateExpression(ctx, vs.expr, vs.inputs, resumedBegin(virtualUUID(vs.definition.Name), params), params.End)
+		if limit > 0 && len(readings) > limit {
+			readings = readings[:limit]
+		}
+		return readings, err
+	})
+}
+
+// Resampled streams are computed over their whole range. The streams that
+// start from the same time are fetched together
+func (a *Archiver) getResampledPage(ctx context.Context, uuids []common.UUID, params *common.DataParams) ([]common.SmapNumbersResponse, error) {
+	var (
+		byBegin = make(map[uint64][]common.UUID)
+		begins  []uint64
+	)
+	for _, uuid := range uuids {
+		begin := resumedBegin(uuid, params)
+		if _, found := byBegin[begin]; !found {
+			begins = append(begins, begin)
+		}
+		byBegin[begin] = append(byBegin[begin], uuid)
+	}
+	var readings = make(map[common.UUID]common.SmapNumbersResponse, len(uuids))
+	for _, begin := range begins {
+		streamParams := *params
+		streamParams.Begin = begin
+		res, err := a.getData(ctx, byBegin[begin], &streamParams)
+		if err != nil {
+			return nil, err
+		}
+		for _, resp := range res {
+			readings[resp.UUID] = resp
+		}
+	}
+	var ret = make([]common.SmapNumbersResponse, 0, len(uuids))
+	for _, uuid := range uuids {
+		if resp, found := readings[uuid]; found {
+			ret = append(ret, resp)
+		}
+	}
+	return ret, nil
+}
+
+// like GetObjects, but each stream in params.Resume starts from its own time
+func (a *Archiver) getResumedObjects(ctx context.Context, uuids []common.UUID, params *common.DataParams) ([]common.SmapObjectResponse, error) {
+	defer traceOf(ctx).fetched("GetObjects")
+	if params.Resume == nil {
+		return a.objStore.GetObjects(ctx, uuids, params.Begin, params.End)
+	}
+	var ret []common.SmapObjectResponse
+	for _, uuid := range uuids {
+		begin := params.Begin
+		if resume := params.Resume[uuid]; resume > begin {
+			begin = resume
+		}
+		objects, err := a.objStore.GetObjects(ctx, []common.UUID{uuid}, begin, params.End)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, objects...)
+	}
+	return ret, nil
+}
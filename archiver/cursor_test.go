@@ -0,0 +1,173 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestPagedQueries(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	base, minute := uint64(1451606400000000000), uint64(time.Minute)
+	// five streams with three readings each
+	for i := 0; i < 5; i++ {
+		msg := &common.SmapMessage{UUID: common.NewUUID(), Path: fmt.Sprintf("/meter%d", i), Metadata: common.Dict{"Type": "Meter"}}
+		for j := uint64(0); j < 3; j++ {
+			msg.Readings = append(msg.Readings, &common.SmapNumberReading{Time: base + j*minute, UoT: common.UOT_NS, Value: float64(j)})
+		}
+		if err := a.AddData(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// follows the cursors of the query, and returns every page
+	pages := func(query string) (ret []common.SmapMessageList) {
+		res, err := a.HandleQuery(context.Background(), query)
+		for len(ret) < 20 {
+			if err != nil {
+				t.Errorf("%v: %v", query, err)
+				return
+			}
+			page, truncated := res.(common.ResultPage)
+			if !truncated {
+				return append(ret, res.(common.SmapMessageList))
+			}
+			ret = append(ret, page.Results)
+			res, err = a.HandleCursor(context.Background(), page.Next)
+		}
+		t.Errorf("%v: too many pages", query)
+		return
+	}
+
+	var seen = make(map[common.UUID]bool)
+	metadata := pages("select uuid where Metadata/Type = 'Meter' limit 2")
+	if len(metadata) != 3 {
+		t.Errorf("Expected 3 pages of metadata, got %v", metadata)
+	}
+	for _, page := range metadata {
+		for _, msg := range page {
+			if seen[msg.UUID] {
+				t.Errorf("Stream %v is on more than one page", msg.UUID)
+			}
+			seen[msg.UUID] = true
+		}
+	}
+	if len(seen) != 5 {
+		t.Errorf("Expected all 5 streams on the pages, got %v", seen)
+	}
+	if last := pages("select uuid where Metadata/Type = 'Meter' limit 2 offset 4"); len(last) != 1 || len(last[0]) != 1 {
+		t.Errorf("Expected the last stream only, got %v", last)
+	}
+
+	// two readings of two streams at a time: each pair of streams takes two pages
+	var readings = make(map[common.UUID][]uint64)
+	data := pages("select data in (1451606400, 1451606700) limit 2 streamlimit 2 as ns where Metadata/Type = 'Meter'")
+	if len(data) != 6 {
+		t.Errorf("Expected 6 pages of data, got %d", len(data))
+	}
+	for _, page := range data {
+		for _, msg := range page {
+			for _, rdg := range msg.Readings {
+				readings[msg.UUID] = append(readings[msg.UUID], rdg.GetTime())
+			}
+		}
+	}
+	for uuid := range seen {
+		if times := readings[uuid]; len(times) != 3 || times[0] != base || times[1] != base+minute || times[2] != base+2*minute {
+			t.Errorf("Expected every reading of %v once, got %v", uuid, times)
+		}
+	}
+
+	if _, err := a.HandleCursor(context.Background(), "not a cursor"); err == nil {
+		t.Error("Invalid cursor should be rejected")
+	}
+	// cursors come from clients, so they must not smuggle in other queries
+	for _, query := range []string{
+		"delete data in (1451606400, 1451606700) where Metadata/Type = 'Meter'",
+		"set Metadata/Type = 'Gone' where Metadata/Type = 'Meter'",
+		"select distinct Metadata/Type",
+		"select data before 1451606700 where Metadata/Type = 'Meter'",
+	} {
+		if _, err := a.HandleCursor(context.Background(), queryCursor{Query: query}.encode()); err == nil {
+			t.Errorf("Cursor with %v should be rejected", query)
+		}
+	}
+	if uuids, _ := a.mdStore.GetUUIDs(context.Background(), common.Dict{"Metadata.Type": "Meter"}.ToBson()); len(uuids) != 5 {
+		t.Errorf("Expected the cursors to leave the metadata alone, got %v", uuids)
+	}
+}
+
+// records the limit of every page fetched
+type pageCountingStore struct {
+	*embeddedDB
+	limits []int
+}
+
+func (p *pageCountingStore) GetDataPage(ctx context.Context, uuids []common.UUID, starts []uint64, end uint64, limit int) ([]common.SmapNumbersResponse, error) {
+	p.limits = append(p.limits, limit)
+	return p.embeddedDB.GetDataPage(ctx, uuids, starts, end, limit)
+}
+
+func TestDataPageSize(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	store := &pageCountingStore{embeddedDB: a.tsStore.(*embeddedDB)}
+	a.tsStore = store
+	base, minute := uint64(1451606400000000000), uint64(time.Minute)
+	for i := 0; i < 3; i++ {
+		msg := &common.SmapMessage{UUID: common.NewUUID(), Path: fmt.Sprintf("/meter%d", i), Metadata: common.Dict{"Type": "Meter"}}
+		for j := uint64(0); j < 5; j++ {
+			msg.Readings = append(msg.Readings, &common.SmapNumberReading{Time: base + j*minute, UoT: common.UOT_NS, Value: float64(j)})
+		}
+		if err := a.AddData(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// without a limit, the query is paged by the configured page size
+	pageSize := 2
+	a.Config.Archiver.DataPageSize = &pageSize
+	var (
+		pages    int
+		readings int
+	)
+	res, err := a.HandleQuery(context.Background(), "select data in (1451606400, 1451606700) where Metadata/Type = 'Meter'")
+	for err == nil {
+		pages += 1
+		page, truncated := res.(common.ResultPage)
+		if !truncated {
+			for _, msg := range res.(common.SmapMessageList) {
+				readings += len(msg.Readings)
+			}
+			break
+		}
+		for _, msg := range page.Results {
+			if len(msg.Readings) > pageSize {
+				t.Errorf("Expected at most %d readings of a stream on a page, got %v", pageSize, msg.Readings)
+			}
+			readings += len(msg.Readings)
+		}
+		res, err = a.HandleCursor(context.Background(), page.Next)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages != 3 || readings != 15 {
+		t.Errorf("Expected the 15 readings on 3 pages, got %d readings on %d pages", readings, pages)
+	}
+	// every page, resumed or not, is fetched with one call that reads one
+	// reading more than the page size
+	if len(store.limits) != 3 {
+		t.Errorf("Expected one fetch per page, got %v", store.limits)
+	}
+	for _, limit := range store.limits {
+		if limit != pageSize+1 {
+			t.Errorf("Expected pages to be fetched with a limit of %d, got %v", pageSize+1, store.limits)
+			break
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package archiver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jf87/giles2/common"
+)
+
+// Retention rules, rollups and virtual streams are named definitions. They
+// are kept in the metadata store, one collection per kind, and are listed,
+// saved and removed through the same admin API: ListDefinitions,
+// SaveDefinition and RemoveDefinition, which the HTTP plugin serves under
+// /admin/<kind>.
+
+const (
+	retentionDefinitions = "retention"
+	rollupDefinitions    = "rollups"
+	virtualDefinitions   = "virtual"
+)
+
+// the kinds of definitions that are managed through the admin API
+var definitionKinds = []string{retentionDefinitions, rollupDefinitions, virtualDefinitions}
+
+// the admin API of one kind of definition
+type definitionKind struct {
+	// returns all definitions, sorted by name
+	list func(ctx context.Context) (interface{}, error)
+	// decodes one definition from JSON, checks and saves it on behalf of the
+	// writer
+	save   func(data []byte, writer string) error
+	remove func(name string) error
+}
+
+func (a *Archiver) definitionKind(kind string) (definitionKind, error) {
+	switch kind {
+	case retentionDefinitions:
+		return definitionKind{
+			list: func(ctx context.Context) (interface{}, error) { return a.GetRetentionRules(ctx) },
+			save: func(data []byte, writer string) error {
+				var rule common.RetentionRule
+				if err := json.Unmarshal(data, &rule); err != nil {
+					return err
+				}
+				return a.SaveRetentionRule(rule, writer)
+			},
+			remove: a.RemoveRetentionRule,
+		}, nil
+	case rollupDefinitions:
+		return definitionKind{
+			list: func(ctx context.Context) (interface{}, error) { return a.GetRollups(ctx) },
+			save: func(data []byte, writer string) error {
+				var rollup common.Rollup
+				if err := json.Unmarshal(data, &rollup); err != nil {
+					return err
+				}
+				return a.SaveRollup(rollup)
+			},
+			remove: a.RemoveRollup,
+		}, nil
+	case virtualDefinitions:
+		return definitionKind{
+			list: func(ctx context.Context) (interface{}, error) { return a.GetVirtualStreams(ctx) },
+			save: func(data []byte, writer string) error {
+				var virtual common.VirtualStream
+				if err := json.Unmarshal(data, &virtual); err != nil {
+					return err
+				}
+				return a.SaveVirtualStream(virtual)
+			},
+			remove: a.RemoveVirtualStream,
+		}, nil
+	}
+	return definitionKind{}, fmt.Errorf("Unknown kind of definition %v", kind)
+}
+
+// returns all definitions of the kind ("retention", "rollups" or "virtual"),
+// sorted by name
+func (a *Archiver) ListDefinitions(ctx context.Context, kind string) (interface{}, error) {
+	k, err := a.definitionKind(kind)
+	if err != nil {
+		return nil, err
+	}
+	return k.list(ctx)
+}
+
+// decodes a definition of the kind from JSON, checks it and saves it,
+// replacing the definition with the same name. The writer is checked like for
+// a DELETE query if the definition removes data
+func (a *Archiver) SaveDefinition(kind string, data []byte, writer string) error {
+	k, err := a.definitionKind(kind)
+	if err != nil {
+		return err
+	}
+	return k.save(data, writer)
+}
+
+func (a *Archiver) RemoveDefinition(kind, name string) error {
+	k, err := a.definitionKind(kind)
+	if err != nil {
+		return err
+	}
+	return k.remove(name)
+}
+
+// returns true if the definitions of the kind can be managed through the
+// admin API
+func IsDefinitionKind(kind string) bool {
+	for _, k := range definitionKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
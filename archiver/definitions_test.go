@@ -0,0 +1,73 @@
+package archiver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestDefinitions(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+
+	for _, data := range []string{
+		`{"Name": "soda15", "Where": "Metadata/Building = 'Soda'", "Width": "15min"}`,
+		`{"Name": "cory1h", "Where": "Metadata/Building = 'Cory'", "Width": "1h"}`,
+	} {
+		if err := a.SaveDefinition(rollupDefinitions, []byte(data), "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.SaveDefinition(rollupDefinitions, []byte(`{"Name": "bad", "Width": "soon"}`), "test"); err == nil {
+		t.Error("Saving an invalid rollup should fail")
+	}
+	if err := a.SaveDefinition("triggers", []byte(`{"Name": "x"}`), "test"); err == nil {
+		t.Error("Saving an unknown kind of definition should fail")
+	}
+	if rollups, err := a.ListDefinitions(context.Background(), rollupDefinitions); err != nil {
+		t.Fatal(err)
+	} else if r := rollups.(common.Rollups); len(r) != 2 || r[0].Name != "cory1h" || r[1].Width != "15min" {
+		t.Errorf("Expected both rollups sorted by name, got %v", r)
+	}
+	if rules, _ := a.ListDefinitions(context.Background(), retentionDefinitions); len(rules.(common.RetentionRules)) != 0 {
+		t.Errorf("Expected no retention rules, got %v", rules)
+	}
+
+	if err := a.RemoveDefinition(rollupDefinitions, "cory1h"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RemoveDefinition(rollupDefinitions, "cory1h"); err == nil {
+		t.Error("Removing a missing rollup should fail")
+	}
+	if rollups, _ := a.GetRollups(context.Background()); len(rollups) != 1 || rollups[0].Name != "soda15" {
+		t.Errorf("Expected only soda15 to remain, got %v", rollups)
+	}
+}
+
+func TestMemoryStoreDefinitionsSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "giles-definitions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := &memoryConfig{snapshot: filepath.Join(dir, "metadata.bson")}
+
+	m := newMemoryStore(config)
+	rule := common.RetentionRule{Name: "soda", Where: "Metadata/Building = 'Soda'", Keep: "90d"}
+	if err = m.SaveDefinition(retentionDefinitions, rule.Name, rule); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	var rules common.RetentionRules
+	if err = newMemoryStore(config).GetDefinitions(context.Background(), retentionDefinitions, &rules); err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0] != rule {
+		t.Errorf("Expected %v after reloading, got %v", rule, rules)
+	}
+}
@@ -0,0 +1,170 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/jf87/giles2/common"
+)
+
+// Distributions summarize the raw readings of each stream within each window
+// beyond the count, minimum, mean and maximum of statistical data, e.g.
+//
+//	select percentile(50, 95, 99, window(1h) data in (now -1d, now)) where Metadata/Type = 'Temperature'
+//	select histogram(18, 20, 22, 24, window(1h) data in (now -1d, now)) where Metadata/Type = 'Temperature'
+//
+// percentile takes one or more percentiles between 0 and 100, interpolated
+// linearly between the closest readings. histogram takes the ascending edges
+// of its buckets, and counts the readings below the first edge, between each
+// pair of edges and above the last edge. Windows are aligned the same way as
+// for window and statistical data; without a window, the whole time range is
+// summarized. Transforms inside the distribution are applied to the raw
+// readings first.
+
+func isDistribution(name string) bool {
+	return name == "percentile" || name == "histogram"
+}
+
+// parses the arguments of a distribution function
+func distributionArgs(fn common.DataFunction) ([]float64, error) {
+	if len(fn.Args) == 0 {
+		return nil, fmt.Errorf("%v needs at least one argument", fn.Name)
+	}
+	var args = make([]float64, len(fn.Args))
+	for i, arg := range fn.Args {
+		num, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid argument %v to %v (%v)", arg, fn.Name, err)
+		}
+		switch {
+		case fn.Name == "percentile" && (num < 0 || num > 100):
+			return nil, fmt.Errorf("Percentile %v has to be between 0 and 100", arg)
+		case fn.Name == "histogram" && i > 0 && num <= args[i-1]:
+			return nil, fmt.Errorf("Histogram edges have to be ascending (%v after %v)", arg, args[i-1])
+		}
+		args[i] = num
+	}
+	return args, nil
+}
+
+// selects the raw data for the matching streams within the range given by
+// Begin/End and computes the distribution in params.Functions for every
+// window of every stream
+func (a *Archiver) SelectDistributionData(ctx context.Context, params *common.DataParams) (result common.SmapMessageList, err error) {
+	fn := params.Functions[len(params.Functions)-1]
+	args, err := distributionArgs(fn)
+	if err != nil {
+		return
+	}
+	fns, err := lookupTransforms(params.Functions[:len(params.Functions)-1])
+	if err != nil {
+		return
+	}
+	if err = a.prepareDataParams(ctx, params); err != nil {
+		return
+	}
+	// switch order so its consistent
+	if params.End < params.Begin {
+		params.Begin, params.End = params.End, params.Begin
+	}
+	var start, width = params.Begin, params.End - params.Begin
+	switch {
+	case params.IsWindow:
+		width = params.Width
+	case params.IsStatistical:
+		if params.PointWidth < 0 || params.PointWidth > 62 {
+			return result, fmt.Errorf("Invalid point width %v", params.PointWidth)
+		}
+		width = uint64(1) << uint(params.PointWidth)
+		start -= start % width
+	}
+	if width == 0 {
+		return result, fmt.Errorf("Invalid window width %v", width)
+	}
+	// distributions are only defined for numeric streams
+	numeric, _, err := a.splitByStreamType(ctx, params.UUIDs)
+	if err != nil {
+		return
+	}
+	readings, err := a.getData(ctx, numeric, params)
+	if err != nil {
+		return
+	}
+
+	for _, resp := range readings {
+		series := applyTransforms(fns, resp.Readings)
+		if len(series) == 0 {
+			continue
+		}
+		msg := &common.SmapMessage{UUID: resp.UUID}
+		for _, window := range windowReadings(series, start, width) {
+			rdg := &common.DistributionReading{Time: window.time, UoT: common.UOT_NS, Count: uint64(len(window.values))}
+			if fn.Name == "percentile" {
+				rdg.Percentiles, rdg.Values = args, percentiles(window.values, args)
+			} else {
+				rdg.Edges, rdg.Buckets = args, histogram(window.values, args)
+			}
+			rdg.ConvertTime(common.UnitOfTime(params.ConvertToUnit))
+			msg.Readings = append(msg.Readings, rdg)
+		}
+		// apply data limit if exists
+		if params.DataLimit > 0 && len(msg.Readings) > params.DataLimit {
+			msg.Readings = msg.Readings[:params.DataLimit]
+		}
+		result = append(result, msg)
+	}
+	return
+}
+
+type readingWindow struct {
+	time   uint64
+	values []float64
+}
+
+// groups the time-ordered readings into the windows of the given width after
+// start, leaving out empty windows
+func windowReadings(readings []*common.SmapNumberReading, start, width uint64) []readingWindow {
+	var ret []readingWindow
+	for _, rdg := range readings {
+		if rdg.Time < start {
+			continue
+		}
+		windowStart := rdg.Time - (rdg.Time-start)%width
+		if len(ret) == 0 || ret[len(ret)-1].time != windowStart {
+			ret = append(ret, readingWindow{time: windowStart})
+		}
+		ret[len(ret)-1].values = append(ret[len(ret)-1].values, rdg.Value)
+	}
+	return ret
+}
+
+// Returns the value of each percentile of the values, interpolating linearly
+// between the closest ranks
+func percentiles(values []float64, ps []float64) []float64 {
+	var (
+		sorted = append([]float64{}, values...)
+		ret    = make([]float64, len(ps))
+	)
+	sort.Float64s(sorted)
+	for i, p := range ps {
+		rank := p / 100 * float64(len(sorted)-1)
+		lower := int(math.Floor(rank))
+		ret[i] = sorted[lower]
+		if lower+1 < len(sorted) {
+			ret[i] += (rank - float64(lower)) * (sorted[lower+1] - sorted[lower])
+		}
+	}
+	return ret
+}
+
+// Counts the values in the buckets between the ascending edges
+func histogram(values []float64, edges []float64) []uint64 {
+	var buckets = make([]uint64, len(edges)+1)
+	for _, v := range values {
+		buckets[sort.Search(len(edges), func(i int) bool { return edges[i] > v })] += 1
+	}
+	return buckets
+}
@@ -0,0 +1,72 @@
+package archiver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestDistributionQueries(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	base, minute := uint64(1451606400000000000), uint64(time.Minute)
+	// four readings in the first hour, three in the second
+	msg := &common.SmapMessage{UUID: common.NewUUID(), Path: "/room", Metadata: common.Dict{"Type": "Temperature"}}
+	for i, value := range []float64{23, 19, 21, 25, 20, 22, 18} {
+		msg.Readings = append(msg.Readings, &common.SmapNumberReading{Time: base + uint64(i)*15*minute, UoT: common.UOT_NS, Value: value})
+	}
+	if err := a.AddData(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := a.HandleQuery(context.Background(), "select percentile(50, 90, window(1h) data in (1451606400, 1451613600) as ns) where Metadata/Type = 'Temperature'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := res.(common.SmapMessageList)
+	if len(result) != 1 || len(result[0].Readings) != 2 {
+		t.Fatalf("Expected 2 windows, got %v", result)
+	}
+	for i, expected := range []common.DistributionReading{
+		{Time: base, Count: 4, Values: []float64{22, 24.4}},
+		{Time: base + 60*minute, Count: 3, Values: []float64{20, 21.6}},
+	} {
+		rdg := result[0].Readings[i].(*common.DistributionReading)
+		if rdg.Time != expected.Time || rdg.Count != expected.Count || len(rdg.Values) != 2 {
+			t.Errorf("Expected %+v, got %+v", expected, rdg)
+			continue
+		}
+		for j, value := range rdg.Values {
+			if diff := value - expected.Values[j]; diff > 1e-9 || diff < -1e-9 {
+				t.Errorf("Expected percentile %v to be %v, got %v", rdg.Percentiles[j], expected.Values[j], value)
+			}
+		}
+	}
+
+	// without a window the whole range is summarized
+	res, err = a.HandleQuery(context.Background(), "select histogram(20, 22, 24, data in (1451606400, 1451613600)) where Metadata/Type = 'Temperature'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result = res.(common.SmapMessageList)
+	if len(result) != 1 || len(result[0].Readings) != 1 {
+		t.Fatalf("Expected 1 window, got %v", result)
+	}
+	if rdg := result[0].Readings[0].(*common.DistributionReading); rdg.Count != 7 || !reflect.DeepEqual(rdg.Buckets, []uint64{2, 2, 2, 1}) {
+		t.Errorf("Expected buckets [2 2 2 1] of 7 readings, got %+v", rdg)
+	}
+
+	for _, query := range []string{
+		"select percentile(120, data in (1451606400, 1451613600)) where Metadata/Type = 'Temperature'",
+		"select histogram(24, 20, data in (1451606400, 1451613600)) where Metadata/Type = 'Temperature'",
+		"select percentile(data in (1451606400, 1451613600)) where Metadata/Type = 'Temperature'",
+		"select sum(5, data in (1451606400, 1451613600)) where Metadata/Type = 'Temperature'",
+	} {
+		if _, err := a.HandleQuery(context.Background(), query); err == nil {
+			t.Errorf("%v: should be rejected", query)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package archiver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/jf87/giles2/common"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The embedded object store works like the embedded timeseries store, but
+// because object values have no fixed size, each record in a stream file is
+// a BSON document {t: <nanoseconds>, v: <value>}. BSON documents carry their
+// own length, so the file can be read back without any extra framing.
+
+type embeddedObjectRecord struct {
+	Time  int64       `bson:"t"`
+	Value interface{} `bson:"v"`
+}
+
+type embeddedObjectStream struct {
+	path    string
+	loaded  bool
+	records []embeddedObjectRecord
+	sync.RWMutex
+}
+
+type embeddedObjectDB struct {
+	dir     string
+	streams map[common.UUID]*embeddedObjectStream
+	sync.RWMutex
+}
+
+func newEmbeddedObjectDB(c *embeddedConfig) *embeddedObjectDB {
+	e := &embeddedObjectDB{
+		dir:     c.dir,
+		streams: make(map[common.UUID]*embeddedObjectStream),
+	}
+	log.Noticef("Using embedded object store at %v", e.dir)
+	if err := os.MkdirAll(e.dir, 0755); err != nil {
+		log.Fatalf("Could not create embedded store directory %v (%v)", e.dir, err)
+	}
+	return e
+}
+
+func (e *embeddedObjectDB) getStream(uuid common.UUID) (*embeddedObjectStream, error) {
+	e.RLock()
+	s, found := e.streams[uuid]
+	e.RUnlock()
+	if !found {
+		path, err := embeddedPath(e.dir, uuid, ".obj")
+		if err != nil {
+			return nil, err
+		}
+		e.Lock()
+		if s, found = e.streams[uuid]; !found {
+			s = &embeddedObjectStream{path: path}
+			e.streams[uuid] = s
+		}
+		e.Unlock()
+	}
+	s.Lock()
+	defer s.Unlock()
+	if !s.loaded {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Caller must hold the write lock
+func (s *embeddedObjectStream) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		s.loaded = true
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "Could not open %v", s.path)
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	s.records = s.records[:0]
+	for {
+		var (
+			length = make([]byte, 4)
+			rec    embeddedObjectRecord
+		)
+		if _, err = io.ReadFull(reader, length); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "Could not read %v", s.path)
+		}
+		doc := make([]byte, binary.LittleEndian.Uint32(length))
+		copy(doc, length)
+		if _, err = io.ReadFull(reader, doc[4:]); err != nil {
+			// a partial trailing record is left over from an interrupted write
+			break
+		}
+		if err = bson.Unmarshal(doc, &rec); err != nil {
+			return errors.Wrapf(err, "Could not decode record in %v", s.path)
+		}
+		s.records = append(s.records, rec)
+	}
+	s.records = dedupEmbeddedObjectRecords(s.records)
+	s.loaded = true
+	return nil
+}
+
+func (s *embeddedObjectStream) write(f *os.File, records []embeddedObjectRecord) error {
+	writer := bufio.NewWriter(f)
+	for _, rec := range records {
+		doc, err := bson.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if _, err = writer.Write(doc); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+func (s *embeddedObjectStream) insert(records []embeddedObjectRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Could not open %v", s.path)
+	}
+	if err = s.write(f, records); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "Could not write %v", s.path)
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	s.records = dedupEmbeddedObjectRecords(append(s.records, records...))
+	return nil
+}
+
+func (s *embeddedObjectStream) remove(start, end uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	kept := s.records[:0]
+	for _, rec := range s.records {
+		if uint64(rec.Time) < start || uint64(rec.Time) >= end {
+			kept = append(kept, rec)
+		}
+	}
+	// nothing to delete, so the file does not need to be rewritten
+	if len(kept) == len(s.records) {
+		return nil
+	}
+	s.records = kept
+
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "Could not create %v", tmp)
+	}
+	if err = s.write(f, s.records); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "Could not write %v", tmp)
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func dedupEmbeddedObjectRecords(records []embeddedObjectRecord) []embeddedObjectRecord {
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time < records[j].Time })
+	deduped := records[:0]
+	for i, rec := range records {
+		if i+1 < len(records) && records[i+1].Time == rec.Time {
+			continue
+		}
+		deduped = append(deduped, rec)
+	}
+	return deduped
+}
+
+func (e *embeddedObjectDB) AddObjects(msg *common.SmapMessage) error {
+	var records []embeddedObjectRecord
+	for _, rdg := range msg.Readings {
+		if !rdg.IsObject() {
+			continue
+		}
+		rdg.ConvertTime(common.UOT_NS)
+		records = append(records, embeddedObjectRecord{Time: int64(rdg.GetTime()), Value: rdg.GetValue()})
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	stream, err := e.getStream(msg.UUID)
+	if err != nil {
+		return err
+	}
+	return stream.insert(records)
+}
+
+func (e *embeddedObjectDB) queryNearestObject(ctx context.Context, uuids []common.UUID, ref uint64, backwards bool) ([]common.SmapObjectResponse, error) {
+	var ret = make([]common.SmapObjectResponse, len(uuids))
+	for i, uu := range uuids {
+		if err := ctx.Err(); err != nil {
+			return ret, err
+		}
+		stream, err := e.getStream(uu)
+		if err != nil {
+			return ret, err
+		}
+		ret[i] = common.SmapObjectResponse{UUID: uu, Readings: []*common.SmapObjectReading{}}
+		stream.RLock()
+		idx := sort.Search(len(stream.records), func(i int) bool { return uint64(stream.records[i].Time) >= ref })
+		if backwards {
+			idx -= 1
+		}
+		if idx >= 0 && idx < len(stream.records) {
+			rec := stream.records[idx]
+			ret[i].Readings = append(ret[i].Readings, &common.SmapObjectReading{Time: uint64(rec.Time), Value: rec.Value, UoT: common.UOT_NS})
+		}
+		stream.RUnlock()
+	}
+	return ret, nil
+}
+
+func (e *embeddedObjectDB) PrevObjects(ctx context.Context, uuids []common.UUID, ref uint64) ([]common.SmapObjectResponse, error) {
+	return e.queryNearestObject(ctx, uuids, ref, true)
+}
+
+func (e *embeddedObjectDB) NextObjects(ctx context.Context, uuids []common.UUID, ref uint64) ([]common.SmapObjectResponse, error) {
+	return e.queryNearestObject(ctx, uuids, ref, false)
+}
+
+func (e *embeddedObjectDB) GetObjects(ctx context.Context, uuids []common.UUID, start, end uint64) ([]common.SmapObjectResponse, error) {
+	var ret = make([]common.SmapObjectResponse, len(uuids))
+	for i, uu := range uuids {
+		if err := ctx.Err(); err != nil {
+			return ret, err
+		}
+		stream, err := e.getStream(uu)
+		if err != nil {
+			return ret, err
+		}
+		sr := common.SmapObjectResponse{UUID: uu, Readings: []*common.SmapObjectReading{}}
+		stream.RLock()
+		for _, rec := range stream.records {
+			if uint64(rec.Time) >= start && uint64(rec.Time) < end {
+				sr.Readings = append(sr.Readings, &common.SmapObjectReading{Time: uint64(rec.Time), Value: rec.Value, UoT: common.UOT_NS})
+			}
+		}
+		stream.RUnlock()
+		ret[i] = sr
+	}
+	return ret, nil
+}
+
+func (e *embeddedObjectDB) CountObjects(ctx context.Context, uuids []common.UUID, start, end uint64) (uint64, error) {
+	var count uint64
+	for _, uu := range uuids {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		stream, err := e.getStream(uu)
+		if err != nil {
+			return count, err
+		}
+		stream.RLock()
+		// records are sorted by time
+		from := sort.Search(len(stream.records), func(i int) bool { return uint64(stream.records[i].Time) >= start })
+		to := sort.Search(len(stream.records), func(i int) bool { return uint64(stream.records[i].Time) >= end })
+		stream.RUnlock()
+		count += uint64(to - from)
+	}
+	return count, nil
+}
+
+func (e *embeddedObjectDB) DeleteObjects(uuids []common.UUID, start, end uint64) error {
+	for _, uu := range uuids {
+		stream, err := e.getStream(uu)
+		if err != nil {
+			return err
+		}
+		if err = stream.remove(start, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package archiver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestEmbeddedObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "giles-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := newEmbeddedObjectDB(&embeddedConfig{dir: dir})
+	uuid := common.NewUUID()
+	base := uint64(1451606400000000000)
+	msg := &common.SmapMessage{UUID: uuid, Readings: []common.Reading{
+		&common.SmapObjectReading{Time: base, UoT: common.UOT_NS, Value: "on"},
+		&common.SmapObjectReading{Time: base + 10, UoT: common.UOT_NS, Value: map[string]interface{}{"state": "off"}},
+		&common.SmapObjectReading{Time: base + 20, UoT: common.UOT_NS, Value: "on"},
+	}}
+	if err = db.AddObjects(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := db.GetObjects(context.Background(), []common.UUID{uuid}, base, base+20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || len(res[0].Readings) != 2 || res[0].Readings[0].Value != "on" {
+		t.Errorf("Expected 2 objects, got %v", res)
+	}
+	if prev, _ := db.PrevObjects(context.Background(), []common.UUID{uuid}, base+10); len(prev[0].Readings) != 1 || prev[0].Readings[0].Time != base {
+		t.Errorf("Prev should return object at %v, got %v", base, prev)
+	}
+	if next, _ := db.NextObjects(context.Background(), []common.UUID{uuid}, base+10); len(next[0].Readings) != 1 || next[0].Readings[0].Time != base+10 {
+		t.Errorf("Next should return object at %v, got %v", base+10, next)
+	}
+
+	if err = db.DeleteObjects([]common.UUID{uuid}, base, base+10); err != nil {
+		t.Fatal(err)
+	}
+	reopened := newEmbeddedObjectDB(&embeddedConfig{dir: dir})
+	res, _ = reopened.GetObjects(context.Background(), []common.UUID{uuid}, 0, base+100)
+	if len(res[0].Readings) != 2 || res[0].Readings[0].Time != base+10 {
+		t.Errorf("Expected 2 objects after delete and reload, got %v", res[0].Readings)
+	}
+}
+
+func TestEmbeddedObjectsInvalidUUID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "giles-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := newEmbeddedObjectDB(&embeddedConfig{dir: dir})
+	outside := filepath.Join(filepath.Dir(dir), "giles-outside.obj")
+	defer os.Remove(outside)
+	msg := &common.SmapMessage{UUID: "../giles-outside", Readings: []common.Reading{
+		&common.SmapObjectReading{Time: 1451606400000000000, UoT: common.UOT_NS, Value: "on"},
+	}}
+	if err = db.AddObjects(msg); err == nil {
+		t.Error("Expected the stream to be refused")
+	}
+	if _, err = os.Stat(outside); !os.IsNotExist(err) {
+		t.Errorf("Expected no file outside of the store, got %v", err)
+	}
+}
@@ -0,0 +1,434 @@
+package archiver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/jf87/giles2/common"
+	uuidlib "github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// The embedded timeseries store keeps one append-only file per stream inside
+// a local directory. Each record is 16 bytes: the timestamp in nanoseconds
+// followed by the IEEE 754 bits of the value, both little endian. A stream's
+// file is read into memory the first time the stream is touched; writes are
+// appended to the file and merged into the sorted in-memory copy. Deletes
+// rewrite the file. This is meant for development machines and small
+// deployments that do not want to run BtrDB.
+
+const embeddedRecordSize = 16
+
+type embeddedConfig struct {
+	dir string
+}
+
+type embeddedRecord struct {
+	time  uint64
+	value float64
+}
+
+type embeddedStream struct {
+	path    string
+	loaded  bool
+	records []embeddedRecord
+	sync.RWMutex
+}
+
+type embeddedDB struct {
+	dir     string
+	streams map[common.UUID]*embeddedStream
+	sync.RWMutex
+}
+
+func newEmbeddedDB(c *embeddedConfig) *embeddedDB {
+	e := &embeddedDB{
+		dir:     c.dir,
+		streams: make(map[common.UUID]*embeddedStream),
+	}
+	log.Noticef("Using embedded timeseries store at %v", e.dir)
+	if err := os.MkdirAll(e.dir, 0755); err != nil {
+		log.Fatalf("Could not create embedded store directory %v (%v)", e.dir, err)
+	}
+	return e
+}
+
+// returns the path of the file of the stream in dir. UUIDs come from clients,
+// so only well-formed ones are accepted; anything else, e.g. "../x", could
+// name a file outside of dir
+func embeddedPath(dir string, uuid common.UUID, ext string) (string, error) {
+	if uuidlib.Parse(string(uuid)) == nil {
+		return "", fmt.Errorf("Invalid UUID %q", uuid)
+	}
+	return filepath.Join(dir, string(uuid)+ext), nil
+}
+
+// returns the stream for the given uuid, loading it from disk if necessary
+func (e *embeddedDB) getStream(uuid common.UUID) (*embeddedStream, error) {
+	e.RLock()
+	s, found := e.streams[uuid]
+	e.RUnlock()
+	if !found {
+		path, err := embeddedPath(e.dir, uuid, ".dat")
+		if err != nil {
+			return nil, err
+		}
+		e.Lock()
+		if s, found = e.streams[uuid]; !found {
+			s = &embeddedStream{path: path}
+			e.streams[uuid] = s
+		}
+		e.Unlock()
+	}
+	s.Lock()
+	defer s.Unlock()
+	if !s.loaded {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// reads all records for this stream from disk. Later records for the same
+// timestamp replace earlier ones. Caller must hold the write lock
+func (s *embeddedStream) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		s.loaded = true
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "Could not open %v", s.path)
+	}
+	defer f.Close()
+	var (
+		reader = bufio.NewReader(f)
+		buf    = make([]byte, embeddedRecordSize)
+	)
+	s.records = s.records[:0]
+	for {
+		if _, err = io.ReadFull(reader, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+			// a partial trailing record is left over from an interrupted write
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "Could not read %v", s.path)
+		}
+		s.records = append(s.records, decodeEmbeddedRecord(buf))
+	}
+	s.records = dedupEmbeddedRecords(s.records)
+	s.loaded = true
+	return nil
+}
+
+// appends the records to the stream file and merges them into memory.
+func (s *embeddedStream) insert(records []embeddedRecord) error {
+	records = dedupEmbeddedRecords(records)
+	s.Lock()
+	defer s.Unlock()
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Could not open %v", s.path)
+	}
+	writer := bufio.NewWriter(f)
+	buf := make([]byte, embeddedRecordSize)
+	for _, rec := range records {
+		encodeEmbeddedRecord(buf, rec)
+		if _, err = writer.Write(buf); err != nil {
+			f.Close()
+			return errors.Wrapf(err, "Could not write %v", s.path)
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "Could not write %v", s.path)
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	s.records = mergeEmbeddedRecords(s.records, records)
+	return nil
+}
+
+// removes all records in [start, end) and rewrites the stream file
+func (s *embeddedStream) remove(start, end uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	var kept []embeddedRecord
+	for _, rec := range s.records {
+		if rec.time < start || rec.time >= end {
+			kept = append(kept, rec)
+		}
+	}
+	// nothing to delete, so the file does not need to be rewritten
+	if len(kept) == len(s.records) {
+		return nil
+	}
+
+	// memory is only updated once the file has been replaced, so that both
+	// still agree if the write fails
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "Could not create %v", tmp)
+	}
+	writer := bufio.NewWriter(f)
+	buf := make([]byte, embeddedRecordSize)
+	for _, rec := range kept {
+		encodeEmbeddedRecord(buf, rec)
+		if _, err = writer.Write(buf); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrapf(err, "Could not write %v", tmp)
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.records = kept
+	return nil
+}
+
+// returns the records with start <= time < end
+func (s *embeddedStream) between(start, end uint64) []embeddedRecord {
+	s.RLock()
+	defer s.RUnlock()
+	lo := sort.Search(len(s.records), func(i int) bool { return s.records[i].time >= start })
+	hi := sort.Search(len(s.records), func(i int) bool { return s.records[i].time >= end })
+	if lo >= hi {
+		return nil
+	}
+	ret := make([]embeddedRecord, hi-lo)
+	copy(ret, s.records[lo:hi])
+	return ret
+}
+
+func encodeEmbeddedRecord(buf []byte, rec embeddedRecord) {
+	binary.LittleEndian.PutUint64(buf[:8], rec.time)
+	binary.LittleEndian.PutUint64(buf[8:], math.Float64bits(rec.value))
+}
+
+func decodeEmbeddedRecord(buf []byte) embeddedRecord {
+	return embeddedRecord{
+		time:  binary.LittleEndian.Uint64(buf[:8]),
+		value: math.Float64frombits(binary.LittleEndian.Uint64(buf[8:])),
+	}
+}
+
+// sorts the records by time. If there is more than one record for a
+// timestamp, the one that was added last wins
+func dedupEmbeddedRecords(records []embeddedRecord) []embeddedRecord {
+	sort.SliceStable(records, func(i, j int) bool { return records[i].time < records[j].time })
+	deduped := records[:0]
+	for i, rec := range records {
+		if i+1 < len(records) && records[i+1].time == rec.time {
+			continue
+		}
+		deduped = append(deduped, rec)
+	}
+	return deduped
+}
+
+// merges sorted and deduplicated records into the sorted records of a
+// stream, so that only the new records are sorted on insert. Added records
+// replace existing ones with the same timestamp
+func mergeEmbeddedRecords(existing, added []embeddedRecord) []embeddedRecord {
+	// readings usually arrive in order
+	if len(existing) == 0 || len(added) == 0 || added[0].time > existing[len(existing)-1].time {
+		return append(existing, added...)
+	}
+	var (
+		merged = make([]embeddedRecord, 0, len(existing)+len(added))
+		i, j   int
+	)
+	for i < len(existing) && j < len(added) {
+		switch {
+		case existing[i].time < added[j].time:
+			merged = append(merged, existing[i])
+			i++
+		case existing[i].time > added[j].time:
+			merged = append(merged, added[j])
+			j++
+		default:
+			merged = append(merged, added[j])
+			i++
+			j++
+		}
+	}
+	merged = append(merged, existing[i:]...)
+	return append(merged, added[j:]...)
+}
+
+func (e *embeddedDB) AddMessage(msg *common.SmapMessage) error {
+	if len(msg.Readings) == 0 {
+		return nil
+	}
+	records := make([]embeddedRecord, len(msg.Readings))
+	for i, rdg := range msg.Readings {
+		rdg.ConvertTime(common.UOT_NS)
+		num, ok := rdg.GetValue().(float64)
+		if !ok {
+			return fmt.Errorf("Bad number in message %v %v", msg.UUID, rdg)
+		}
+		records[i] = embeddedRecord{time: rdg.GetTime(), value: num}
+	}
+	stream, err := e.getStream(msg.UUID)
+	if err != nil {
+		return err
+	}
+	return stream.insert(records)
+}
+
+func (e *embeddedDB) queryNearestValue(ctx context.Context, uuids []common.UUID, start uint64, backwards bool) ([]common.SmapNumbersResponse, error) {
+	var ret = make([]common.SmapNumbersResponse, len(uuids))
+	for i, uu := range uuids {
+		if err := ctx.Err(); err != nil {
+			return ret, err
+		}
+		stream, err := e.getStream(uu)
+		if err != nil {
+			return ret, err
+		}
+		ret[i] = common.SmapNumbersResponse{UUID: uu, Readings: []*common.SmapNumberReading{}}
+		stream.RLock()
+		idx := sort.Search(len(stream.records), func(i int) bool { return stream.records[i].time >= start })
+		if backwards {
+			idx -= 1
+		}
+		if idx >= 0 && idx < len(stream.records) {
+			rec := stream.records[idx]
+			ret[i].Readings = append(ret[i].Readings, &common.SmapNumberReading{Time: rec.time, Value: rec.value, UoT: common.UOT_NS})
+		}
+		stream.RUnlock()
+	}
+	return ret, nil
+}
+
+func (e *embeddedDB) Prev(ctx context.Context, uuids []common.UUID, start uint64) ([]common.SmapNumbersResponse, error) {
+	return e.queryNearestValue(ctx, uuids, start, true)
+}
+
+func (e *embeddedDB) Next(ctx context.Context, uuids []common.UUID, start uint64) ([]common.SmapNumbersResponse, error) {
+	return e.queryNearestValue(ctx, uuids, start, false)
+}
+
+func (e *embeddedDB) GetData(ctx context.Context, uuids []common.UUID, start, end uint64) ([]common.SmapNumbersResponse, error) {
+	var starts = make([]uint64, len(uuids))
+	for i := range starts {
+		starts[i] = start
+	}
+	return e.GetDataPage(ctx, uuids, starts, end, 0)
+}
+
+func (e *embeddedDB) GetDataPage(ctx context.Context, uuids []common.UUID, starts []uint64, end uint64, limit int) ([]common.SmapNumbersResponse, error) {
+	var ret = make([]common.SmapNumbersResponse, len(uuids))
+	for i, uu := range uuids {
+		if err := ctx.Err(); err != nil {
+			return ret, err
+		}
+		stream, err := e.getStream(uu)
+		if err != nil {
+			return ret, err
+		}
+		records := stream.between(starts[i], end)
+		if limit > 0 && len(records) > limit {
+			records = records[:limit]
+		}
+		sr := common.SmapNumbersResponse{UUID: uu, Readings: []*common.SmapNumberReading{}}
+		for _, rec := range records {
+			sr.Readings = append(sr.Readings, &common.SmapNumberReading{Time: rec.time, Value: rec.value, UoT: common.UOT_NS})
+		}
+		ret[i] = sr
+	}
+	return ret, nil
+}
+
+func (e *embeddedDB) StatisticalData(ctx context.Context, uuids []common.UUID, pointWidth int, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
+	if pointWidth < 0 || pointWidth > 62 {
+		return nil, fmt.Errorf("Invalid point width %v", pointWidth)
+	}
+	// statistical windows are aligned to multiples of 2^pointWidth
+	var width = uint64(1) << uint(pointWidth)
+	return e.windows(ctx, uuids, start-start%width, width, end)
+}
+
+func (e *embeddedDB) WindowData(ctx context.Context, uuids []common.UUID, width, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
+	if width == 0 {
+		return nil, fmt.Errorf("Invalid window width %v", width)
+	}
+	return e.windows(ctx, uuids, start, width, end)
+}
+
+// computes count/min/mean/max over consecutive windows of [width] nanoseconds
+// beginning at [start]. Windows without readings are omitted
+func (e *embeddedDB) windows(ctx context.Context, uuids []common.UUID, start, width, end uint64) ([]common.StatisticalNumbersResponse, error) {
+	var ret = make([]common.StatisticalNumbersResponse, len(uuids))
+	for i, uu := range uuids {
+		if err := ctx.Err(); err != nil {
+			return ret, err
+		}
+		stream, err := e.getStream(uu)
+		if err != nil {
+			return ret, err
+		}
+		sr := common.StatisticalNumbersResponse{UUID: uu, Readings: []*common.StatisticalNumberReading{}}
+		var cur *common.StatisticalNumberReading
+		for _, rec := range stream.between(start, end) {
+			windowStart := start + ((rec.time-start)/width)*width
+			if cur == nil || cur.Time != windowStart {
+				if cur != nil {
+					cur.Mean /= float64(cur.Count)
+				}
+				cur = &common.StatisticalNumberReading{Time: windowStart, Min: rec.value, Max: rec.value, UoT: common.UOT_NS}
+				sr.Readings = append(sr.Readings, cur)
+			}
+			cur.Count += 1
+			cur.Mean += rec.value
+			cur.Min = math.Min(cur.Min, rec.value)
+			cur.Max = math.Max(cur.Max, rec.value)
+		}
+		if cur != nil {
+			cur.Mean /= float64(cur.Count)
+		}
+		ret[i] = sr
+	}
+	return ret, nil
+}
+
+func (e *embeddedDB) DeleteData(uuids []common.UUID, start uint64, end uint64) error {
+	for _, uu := range uuids {
+		stream, err := e.getStream(uu)
+		if err != nil {
+			return err
+		}
+		if err = stream.remove(start, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *embeddedDB) ValidTimestamp(time uint64, uot common.UnitOfTime) bool {
+	var err error
+	if uot != common.UOT_NS {
+		time, err = common.ConvertTime(time, uot, common.UOT_NS)
+	}
+	return time <= MaximumTime && err == nil
+}
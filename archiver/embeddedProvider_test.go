@@ -0,0 +1,163 @@
+package archiver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jf87/giles2/common"
+)
+
+func newTestEmbeddedDB(t *testing.T) (*embeddedDB, func()) {
+	dir, err := ioutil.TempDir("", "giles-embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newEmbeddedDB(&embeddedConfig{dir: dir}), func() { os.RemoveAll(dir) }
+}
+
+func embeddedTestMessage(uuid common.UUID, times ...uint64) *common.SmapMessage {
+	msg := &common.SmapMessage{UUID: uuid}
+	for i, t := range times {
+		msg.Readings = append(msg.Readings, &common.SmapNumberReading{Time: t, UoT: common.UOT_NS, Value: float64(i)})
+	}
+	return msg
+}
+
+func TestEmbeddedGetData(t *testing.T) {
+	db, cleanup := newTestEmbeddedDB(t)
+	defer cleanup()
+	uuid := common.NewUUID()
+	base := uint64(1451606400000000000)
+	if err := db.AddMessage(embeddedTestMessage(uuid, base+20, base, base+10)); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := db.GetData(context.Background(), []common.UUID{uuid}, base, base+20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || len(res[0].Readings) != 2 {
+		t.Fatalf("Expected 2 readings, got %v", res)
+	}
+	if res[0].Readings[0].Time != base || res[0].Readings[1].Time != base+10 {
+		t.Errorf("Readings out of order: %v %v", res[0].Readings[0], res[0].Readings[1])
+	}
+
+	prev, _ := db.Prev(context.Background(), []common.UUID{uuid}, base+15)
+	if len(prev[0].Readings) != 1 || prev[0].Readings[0].Time != base+10 {
+		t.Errorf("Prev should return %v, got %v", base+10, prev[0].Readings)
+	}
+	next, _ := db.Next(context.Background(), []common.UUID{uuid}, base+15)
+	if len(next[0].Readings) != 1 || next[0].Readings[0].Time != base+20 {
+		t.Errorf("Next should return %v, got %v", base+20, next[0].Readings)
+	}
+}
+
+func TestEmbeddedPersistence(t *testing.T) {
+	db, cleanup := newTestEmbeddedDB(t)
+	defer cleanup()
+	uuid := common.NewUUID()
+	base := uint64(1451606400000000000)
+	db.AddMessage(embeddedTestMessage(uuid, base, base+10, base+20))
+	if err := db.DeleteData([]common.UUID{uuid}, base+5, base+15); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen the same directory
+	reopened := newEmbeddedDB(&embeddedConfig{dir: db.dir})
+	res, err := reopened.GetData(context.Background(), []common.UUID{uuid}, 0, MaximumTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res[0].Readings) != 2 {
+		t.Fatalf("Expected 2 readings after delete and reopen, got %d", len(res[0].Readings))
+	}
+	if res[0].Readings[1].Value != 2 {
+		t.Errorf("Expected value 2, got %v", res[0].Readings[1].Value)
+	}
+}
+
+func TestEmbeddedWindowData(t *testing.T) {
+	db, cleanup := newTestEmbeddedDB(t)
+	defer cleanup()
+	uuid := common.NewUUID()
+	base := uint64(1451606400000000000)
+	db.AddMessage(embeddedTestMessage(uuid, base, base+1, base+2, base+10))
+
+	res, err := db.WindowData(context.Background(), []common.UUID{uuid}, 5, base, base+20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res[0].Readings) != 2 {
+		t.Fatalf("Expected 2 windows, got %d", len(res[0].Readings))
+	}
+	first := res[0].Readings[0]
+	if first.Count != 3 || first.Min != 0 || first.Max != 2 || first.Mean != 1 {
+		t.Errorf("Bad first window %+v", first)
+	}
+}
+
+func TestEmbeddedMergeRecords(t *testing.T) {
+	db, cleanup := newTestEmbeddedDB(t)
+	defer cleanup()
+	uuid := common.NewUUID()
+	base := uint64(1451606400000000000)
+	db.AddMessage(embeddedTestMessage(uuid, base, base+20, base+40))
+	// in order, out of order, and overwriting base+20 with value 1
+	db.AddMessage(embeddedTestMessage(uuid, base+50))
+	db.AddMessage(embeddedTestMessage(uuid, base+30, base+20, base+10))
+
+	res, err := db.GetData(context.Background(), []common.UUID{uuid}, 0, MaximumTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var times []uint64
+	for _, rdg := range res[0].Readings {
+		times = append(times, rdg.Time-base)
+	}
+	if !reflect.DeepEqual(times, []uint64{0, 10, 20, 30, 40, 50}) {
+		t.Fatalf("Expected the merged readings in order, got offsets %v", times)
+	}
+	if res[0].Readings[2].Value != 1 {
+		t.Errorf("Expected the later reading to replace the earlier one, got %v", res[0].Readings[2].Value)
+	}
+}
+
+func TestEmbeddedInvalidUUID(t *testing.T) {
+	db, cleanup := newTestEmbeddedDB(t)
+	defer cleanup()
+	outside := filepath.Join(filepath.Dir(db.dir), "giles-outside")
+	defer os.Remove(outside + ".dat")
+	for _, uuid := range []common.UUID{"", "../giles-outside", "x/../../giles-outside"} {
+		if err := db.AddMessage(embeddedTestMessage(uuid, 1451606400000000000)); err == nil {
+			t.Errorf("Expected stream %q to be refused", uuid)
+		}
+	}
+	if _, err := os.Stat(outside + ".dat"); !os.IsNotExist(err) {
+		t.Errorf("Expected no file outside of the store, got %v", err)
+	}
+}
+
+func TestEmbeddedRemoveFailure(t *testing.T) {
+	db, cleanup := newTestEmbeddedDB(t)
+	defer cleanup()
+	uuid := common.NewUUID()
+	base := uint64(1451606400000000000)
+	db.AddMessage(embeddedTestMessage(uuid, base, base+10))
+
+	// the rewritten file cannot be created, so nothing is removed
+	if err := os.Mkdir(db.streams[uuid].path+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteData([]common.UUID{uuid}, base, base+5); err == nil {
+		t.Fatal("Expected the delete to fail")
+	}
+	res, _ := db.GetData(context.Background(), []common.UUID{uuid}, 0, MaximumTime)
+	if len(res[0].Readings) != 2 {
+		t.Errorf("Expected both readings to be kept in memory, got %v", res[0].Readings)
+	}
+}
@@ -0,0 +1,214 @@
+package archiver
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jf87/giles2/archiver/internal/querylang"
+	"github.com/jf87/giles2/common"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// EXPLAIN reports how a query is evaluated instead of its results:
+//
+//	explain select data in (now -1h, now) where Metadata/Type = 'Meter'
+//
+// returns the parsed query, the filter Mongo evaluates for its where clause,
+// the number of streams it resolved to, the timeseries store methods that
+// fetched the data and how long each phase took. The query is evaluated once,
+// with a trace in its context that the evaluation fills in as it parses the
+// query, resolves the where clause, fetches the data from the stores and
+// packs the results. SET and DELETE queries that are not dry runs are not
+// evaluated; only their streams are resolved.
+
+type traceKey struct{}
+
+// the trace of the evaluation of an explained query. A nil trace records
+// nothing, so the evaluation can fill in the trace of any query
+type queryTrace struct {
+	sync.Mutex
+	// the end of the last phase
+	last    time.Time
+	phases  []string
+	timings map[string]time.Duration
+	// the timeseries store methods called, in order of their first call
+	methods []string
+	uuids   int
+}
+
+// returns the trace in the context, or nil if the query is not explained
+func traceOf(ctx context.Context) *queryTrace {
+	trace, _ := ctx.Value(traceKey{}).(*queryTrace)
+	return trace
+}
+
+// If the query is explained, returns a context with a new trace whose first
+// phase, parsing the query, started at start
+func traceQuery(ctx context.Context, parsed *querylang.ParsedQuery, start time.Time) context.Context {
+	if !parsed.Explain || traceOf(ctx) != nil {
+		return ctx
+	}
+	trace := &queryTrace{last: start, timings: make(map[string]time.Duration)}
+	trace.phase("parse")
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+// adds the time since the end of the last phase to the named phase. A phase
+// can be entered more than once, e.g. to fetch the numeric and then the
+// object readings
+func (t *queryTrace) phase(name string) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	if _, found := t.timings[name]; !found {
+		t.phases = append(t.phases, name)
+	}
+	t.timings[name] += now.Sub(t.last)
+	t.last = now
+}
+
+// records that the where clause resolved to n (more) streams
+func (t *queryTrace) resolved(n int) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	t.uuids += n
+	t.Unlock()
+	t.phase("resolve")
+}
+
+// records that the data was fetched with the store method
+func (t *queryTrace) fetched(method string) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	found := false
+	for _, m := range t.methods {
+		found = found || m == method
+	}
+	if !found {
+		t.methods = append(t.methods, method)
+	}
+	t.Unlock()
+	t.phase("fetch")
+}
+
+// reports how the query is evaluated
+func (a *Archiver) explainQuery(ctx context.Context, parsed *querylang.ParsedQuery) (QueryResult, error) {
+	ctx = traceQuery(ctx, parsed, time.Now())
+	var (
+		trace       = traceOf(ctx)
+		explanation = common.Explanation{Query: parsed}
+	)
+	a.explainFilters(parsed, &explanation)
+
+	if (parsed.QueryType == querylang.SET_TYPE || parsed.QueryType == querylang.DELETE_TYPE) && !parsed.DryRun {
+		md, where, err := a.metadataAsOf(ctx, parsed.AsOf, parsed.Where)
+		if err != nil {
+			return nil, err
+		}
+		uuids, err := md.GetUUIDs(ctx, where.ToBson())
+		if err != nil {
+			return nil, err
+		}
+		trace.resolved(len(uuids))
+	} else {
+		query := *parsed
+		query.Explain = false
+		res, err := a.evaluateQuery(ctx, &query)
+		if err != nil {
+			return nil, err
+		}
+		// metadata queries resolve their where clause and fetch the
+		// documents with one call to the store
+		if parsed.QueryType == querylang.SELECT_TYPE {
+			switch result := res.(type) {
+			case common.SmapMessageList:
+				trace.uuids = len(result)
+			case common.ResultPage:
+				trace.uuids = len(result.Results)
+			case common.DistinctResult:
+				trace.uuids = len(result)
+			}
+		}
+		if len(trace.methods) > 0 {
+			trace.phase("pack")
+		} else {
+			trace.phase("evaluate")
+		}
+	}
+
+	explanation.UUIDs = trace.uuids
+	explanation.Methods = trace.methods
+	for _, name := range trace.phases {
+		explanation.Timings = append(explanation.Timings, common.PhaseTiming{Phase: name, Duration: trace.timings[name].String()})
+	}
+	return explanation, nil
+}
+
+// fills in the filters Mongo evaluates for the where clause, or for the
+// inputs of an expression
+func (a *Archiver) explainFilters(parsed *querylang.ParsedQuery, explanation *common.Explanation) {
+	if parsed.QueryType != querylang.DATA_TYPE && parsed.QueryType != querylang.APPLY_TYPE {
+		explanation.Filter = mongoFilter(parsed.Where.ToBson())
+		return
+	}
+	params := parsed.GetParams().(*common.DataParams)
+	if params.Expression == "" {
+		explanation.Filter = mongoFilter(params.Where.ToBson())
+		return
+	}
+	explanation.Inputs = make(map[string]bson.M, len(params.Inputs))
+	for name, where := range params.Inputs {
+		explanation.Inputs[name] = mongoFilter(inputWhere(where).ToBson())
+	}
+}
+
+// tracedStore records the reads of explained queries in their trace
+type tracedStore struct {
+	TimeseriesStore
+}
+
+func (t *tracedStore) Prev(ctx context.Context, uuids []common.UUID, ref uint64) ([]common.SmapNumbersResponse, error) {
+	defer traceOf(ctx).fetched("Prev")
+	return t.TimeseriesStore.Prev(ctx, uuids, ref)
+}
+
+func (t *tracedStore) Next(ctx context.Context, uuids []common.UUID, ref uint64) ([]common.SmapNumbersResponse, error) {
+	defer traceOf(ctx).fetched("Next")
+	return t.TimeseriesStore.Next(ctx, uuids, ref)
+}
+
+func (t *tracedStore) GetData(ctx context.Context, uuids []common.UUID, start uint64, end uint64) ([]common.SmapNumbersResponse, error) {
+	defer traceOf(ctx).fetched("GetData")
+	return t.TimeseriesStore.GetData(ctx, uuids, start, end)
+}
+
+func (t *tracedStore) GetDataPage(ctx context.Context, uuids []common.UUID, starts []uint64, end uint64, limit int) ([]common.SmapNumbersResponse, error) {
+	defer traceOf(ctx).fetched("GetDataPage")
+	return t.TimeseriesStore.GetDataPage(ctx, uuids, starts, end, limit)
+}
+
+func (t *tracedStore) StatisticalData(ctx context.Context, uuids []common.UUID, pointWidth int, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
+	defer traceOf(ctx).fetched("StatisticalData")
+	return t.TimeseriesStore.StatisticalData(ctx, uuids, pointWidth, start, end)
+}
+
+func (t *tracedStore) WindowData(ctx context.Context, uuids []common.UUID, width, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
+	defer traceOf(ctx).fetched("WindowData")
+	return t.TimeseriesStore.WindowData(ctx, uuids, width, start, end)
+}
+
+func (t *tracedStore) Close() error {
+	if closer, ok := t.TimeseriesStore.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package archiver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestExplain(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	a.tsStore = &tracedStore{a.tsStore}
+	base := uint64(1451606400000000000)
+	for i := 0; i < 3; i++ {
+		msg := &common.SmapMessage{UUID: common.NewUUID(), Path: fmt.Sprintf("/meter%d", i), Metadata: common.Dict{"Type": "Meter"},
+			Readings: []common.Reading{&common.SmapNumberReading{Time: base, UoT: common.UOT_NS, Value: float64(i)}}}
+		if err := a.AddData(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		query   string
+		uuids   int
+		methods []string
+		phases  []string
+	}{
+		{"explain select * where Metadata/Type = 'Meter'", 3, nil, []string{"parse", "evaluate"}},
+		{"explain select distinct Metadata/Type where Metadata/Type = 'Meter'", 1, nil, []string{"parse", "evaluate"}},
+		{"explain select data in (1451606400, 1451606500) streamlimit 2 where Metadata/Type = 'Meter'", 2, []string{"GetDataPage"}, []string{"parse", "resolve", "fetch", "pack"}},
+		{"explain select data before now where Metadata/Type = 'Meter'", 3, []string{"Prev"}, []string{"parse", "resolve", "fetch", "pack"}},
+		{"explain select window(1min) data in (1451606400, 1451606500) where Metadata/Type = 'Meter'", 3, []string{"WindowData"}, []string{"parse", "resolve", "fetch", "pack"}},
+		// the percentiles are computed from the raw readings
+		{"explain select percentile(50, window(1min) data in (1451606400, 1451606500)) where Metadata/Type = 'Meter'", 3, []string{"GetData"}, []string{"parse", "resolve", "fetch", "pack"}},
+		{"explain select sum(data in (1451606400, 1451606500)) where Metadata/Type = 'Meter'", 3, []string{"GetData"}, []string{"parse", "resolve", "fetch", "pack"}},
+		{"explain select data in (1451606400, 1451606500) as expr('a + b') with a = where Metadata/Type = 'Meter', b = where Metadata/Type = 'Meter'", 6, []string{"GetData"}, []string{"parse", "resolve", "fetch", "pack"}},
+		// changes are not made, so only their streams are resolved
+		{"explain set Metadata/Room = '410' where Metadata/Type = 'Meter'", 3, nil, []string{"parse", "resolve"}},
+		{"explain set Metadata/Room = '410' where Metadata/Type = 'Meter' dry run", 3, nil, []string{"parse", "resolve", "evaluate"}},
+	} {
+		res, err := a.HandleQuery(context.Background(), test.query)
+		if err != nil {
+			t.Errorf("%v: %v", test.query, err)
+			continue
+		}
+		explanation, ok := res.(common.Explanation)
+		if !ok {
+			t.Errorf("%v: expected an explanation, got %v", test.query, res)
+			continue
+		}
+		if explanation.UUIDs != test.uuids {
+			t.Errorf("%v: expected %d streams, got %d", test.query, test.uuids, explanation.UUIDs)
+		}
+		if !reflect.DeepEqual(explanation.Methods, test.methods) {
+			t.Errorf("%v: expected methods %v, got %v", test.query, test.methods, explanation.Methods)
+		}
+		var phases []string
+		for _, timing := range explanation.Timings {
+			phases = append(phases, timing.Phase)
+		}
+		if !reflect.DeepEqual(phases, test.phases) {
+			t.Errorf("%v: expected phases %v, got %v", test.query, test.phases, explanation.Timings)
+		}
+		if explanation.Filter == nil && explanation.Inputs == nil {
+			t.Errorf("%v: expected a filter", test.query)
+		}
+		if _, err := json.Marshal(explanation); err != nil {
+			t.Errorf("%v: %v", test.query, err)
+		}
+	}
+
+	// nothing was set
+	res, err := a.HandleQuery(context.Background(), "select distinct Metadata/Room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rooms := res.(common.DistinctResult); len(rooms) != 0 {
+		t.Errorf("Expected no rooms to be set, got %v", rooms)
+	}
+}
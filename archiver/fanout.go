@@ -0,0 +1,154 @@
+package archiver
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jf87/giles2/common"
+)
+
+// fanoutStore is a TimeseriesStore that replicates writes to several
+// backends, e.g. to run a new BtrDB cluster alongside an old one while
+// migrating. Reads are served by the primary store only. AddMessage and
+// DeleteData are run against the primary, whose error is returned to the
+// caller, and are queued for every mirror. Each mirror works through its own
+// queue in order, so a slow or unreachable mirror never holds up ingest or
+// the other mirrors. When a mirror's queue is full, further writes to it are
+// dropped and counted in "mirrorDropped.<name>"; mirror failures are logged
+// and counted in "mirrorErrors.<name>".
+
+const defaultMirrorQueueSize = 10000
+
+type fanoutConfig struct {
+	primary TimeseriesStore
+	mirrors map[string]TimeseriesStore
+	// how many writes may wait for each mirror
+	queueSize int
+	metrics   metricMap
+}
+
+type fanoutStore struct {
+	primary TimeseriesStore
+	mirrors map[string]*mirror
+	metrics metricMap
+	wg      sync.WaitGroup
+}
+
+type mirror struct {
+	name  string
+	store TimeseriesStore
+	queue chan *mirrorOp
+}
+
+type mirrorOp struct {
+	op    string
+	uuids []common.UUID
+	do    func(TimeseriesStore) error
+}
+
+func newFanoutStore(c *fanoutConfig) *fanoutStore {
+	f := &fanoutStore{
+		primary: c.primary,
+		mirrors: make(map[string]*mirror, len(c.mirrors)),
+		metrics: c.metrics,
+	}
+	queueSize := c.queueSize
+	if queueSize <= 0 {
+		queueSize = defaultMirrorQueueSize
+	}
+	for name, store := range c.mirrors {
+		log.Noticef("Mirroring timeseries writes to %v", name)
+		f.metrics.addMetric("mirrorErrors." + name)
+		f.metrics.addMetric("mirrorDropped." + name)
+		m := &mirror{
+			name:  name,
+			store: store,
+			queue: make(chan *mirrorOp, queueSize),
+		}
+		f.mirrors[name] = m
+		f.wg.Add(1)
+		go f.replicate(m)
+	}
+	return f
+}
+
+// works through the mirror's queue until it is closed
+func (f *fanoutStore) replicate(m *mirror) {
+	defer f.wg.Done()
+	for op := range m.queue {
+		if err := op.do(m.store); err != nil {
+			log.Errorf("Mirror %v failed to %v %v (%v)", m.name, op.op, op.uuids, err)
+			f.metrics["mirrorErrors."+m.name].Mark(1)
+		}
+	}
+}
+
+// queues the operation for all mirrors, then runs it against the primary and
+// returns the primary's error
+func (f *fanoutStore) forward(op string, uuids []common.UUID, do func(TimeseriesStore) error) error {
+	mop := &mirrorOp{op: op, uuids: uuids, do: do}
+	for name, m := range f.mirrors {
+		select {
+		case m.queue <- mop:
+		default:
+			log.Warningf("Mirror %v is falling behind, dropping write to %v %v", name, op, uuids)
+			f.metrics["mirrorDropped."+name].Mark(1)
+		}
+	}
+	return do(f.primary)
+}
+
+// waits until the mirrors have worked through their queues. No writes may be
+// forwarded afterwards
+func (f *fanoutStore) Close() error {
+	for _, m := range f.mirrors {
+		close(m.queue)
+	}
+	f.wg.Wait()
+	return nil
+}
+
+func (f *fanoutStore) AddMessage(msg *common.SmapMessage) error {
+	// the stores convert readings to nanoseconds in place. Doing it here
+	// first means they only ever read the shared readings
+	for _, rdg := range msg.Readings {
+		rdg.ConvertTime(common.UOT_NS)
+	}
+	return f.forward("add readings for", []common.UUID{msg.UUID}, func(store TimeseriesStore) error {
+		return store.AddMessage(msg)
+	})
+}
+
+func (f *fanoutStore) DeleteData(uuids []common.UUID, start uint64, end uint64) error {
+	return f.forward("delete data for", uuids, func(store TimeseriesStore) error {
+		return store.DeleteData(uuids, start, end)
+	})
+}
+
+func (f *fanoutStore) Prev(ctx context.Context, uuids []common.UUID, ref uint64) ([]common.SmapNumbersResponse, error) {
+	return f.primary.Prev(ctx, uuids, ref)
+}
+
+func (f *fanoutStore) Next(ctx context.Context, uuids []common.UUID, ref uint64) ([]common.SmapNumbersResponse, error) {
+	return f.primary.Next(ctx, uuids, ref)
+}
+
+func (f *fanoutStore) GetData(ctx context.Context, uuids []common.UUID, start uint64, end uint64) ([]common.SmapNumbersResponse, error) {
+	return f.primary.GetData(ctx, uuids, start, end)
+}
+
+func (f *fanoutStore) GetDataPage(ctx context.Context, uuids []common.UUID, starts []uint64, end uint64, limit int) ([]common.SmapNumbersResponse, error) {
+	return f.primary.GetDataPage(ctx, uuids, starts, end, limit)
+}
+
+func (f *fanoutStore) StatisticalData(ctx context.Context, uuids []common.UUID, pointWidth int, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
+	return f.primary.StatisticalData(ctx, uuids, pointWidth, start, end)
+}
+
+func (f *fanoutStore) WindowData(ctx context.Context, uuids []common.UUID, width, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
+	return f.primary.WindowData(ctx, uuids, width, start, end)
+}
+
+func (f *fanoutStore) ValidTimestamp(time uint64, uot common.UnitOfTime) bool {
+	return f.primary.ValidTimestamp(time, uot)
+}
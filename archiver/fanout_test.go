@@ -0,0 +1,109 @@
+package archiver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+// blocks every write until release is closed
+type blockingStore struct {
+	*embeddedDB
+	release chan struct{}
+}
+
+func (b *blockingStore) AddMessage(msg *common.SmapMessage) error {
+	<-b.release
+	return b.embeddedDB.AddMessage(msg)
+}
+
+func TestFanoutStore(t *testing.T) {
+	primary, cleanupPrimary := newTestEmbeddedDB(t)
+	defer cleanupPrimary()
+	mirror, cleanupMirror := newTestEmbeddedDB(t)
+	defer cleanupMirror()
+	broken, cleanupBroken := newTestEmbeddedDB(t)
+	defer cleanupBroken()
+
+	metrics := make(metricMap)
+	f := newFanoutStore(&fanoutConfig{
+		primary: primary,
+		mirrors: map[string]TimeseriesStore{
+			"mirror": mirror,
+			"broken": &flakyStore{embeddedDB: broken, down: true},
+		},
+		metrics: metrics,
+	})
+	uuid := common.NewUUID()
+	base := uint64(1451606400000000000)
+	if err := f.AddMessage(embeddedTestMessage(uuid, base, base+10)); err != nil {
+		t.Errorf("Mirror failure should not be returned (%v)", err)
+	}
+	if err := f.DeleteData([]common.UUID{uuid}, base, base+5); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for name, store := range map[string]TimeseriesStore{"primary": primary, "mirror": mirror} {
+		if res, _ := store.GetData(context.Background(), []common.UUID{uuid}, base, base+20); len(res[0].Readings) != 1 {
+			t.Errorf("Expected the add and the delete to reach %v, got %v", name, res[0].Readings)
+		}
+	}
+	if errs := metrics["mirrorErrors.broken"].Get(); errs != 1 {
+		t.Errorf("Expected 1 mirror error, got %d", errs)
+	}
+}
+
+func TestFanoutSlowMirror(t *testing.T) {
+	primary, cleanupPrimary := newTestEmbeddedDB(t)
+	defer cleanupPrimary()
+	slow, cleanupSlow := newTestEmbeddedDB(t)
+	defer cleanupSlow()
+	fast, cleanupFast := newTestEmbeddedDB(t)
+	defer cleanupFast()
+
+	metrics := make(metricMap)
+	blocked := &blockingStore{embeddedDB: slow, release: make(chan struct{})}
+	f := newFanoutStore(&fanoutConfig{
+		primary: primary,
+		// two mirrors of the same store type, told apart by name
+		mirrors: map[string]TimeseriesStore{
+			"old-cluster": blocked,
+			"new-cluster": fast,
+		},
+		queueSize: 2,
+		metrics:   metrics,
+	})
+	uuid := common.NewUUID()
+	base := uint64(1451606400000000000)
+	// the first write is taken off the queue and blocks the slow mirror, the
+	// next two fill its queue and the last one is dropped
+	for i := uint64(0); i < 4; i++ {
+		if err := f.AddMessage(embeddedTestMessage(uuid, base+i)); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			// give the mirror time to pick up the first write
+			for len(f.mirrors["old-cluster"].queue) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	if res, _ := primary.GetData(context.Background(), []common.UUID{uuid}, base, base+10); len(res[0].Readings) != 4 {
+		t.Errorf("A blocked mirror should not hold up the primary, got %v", res[0].Readings)
+	}
+	close(blocked.release)
+	f.Close()
+
+	if dropped := metrics["mirrorDropped.old-cluster"].Get(); dropped != 1 {
+		t.Errorf("Expected 1 dropped write, got %d", dropped)
+	}
+	if res, _ := slow.GetData(context.Background(), []common.UUID{uuid}, base, base+10); len(res[0].Readings) != 3 {
+		t.Errorf("Expected the queued writes to reach the slow mirror, got %v", res[0].Readings)
+	}
+	if res, _ := fast.GetData(context.Background(), []common.UUID{uuid}, base, base+10); len(res[0].Readings) != 4 {
+		t.Errorf("Expected all writes to reach the fast mirror, got %v", res[0].Readings)
+	}
+}
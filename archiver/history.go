@@ -0,0 +1,80 @@
+package archiver
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"time"
+
+	"github.com/jf87/giles2/common"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The metadata stores keep the history of every metadata document: whenever
+// a document changes, the whole document is saved as a new version along with
+// the time of the change and who made it. Queries can select streams by their
+// metadata at an earlier time with AS OF, e.g.
+//
+//	select Metadata/Room where uuid = '...' as of '3/1/2016'
+//	select data in (now -1d, now) where Metadata/Room = '410' as of now -1y
+//
+// which evaluate the where clause (and select the tags) over the most recent
+// version of each document at that time. The documents that already exist
+// when the history is first kept are recorded with a version at time 0, and
+// removed documents are recorded as such.
+
+// the time of the versions of the documents that existed before the history
+// was kept
+const seededVersionTime = 0
+
+// one version of a metadata document
+type metadataVersion struct {
+	UUID common.UUID `bson:"uuid"`
+	// nanoseconds since the epoch
+	Time uint64 `bson:"time"`
+	// who made the change, if known
+	Writer string `bson:"writer"`
+	// the document was removed
+	Removed bool `bson:"removed,omitempty"`
+	// the whole document after the change
+	Document bson.M `bson:"doc,omitempty"`
+}
+
+// a digest of the document that changes whenever the document does
+func docDigest(doc bson.M) string {
+	// fmt prints maps ordered by key
+	return fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%v", doc))))
+}
+
+// returns a metadata store holding the given versions of the documents, in
+// their order
+func historicalStore(docs []bson.M) *memoryStore {
+	m := &memoryStore{index: make(map[common.UUID]int)}
+	for _, doc := range docs {
+		if uuid, ok := doc["uuid"].(string); ok {
+			m.index[common.UUID(uuid)] = len(m.docs)
+			m.docs = append(m.docs, doc)
+		}
+	}
+	return m
+}
+
+// saves a version of the documents of the streams that changed
+func (a *Archiver) recordVersions(uuids []common.UUID, writer string) error {
+	if len(uuids) == 0 {
+		return nil
+	}
+	return a.mdStore.RecordVersions(uuids, writer, uint64(time.Now().UnixNano()))
+}
+
+// Returns the metadata as it was at the given time (in nanoseconds), or the
+// current metadata if asOf is 0, and the where clause to evaluate over it.
+// The stores evaluate the where clause while reading the history, so nothing
+// is left to evaluate over earlier metadata
+func (a *Archiver) metadataAsOf(ctx context.Context, asOf uint64, where common.Dict) (MetadataStore, common.Dict, error) {
+	if asOf == 0 {
+		return a.mdStore, where, nil
+	}
+	md, err := a.mdStore.AsOf(ctx, asOf, where.ToBson())
+	return md, common.Dict{}, err
+}
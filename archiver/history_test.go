@@ -0,0 +1,165 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestMetadataHistory(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	second := uint64(1000000000)
+	base := 1451606400 * second
+	sensor := common.NewUUID()
+
+	// the sensor moves from room 410 to room 420 and is removed later
+	msg := &common.SmapMessage{UUID: sensor, Path: "/sensor", Metadata: common.Dict{"Room": "410"}}
+	if _, err := a.mdStore.SaveTags(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.mdStore.RecordVersions([]common.UUID{sensor}, "alice", base); err != nil {
+		t.Fatal(err)
+	}
+	// unchanged documents get no new version
+	if err := a.mdStore.RecordVersions([]common.UUID{sensor}, "alice", base+50*second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.mdStore.UpdateDocs(common.Dict{"Metadata.Room": "420"}.ToBson(), common.Dict{"uuid": string(sensor)}.ToBson()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.mdStore.RecordVersions([]common.UUID{sensor}, "bob", base+100*second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.mdStore.RemoveDocs(common.Dict{"uuid": string(sensor)}.ToBson()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.mdStore.RecordVersions([]common.UUID{sensor}, "bob", base+200*second); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		asOf uint64
+		room string
+	}{
+		{base - 10*second, ""},
+		{base, "410"},
+		{base + 60*second, "410"},
+		{base + 100*second, "420"},
+		{base + 200*second, ""},
+	} {
+		query := fmt.Sprintf("select Metadata/Room where uuid = '%v' as of %d", sensor, test.asOf/second)
+		res, err := a.HandleQuery(context.Background(), query)
+		if err != nil {
+			t.Errorf("%v: %v", query, err)
+			continue
+		}
+		result := res.(common.SmapMessageList)
+		switch {
+		case test.room == "" && len(result) != 0:
+			t.Errorf("%v: expected no document, got %v", query, result)
+		case test.room != "" && (len(result) != 1 || result[0].Metadata["Room"] != test.room):
+			t.Errorf("%v: expected room %v, got %v", query, test.room, result)
+		}
+	}
+
+	// data queries select the streams by their metadata at that time
+	meter := &common.SmapMessage{UUID: common.NewUUID(), Path: "/meter", Metadata: common.Dict{"Room": "410"},
+		Readings: []common.Reading{&common.SmapNumberReading{Time: base, UoT: common.UOT_NS, Value: 1}}}
+	if err := a.AddData(meter); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.HandleQueryBy(context.Background(), fmt.Sprintf("set Metadata/Room = '420' where uuid = '%v'", meter.UUID), "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if store, ok := a.mdStore.(*memoryStore); ok {
+		if last := store.history[len(store.history)-1]; last.UUID != meter.UUID || last.Writer != "carol" {
+			t.Errorf("Expected the last version to be written by carol, got %+v", last)
+		}
+	}
+	for _, test := range []struct {
+		query string
+		found bool
+	}{
+		{"select data in (1451606400, 1451606500) where Metadata/Room = '410'", false},
+		{"select data in (1451606400, 1451606500) where Metadata/Room = '410' as of now", false},
+		{"select data in (1451606400, 1451606500) where Metadata/Room = '420' as of now", true},
+		{"select data in (1451606400, 1451606500) where Metadata/Room = '410' as of now -3650d", false},
+	} {
+		res, err := a.HandleQuery(context.Background(), test.query)
+		if err != nil {
+			t.Errorf("%v: %v", test.query, err)
+			continue
+		}
+		if found := len(res.(common.SmapMessageList)) > 0; found != test.found {
+			t.Errorf("%v: expected the meter to be found: %v, got %v", test.query, test.found, res)
+		}
+	}
+}
+
+func TestSeededHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "giles-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := &memoryConfig{snapshot: filepath.Join(dir, "metadata.bson")}
+	// a snapshot from before the history was kept
+	m := newMemoryStore(config)
+	uuid := common.NewUUID()
+	m.SaveTags(&common.SmapMessage{UUID: uuid, Path: "/a", Metadata: common.Dict{"Type": "Sensor"}})
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := newMemoryStore(config)
+	for _, test := range []struct {
+		where common.Dict
+		found int
+	}{
+		{common.Dict{"Metadata.Type": "Sensor"}, 1},
+		{common.Dict{"Metadata.Type": "Meter"}, 0},
+	} {
+		md, err := reopened.AsOf(context.Background(), 1, test.where.ToBson())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found, _ := md.GetUUIDs(context.Background(), nil); len(found) != test.found {
+			t.Errorf("Expected %d documents where %v as of the seeded history, got %v", test.found, test.where, found)
+		}
+	}
+}
+
+// counts the calls to RecordVersions
+type versionCountingStore struct {
+	MetadataStore
+	calls int
+}
+
+func (v *versionCountingStore) RecordVersions(uuids []common.UUID, writer string, time uint64) error {
+	v.calls += 1
+	return v.MetadataStore.RecordVersions(uuids, writer, time)
+}
+
+func TestVersionsOnlyOnChange(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	store := &versionCountingStore{MetadataStore: a.mdStore}
+	a.mdStore = store
+	uuid := common.NewUUID()
+	for i, room := range []string{"410", "410", "410", "420"} {
+		msg := &common.SmapMessage{UUID: uuid, Path: "/sensor", Metadata: common.Dict{"Room": room},
+			Readings: []common.Reading{&common.SmapNumberReading{Time: uint64(1451606400 + i), UoT: common.UOT_S, Value: 1}}}
+		if err := a.AddData(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.calls != 2 {
+		t.Errorf("Expected versions to be recorded for the new and the changed document only, got %d", store.calls)
+	}
+}
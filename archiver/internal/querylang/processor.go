@@ -2,46 +2,329 @@
 package querylang
 
 import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"github.com/jf87/giles2/common"
+	"math"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Parsed queries are cached by their text, as clients tend to send the same
+// handful of queries over and over. Queries that refer to the current time
+// (e.g. "select data before now") are parsed every time, because their times
+// are resolved while parsing.
+//
+// Queries can also be prepared once with $1, $2, ... parameters, e.g.
+//
+//	select data before now where uuid = $1
+//
+// and then parsed with values bound to them (see ParsePrepared). Up to
+// maxPrepared prepared queries are kept; beyond that, the least recently used
+// one is dropped and has to be prepared again.
 type QueryProcessor struct {
+	sync.Mutex
+	// the cached queries, most recently used first
+	cache     *list.List
+	cached    map[string]*list.Element
+	cacheSize int
+	// the prepared queries by ID, most recently used first
+	prepared     *list.List
+	preparedIDs  map[string]*list.Element
+	preparedSize int
+	// time zone of the times in queries, e.g. "today" and '2016-03-01'
+	location *time.Location
 }
 
-// TODO: add caching?
-func NewQueryProcessor() *QueryProcessor {
-	return &QueryProcessor{}
+type cacheEntry struct {
+	key    string
+	parsed *ParsedQuery
+}
+
+// the number of prepared queries that are kept
+const maxPrepared = 1000
+
+// a value bound to a parameter, and the token it is substituted as
+type boundParam struct {
+	token int
+	str   string
+}
+
+// caches up to cacheSize parsed queries, or none if cacheSize is 0, and
+// resolves the times in queries in the given time zone
+func NewQueryProcessor(cacheSize int, location *time.Location) *QueryProcessor {
+	return &QueryProcessor{
+		cache:        list.New(),
+		cached:       make(map[string]*list.Element),
+		cacheSize:    cacheSize,
+		prepared:     list.New(),
+		preparedIDs:  make(map[string]*list.Element),
+		preparedSize: maxPrepared,
+		location:     location,
+	}
 }
 
 func (qp *QueryProcessor) Parse(querystring string) *ParsedQuery {
-	if !strings.HasSuffix(querystring, ";") {
-		querystring = querystring + ";"
+	return qp.ParseWith(querystring, nil)
+}
+
+// Parses a query whose $1, $2, ... parameters are bound to the given strings
+// or numbers. Each value is substituted as a single string or number literal,
+// so parameters stand for values and never for tag names or keywords
+func (qp *QueryProcessor) ParseWith(querystring string, params []interface{}) *ParsedQuery {
+	querystring = normalizeQuery(querystring)
+	key := querystring
+	if params != nil {
+		encoded, _ := json.Marshal(params)
+		key += "\x00" + string(encoded)
+	}
+	if parsed := qp.lookup(key); parsed != nil {
+		return parsed
+	}
+	bound, err := bindParams(params)
+	if err != nil {
+		return &ParsedQuery{Err: err, Querystring: querystring, Params: params}
 	}
 	l := NewSQLex(querystring)
+	l.params = bound
+	l.location = qp.location
 	sqParse(l)
 	pq := ParsedQuery{
-		QueryType: l.query.qtype,
-		Keys:      make([]string, len(l._keys)),
-		Target:    l.query.Contents,
-		Where:     l.query.where,
-		Set:       l.query.set,
-		Distinct:  l.query.distinct,
-		Data:      l.query.data,
-		Err:       l.error,
-		ErrPos:    l.lasttoken,
+		QueryType:  l.query.qtype,
+		Keys:       make([]string, len(l._keys)),
+		Target:     l.query.Contents,
+		Where:      l.query.where,
+		Set:        l.query.set,
+		Distinct:   l.query.distinct,
+		DryRun:     l.query.dryRun,
+		Explain:    l.query.explain,
+		GroupBy:    l.query.groupBy,
+		OrderBy:    l.query.orderBy,
+		Operators:  l.query.operators,
+		Expression: l.query.expression,
+		Inputs:     l.query.inputs,
+		Data:       l.query.data,
+		Limit:      int(l.query.page.Limit),
+		Offset:     int(l.query.page.Offset),
+		Err:        l.error,
+		ErrPos:     l.lasttoken,
 		//TODO: have a more robust hash function
-		Hash:        QueryHash(querystring),
+		Hash:        QueryHash(key),
 		Querystring: querystring,
+		Params:      params,
+	}
+	if !l.query.asOf.IsZero() {
+		pq.AsOf = uint64(l.query.asOf.UnixNano())
 	}
 	i := 0
 	for key, _ := range l._keys {
 		pq.Keys[i] = cleantagstring(key)
 		i += 1
 	}
+	if !l.now {
+		qp.store(key, &pq)
+	}
 	return &pq
 }
 
+// Registers a query with $1, $2, ... parameters, which is then parsed by
+// ParsePrepared. Fails if the query does not parse with any values bound to
+// its parameters. Preparing the same query again returns the same ID
+func (qp *QueryProcessor) Prepare(querystring string) (common.PreparedQuery, error) {
+	querystring = normalizeQuery(querystring)
+	hash := sha1.Sum([]byte(querystring))
+	prepared := common.PreparedQuery{
+		ID:         hex.EncodeToString(hash[:8]),
+		Query:      querystring,
+		Parameters: countParams(querystring),
+	}
+	if err := checkPrepared(querystring, prepared.Parameters); err != nil {
+		return prepared, err
+	}
+	qp.Lock()
+	defer qp.Unlock()
+	if elem, found := qp.preparedIDs[prepared.ID]; found {
+		qp.prepared.MoveToFront(elem)
+		return prepared, nil
+	}
+	qp.preparedIDs[prepared.ID] = qp.prepared.PushFront(prepared)
+	if qp.prepared.Len() > qp.preparedSize {
+		oldest := qp.prepared.Back()
+		qp.prepared.Remove(oldest)
+		delete(qp.preparedIDs, oldest.Value.(common.PreparedQuery).ID)
+	}
+	return prepared, nil
+}
+
+// Parses the prepared query with the given values bound to its parameters
+func (qp *QueryProcessor) ParsePrepared(id string, params []interface{}) (*ParsedQuery, error) {
+	qp.Lock()
+	elem, found := qp.preparedIDs[id]
+	if found {
+		qp.prepared.MoveToFront(elem)
+	}
+	qp.Unlock()
+	if !found {
+		return nil, fmt.Errorf("No prepared query with ID %v", id)
+	}
+	prepared := elem.Value.(common.PreparedQuery)
+	if len(params) != prepared.Parameters {
+		return nil, fmt.Errorf("Prepared query %v takes %d parameters, got %d", id, prepared.Parameters, len(params))
+	}
+	if params == nil {
+		params = []interface{}{}
+	}
+	return qp.ParseWith(prepared.Query, params), nil
+}
+
+// returns a copy of the cached query, if any, as callers fill in some of its
+// fields
+func (qp *QueryProcessor) lookup(key string) *ParsedQuery {
+	qp.Lock()
+	defer qp.Unlock()
+	elem, found := qp.cached[key]
+	if !found {
+		return nil
+	}
+	qp.cache.MoveToFront(elem)
+	parsed := *elem.Value.(*cacheEntry).parsed
+	return &parsed
+}
+
+// caches a copy of the query, evicting the least recently used one if the
+// cache is full
+func (qp *QueryProcessor) store(key string, parsed *ParsedQuery) {
+	if qp.cacheSize <= 0 {
+		return
+	}
+	cached := *parsed
+	qp.Lock()
+	defer qp.Unlock()
+	if elem, found := qp.cached[key]; found {
+		// parsed concurrently
+		qp.cache.MoveToFront(elem)
+		return
+	}
+	qp.cached[key] = qp.cache.PushFront(&cacheEntry{key: key, parsed: &cached})
+	if qp.cache.Len() > qp.cacheSize {
+		oldest := qp.cache.Back()
+		qp.cache.Remove(oldest)
+		delete(qp.cached, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// collapses runs of spaces and tabs outside of quoted strings and adds the
+// trailing semicolon, so that queries only differing in those have the same
+// text
+func normalizeQuery(querystring string) string {
+	var (
+		normalized = make([]byte, 0, len(querystring)+1)
+		quote      byte
+	)
+	for i := 0; i < len(querystring); i++ {
+		c := querystring[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ' ' || c == '\t':
+			if len(normalized) == 0 || normalized[len(normalized)-1] == ' ' {
+				continue
+			}
+			c = ' '
+		}
+		normalized = append(normalized, c)
+	}
+	querystring = strings.TrimRight(string(normalized), " ")
+	if !strings.HasSuffix(querystring, ";") {
+		querystring = querystring + ";"
+	}
+	return querystring
+}
+
+// checks that the values are strings or numbers, and returns the tokens they
+// are substituted as
+func bindParams(params []interface{}) ([]boundParam, error) {
+	var bound = make([]boundParam, len(params))
+	for i, param := range params {
+		switch value := param.(type) {
+		case string:
+			bound[i] = boundParam{QSTRING, "'" + value + "'"}
+		case json.Number:
+			if _, err := strconv.ParseFloat(string(value), 64); err != nil {
+				return nil, fmt.Errorf("Invalid number %v for parameter $%d", value, i+1)
+			}
+			bound[i] = boundParam{NUMBER, string(value)}
+		case float64:
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return nil, fmt.Errorf("Invalid number %v for parameter $%d", value, i+1)
+			}
+			bound[i] = boundParam{NUMBER, strconv.FormatFloat(value, 'f', -1, 64)}
+		case int:
+			bound[i] = boundParam{NUMBER, strconv.Itoa(value)}
+		default:
+			return nil, fmt.Errorf("Parameter $%d must be a string or a number, got %v", i+1, param)
+		}
+	}
+	return bound, nil
+}
+
+// checks that the query parses with some string or number bound to each of its
+// parameters. Each parameter is bound to a string unless the parser rejects
+// it, in which case it is bound to a number. The string is a date, so it is
+// also accepted as a time
+func checkPrepared(querystring string, parameters int) error {
+	var bound = make([]boundParam, parameters)
+	for i := range bound {
+		bound[i] = boundParam{QSTRING, "'1/1/2016'"}
+	}
+	for {
+		l := NewSQLex(querystring)
+		l.params = bound
+		sqParse(l)
+		if l.error == nil {
+			return nil
+		}
+		if i := l.errParam - 1; i >= 0 && bound[i].token == QSTRING {
+			bound[i] = boundParam{NUMBER, "1"}
+			continue
+		}
+		return fmt.Errorf("Error (%v) in query \"%v\" (error at %v)", l.error, querystring, l.lasttoken)
+	}
+}
+
+// the number of parameters of the query, i.e. the highest n of its $n
+func countParams(querystring string) int {
+	var (
+		l     = NewSQLex(querystring)
+		lval  sqSymType
+		count int
+	)
+	for l.Lex(&lval) != eof {
+		if index, isParam := paramIndex(lval.str); isParam && index > count {
+			count = index
+		}
+	}
+	return count
+}
+
+// the n of a $n parameter
+func paramIndex(token string) (int, bool) {
+	if len(token) < 2 || token[0] != '$' {
+		return 0, false
+	}
+	index, err := strconv.Atoi(token[1:])
+	return index, err == nil && index > 0
+}
+
 type ParsedQuery struct {
 	QueryType QueryType
 	// all the keys contained in this query
@@ -55,6 +338,34 @@ type ParsedQuery struct {
 	Set common.Dict
 	// are we querying distinct values?
 	Distinct bool
+	// only report what a SET or DELETE would change
+	DryRun bool
+	// report how the query is evaluated instead of its results
+	Explain bool
+	// tag whose values group the streams of a data query
+	GroupBy string
+	// order of the documents of a metadata query, or of the streams
+	// of a data query
+	OrderBy *common.OrderBy
+	// time (in nanoseconds) of the metadata the query is evaluated over,
+	// or 0 for the current metadata
+	AsOf uint64
+	// who sent the query, recorded in the metadata history
+	Writer string
+	// operators of an APPLY query, innermost first
+	Operators []common.DataFunction
+	// arithmetic expression of a data query, and the where clause
+	// selecting the streams of each of its inputs
+	Expression string
+	Inputs     map[string]common.Dict
+	// the number of documents a metadata query returns (0 for all of them),
+	// and the number of documents (or streams, for data queries) skipped
+	Limit  int
+	Offset int
+	// where each stream of a data query continues, when resuming it
+	Resume map[common.UUID]uint64
+	// values bound to the $1, $2, ... parameters of the query
+	Params []interface{}
 	// a unique representation of this query used to compare two different query objects
 	Hash QueryHash
 	Data *DataQuery
@@ -72,17 +383,24 @@ func (parsed *ParsedQuery) GetParams() common.QueryParams {
 			return &common.DistinctParams{
 				Tag:   parsed.Target[0],
 				Where: parsed.Where,
+				AsOf:  parsed.AsOf,
 			}
 		}
 		return &common.TagParams{
-			Tags:  parsed.Target,
-			Where: parsed.Where,
+			Tags:    parsed.Target,
+			Where:   parsed.Where,
+			Limit:   parsed.Limit,
+			Offset:  parsed.Offset,
+			OrderBy: parsed.OrderBy,
+			AsOf:    parsed.AsOf,
 		}
 	case DELETE_TYPE:
 		if parsed.Data == nil {
 			return &common.TagParams{
-				Tags:  parsed.Target,
-				Where: parsed.Where,
+				Tags:   parsed.Target,
+				Where:  parsed.Where,
+				DryRun: parsed.DryRun,
+				Writer: parsed.Writer,
 			}
 		} else {
 			return &common.DataParams{
@@ -91,12 +409,15 @@ func (parsed *ParsedQuery) GetParams() common.QueryParams {
 				End:           uint64(parsed.Data.End.UnixNano()),
 				IsStatistical: false,
 				IsWindow:      false,
+				DryRun:        parsed.DryRun,
 			}
 		}
 	case SET_TYPE:
 		return &common.SetParams{
-			Set:   parsed.Set,
-			Where: parsed.Where,
+			Set:    parsed.Set,
+			Where:  parsed.Where,
+			DryRun: parsed.DryRun,
+			Writer: parsed.Writer,
 		}
 	case DATA_TYPE:
 		return &common.DataParams{
@@ -110,6 +431,31 @@ func (parsed *ParsedQuery) GetParams() common.QueryParams {
 			IsWindow:      parsed.Data.IsWindow,
 			Width:         parsed.Data.Width,
 			PointWidth:    int(parsed.Data.PointWidth),
+			Functions:     parsed.Data.Functions,
+			GroupBy:       parsed.GroupBy,
+			Resample:      parsed.Data.Resample,
+			Expression:    parsed.Expression,
+			Inputs:        parsed.Inputs,
+			StreamOffset:  parsed.Offset,
+			Resume:        parsed.Resume,
+			OrderBy:       parsed.OrderBy,
+			AsOf:          parsed.AsOf,
+		}
+	case APPLY_TYPE:
+		return &common.DataParams{
+			Where:         parsed.Where,
+			StreamLimit:   int(parsed.Data.Limit.Streamlimit),
+			DataLimit:     int(parsed.Data.Limit.Limit),
+			Begin:         uint64(parsed.Data.Start.UnixNano()),
+			End:           uint64(parsed.Data.End.UnixNano()),
+			ConvertToUnit: parsed.Data.Timeconv,
+			IsStatistical: parsed.Data.IsStatistical,
+			IsWindow:      parsed.Data.IsWindow,
+			Functions:     parsed.Data.Functions,
+			Resample:      parsed.Data.Resample,
+			Operators:     parsed.Operators,
+			OrderBy:       parsed.OrderBy,
+			AsOf:          parsed.AsOf,
 		}
 	default:
 		return nil
@@ -0,0 +1,212 @@
+package querylang
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestParseCache(t *testing.T) {
+	qp := NewQueryProcessor(2, time.UTC)
+	first := qp.Parse("select *  where Metadata/Type = 'Meter'")
+	first.Writer = "alice"
+	second := qp.Parse("select * where   Metadata/Type = 'Meter';")
+	if len(qp.cached) != 1 {
+		t.Errorf("Expected queries differing in spaces to be cached once, got %d entries", len(qp.cached))
+	}
+	if second.Writer != "" || second.Err != nil || second.Where["Metadata.Type"] != "Meter" {
+		t.Errorf("Expected an unchanged copy of the cached query, got %+v", second)
+	}
+	// spaces in strings are significant
+	if third := qp.Parse("select * where Metadata/Type = 'Meter  '"); third.Where["Metadata.Type"] != "Meter  " {
+		t.Errorf("Expected the string to keep its spaces, got %v", third.Where)
+	}
+
+	// times relative to now are resolved while parsing
+	qp.Parse("select data before now where Metadata/Type = 'Meter'")
+	if len(qp.cached) != 2 {
+		t.Errorf("Expected queries referring to now not to be cached, got %d entries", len(qp.cached))
+	}
+
+	// the least recently used query is evicted
+	qp.Parse("select * where Metadata/Type = 'Meter'")
+	qp.Parse("select uuid where Metadata/Type = 'Meter'")
+	if _, found := qp.cached["select * where Metadata/Type = 'Meter  ';"]; found || len(qp.cached) != 2 {
+		t.Errorf("Expected the least recently used query to be evicted, got %v", qp.cached)
+	}
+}
+
+func TestCalendarTimes(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	qp := NewQueryProcessor(10, berlin)
+	parsed := qp.Parse("select data in (start of month -1 month, start of month) where Metadata/Type = 'Meter'")
+	if parsed.Err != nil {
+		t.Fatal(parsed.Err)
+	}
+	year, month, _ := time.Now().In(berlin).Date()
+	end := time.Date(year, month, 1, 0, 0, 0, 0, berlin)
+	if !parsed.Data.End.Equal(end) || !parsed.Data.Start.Equal(end.AddDate(0, -1, 0)) {
+		t.Errorf("Expected the previous month in Berlin, got (%v, %v)", parsed.Data.Start, parsed.Data.End)
+	}
+
+	for _, query := range []string{
+		"select data in (today -1w, today) where Metadata/Type = 'Meter'",
+		"select data in (last monday, last monday +1d) where Metadata/Type = 'Meter'",
+		"select data in (start of year, now) where Metadata/Type = 'Meter'",
+		"select * where Metadata/Type = 'Meter' as of start of day",
+	} {
+		if parsed := qp.Parse(query); parsed.Err != nil {
+			t.Errorf("%v: %v", query, parsed.Err)
+		}
+	}
+	if len(qp.cached) != 0 {
+		t.Errorf("Expected calendar times not to be cached, got %d entries", len(qp.cached))
+	}
+
+	// absolute times are in the time zone too, and so are the months added
+	// to them
+	march, april := time.Date(2016, 3, 1, 0, 0, 0, 0, berlin), time.Date(2016, 4, 1, 0, 0, 0, 0, berlin)
+	for _, query := range []string{
+		"select data in ('2016-03-01', '2016-03-01' +1mo) where Metadata/Type = 'Meter'",
+		"select data in ('3/1/2016', '3/1/2016' +1mo) where Metadata/Type = 'Meter'",
+		"select data in (1456786800, 1456786800 +1mo) where Metadata/Type = 'Meter'",
+		"select data in (1456786800000 ms, 1456786800000 ms +1mo) where Metadata/Type = 'Meter'",
+	} {
+		parsed := qp.Parse(query)
+		if parsed.Err != nil {
+			t.Errorf("%v: %v", query, parsed.Err)
+		} else if !parsed.Data.Start.Equal(march) || !parsed.Data.End.Equal(april) {
+			t.Errorf("%v: expected March in Berlin, got (%v, %v)", query, parsed.Data.Start, parsed.Data.End)
+		}
+	}
+
+	for _, query := range []string{
+		"select data in (start of fortnight, now) where Metadata/Type = 'Meter'",
+		"select data in (last someday, now) where Metadata/Type = 'Meter'",
+		"select data in (today -1 fortnight, now) where Metadata/Type = 'Meter'",
+	} {
+		if parsed := qp.Parse(query); parsed.Err == nil {
+			t.Errorf("%v: expected an error", query)
+		}
+	}
+}
+
+func TestParsePrepared(t *testing.T) {
+	qp := NewQueryProcessor(10, time.UTC)
+	prepared, err := qp.Prepare("select data before now where uuid = $1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := qp.Prepare("select data before now  where uuid = $1"); prepared.Parameters != 1 || again.ID != prepared.ID {
+		t.Errorf("Expected a query with one parameter and a stable ID, got %+v", prepared)
+	}
+	for _, test := range []struct {
+		params []interface{}
+		uuid   interface{}
+	}{
+		{[]interface{}{"d24325e6-1d7d-11e2-ad69-a7c2fa8dba61"}, "d24325e6-1d7d-11e2-ad69-a7c2fa8dba61"},
+		// values never become part of the query
+		{[]interface{}{"x' or uuid = 'y"}, "x' or uuid = 'y"},
+		{[]interface{}{json.Number("42")}, "42"},
+	} {
+		parsed, err := qp.ParsePrepared(prepared.ID, test.params)
+		if err != nil || parsed.Err != nil {
+			t.Errorf("%v: %v %v", test.params, err, parsed.Err)
+			continue
+		}
+		if parsed.Where["uuid"] != test.uuid || len(parsed.Where) != 1 {
+			t.Errorf("%v: expected uuid %v, got %v", test.params, test.uuid, parsed.Where)
+		}
+	}
+
+	if _, err := qp.ParsePrepared(prepared.ID, nil); err == nil {
+		t.Error("Expected an error for a missing parameter")
+	}
+	if _, err := qp.ParsePrepared("unknown", []interface{}{"x"}); err == nil {
+		t.Error("Expected an error for an unknown prepared query")
+	}
+	if parsed, _ := qp.ParsePrepared(prepared.ID, []interface{}{true}); parsed.Err == nil {
+		t.Error("Expected an error for a value that is not a string or number")
+	}
+
+	// numbers bind where the query takes numbers
+	limited, err := qp.Prepare("select * where Metadata/Floor > $1 limit $2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := qp.ParsePrepared(limited.ID, []interface{}{3.5, 10})
+	if err != nil || parsed.Err != nil {
+		t.Fatalf("%v %v", err, parsed.Err)
+	}
+	if parsed.Limit != 10 || parsed.Where["Metadata.Floor"].(common.Dict)["$gt"] != 3.5 {
+		t.Errorf("Expected the bound floor and limit, got %v and %v", parsed.Where, parsed.Limit)
+	}
+}
+
+func TestPrepareChecksQueries(t *testing.T) {
+	qp := NewQueryProcessor(10, time.UTC)
+	for _, query := range []string{
+		"select data before now where uuid = $1",
+		"select data in ($1, $2) limit $3 where Metadata/Type = $4",
+		"select window($1 min) data in ($2, now) where uuid = $3",
+		"set Metadata/Floor = $1 where uuid = $2",
+	} {
+		if _, err := qp.Prepare(query); err != nil {
+			t.Errorf("%v: %v", query, err)
+		}
+	}
+	for _, query := range []string{
+		"select data before now where uuid = $1 and",
+		"select data before now where $1 = 'x'",
+		"selct * where uuid = $1",
+	} {
+		if prepared, err := qp.Prepare(query); err == nil {
+			t.Errorf("%v: expected an error, got %+v", query, prepared)
+		} else if _, err = qp.ParsePrepared(prepared.ID, []interface{}{"x"}); err == nil {
+			t.Errorf("%v: should not have been prepared", query)
+		}
+	}
+}
+
+func TestPreparedQueriesAreEvicted(t *testing.T) {
+	qp := NewQueryProcessor(10, time.UTC)
+	qp.preparedSize = 2
+	first, _ := qp.Prepare("select * where uuid = $1")
+	second, _ := qp.Prepare("select * where Metadata/Type = $1")
+	// using the first query keeps it around
+	if _, err := qp.ParsePrepared(first.ID, []interface{}{"x"}); err != nil {
+		t.Fatal(err)
+	}
+	qp.Prepare("select * where Path = $1")
+	if _, err := qp.ParsePrepared(second.ID, []interface{}{"x"}); err == nil {
+		t.Error("Expected the least recently used query to be evicted")
+	}
+	if _, err := qp.ParsePrepared(first.ID, []interface{}{"x"}); err != nil {
+		t.Errorf("Expected the recently used query to be kept (%v)", err)
+	}
+	if qp.prepared.Len() != 2 {
+		t.Errorf("Expected 2 prepared queries, got %d", qp.prepared.Len())
+	}
+}
+
+// keywords are only recognized as whole words, so tags may start with one
+func TestKeywordPrefixedTags(t *testing.T) {
+	qp := NewQueryProcessor(10, time.UTC)
+	for query, tag := range map[string]string{
+		"select * where betweenness = 'a'":          "betweenness",
+		"select * where Metadata/betweenness = 'a'": "Metadata.betweenness",
+		"select * where fillrate = 'a'":             "fillrate",
+		"select * where resampled = 'a'":            "resampled",
+	} {
+		if parsed := qp.Parse(query); parsed.Err != nil {
+			t.Errorf("%v: %v (error at %v)", query, parsed.Err, parsed.ErrPos)
+		} else if parsed.Where[tag] != "a" {
+			t.Errorf("%v: expected %v = 'a', got %v", query, tag, parsed.Where)
+		}
+	}
+}
@@ -1,17 +1,20 @@
+// Code generated by goyacc -o query.go -p sq query.y. DO NOT EDIT.
+
 //line query.y:2
+
 package querylang
 
 import __yyfmt__ "fmt"
 
 //line query.y:3
+
 import (
 	"bufio"
 	"fmt"
-	"strconv"
-	_time "time"
-
 	"github.com/jf87/giles2/common"
 	"github.com/taylorchu/toki"
+	"strconv"
+	_time "time"
 )
 
 /**
@@ -20,15 +23,21 @@ Notes here
 
 //line query.y:20
 type sqSymType struct {
-	yys      int
-	str      string
-	dict     common.Dict
-	data     *DataQuery
-	limit    Limit
-	timeconv common.UnitOfTime
-	list     List
-	time     _time.Time
-	timediff _time.Duration
+	yys       int
+	str       string
+	num       float64
+	dict      common.Dict
+	data      *DataQuery
+	limit     Limit
+	page      Page
+	resample  *common.Resample
+	operators []common.DataFunction
+	operator  common.DataFunction
+	inputs    map[string]common.Dict
+	timeconv  common.UnitOfTime
+	list      List
+	time      _time.Time
+	timediff  common.RelTime
 }
 
 const SELECT = 57346
@@ -36,39 +45,58 @@ const DISTINCT = 57347
 const DELETE = 57348
 const SET = 57349
 const APPLY = 57350
-const STATISTICAL = 57351
-const WINDOW = 57352
-const STATISTICS = 57353
-const WHERE = 57354
-const DATA = 57355
-const BEFORE = 57356
-const AFTER = 57357
-const LIMIT = 57358
-const STREAMLIMIT = 57359
-const NOW = 57360
-const LVALUE = 57361
-const QSTRING = 57362
-const EQ = 57363
-const NEQ = 57364
-const COMMA = 57365
-const ALL = 57366
-const LEFTPIPE = 57367
-const LIKE = 57368
-const AS = 57369
-const AND = 57370
-const OR = 57371
-const HAS = 57372
-const NOT = 57373
-const IN = 57374
-const TO = 57375
-const LPAREN = 57376
-const RPAREN = 57377
-const LBRACK = 57378
-const RBRACK = 57379
-const NUMBER = 57380
-const SEMICOLON = 57381
-const NEWLINE = 57382
-const TIMEUNIT = 57383
+const EXPLAIN = 57351
+const STATISTICAL = 57352
+const WINDOW = 57353
+const STATISTICS = 57354
+const DRYRUN = 57355
+const GROUPBY = 57356
+const ORDERBY = 57357
+const ASC = 57358
+const DESC = 57359
+const RESAMPLE = 57360
+const FILL = 57361
+const ASEXPR = 57362
+const ASOF = 57363
+const WITH = 57364
+const WHERE = 57365
+const DATA = 57366
+const BEFORE = 57367
+const AFTER = 57368
+const LIMIT = 57369
+const OFFSET = 57370
+const STREAMLIMIT = 57371
+const NOW = 57372
+const TODAY = 57373
+const STARTOF = 57374
+const LAST = 57375
+const LVALUE = 57376
+const QSTRING = 57377
+const EQ = 57378
+const NEQ = 57379
+const COMMA = 57380
+const ALL = 57381
+const LT = 57382
+const LTE = 57383
+const GT = 57384
+const GTE = 57385
+const BETWEEN = 57386
+const LIKE = 57387
+const AS = 57388
+const AND = 57389
+const OR = 57390
+const HAS = 57391
+const NOT = 57392
+const IN = 57393
+const TO = 57394
+const LPAREN = 57395
+const RPAREN = 57396
+const LBRACK = 57397
+const RBRACK = 57398
+const NUMBER = 57399
+const SEMICOLON = 57400
+const NEWLINE = 57401
+const TIMEUNIT = 57402
 
 var sqToknames = [...]string{
 	"$end",
@@ -79,23 +107,42 @@ var sqToknames = [...]string{
 	"DELETE",
 	"SET",
 	"APPLY",
+	"EXPLAIN",
 	"STATISTICAL",
 	"WINDOW",
 	"STATISTICS",
+	"DRYRUN",
+	"GROUPBY",
+	"ORDERBY",
+	"ASC",
+	"DESC",
+	"RESAMPLE",
+	"FILL",
+	"ASEXPR",
+	"ASOF",
+	"WITH",
 	"WHERE",
 	"DATA",
 	"BEFORE",
 	"AFTER",
 	"LIMIT",
+	"OFFSET",
 	"STREAMLIMIT",
 	"NOW",
+	"TODAY",
+	"STARTOF",
+	"LAST",
 	"LVALUE",
 	"QSTRING",
 	"EQ",
 	"NEQ",
 	"COMMA",
 	"ALL",
-	"LEFTPIPE",
+	"LT",
+	"LTE",
+	"GT",
+	"GTE",
+	"BETWEEN",
 	"LIKE",
 	"AS",
 	"AND",
@@ -113,13 +160,15 @@ var sqToknames = [...]string{
 	"NEWLINE",
 	"TIMEUNIT",
 }
+
 var sqStatenames = [...]string{}
 
 const sqEofCode = 1
 const sqErrCode = 2
 const sqInitialStackSize = 16
 
-//line query.y:415
+//line query.y:744
+
 const eof = 0
 
 var supported_formats = []string{"1/2/2006",
@@ -128,7 +177,8 @@ var supported_formats = []string{"1/2/2006",
 	"1-2-2006 03:04:05 PM MST",
 	"1/2/2006 15:04:05 MST",
 	"1-2-2006 15:04:05 MST",
-	"2006-1-2 15:04:05 MST"}
+	"2006-1-2 15:04:05 MST",
+	"2006-1-2"}
 
 type List []string
 
@@ -143,6 +193,8 @@ func (qt QueryType) String() string {
 		ret = "set"
 	case DATA_TYPE:
 		ret = "data"
+	case APPLY_TYPE:
+		ret = "apply"
 	}
 	return ret
 }
@@ -158,6 +210,23 @@ type query struct {
 	where common.Dict
 	// are we querying distinct values?
 	distinct bool
+	// only report what a SET or DELETE would change
+	dryRun bool
+	// report how the query is evaluated
+	explain bool
+	// tag whose values group the streams of a data query
+	groupBy string
+	// order of the documents or streams
+	orderBy *common.OrderBy
+	// time of the metadata the query is evaluated over, if not zero
+	asOf _time.Time
+	// arithmetic expression of a data query over its inputs
+	expression string
+	inputs     map[string]common.Dict
+	// operators of an APPLY query, innermost first
+	operators []common.DataFunction
+	// the documents a metadata query returns
+	page Page
 	// list of tags to target for deletion, selection
 	Contents []string
 }
@@ -186,6 +255,16 @@ type sqLex struct {
 	// all keys that we encounter. Used for republish concerns
 	_keys map[string]struct{}
 	keys  []string
+	// values bound to the $1, $2, ... parameters of a prepared query
+	params []boundParam
+	// the n of the last token if it is the parameter $n, else 0, and of the
+	// token the first error was found at
+	param    int
+	errParam int
+	// whether the query refers to the current time
+	now bool
+	// time zone of the times in the query, or nil for local time
+	location *_time.Location
 }
 
 func NewSQLex(s string) *sqLex {
@@ -195,29 +274,48 @@ func NewSQLex(s string) *sqLex {
 			{Token: SELECT, Pattern: "select"},
 			{Token: APPLY, Pattern: "apply"},
 			{Token: DELETE, Pattern: "delete"},
+			{Token: DESC, Pattern: "desc\\b"},
 			{Token: DISTINCT, Pattern: "distinct"},
+			{Token: DRYRUN, Pattern: "dry\\s+run"},
+			{Token: EXPLAIN, Pattern: "explain\\b"},
+			{Token: GROUPBY, Pattern: "group\\s+by"},
+			{Token: ORDERBY, Pattern: "order\\s+by"},
 			{Token: STATISTICAL, Pattern: "statistical"},
 			{Token: STATISTICS, Pattern: "statistics"},
 			{Token: WINDOW, Pattern: "window"},
 			{Token: LIMIT, Pattern: "limit"},
+			{Token: OFFSET, Pattern: "offset\\b"},
 			{Token: STREAMLIMIT, Pattern: "streamlimit"},
+			{Token: STARTOF, Pattern: "start\\s+of\\b"},
 			{Token: ALL, Pattern: "\\*"},
 			{Token: NOW, Pattern: "now"},
+			{Token: TODAY, Pattern: "today\\b"},
+			{Token: LAST, Pattern: "last\\b"},
 			{Token: SET, Pattern: "set"},
 			{Token: BEFORE, Pattern: "before"},
+			{Token: BETWEEN, Pattern: "between\\b"},
+			{Token: RESAMPLE, Pattern: "resample\\b"},
+			{Token: FILL, Pattern: "fill\\b"},
 			{Token: AFTER, Pattern: "after"},
 			{Token: COMMA, Pattern: ","},
 			{Token: AND, Pattern: "and"},
+			{Token: ASEXPR, Pattern: "as\\s+expr"},
+			{Token: ASOF, Pattern: "as\\s+of\\b"},
+			{Token: ASC, Pattern: "asc\\b"},
 			{Token: AS, Pattern: "as"},
 			{Token: TO, Pattern: "to"},
 			{Token: DATA, Pattern: "data"},
+			{Token: WITH, Pattern: "with\\b"},
 			{Token: OR, Pattern: "or"},
-			{Token: IN, Pattern: "in"},
+			{Token: IN, Pattern: "in\\b"},
 			{Token: HAS, Pattern: "has"},
 			{Token: NOT, Pattern: "not"},
 			{Token: NEQ, Pattern: "!="},
 			{Token: EQ, Pattern: "="},
-			{Token: LEFTPIPE, Pattern: "<"},
+			{Token: LTE, Pattern: "<="},
+			{Token: LT, Pattern: "<"},
+			{Token: GTE, Pattern: ">="},
+			{Token: GT, Pattern: ">"},
 			{Token: LPAREN, Pattern: "\\("},
 			{Token: RPAREN, Pattern: "\\)"},
 			{Token: LBRACK, Pattern: "\\["},
@@ -242,13 +340,39 @@ func (sq *sqLex) Lex(lval *sqSymType) int {
 	}
 	lval.str = string(r.Value)
 	sq.tokens = append(sq.tokens, lval.str)
+	sq.param = 0
+	// bound values are substituted as a whole token, so they are never
+	// scanned and cannot change the structure of the query
+	if index, isParam := paramIndex(lval.str); isParam && r.Token == LVALUE && sq.params != nil && index <= len(sq.params) {
+		sq.param = index
+		lval.str = sq.params[index-1].str
+		return sq.params[index-1].token
+	}
 	return int(r.Token)
 }
 
 func (sq *sqLex) Error(s string) {
+	if sq.error == nil {
+		sq.errParam = sq.param
+	}
 	sq.error = fmt.Errorf(s)
 }
 
+// the current time in the time zone of the query. Queries that refer to it
+// are not cached
+func (sq *sqLex) currentTime() _time.Time {
+	sq.now = true
+	return _time.Now().In(sq.timeLocation())
+}
+
+// the time zone of the times in the query
+func (sq *sqLex) timeLocation() *_time.Location {
+	if sq.location == nil {
+		return _time.Local
+	}
+	return sq.location
+}
+
 func readline(fi *bufio.Reader) (string, bool) {
 	fmt.Printf("smap> ")
 	s, err := fi.ReadString('\n')
@@ -261,134 +385,205 @@ func readline(fi *bufio.Reader) (string, bool) {
 // Parse has been moved to query_processor.go
 
 //line yacctab:1
-var sqExca = [...]int{
+var sqExca = [...]int8{
 	-1, 1,
 	1, -1,
 	-2, 0,
 }
 
-const sqNprod = 60
 const sqPrivate = 57344
 
-var sqTokenNames []string
-var sqStates []string
-
-const sqLast = 183
-
-var sqAct = [...]int{
-
-	109, 85, 53, 42, 82, 78, 14, 17, 14, 16,
-	55, 67, 41, 25, 54, 54, 55, 55, 21, 55,
-	66, 21, 62, 50, 48, 47, 46, 38, 64, 15,
-	49, 132, 83, 112, 52, 52, 14, 99, 63, 15,
-	43, 40, 111, 60, 45, 34, 46, 74, 23, 79,
-	43, 56, 57, 70, 45, 59, 46, 58, 77, 88,
-	104, 152, 148, 44, 91, 147, 130, 116, 103, 90,
-	89, 139, 134, 80, 97, 98, 100, 133, 31, 101,
-	30, 95, 96, 29, 135, 7, 128, 108, 127, 113,
-	18, 102, 27, 28, 76, 75, 17, 17, 17, 65,
-	68, 69, 117, 118, 119, 107, 120, 110, 79, 123,
-	26, 121, 146, 124, 142, 9, 141, 106, 61, 11,
-	13, 12, 105, 10, 131, 94, 72, 73, 35, 15,
-	122, 71, 136, 125, 8, 93, 92, 140, 11, 13,
-	12, 21, 10, 81, 32, 55, 15, 84, 15, 150,
-	151, 153, 154, 126, 155, 20, 156, 137, 138, 86,
-	87, 22, 24, 143, 129, 144, 145, 115, 114, 21,
-	149, 1, 33, 51, 36, 37, 2, 6, 4, 3,
-	5, 39, 19,
+const sqLast = 355
+
+var sqAct = [...]int16{
+	192, 68, 141, 217, 71, 29, 169, 231, 66, 131,
+	124, 24, 32, 95, 31, 35, 60, 127, 9, 292,
+	18, 242, 25, 18, 59, 28, 244, 97, 76, 36,
+	50, 215, 211, 54, 55, 76, 181, 76, 162, 80,
+	81, 82, 291, 248, 65, 161, 243, 157, 78, 108,
+	96, 236, 98, 98, 98, 64, 102, 104, 103, 167,
+	229, 18, 86, 170, 92, 132, 195, 194, 183, 125,
+	72, 73, 74, 75, 126, 76, 182, 51, 120, 85,
+	26, 139, 136, 111, 130, 144, 84, 83, 123, 72,
+	73, 74, 75, 225, 76, 61, 58, 70, 151, 63,
+	178, 64, 147, 72, 73, 74, 75, 56, 76, 294,
+	293, 281, 79, 14, 16, 15, 70, 165, 166, 168,
+	153, 38, 39, 171, 172, 173, 174, 13, 101, 278,
+	70, 274, 106, 107, 163, 164, 156, 89, 175, 14,
+	16, 15, 191, 273, 180, 196, 188, 37, 270, 186,
+	150, 233, 224, 88, 199, 189, 187, 153, 98, 26,
+	201, 177, 148, 89, 203, 153, 146, 204, 200, 145,
+	205, 206, 207, 155, 61, 25, 25, 25, 63, 62,
+	64, 152, 239, 289, 125, 251, 90, 238, 237, 235,
+	210, 43, 216, 209, 77, 49, 213, 48, 47, 42,
+	41, 40, 38, 39, 226, 122, 121, 193, 45, 222,
+	221, 202, 227, 176, 94, 228, 208, 113, 114, 46,
+	234, 115, 116, 117, 118, 119, 112, 240, 37, 109,
+	110, 19, 269, 105, 266, 247, 260, 246, 259, 249,
+	250, 10, 252, 253, 241, 190, 179, 160, 27, 257,
+	159, 256, 254, 261, 262, 158, 149, 263, 265, 140,
+	264, 267, 268, 99, 100, 44, 271, 245, 53, 76,
+	272, 275, 277, 258, 276, 232, 279, 280, 93, 282,
+	285, 286, 22, 288, 287, 12, 91, 219, 290, 30,
+	14, 16, 15, 14, 16, 15, 14, 16, 15, 23,
+	255, 26, 154, 135, 13, 21, 30, 13, 134, 133,
+	13, 142, 223, 143, 17, 198, 220, 17, 212, 11,
+	89, 128, 129, 197, 52, 34, 30, 33, 30, 30,
+	214, 33, 284, 218, 30, 184, 185, 67, 138, 52,
+	3, 137, 6, 5, 4, 2, 1, 283, 69, 7,
+	230, 20, 87, 8, 57,
 }
-var sqPact = [...]int{
-
-	172, -1000, 110, 127, 129, 9, 157, -1000, -1000, 127,
-	78, 49, 46, 44, 121, -1000, 6, 107, 157, 157,
-	-12, 10, -14, -1000, -15, -1000, -4, -3, -3, 19,
-	17, 5, 127, -17, -1000, -10, -19, -28, -1000, 72,
-	20, -1000, 105, 127, 63, 20, 125, -1000, -1000, -3,
-	120, -6, 128, -1000, -1000, -1000, 143, 143, 35, 34,
-	127, -1000, -1000, 113, 112, 102, -1000, -1000, 20, 20,
-	-1000, 125, -1, 125, -1000, 127, 59, 33, 23, 99,
-	94, -3, -1000, 127, -1000, 80, 4, -5, 80, 155,
-	154, 32, 127, 127, 127, -1000, -1000, -1000, -1000, -1000,
-	-1000, -1000, 127, -1000, -1000, 125, -3, 143, -6, -1000,
-	114, 136, -1000, -1000, 56, 54, 151, -1000, -1000, -1000,
-	-1000, -1000, 31, 80, -1000, -1000, -7, 43, 38, 52,
-	143, -1000, -1000, -3, -3, 37, 80, 93, 91, -3,
-	-1000, -3, -3, 89, 30, 27, -3, 143, 143, 26,
-	80, 80, 143, -1000, -1000, 80, -1000,
+
+var sqPact = [...]int16{
+	336, -32768, 336, 280, 271, 267, 283, -32768, 306, 305,
+	-32768, -32768, 267, 177, 148, 147, 146, 138, 227, 156,
+	179, 145, 144, 142, 311, 232, -32768, 303, 303, 326,
+	46, 310, 322, 73, 141, 310, -32768, 59, 73, 73,
+	30, 29, 22, 129, 267, 286, 271, -7, -7, -7,
+	326, -2, -32768, 0, 326, 326, -9, 182, 125, -32768,
+	181, 267, 155, 125, 234, 322, 294, 267, -32768, 8,
+	275, -32768, -32768, -32768, 274, 269, -32768, 234, 324, 73,
+	221, 284, 284, 115, 112, 267, 108, 218, 96, 138,
+	-32768, -32768, 303, -32768, 127, -32768, 268, -32768, -32768, 119,
+	82, -11, -32768, 217, 212, 209, -13, -20, -32768, 125,
+	125, -32768, 234, 2, 234, 6, 6, 6, 6, 6,
+	-32768, 267, 162, 107, 44, 208, 294, -22, 19, 11,
+	319, -32768, 267, -32768, -32768, -32768, 102, 322, 267, 207,
+	73, 161, 10, 9, 161, 299, 291, 100, -32768, 103,
+	160, 310, -32768, -7, -32768, -32768, -32768, -32768, 267, 267,
+	267, -32768, -32768, -32768, -32768, -32768, -32768, -32768, -32768, -32768,
+	-32768, -32768, -32768, -32768, 169, -32768, 267, -32768, -32768, 234,
+	-26, -32768, 290, -32768, -32768, -32768, 8, 308, -27, -32768,
+	73, 315, -32768, 253, 287, -32768, -32768, 159, 158, 288,
+	98, -32768, 40, 322, -32768, -32768, -32768, -32768, 6, -32768,
+	-32768, -32768, 3, -32768, 241, -32768, 97, 284, 136, -32768,
+	-6, 135, 134, 131, -32768, 73, 206, -37, -32768, -32768,
+	-12, -32768, 231, 315, 161, -14, -32768, 73, 73, 132,
+	204, 73, -32768, -32768, 241, 266, 284, -32768, 239, 200,
+	198, 73, 73, 315, -32768, 234, -32768, 161, 196, 73,
+	73, 194, 94, 284, -32768, -32768, 236, 89, 77, 73,
+	315, 161, 75, 284, 284, 57, 284, -32768, 313, 161,
+	161, 284, 161, -32768, 130, -32768, -32768, 161, -32768, -15,
+	-32768, 56, 55, -32768, -32768,
 }
-var sqPgo = [...]int{
 
-	0, 181, 12, 155, 9, 180, 85, 5, 63, 177,
-	23, 173, 4, 1, 0, 2, 3, 171,
+var sqPgo = [...]int16{
+	0, 354, 24, 5, 11, 353, 241, 10, 179, 352,
+	214, 231, 351, 350, 7, 13, 18, 1, 348, 9,
+	2, 17, 3, 347, 0, 4, 16, 6, 346, 12,
+	8, 341, 77,
 }
-var sqR1 = [...]int{
-
-	0, 17, 17, 17, 17, 17, 17, 17, 17, 6,
-	6, 8, 7, 7, 4, 4, 4, 4, 4, 4,
-	5, 5, 5, 5, 9, 9, 9, 9, 9, 9,
-	9, 10, 10, 11, 11, 11, 11, 12, 12, 13,
-	13, 13, 13, 14, 14, 3, 2, 2, 2, 2,
-	2, 2, 2, 2, 15, 16, 1, 1, 1, 1,
+
+var sqR1 = [...]int8{
+	0, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+	28, 28, 11, 11, 12, 12, 12, 12, 10, 10,
+	15, 15, 15, 15, 13, 13, 14, 14, 31, 31,
+	29, 29, 30, 30, 30, 30, 32, 32, 6, 6,
+	8, 7, 7, 4, 4, 4, 4, 4, 4, 5,
+	5, 5, 5, 16, 16, 16, 16, 16, 16, 16,
+	16, 16, 16, 16, 9, 9, 17, 17, 18, 18,
+	18, 18, 18, 18, 18, 19, 19, 22, 22, 23,
+	23, 23, 20, 20, 20, 20, 21, 21, 21, 21,
+	24, 24, 3, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 27, 25, 26, 1,
+	1, 1, 1,
 }
-var sqR2 = [...]int{
-
-	0, 4, 3, 4, 4, 3, 4, 4, 3, 1,
-	3, 3, 1, 3, 3, 3, 3, 5, 5, 5,
-	1, 1, 2, 1, 9, 7, 13, 13, 14, 5,
-	5, 1, 2, 2, 1, 1, 1, 2, 3, 0,
-	2, 2, 4, 0, 2, 2, 3, 3, 3, 3,
-	2, 3, 4, 3, 1, 1, 3, 3, 2, 1,
+
+var sqR2 = [...]int8{
+	0, 2, 7, 6, 8, 9, 7, 5, 4, 5,
+	5, 4, 1, 3, 1, 4, 4, 4, 1, 3,
+	1, 2, 1, 1, 1, 3, 4, 3, 0, 2,
+	0, 2, 0, 2, 3, 3, 0, 1, 1, 3,
+	3, 1, 3, 3, 3, 3, 5, 5, 5, 1,
+	1, 2, 1, 10, 8, 13, 13, 14, 4, 6,
+	13, 11, 5, 5, 1, 3, 1, 2, 2, 1,
+	1, 1, 1, 2, 2, 2, 3, 0, 8, 0,
+	4, 4, 0, 2, 2, 4, 0, 2, 4, 2,
+	0, 2, 2, 3, 3, 3, 3, 3, 3, 3,
+	3, 5, 2, 3, 4, 3, 1, 1, 1, 3,
+	3, 2, 1,
 }
-var sqChk = [...]int{
-
-	-1000, -17, 4, 7, 6, -5, -9, -6, 24, 5,
-	13, 9, 11, 10, -16, 19, -4, -16, -6, -9,
-	-3, 12, -3, 39, -3, -16, 32, 14, 15, 34,
-	34, 34, 23, -3, 39, 21, -3, -3, 39, -1,
-	31, -2, -16, 30, -8, 34, 36, 39, 39, 34,
-	-10, -11, 38, -15, 18, 20, -10, -10, 38, 38,
-	38, -6, 39, -15, 38, -8, 39, 39, 28, 29,
-	-2, 26, 21, 22, -16, 32, 31, -2, -7, -15,
-	-10, 23, -12, 38, 19, -13, 16, 17, -13, 35,
-	35, -16, 23, 23, 23, -2, -2, -15, -15, 38,
-	-15, -16, 32, 35, 37, 23, 23, -10, -16, -14,
-	27, 38, 38, -14, 13, 13, 35, -4, -4, -4,
-	-16, -7, -10, -13, -12, 19, 17, 32, 32, 13,
-	35, -14, 38, 34, 34, 32, -13, -10, -10, 34,
-	-14, 23, 23, -10, -10, -10, 23, 35, 35, -10,
-	-13, -13, 35, -14, -14, -13, -14,
+
+var sqChk = [...]int16{
+	-32768, -28, 9, 4, 8, 7, 6, -28, -5, -16,
+	-6, 39, 5, 24, 10, 12, 11, 34, -26, -11,
+	-12, 34, 11, 28, -4, -26, 34, -6, -16, -3,
+	23, -3, -29, 21, 20, -3, -26, 51, 25, 26,
+	53, 53, 53, 53, 38, 52, 40, 53, 53, 53,
+	-3, -32, 13, 36, -3, -3, -32, -1, 50, -2,
+	-26, 49, -8, 53, 55, -29, -30, 15, -17, -18,
+	57, -25, 30, 31, 32, 33, 35, 53, -29, 53,
+	-17, -17, -17, 57, 57, 57, -16, -9, 24, 34,
+	57, -6, -16, -11, -10, -15, 57, 34, -25, -10,
+	-10, -32, 58, -25, 57, -8, -32, -32, 58, 47,
+	48, -2, 45, 36, 37, 40, 41, 42, 43, 44,
+	-26, 51, 50, -2, -7, -25, -30, -21, 27, 28,
+	-26, -19, 57, 34, 34, 34, -25, -31, 14, -17,
+	38, -20, 27, 29, -20, 54, 54, -26, 54, 38,
+	54, -3, 54, 38, 34, 54, 54, 58, 38, 38,
+	38, 58, 58, -2, -2, -25, -25, 57, -25, -27,
+	57, -27, -27, -27, -27, -26, 51, 54, 56, 38,
+	-21, 58, 57, 57, 16, 17, -26, 54, -30, -26,
+	38, -17, -24, 46, 57, 57, -24, 24, 24, 54,
+	-16, 57, 51, -29, -15, -4, -4, -4, 47, -26,
+	-7, 58, 28, -19, 22, 58, -17, -22, 18, 34,
+	29, 51, 51, 24, 54, 53, -17, -30, -27, 57,
+	-13, -14, 34, 54, -20, 53, 57, 53, 53, 51,
+	-17, 38, 58, 58, 38, 36, -22, -24, 57, -17,
+	-17, 53, 38, -17, -14, 34, -3, -20, 34, 38,
+	38, -17, -17, -22, -25, -24, 38, -17, -17, 38,
+	54, -20, 34, 54, 54, -17, -22, -24, 54, -20,
+	-20, 54, -20, -23, 19, -24, -24, -20, -24, 53,
+	-24, 57, 34, 54, 54,
 }
-var sqDef = [...]int{
-
-	0, -2, 0, 0, 0, 0, 0, 20, 21, 23,
-	0, 0, 0, 0, 9, 55, 0, 0, 0, 0,
-	0, 0, 0, 2, 0, 22, 0, 0, 0, 0,
-	0, 0, 0, 0, 5, 0, 0, 0, 8, 45,
-	0, 59, 0, 0, 0, 0, 0, 1, 3, 0,
-	0, 31, 34, 35, 36, 54, 39, 39, 0, 0,
-	0, 10, 4, 14, 15, 16, 6, 7, 0, 0,
-	58, 0, 0, 0, 50, 0, 0, 0, 0, 12,
-	0, 0, 32, 0, 33, 43, 0, 0, 43, 0,
-	0, 0, 0, 0, 0, 56, 57, 46, 47, 48,
-	49, 51, 0, 53, 11, 0, 0, 39, 37, 29,
-	0, 40, 41, 30, 0, 0, 0, 17, 18, 19,
-	52, 13, 0, 43, 38, 44, 0, 0, 0, 0,
-	39, 25, 42, 0, 0, 0, 43, 0, 0, 0,
-	24, 0, 0, 0, 0, 0, 0, 39, 39, 0,
-	43, 43, 39, 26, 27, 43, 28,
+
+var sqDef = [...]int8{
+	0, -2, 0, 0, 0, 0, 0, 1, 30, 0,
+	49, 50, 52, 0, 0, 0, 0, 108, 38, 0,
+	12, 14, 0, 0, 36, 0, 108, 0, 0, 36,
+	0, 30, 32, 0, 0, 30, 51, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	36, 0, 37, 0, 36, 36, 0, 92, 0, 112,
+	0, 0, 0, 0, 0, 32, 86, 0, 31, 66,
+	69, 70, 71, 72, 0, 0, 107, 0, 28, 0,
+	0, 82, 82, 0, 0, 0, 0, 0, 0, 0,
+	64, 39, 0, 13, 0, 18, 20, 22, 23, 0,
+	0, 0, 8, 43, 44, 45, 0, 0, 11, 0,
+	0, 111, 0, 0, 0, 0, 0, 0, 0, 0,
+	102, 0, 0, 0, 0, 41, 86, 0, 0, 0,
+	33, 67, 0, 68, 73, 74, 0, 32, 0, 0,
+	0, 90, 0, 0, 90, 0, 0, 0, 58, 0,
+	0, 30, 15, 0, 21, 16, 17, 7, 0, 0,
+	0, 9, 10, 109, 110, 93, 94, 95, 96, 97,
+	106, 98, 99, 100, 0, 103, 0, 105, 40, 0,
+	0, 3, 87, 89, 34, 35, 75, 0, 0, 29,
+	0, 77, 62, 0, 83, 84, 63, 0, 0, 0,
+	0, 65, 0, 32, 19, 46, 47, 48, 0, 104,
+	42, 2, 0, 76, 0, 6, 0, 82, 0, 91,
+	0, 0, 0, 0, 59, 0, 0, 0, 101, 88,
+	0, 24, 0, 77, 90, 0, 85, 0, 0, 0,
+	0, 0, 4, 5, 0, 0, 82, 54, 0, 0,
+	0, 0, 0, 77, 25, 0, 27, 90, 0, 0,
+	0, 0, 0, 82, 26, 53, 0, 0, 0, 0,
+	77, 90, 0, 82, 82, 0, 82, 61, 79, 90,
+	90, 82, 90, 78, 0, 55, 56, 90, 60, 0,
+	57, 0, 0, 80, 81,
 }
-var sqTok1 = [...]int{
 
+var sqTok1 = [...]int8{
 	1,
 }
-var sqTok2 = [...]int{
 
+var sqTok2 = [...]int8{
 	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
 	12, 13, 14, 15, 16, 17, 18, 19, 20, 21,
 	22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
 	32, 33, 34, 35, 36, 37, 38, 39, 40, 41,
+	42, 43, 44, 45, 46, 47, 48, 49, 50, 51,
+	52, 53, 54, 55, 56, 57, 58, 59, 60,
 }
-var sqTok3 = [...]int{
+
+var sqTok3 = [...]int8{
 	0,
 }
 
@@ -431,7 +626,7 @@ func sqNewParser() sqParser {
 	return &sqParserImpl{}
 }
 
-const sqFlag = -1000
+const sqFlag = -32768
 
 func sqTokname(c int) string {
 	if c >= 1 && c-1 < len(sqToknames) {
@@ -470,9 +665,9 @@ func sqErrorMessage(state, lookAhead int) string {
 	expected := make([]int, 0, 4)
 
 	// Look for shiftable tokens.
-	base := sqPact[state]
+	base := int(sqPact[state])
 	for tok := TOKSTART; tok-1 < len(sqToknames); tok++ {
-		if n := base + tok; n >= 0 && n < sqLast && sqChk[sqAct[n]] == tok {
+		if n := base + tok; n >= 0 && n < sqLast && int(sqChk[int(sqAct[n])]) == tok {
 			if len(expected) == cap(expected) {
 				return res
 			}
@@ -482,13 +677,13 @@ func sqErrorMessage(state, lookAhead int) string {
 
 	if sqDef[state] == -2 {
 		i := 0
-		for sqExca[i] != -1 || sqExca[i+1] != state {
+		for sqExca[i] != -1 || int(sqExca[i+1]) != state {
 			i += 2
 		}
 
 		// Look for tokens that we accept or reduce.
 		for i += 2; sqExca[i] >= 0; i += 2 {
-			tok := sqExca[i]
+			tok := int(sqExca[i])
 			if tok < TOKSTART || sqExca[i+1] == 0 {
 				continue
 			}
@@ -519,30 +714,30 @@ func sqlex1(lex sqLexer, lval *sqSymType) (char, token int) {
 	token = 0
 	char = lex.Lex(lval)
 	if char <= 0 {
-		token = sqTok1[0]
+		token = int(sqTok1[0])
 		goto out
 	}
 	if char < len(sqTok1) {
-		token = sqTok1[char]
+		token = int(sqTok1[char])
 		goto out
 	}
 	if char >= sqPrivate {
 		if char < sqPrivate+len(sqTok2) {
-			token = sqTok2[char-sqPrivate]
+			token = int(sqTok2[char-sqPrivate])
 			goto out
 		}
 	}
 	for i := 0; i < len(sqTok3); i += 2 {
-		token = sqTok3[i+0]
+		token = int(sqTok3[i+0])
 		if token == char {
-			token = sqTok3[i+1]
+			token = int(sqTok3[i+1])
 			goto out
 		}
 	}
 
 out:
 	if token == 0 {
-		token = sqTok2[1] /* unknown char */
+		token = int(sqTok2[1]) /* unknown char */
 	}
 	if sqDebug >= 3 {
 		__yyfmt__.Printf("lex %s(%d)\n", sqTokname(token), uint(char))
@@ -597,7 +792,7 @@ sqstack:
 	sqS[sqp].yys = sqstate
 
 sqnewstate:
-	sqn = sqPact[sqstate]
+	sqn = int(sqPact[sqstate])
 	if sqn <= sqFlag {
 		goto sqdefault /* simple state */
 	}
@@ -608,8 +803,8 @@ sqnewstate:
 	if sqn < 0 || sqn >= sqLast {
 		goto sqdefault
 	}
-	sqn = sqAct[sqn]
-	if sqChk[sqn] == sqtoken { /* valid shift */
+	sqn = int(sqAct[sqn])
+	if int(sqChk[sqn]) == sqtoken { /* valid shift */
 		sqrcvr.char = -1
 		sqtoken = -1
 		sqVAL = sqrcvr.lval
@@ -622,7 +817,7 @@ sqnewstate:
 
 sqdefault:
 	/* default state action */
-	sqn = sqDef[sqstate]
+	sqn = int(sqDef[sqstate])
 	if sqn == -2 {
 		if sqrcvr.char < 0 {
 			sqrcvr.char, sqtoken = sqlex1(sqlex, &sqrcvr.lval)
@@ -631,18 +826,18 @@ sqdefault:
 		/* look through exception table */
 		xi := 0
 		for {
-			if sqExca[xi+0] == -1 && sqExca[xi+1] == sqstate {
+			if sqExca[xi+0] == -1 && int(sqExca[xi+1]) == sqstate {
 				break
 			}
 			xi += 2
 		}
 		for xi += 2; ; xi += 2 {
-			sqn = sqExca[xi+0]
+			sqn = int(sqExca[xi+0])
 			if sqn < 0 || sqn == sqtoken {
 				break
 			}
 		}
-		sqn = sqExca[xi+1]
+		sqn = int(sqExca[xi+1])
 		if sqn < 0 {
 			goto ret0
 		}
@@ -664,10 +859,10 @@ sqdefault:
 
 			/* find a state where "error" is a legal shift action */
 			for sqp >= 0 {
-				sqn = sqPact[sqS[sqp].yys] + sqErrCode
+				sqn = int(sqPact[sqS[sqp].yys]) + sqErrCode
 				if sqn >= 0 && sqn < sqLast {
-					sqstate = sqAct[sqn] /* simulate a shift of "error" */
-					if sqChk[sqstate] == sqErrCode {
+					sqstate = int(sqAct[sqn]) /* simulate a shift of "error" */
+					if int(sqChk[sqstate]) == sqErrCode {
 						goto sqstack
 					}
 				}
@@ -703,7 +898,7 @@ sqdefault:
 	sqpt := sqp
 	_ = sqpt // guard against "declared and not used"
 
-	sqp -= sqR2[sqn]
+	sqp -= int(sqR2[sqn])
 	// sqp is now the index of $0. Perform the default action. Iff the
 	// reduced production is ε, $1 is possibly out of range.
 	if sqp+1 >= len(sqS) {
@@ -714,194 +909,381 @@ sqdefault:
 	sqVAL = sqS[sqp+1]
 
 	/* consult goto table to find next state */
-	sqn = sqR1[sqn]
-	sqg := sqPgo[sqn]
+	sqn = int(sqR1[sqn])
+	sqg := int(sqPgo[sqn])
 	sqj := sqg + sqS[sqp].yys + 1
 
 	if sqj >= sqLast {
-		sqstate = sqAct[sqg]
+		sqstate = int(sqAct[sqg])
 	} else {
-		sqstate = sqAct[sqj]
-		if sqChk[sqstate] != -sqn {
-			sqstate = sqAct[sqg]
+		sqstate = int(sqAct[sqj])
+		if int(sqChk[sqstate]) != -sqn {
+			sqstate = int(sqAct[sqg])
 		}
 	}
 	// dummy call; replaced with literal code
 	switch sqnt {
 
 	case 1:
-		sqDollar = sqS[sqpt-4 : sqpt+1]
-		//line query.y:59
+		sqDollar = sqS[sqpt-2 : sqpt+1]
+//line query.y:74
+		{
+			sqlex.(*sqLex).query.explain = true
+		}
+	case 2:
+		sqDollar = sqS[sqpt-7 : sqpt+1]
+//line query.y:78
 		{
 			sqlex.(*sqLex).query.Contents = sqDollar[2].list
 			sqlex.(*sqLex).query.where = sqDollar[3].dict
+			sqlex.(*sqLex).query.page = sqDollar[6].page
 			sqlex.(*sqLex).query.qtype = SELECT_TYPE
 		}
-	case 2:
-		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:65
+	case 3:
+		sqDollar = sqS[sqpt-6 : sqpt+1]
+//line query.y:85
 		{
 			sqlex.(*sqLex).query.Contents = sqDollar[2].list
+			sqlex.(*sqLex).query.page = sqDollar[5].page
 			sqlex.(*sqLex).query.qtype = SELECT_TYPE
 		}
-	case 3:
-		sqDollar = sqS[sqpt-4 : sqpt+1]
-		//line query.y:70
+	case 4:
+		sqDollar = sqS[sqpt-8 : sqpt+1]
+//line query.y:91
+		{
+			sqlex.(*sqLex).query.where = sqDollar[5].dict
+			sqlex.(*sqLex).query.data = sqDollar[4].data
+			sqlex.(*sqLex).query.operators = sqDollar[2].operators
+			sqlex.(*sqLex).query.qtype = APPLY_TYPE
+		}
+	case 5:
+		sqDollar = sqS[sqpt-9 : sqpt+1]
+//line query.y:98
+		{
+			sqlex.(*sqLex).query.data = sqDollar[2].data
+			sqlex.(*sqLex).query.expression = sqDollar[5].str
+			sqlex.(*sqLex).query.inputs = sqDollar[8].inputs
+			sqlex.(*sqLex).query.qtype = DATA_TYPE
+		}
+	case 6:
+		sqDollar = sqS[sqpt-7 : sqpt+1]
+//line query.y:105
 		{
 			sqlex.(*sqLex).query.where = sqDollar[3].dict
 			sqlex.(*sqLex).query.data = sqDollar[2].data
 			sqlex.(*sqLex).query.qtype = DATA_TYPE
 		}
-	case 4:
-		sqDollar = sqS[sqpt-4 : sqpt+1]
-		//line query.y:76
+	case 7:
+		sqDollar = sqS[sqpt-5 : sqpt+1]
+//line query.y:111
 		{
 			sqlex.(*sqLex).query.where = sqDollar[3].dict
 			sqlex.(*sqLex).query.set = sqDollar[2].dict
 			sqlex.(*sqLex).query.qtype = SET_TYPE
 		}
-	case 5:
-		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:82
+	case 8:
+		sqDollar = sqS[sqpt-4 : sqpt+1]
+//line query.y:117
 		{
 			sqlex.(*sqLex).query.set = sqDollar[2].dict
 			sqlex.(*sqLex).query.qtype = SET_TYPE
 		}
-	case 6:
-		sqDollar = sqS[sqpt-4 : sqpt+1]
-		//line query.y:87
+	case 9:
+		sqDollar = sqS[sqpt-5 : sqpt+1]
+//line query.y:122
 		{
 			sqlex.(*sqLex).query.Contents = sqDollar[2].list
 			sqlex.(*sqLex).query.where = sqDollar[3].dict
 			sqlex.(*sqLex).query.qtype = DELETE_TYPE
 		}
-	case 7:
-		sqDollar = sqS[sqpt-4 : sqpt+1]
-		//line query.y:93
+	case 10:
+		sqDollar = sqS[sqpt-5 : sqpt+1]
+//line query.y:128
 		{
 			sqlex.(*sqLex).query.data = sqDollar[2].data
 			sqlex.(*sqLex).query.where = sqDollar[3].dict
 			sqlex.(*sqLex).query.qtype = DELETE_TYPE
 		}
-	case 8:
-		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:99
+	case 11:
+		sqDollar = sqS[sqpt-4 : sqpt+1]
+//line query.y:134
 		{
 			sqlex.(*sqLex).query.Contents = []string{}
 			sqlex.(*sqLex).query.where = sqDollar[2].dict
 			sqlex.(*sqLex).query.qtype = DELETE_TYPE
 		}
-	case 9:
+	case 12:
+		sqDollar = sqS[sqpt-1 : sqpt+1]
+//line query.y:144
+		{
+			sqVAL.operators = []common.DataFunction{sqDollar[1].operator}
+		}
+	case 13:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:148
+		{
+			sqVAL.operators = append(sqDollar[3].operators, sqDollar[1].operator)
+		}
+	case 14:
+		sqDollar = sqS[sqpt-1 : sqpt+1]
+//line query.y:154
+		{
+			sqVAL.operator = common.DataFunction{Name: sqDollar[1].str}
+		}
+	case 15:
+		sqDollar = sqS[sqpt-4 : sqpt+1]
+//line query.y:158
+		{
+			sqVAL.operator = common.DataFunction{Name: sqDollar[1].str, Args: sqDollar[3].list}
+		}
+	case 16:
+		sqDollar = sqS[sqpt-4 : sqpt+1]
+//line query.y:162
+		{
+			sqVAL.operator = common.DataFunction{Name: sqDollar[1].str, Args: sqDollar[3].list}
+		}
+	case 17:
+		sqDollar = sqS[sqpt-4 : sqpt+1]
+//line query.y:166
+		{
+			sqVAL.operator = common.DataFunction{Name: sqDollar[1].str, Args: sqDollar[3].list}
+		}
+	case 18:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:107
+//line query.y:172
 		{
 			sqVAL.list = List{sqDollar[1].str}
 		}
-	case 10:
+	case 19:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:176
+		{
+			sqVAL.list = append(sqDollar[1].list, sqDollar[3].str)
+		}
+	case 20:
+		sqDollar = sqS[sqpt-1 : sqpt+1]
+//line query.y:183
+		{
+			sqVAL.str = sqDollar[1].str
+		}
+	case 21:
+		sqDollar = sqS[sqpt-2 : sqpt+1]
+//line query.y:187
+		{
+			sqVAL.str = sqDollar[1].str + sqDollar[2].str
+		}
+	case 22:
+		sqDollar = sqS[sqpt-1 : sqpt+1]
+//line query.y:191
+		{
+			sqVAL.str = sqDollar[1].str
+		}
+	case 23:
+		sqDollar = sqS[sqpt-1 : sqpt+1]
+//line query.y:195
+		{
+			sqVAL.str = sqDollar[1].str
+		}
+	case 24:
+		sqDollar = sqS[sqpt-1 : sqpt+1]
+//line query.y:203
+		{
+			sqVAL.inputs = sqDollar[1].inputs
+		}
+	case 25:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:207
+		{
+			for name, where := range sqDollar[3].inputs {
+				if _, found := sqDollar[1].inputs[name]; found {
+					sqlex.(*sqLex).Error(fmt.Sprintf("Input %v is defined twice", name))
+				}
+				sqDollar[1].inputs[name] = where
+			}
+			sqVAL.inputs = sqDollar[1].inputs
+		}
+	case 26:
+		sqDollar = sqS[sqpt-4 : sqpt+1]
+//line query.y:219
+		{
+			if sqDollar[3].str != "uuid" {
+				sqlex.(*sqLex).Error(fmt.Sprintf("Expected uuid or where for input %v, got %v", sqDollar[1].str, sqDollar[3].str))
+			}
+			sqVAL.inputs = map[string]common.Dict{sqDollar[1].str: common.Dict{"uuid": sqDollar[4].str}}
+		}
+	case 27:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:111
+//line query.y:226
+		{
+			sqVAL.inputs = map[string]common.Dict{sqDollar[1].str: sqDollar[3].dict}
+		}
+	case 28:
+		sqDollar = sqS[sqpt-0 : sqpt+1]
+//line query.y:232
+		{
+		}
+	case 29:
+		sqDollar = sqS[sqpt-2 : sqpt+1]
+//line query.y:235
+		{
+			sqlex.(*sqLex).query.groupBy = sqDollar[2].str
+		}
+	case 30:
+		sqDollar = sqS[sqpt-0 : sqpt+1]
+//line query.y:242
+		{
+		}
+	case 31:
+		sqDollar = sqS[sqpt-2 : sqpt+1]
+//line query.y:245
+		{
+			sqlex.(*sqLex).query.asOf = sqDollar[2].time
+		}
+	case 32:
+		sqDollar = sqS[sqpt-0 : sqpt+1]
+//line query.y:253
+		{
+		}
+	case 33:
+		sqDollar = sqS[sqpt-2 : sqpt+1]
+//line query.y:256
+		{
+			sqlex.(*sqLex).query.orderBy = &common.OrderBy{Tag: sqDollar[2].str}
+		}
+	case 34:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:260
+		{
+			sqlex.(*sqLex).query.orderBy = &common.OrderBy{Tag: sqDollar[2].str}
+		}
+	case 35:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:264
+		{
+			sqlex.(*sqLex).query.orderBy = &common.OrderBy{Tag: sqDollar[2].str, Descending: true}
+		}
+	case 36:
+		sqDollar = sqS[sqpt-0 : sqpt+1]
+//line query.y:270
+		{
+		}
+	case 37:
+		sqDollar = sqS[sqpt-1 : sqpt+1]
+//line query.y:273
+		{
+			sqlex.(*sqLex).query.dryRun = true
+		}
+	case 38:
+		sqDollar = sqS[sqpt-1 : sqpt+1]
+//line query.y:279
+		{
+			sqVAL.list = List{sqDollar[1].str}
+		}
+	case 39:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:283
 		{
 			sqVAL.list = append(List{sqDollar[1].str}, sqDollar[3].list...)
 		}
-	case 11:
+	case 40:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:117
+//line query.y:289
 		{
 			sqVAL.list = sqDollar[2].list
 		}
-	case 12:
+	case 41:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:122
+//line query.y:294
 		{
 			sqVAL.list = List{sqDollar[1].str}
 		}
-	case 13:
+	case 42:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:126
+//line query.y:298
 		{
 			sqVAL.list = append(List{sqDollar[1].str}, sqDollar[3].list...)
 		}
-	case 14:
+	case 43:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:132
+//line query.y:304
 		{
 			sqVAL.dict = common.Dict{sqDollar[1].str: sqDollar[3].str}
 		}
-	case 15:
+	case 44:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:136
+//line query.y:308
 		{
 			sqVAL.dict = common.Dict{sqDollar[1].str: sqDollar[3].str}
 		}
-	case 16:
+	case 45:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:140
+//line query.y:312
 		{
 			sqVAL.dict = common.Dict{sqDollar[1].str: sqDollar[3].list}
 		}
-	case 17:
+	case 46:
 		sqDollar = sqS[sqpt-5 : sqpt+1]
-		//line query.y:144
+//line query.y:316
 		{
 			sqDollar[5].dict[sqDollar[1].str] = sqDollar[3].str
 			sqVAL.dict = sqDollar[5].dict
 		}
-	case 18:
+	case 47:
 		sqDollar = sqS[sqpt-5 : sqpt+1]
-		//line query.y:149
+//line query.y:321
 		{
 			sqDollar[5].dict[sqDollar[1].str] = sqDollar[3].str
 			sqVAL.dict = sqDollar[5].dict
 		}
-	case 19:
+	case 48:
 		sqDollar = sqS[sqpt-5 : sqpt+1]
-		//line query.y:154
+//line query.y:326
 		{
 			sqDollar[5].dict[sqDollar[1].str] = sqDollar[3].list
 			sqVAL.dict = sqDollar[5].dict
 		}
-	case 20:
+	case 49:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:161
+//line query.y:333
 		{
 			sqlex.(*sqLex).query.Contents = sqDollar[1].list
 			sqVAL.list = sqDollar[1].list
 		}
-	case 21:
+	case 50:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:166
+//line query.y:338
 		{
 			sqVAL.list = List{}
 		}
-	case 22:
+	case 51:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:170
+//line query.y:342
 		{
 			sqlex.(*sqLex).query.distinct = true
 			sqVAL.list = List{sqDollar[2].str}
 		}
-	case 23:
+	case 52:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:175
+//line query.y:347
 		{
 			sqlex.(*sqLex).query.distinct = true
 			sqVAL.list = List{}
 		}
-	case 24:
-		sqDollar = sqS[sqpt-9 : sqpt+1]
-		//line query.y:182
+	case 53:
+		sqDollar = sqS[sqpt-10 : sqpt+1]
+//line query.y:354
 		{
-			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[4].time, End: sqDollar[6].time, Limit: sqDollar[8].limit, Timeconv: sqDollar[9].timeconv, IsStatistical: false, IsWindow: false}
+			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[4].time, End: sqDollar[6].time, Resample: sqDollar[8].resample, Limit: sqDollar[9].limit, Timeconv: sqDollar[10].timeconv, IsStatistical: false, IsWindow: false}
 		}
-	case 25:
-		sqDollar = sqS[sqpt-7 : sqpt+1]
-		//line query.y:186
+	case 54:
+		sqDollar = sqS[sqpt-8 : sqpt+1]
+//line query.y:358
 		{
-			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[3].time, End: sqDollar[5].time, Limit: sqDollar[6].limit, Timeconv: sqDollar[7].timeconv, IsStatistical: false, IsWindow: false}
+			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[3].time, End: sqDollar[5].time, Resample: sqDollar[6].resample, Limit: sqDollar[7].limit, Timeconv: sqDollar[8].timeconv, IsStatistical: false, IsWindow: false}
 		}
-	case 26:
+	case 55:
 		sqDollar = sqS[sqpt-13 : sqpt+1]
-		//line query.y:190
+//line query.y:362
 		{
 			num, err := strconv.ParseInt(sqDollar[3].str, 10, 64)
 			if err != nil {
@@ -909,9 +1291,9 @@ sqdefault:
 			}
 			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[8].time, End: sqDollar[10].time, Limit: sqDollar[12].limit, Timeconv: sqDollar[13].timeconv, IsStatistical: true, IsWindow: false, PointWidth: uint64(num)}
 		}
-	case 27:
+	case 56:
 		sqDollar = sqS[sqpt-13 : sqpt+1]
-		//line query.y:198
+//line query.y:370
 		{
 			num, err := strconv.ParseInt(sqDollar[3].str, 10, 64)
 			if err != nil {
@@ -919,9 +1301,9 @@ sqdefault:
 			}
 			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[8].time, End: sqDollar[10].time, Limit: sqDollar[12].limit, Timeconv: sqDollar[13].timeconv, IsStatistical: true, IsWindow: false, PointWidth: uint64(num)}
 		}
-	case 28:
+	case 57:
 		sqDollar = sqS[sqpt-14 : sqpt+1]
-		//line query.y:206
+//line query.y:378
 		{
 			dur, err := common.ParseReltime(sqDollar[3].str, sqDollar[4].str)
 			if err != nil {
@@ -929,57 +1311,95 @@ sqdefault:
 			}
 			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[9].time, End: sqDollar[11].time, Limit: sqDollar[13].limit, Timeconv: sqDollar[14].timeconv, IsStatistical: false, IsWindow: true, Width: uint64(dur.Nanoseconds())}
 		}
-	case 29:
+	case 58:
+		sqDollar = sqS[sqpt-4 : sqpt+1]
+//line query.y:386
+		{
+			sqDollar[3].data.Functions = append(sqDollar[3].data.Functions, common.DataFunction{Name: sqDollar[1].str})
+			sqVAL.data = sqDollar[3].data
+		}
+	case 59:
+		sqDollar = sqS[sqpt-6 : sqpt+1]
+//line query.y:391
+		{
+			sqDollar[5].data.Functions = append(sqDollar[5].data.Functions, common.DataFunction{Name: sqDollar[1].str, Args: sqDollar[3].list})
+			sqVAL.data = sqDollar[5].data
+		}
+	case 60:
+		sqDollar = sqS[sqpt-13 : sqpt+1]
+//line query.y:396
+		{
+			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[7].time, End: sqDollar[9].time, Resample: sqDollar[11].resample, Limit: sqDollar[12].limit, Timeconv: sqDollar[13].timeconv, IsStatistical: false, IsWindow: false, Functions: []common.DataFunction{{Name: sqDollar[1].str}}}
+		}
+	case 61:
+		sqDollar = sqS[sqpt-11 : sqpt+1]
+//line query.y:400
+		{
+			sqVAL.data = &DataQuery{Dtype: IN_TYPE, Start: sqDollar[6].time, End: sqDollar[8].time, Resample: sqDollar[9].resample, Limit: sqDollar[10].limit, Timeconv: sqDollar[11].timeconv, IsStatistical: false, IsWindow: false, Functions: []common.DataFunction{{Name: sqDollar[1].str}}}
+		}
+	case 62:
 		sqDollar = sqS[sqpt-5 : sqpt+1]
-		//line query.y:214
+//line query.y:404
 		{
 			sqVAL.data = &DataQuery{Dtype: BEFORE_TYPE, Start: sqDollar[3].time, Limit: sqDollar[4].limit, Timeconv: sqDollar[5].timeconv, IsStatistical: false, IsWindow: false}
 		}
-	case 30:
+	case 63:
 		sqDollar = sqS[sqpt-5 : sqpt+1]
-		//line query.y:218
+//line query.y:408
 		{
 			sqVAL.data = &DataQuery{Dtype: AFTER_TYPE, Start: sqDollar[3].time, Limit: sqDollar[4].limit, Timeconv: sqDollar[5].timeconv, IsStatistical: false, IsWindow: false}
 		}
-	case 31:
+	case 64:
+		sqDollar = sqS[sqpt-1 : sqpt+1]
+//line query.y:414
+		{
+			sqVAL.list = List{sqDollar[1].str}
+		}
+	case 65:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:418
+		{
+			sqVAL.list = append(sqDollar[1].list, sqDollar[3].str)
+		}
+	case 66:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:224
+//line query.y:424
 		{
 			sqVAL.time = sqDollar[1].time
 		}
-	case 32:
+	case 67:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:228
+//line query.y:428
 		{
-			sqVAL.time = sqDollar[1].time.Add(sqDollar[2].timediff)
+			sqVAL.time = sqDollar[2].timediff.AddTo(sqDollar[1].time)
 		}
-	case 33:
+	case 68:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:234
+//line query.y:434
 		{
 			foundtime, err := common.ParseAbsTime(sqDollar[1].str, sqDollar[2].str)
 			if err != nil {
 				sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse time \"%v %v\" (%v)", sqDollar[1].str, sqDollar[2].str, err.Error()))
 			}
-			sqVAL.time = foundtime
+			sqVAL.time = foundtime.In(sqlex.(*sqLex).timeLocation())
 		}
-	case 34:
+	case 69:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:242
+//line query.y:442
 		{
 			num, err := strconv.ParseInt(sqDollar[1].str, 10, 64)
 			if err != nil {
 				sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse integer \"%v\" (%v)", sqDollar[1].str, err.Error()))
 			}
-			sqVAL.time = _time.Unix(num, 0)
+			sqVAL.time = _time.Unix(num, 0).In(sqlex.(*sqLex).timeLocation())
 		}
-	case 35:
+	case 70:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:250
+//line query.y:450
 		{
 			found := false
 			for _, format := range supported_formats {
-				t, err := _time.Parse(format, sqDollar[1].str)
+				t, err := _time.ParseInLocation(format, sqDollar[1].str, sqlex.(*sqLex).timeLocation())
 				if err != nil {
 					continue
 				}
@@ -991,41 +1411,117 @@ sqdefault:
 				sqlex.(*sqLex).Error(fmt.Sprintf("No time format matching \"%v\" found", sqDollar[1].str))
 			}
 		}
-	case 36:
+	case 71:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:266
+//line query.y:466
 		{
-			sqVAL.time = _time.Now()
+			sqVAL.time = sqlex.(*sqLex).currentTime()
 		}
-	case 37:
+	case 72:
+		sqDollar = sqS[sqpt-1 : sqpt+1]
+//line query.y:470
+		{
+			sqVAL.time, _ = common.StartOf(sqlex.(*sqLex).currentTime(), "day")
+		}
+	case 73:
+		sqDollar = sqS[sqpt-2 : sqpt+1]
+//line query.y:474
+		{
+			start, err := common.StartOf(sqlex.(*sqLex).currentTime(), sqDollar[2].str)
+			if err != nil {
+				sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse time \"start of %v\" (%v)", sqDollar[2].str, err.Error()))
+			}
+			sqVAL.time = start
+		}
+	case 74:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:272
+//line query.y:482
+		{
+			last, err := common.LastWeekday(sqlex.(*sqLex).currentTime(), sqDollar[2].str)
+			if err != nil {
+				sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse time \"last %v\" (%v)", sqDollar[2].str, err.Error()))
+			}
+			sqVAL.time = last
+		}
+	case 75:
+		sqDollar = sqS[sqpt-2 : sqpt+1]
+//line query.y:492
 		{
 			var err error
-			sqVAL.timediff, err = common.ParseReltime(sqDollar[1].str, sqDollar[2].str)
+			sqVAL.timediff, err = common.ParseCalendarReltime(sqDollar[1].str, sqDollar[2].str)
 			if err != nil {
 				sqlex.(*sqLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", sqDollar[1].str, sqDollar[2].str, err.Error()))
 			}
 		}
-	case 38:
+	case 76:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:280
+//line query.y:500
 		{
-			newDuration, err := common.ParseReltime(sqDollar[1].str, sqDollar[2].str)
+			newReltime, err := common.ParseCalendarReltime(sqDollar[1].str, sqDollar[2].str)
 			if err != nil {
 				sqlex.(*sqLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", sqDollar[1].str, sqDollar[2].str, err.Error()))
 			}
-			sqVAL.timediff = common.AddDurations(newDuration, sqDollar[3].timediff)
+			sqVAL.timediff = newReltime.Add(sqDollar[3].timediff)
 		}
-	case 39:
+	case 77:
+		sqDollar = sqS[sqpt-0 : sqpt+1]
+//line query.y:510
+		{
+			sqVAL.resample = nil
+		}
+	case 78:
+		sqDollar = sqS[sqpt-8 : sqpt+1]
+//line query.y:514
+		{
+			dur, err := common.ParseReltime(sqDollar[3].str, sqDollar[4].str)
+			if err != nil {
+				sqlex.(*sqLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", sqDollar[3].str, sqDollar[4].str, err.Error()))
+			} else if dur <= 0 {
+				sqlex.(*sqLex).Error(fmt.Sprintf("Resample width \"%v %v\" has to be positive", sqDollar[3].str, sqDollar[4].str))
+			}
+			switch sqDollar[6].str {
+			case common.RESAMPLE_PREVIOUS, common.RESAMPLE_LINEAR, common.RESAMPLE_NONE:
+			default:
+				sqlex.(*sqLex).Error(fmt.Sprintf("Unknown resample method \"%v\" (use previous, linear or none)", sqDollar[6].str))
+			}
+			sqDollar[8].resample.Width = uint64(dur.Nanoseconds())
+			sqDollar[8].resample.Method = sqDollar[6].str
+			sqVAL.resample = sqDollar[8].resample
+		}
+	case 79:
+		sqDollar = sqS[sqpt-0 : sqpt+1]
+//line query.y:533
+		{
+			sqVAL.resample = &common.Resample{}
+		}
+	case 80:
+		sqDollar = sqS[sqpt-4 : sqpt+1]
+//line query.y:537
+		{
+			num, err := strconv.ParseFloat(sqDollar[3].str, 64)
+			if err != nil {
+				sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse number \"%v\" (%v)", sqDollar[3].str, err.Error()))
+			}
+			sqVAL.resample = &common.Resample{Fill: common.FILL_VALUE, FillValue: num}
+		}
+	case 81:
+		sqDollar = sqS[sqpt-4 : sqpt+1]
+//line query.y:545
+		{
+			if sqDollar[3].str != common.FILL_NULL && sqDollar[3].str != common.FILL_PREVIOUS {
+				sqlex.(*sqLex).Error(fmt.Sprintf("Unknown fill \"%v\" (use a number, null or previous)", sqDollar[3].str))
+			}
+			sqVAL.resample = &common.Resample{Fill: sqDollar[3].str}
+		}
+	case 82:
 		sqDollar = sqS[sqpt-0 : sqpt+1]
-		//line query.y:290
+//line query.y:554
 		{
 			sqVAL.limit = Limit{Limit: -1, Streamlimit: -1}
 		}
-	case 40:
+	case 83:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:294
+//line query.y:558
 		{
 			num, err := strconv.ParseInt(sqDollar[2].str, 10, 64)
 			if err != nil {
@@ -1033,9 +1529,9 @@ sqdefault:
 			}
 			sqVAL.limit = Limit{Limit: num, Streamlimit: -1}
 		}
-	case 41:
+	case 84:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:302
+//line query.y:566
 		{
 			num, err := strconv.ParseInt(sqDollar[2].str, 10, 64)
 			if err != nil {
@@ -1043,9 +1539,9 @@ sqdefault:
 			}
 			sqVAL.limit = Limit{Limit: -1, Streamlimit: num}
 		}
-	case 42:
+	case 85:
 		sqDollar = sqS[sqpt-4 : sqpt+1]
-		//line query.y:310
+//line query.y:574
 		{
 			limit_num, err := strconv.ParseInt(sqDollar[2].str, 10, 64)
 			if err != nil {
@@ -1057,15 +1553,55 @@ sqdefault:
 			}
 			sqVAL.limit = Limit{Limit: limit_num, Streamlimit: slimit_num}
 		}
-	case 43:
+	case 86:
+		sqDollar = sqS[sqpt-0 : sqpt+1]
+//line query.y:589
+		{
+			sqVAL.page = Page{}
+		}
+	case 87:
+		sqDollar = sqS[sqpt-2 : sqpt+1]
+//line query.y:593
+		{
+			num, err := strconv.ParseInt(sqDollar[2].str, 10, 64)
+			if err != nil || num < 0 {
+				sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse limit \"%v\"", sqDollar[2].str))
+			}
+			sqVAL.page = Page{Limit: num}
+		}
+	case 88:
+		sqDollar = sqS[sqpt-4 : sqpt+1]
+//line query.y:601
+		{
+			limit_num, err := strconv.ParseInt(sqDollar[2].str, 10, 64)
+			if err != nil || limit_num < 0 {
+				sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse limit \"%v\"", sqDollar[2].str))
+			}
+			offset_num, err := strconv.ParseInt(sqDollar[4].str, 10, 64)
+			if err != nil || offset_num < 0 {
+				sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse offset \"%v\"", sqDollar[4].str))
+			}
+			sqVAL.page = Page{Limit: limit_num, Offset: offset_num}
+		}
+	case 89:
+		sqDollar = sqS[sqpt-2 : sqpt+1]
+//line query.y:613
+		{
+			num, err := strconv.ParseInt(sqDollar[2].str, 10, 64)
+			if err != nil || num < 0 {
+				sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse offset \"%v\"", sqDollar[2].str))
+			}
+			sqVAL.page = Page{Offset: num}
+		}
+	case 90:
 		sqDollar = sqS[sqpt-0 : sqpt+1]
-		//line query.y:324
+//line query.y:623
 		{
 			sqVAL.timeconv = common.UOT_MS
 		}
-	case 44:
+	case 91:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:328
+//line query.y:627
 		{
 			uot, err := common.ParseUOT(sqDollar[2].str)
 			if err != nil {
@@ -1073,89 +1609,129 @@ sqdefault:
 			}
 			sqVAL.timeconv = uot
 		}
-	case 45:
+	case 92:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:340
+//line query.y:639
 		{
 			sqVAL.dict = sqDollar[2].dict
 		}
-	case 46:
+	case 93:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:347
+//line query.y:646
 		{
 			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[1].str): common.Dict{"$regex": sqDollar[3].str}}
 		}
-	case 47:
+	case 94:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:351
+//line query.y:650
 		{
 			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[1].str): sqDollar[3].str}
 		}
-	case 48:
+	case 95:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:355
+//line query.y:654
 		{
 			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[1].str): sqDollar[3].str}
 		}
-	case 49:
+	case 96:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:359
+//line query.y:658
 		{
 			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[1].str): common.Dict{"$neq": sqDollar[3].str}}
 		}
-	case 50:
+	case 97:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:662
+		{
+			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[1].str): common.Dict{"$lt": sqDollar[3].num}}
+		}
+	case 98:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:666
+		{
+			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[1].str): common.Dict{"$lte": sqDollar[3].num}}
+		}
+	case 99:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:670
+		{
+			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[1].str): common.Dict{"$gt": sqDollar[3].num}}
+		}
+	case 100:
+		sqDollar = sqS[sqpt-3 : sqpt+1]
+//line query.y:674
+		{
+			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[1].str): common.Dict{"$gte": sqDollar[3].num}}
+		}
+	case 101:
+		sqDollar = sqS[sqpt-5 : sqpt+1]
+//line query.y:678
+		{
+			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[1].str): common.Dict{"$gte": sqDollar[3].num, "$lte": sqDollar[5].num}}
+		}
+	case 102:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:363
+//line query.y:682
 		{
 			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[2].str): common.Dict{"$exists": true}}
 		}
-	case 51:
+	case 103:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:367
+//line query.y:686
 		{
 			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[3].str): common.Dict{"$in": sqDollar[1].list}}
 		}
-	case 52:
+	case 104:
 		sqDollar = sqS[sqpt-4 : sqpt+1]
-		//line query.y:371
+//line query.y:690
 		{
-			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[3].str): common.Dict{"$not": common.Dict{"$in": sqDollar[1].list}}}
+			sqVAL.dict = common.Dict{fixMongoKey(sqDollar[4].str): common.Dict{"$not": common.Dict{"$in": sqDollar[1].list}}}
 		}
-	case 53:
+	case 105:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:375
+//line query.y:694
 		{
 			sqVAL.dict = sqDollar[2].dict
 		}
-	case 54:
+	case 106:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:381
+//line query.y:700
+		{
+			num, err := strconv.ParseFloat(sqDollar[1].str, 64)
+			if err != nil {
+				sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse number \"%v\" (%v)", sqDollar[1].str, err.Error()))
+			}
+			sqVAL.num = num
+		}
+	case 107:
+		sqDollar = sqS[sqpt-1 : sqpt+1]
+//line query.y:710
 		{
 			sqVAL.str = sqDollar[1].str[1 : len(sqDollar[1].str)-1]
 		}
-	case 55:
+	case 108:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:387
+//line query.y:716
 		{
 
 			sqlex.(*sqLex)._keys[sqDollar[1].str] = struct{}{}
 			sqVAL.str = cleantagstring(sqDollar[1].str)
 		}
-	case 56:
+	case 109:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:395
+//line query.y:724
 		{
 			sqVAL.dict = common.Dict{"$and": []common.Dict{sqDollar[1].dict, sqDollar[3].dict}}
 		}
-	case 57:
+	case 110:
 		sqDollar = sqS[sqpt-3 : sqpt+1]
-		//line query.y:399
+//line query.y:728
 		{
 			sqVAL.dict = common.Dict{"$or": []common.Dict{sqDollar[1].dict, sqDollar[3].dict}}
 		}
-	case 58:
+	case 111:
 		sqDollar = sqS[sqpt-2 : sqpt+1]
-		//line query.y:403
+//line query.y:732
 		{
 			tmp := make(common.Dict)
 			for k, v := range sqDollar[2].dict {
@@ -1163,9 +1739,9 @@ sqdefault:
 			}
 			sqVAL.dict = tmp
 		}
-	case 59:
+	case 112:
 		sqDollar = sqS[sqpt-1 : sqpt+1]
-		//line query.y:411
+//line query.y:740
 		{
 			sqVAL.dict = sqDollar[1].dict
 		}
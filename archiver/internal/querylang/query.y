@@ -19,20 +19,28 @@ Notes here
 
 %union{
 	str string
+	num float64
 	dict common.Dict
 	data *DataQuery
 	limit Limit
+	page Page
+	resample *common.Resample
+	operators []common.DataFunction
+	operator common.DataFunction
+	inputs map[string]common.Dict
     timeconv common.UnitOfTime
 	list List
 	time _time.Time
-    timediff _time.Duration
+    timediff common.RelTime
 }
 
-%token <str> SELECT DISTINCT DELETE SET APPLY STATISTICAL WINDOW STATISTICS
+%token <str> SELECT DISTINCT DELETE SET APPLY EXPLAIN STATISTICAL WINDOW STATISTICS
+%token <str> DRYRUN GROUPBY ORDERBY ASC DESC RESAMPLE FILL ASEXPR ASOF WITH
 %token <str> WHERE
-%token <str> DATA BEFORE AFTER LIMIT STREAMLIMIT NOW
+%token <str> DATA BEFORE AFTER LIMIT OFFSET STREAMLIMIT NOW TODAY STARTOF LAST
 %token <str> LVALUE QSTRING
-%token <str> EQ NEQ COMMA ALL LEFTPIPE
+%token <str> EQ NEQ COMMA ALL
+%token <str> LT LTE GT GTE BETWEEN
 %token <str> LIKE AS
 %token <str> AND OR HAS NOT IN TO
 %token <str> LPAREN RPAREN LBRACK RBRACK
@@ -42,60 +50,87 @@ Notes here
 %token TIMEUNIT
 
 %type <dict> whereList whereTerm whereClause setList
-%type <list> selector tagList valueList valueListBrack
+%type <list> selector tagList valueList valueListBrack argList operatorArgs
+%type <operators> operatorChain
+%type <operator> operator
+%type <inputs> inputList input
+%type <str> operatorArg
 %type <data> dataClause
 %type <time> timeref abstime
 %type <timediff> reltime
 %type <limit> limit
+%type <page> page
+%type <resample> resample fill
 %type <timeconv> timeconv
 %type <str> NUMBER qstring lvalue TIMEUNIT
+%type <num> number
 %type <str> SEMICOLON NEWLINE
 
 %right EQ
 
 %%
 
-query		: SELECT selector whereClause SEMICOLON
+query		: EXPLAIN query
+			{
+				sqlex.(*sqLex).query.explain = true
+			}
+			| SELECT selector whereClause asOf orderBy page SEMICOLON
 			{
 				sqlex.(*sqLex).query.Contents = $2
 				sqlex.(*sqLex).query.where = $3
+				sqlex.(*sqLex).query.page = $6
 				sqlex.(*sqLex).query.qtype = SELECT_TYPE
 			}
-			| SELECT selector SEMICOLON
+			| SELECT selector asOf orderBy page SEMICOLON
 			{
 				sqlex.(*sqLex).query.Contents = $2
+				sqlex.(*sqLex).query.page = $5
 				sqlex.(*sqLex).query.qtype = SELECT_TYPE
 			}
-			| SELECT dataClause whereClause SEMICOLON
+			| APPLY operatorChain TO dataClause whereClause asOf orderBy SEMICOLON
+			{
+				sqlex.(*sqLex).query.where = $5
+				sqlex.(*sqLex).query.data = $4
+				sqlex.(*sqLex).query.operators = $2
+				sqlex.(*sqLex).query.qtype = APPLY_TYPE
+			}
+			| SELECT dataClause ASEXPR LPAREN qstring RPAREN WITH inputList SEMICOLON
+			{
+				sqlex.(*sqLex).query.data = $2
+				sqlex.(*sqLex).query.expression = $5
+				sqlex.(*sqLex).query.inputs = $8
+				sqlex.(*sqLex).query.qtype = DATA_TYPE
+			}
+			| SELECT dataClause whereClause asOf groupBy orderBy SEMICOLON
 			{
 				sqlex.(*sqLex).query.where = $3
 				sqlex.(*sqLex).query.data = $2
 				sqlex.(*sqLex).query.qtype = DATA_TYPE
 			}
-            | SET setList whereClause SEMICOLON
+            | SET setList whereClause dryRun SEMICOLON
             {
 				sqlex.(*sqLex).query.where = $3
 				sqlex.(*sqLex).query.set = $2
                 sqlex.(*sqLex).query.qtype = SET_TYPE
             }
-            | SET setList SEMICOLON
+            | SET setList dryRun SEMICOLON
             {
 				sqlex.(*sqLex).query.set = $2
                 sqlex.(*sqLex).query.qtype = SET_TYPE
             }
-			| DELETE tagList whereClause SEMICOLON
+			| DELETE tagList whereClause dryRun SEMICOLON
 			{
 				sqlex.(*sqLex).query.Contents = $2
 				sqlex.(*sqLex).query.where = $3
 				sqlex.(*sqLex).query.qtype = DELETE_TYPE
 			}
-            | DELETE dataClause whereClause SEMICOLON
+            | DELETE dataClause whereClause dryRun SEMICOLON
             {
 				sqlex.(*sqLex).query.data = $2
 				sqlex.(*sqLex).query.where = $3
 				sqlex.(*sqLex).query.qtype = DELETE_TYPE
             }
-			| DELETE whereClause SEMICOLON
+			| DELETE whereClause dryRun SEMICOLON
 			{
 				sqlex.(*sqLex).query.Contents = []string{}
 				sqlex.(*sqLex).query.where = $2
@@ -103,6 +138,143 @@ query		: SELECT selector whereClause SEMICOLON
 			}
 			;
 
+/* like sMAP, "a < b" applies a to the output of b, so the operators are
+   stored innermost first */
+operatorChain : operator
+			{
+				$$ = []common.DataFunction{$1}
+			}
+			| operator LT operatorChain
+			{
+				$$ = append($3, $1)
+			}
+			;
+
+operator	: LVALUE
+			{
+				$$ = common.DataFunction{Name: $1}
+			}
+			| LVALUE LPAREN operatorArgs RPAREN
+			{
+				$$ = common.DataFunction{Name: $1, Args: $3}
+			}
+			| WINDOW LPAREN operatorArgs RPAREN
+			{
+				$$ = common.DataFunction{Name: $1, Args: $3}
+			}
+			| OFFSET LPAREN operatorArgs RPAREN
+			{
+				$$ = common.DataFunction{Name: $1, Args: $3}
+			}
+			;
+
+operatorArgs : operatorArg
+			{
+				$$ = List{$1}
+			}
+			| operatorArgs COMMA operatorArg
+			{
+				$$ = append($1, $3)
+			}
+			;
+
+/* durations such as 15min are kept as one argument */
+operatorArg	: NUMBER
+			{
+				$$ = $1
+			}
+			| NUMBER LVALUE
+			{
+				$$ = $1 + $2
+			}
+			| LVALUE
+			{
+				$$ = $1
+			}
+			| qstring
+			{
+				$$ = $1
+			}
+			;
+
+/* the streams an expression is evaluated over, e.g.
+   a = uuid '...', b = where Metadata/Type = 'Load' */
+inputList	: input
+			{
+				$$ = $1
+			}
+			| inputList COMMA input
+			{
+				for name, where := range $3 {
+					if _, found := $1[name]; found {
+						sqlex.(*sqLex).Error(fmt.Sprintf("Input %v is defined twice", name))
+					}
+					$1[name] = where
+				}
+				$$ = $1
+			}
+			;
+
+input		: LVALUE EQ LVALUE qstring
+			{
+				if $3 != "uuid" {
+					sqlex.(*sqLex).Error(fmt.Sprintf("Expected uuid or where for input %v, got %v", $1, $3))
+				}
+				$$ = map[string]common.Dict{$1: common.Dict{"uuid": $4}}
+			}
+			| LVALUE EQ whereClause
+			{
+				$$ = map[string]common.Dict{$1: $3}
+			}
+			;
+
+groupBy		: /* empty */
+			{
+			}
+			| GROUPBY lvalue
+			{
+				sqlex.(*sqLex).query.groupBy = $2
+			}
+			;
+
+/* evaluates the query over the metadata as it was at the given time */
+asOf		: /* empty */
+			{
+			}
+			| ASOF timeref
+			{
+				sqlex.(*sqLex).query.asOf = $2
+			}
+			;
+
+/* the order of the documents of a metadata query, or of the streams of a
+   data query */
+orderBy		: /* empty */
+			{
+			}
+			| ORDERBY lvalue
+			{
+				sqlex.(*sqLex).query.orderBy = &common.OrderBy{Tag: $2}
+			}
+			| ORDERBY lvalue ASC
+			{
+				sqlex.(*sqLex).query.orderBy = &common.OrderBy{Tag: $2}
+			}
+			| ORDERBY lvalue DESC
+			{
+				sqlex.(*sqLex).query.orderBy = &common.OrderBy{Tag: $2, Descending: true}
+			}
+			;
+
+dryRun		: /* empty */
+			{
+			}
+			| DRYRUN
+			{
+				sqlex.(*sqLex).query.dryRun = true
+			}
+			;
+
 tagList		: lvalue
 			{
 				$$ = List{$1}
@@ -178,13 +350,13 @@ selector	: tagList
 			}
 			;
 
-dataClause : DATA IN LPAREN timeref COMMA timeref RPAREN limit timeconv
+dataClause : DATA IN LPAREN timeref COMMA timeref RPAREN resample limit timeconv
 			{
-				$$ = &DataQuery{Dtype: IN_TYPE, Start: $4, End: $6, Limit: $8, Timeconv: $9, IsStatistical: false, IsWindow: false}
+				$$ = &DataQuery{Dtype: IN_TYPE, Start: $4, End: $6, Resample: $8, Limit: $9, Timeconv: $10, IsStatistical: false, IsWindow: false}
 			}
-		   | DATA IN timeref COMMA timeref limit timeconv
+		   | DATA IN timeref COMMA timeref resample limit timeconv
 			{
-				$$ = &DataQuery{Dtype: IN_TYPE, Start: $3, End: $5, Limit: $6, Timeconv: $7, IsStatistical: false, IsWindow: false}
+				$$ = &DataQuery{Dtype: IN_TYPE, Start: $3, End: $5, Resample: $6, Limit: $7, Timeconv: $8, IsStatistical: false, IsWindow: false}
 			}
 		   | STATISTICAL LPAREN NUMBER RPAREN DATA IN LPAREN timeref COMMA timeref RPAREN limit timeconv
 			{
@@ -210,6 +382,24 @@ dataClause : DATA IN LPAREN timeref COMMA timeref RPAREN limit timeconv
                 }
 				$$ = &DataQuery{Dtype: IN_TYPE, Start: $9, End: $11, Limit: $13, Timeconv: $14, IsStatistical: false, IsWindow: true, Width: uint64(dur.Nanoseconds())}
 			}
+		   | LVALUE LPAREN dataClause RPAREN
+			{
+				$3.Functions = append($3.Functions, common.DataFunction{Name: $1})
+				$$ = $3
+			}
+		   | LVALUE LPAREN argList COMMA dataClause RPAREN
+			{
+				$5.Functions = append($5.Functions, common.DataFunction{Name: $1, Args: $3})
+				$$ = $5
+			}
+		   | LVALUE LPAREN DATA RPAREN IN LPAREN timeref COMMA timeref RPAREN resample limit timeconv
+			{
+				$$ = &DataQuery{Dtype: IN_TYPE, Start: $7, End: $9, Resample: $11, Limit: $12, Timeconv: $13, IsStatistical: false, IsWindow: false, Functions: []common.DataFunction{{Name: $1}}}
+			}
+		   | LVALUE LPAREN DATA RPAREN IN timeref COMMA timeref resample limit timeconv
+			{
+				$$ = &DataQuery{Dtype: IN_TYPE, Start: $6, End: $8, Resample: $9, Limit: $10, Timeconv: $11, IsStatistical: false, IsWindow: false, Functions: []common.DataFunction{{Name: $1}}}
+			}
 		   | DATA BEFORE timeref limit timeconv
 			{
 				$$ = &DataQuery{Dtype: BEFORE_TYPE, Start: $3, Limit: $4, Timeconv: $5, IsStatistical: false, IsWindow: false}
@@ -220,13 +410,23 @@ dataClause : DATA IN LPAREN timeref COMMA timeref RPAREN limit timeconv
 			}
 		   ;
 
+argList		: NUMBER
+			{
+				$$ = List{$1}
+			}
+			| argList COMMA NUMBER
+			{
+				$$ = append($1, $3)
+			}
+			;
+
 timeref		: abstime
 			{
 				$$ = $1
 			}
 			| abstime reltime
 			{
-                $$ = $1.Add($2)
+                $$ = $2.AddTo($1)
 			}
 			;
 
@@ -236,7 +436,7 @@ abstime		: NUMBER LVALUE
                 if err != nil {
 				    sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse time \"%v %v\" (%v)", $1, $2, err.Error()))
                 }
-                $$ = foundtime
+                $$ = foundtime.In(sqlex.(*sqLex).timeLocation())
             }
             | NUMBER
             {
@@ -244,13 +444,13 @@ abstime		: NUMBER LVALUE
                 if err != nil {
 				    sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse integer \"%v\" (%v)", $1, err.Error()))
                 }
-                $$ = _time.Unix(num, 0)
+                $$ = _time.Unix(num, 0).In(sqlex.(*sqLex).timeLocation())
             }
 			| qstring
             {
                 found := false
                 for _, format := range supported_formats {
-                    t, err := _time.Parse(format, $1)
+                    t, err := _time.ParseInLocation(format, $1, sqlex.(*sqLex).timeLocation())
                     if err != nil {
                         continue
                     }
@@ -264,28 +464,92 @@ abstime		: NUMBER LVALUE
             }
 			| NOW
             {
-                $$ = _time.Now()
+                $$ = sqlex.(*sqLex).currentTime()
+            }
+			| TODAY
+            {
+                $$, _ = common.StartOf(sqlex.(*sqLex).currentTime(), "day")
+            }
+			| STARTOF LVALUE
+            {
+                start, err := common.StartOf(sqlex.(*sqLex).currentTime(), $2)
+                if err != nil {
+				    sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse time \"start of %v\" (%v)", $2, err.Error()))
+                }
+                $$ = start
+            }
+			| LAST LVALUE
+            {
+                last, err := common.LastWeekday(sqlex.(*sqLex).currentTime(), $2)
+                if err != nil {
+				    sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse time \"last %v\" (%v)", $2, err.Error()))
+                }
+                $$ = last
             }
 			;
 
 reltime		: NUMBER lvalue
             {
                 var err error
-                $$, err = common.ParseReltime($1, $2)
+                $$, err = common.ParseCalendarReltime($1, $2)
                 if err != nil {
 				    sqlex.(*sqLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", $1, $2, err.Error()))
                 }
             }
 			| NUMBER lvalue reltime
             {
-                newDuration, err := common.ParseReltime($1, $2)
+                newReltime, err := common.ParseCalendarReltime($1, $2)
                 if err != nil {
 				    sqlex.(*sqLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", $1, $2, err.Error()))
                 }
-                $$ = common.AddDurations(newDuration, $3)
+                $$ = newReltime.Add($3)
             }
 			;
 
+resample	: /* empty */
+			{
+				$$ = nil
+			}
+			| RESAMPLE LPAREN NUMBER LVALUE COMMA LVALUE RPAREN fill
+			{
+                dur, err := common.ParseReltime($3, $4)
+                if err != nil {
+				    sqlex.(*sqLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", $3, $4, err.Error()))
+                } else if dur <= 0 {
+				    sqlex.(*sqLex).Error(fmt.Sprintf("Resample width \"%v %v\" has to be positive", $3, $4))
+                }
+                switch $6 {
+                case common.RESAMPLE_PREVIOUS, common.RESAMPLE_LINEAR, common.RESAMPLE_NONE:
+                default:
+				    sqlex.(*sqLex).Error(fmt.Sprintf("Unknown resample method \"%v\" (use previous, linear or none)", $6))
+                }
+                $8.Width = uint64(dur.Nanoseconds())
+                $8.Method = $6
+				$$ = $8
+			}
+			;
+
+fill		: /* empty */
+			{
+				$$ = &common.Resample{}
+			}
+			| FILL LPAREN NUMBER RPAREN
+			{
+                num, err := strconv.ParseFloat($3, 64)
+                if err != nil {
+				    sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse number \"%v\" (%v)", $3, err.Error()))
+                }
+				$$ = &common.Resample{Fill: common.FILL_VALUE, FillValue: num}
+			}
+			| FILL LPAREN LVALUE RPAREN
+			{
+                if $3 != common.FILL_NULL && $3 != common.FILL_PREVIOUS {
+				    sqlex.(*sqLex).Error(fmt.Sprintf("Unknown fill \"%v\" (use a number, null or previous)", $3))
+                }
+				$$ = &common.Resample{Fill: $3}
+			}
+			;
+
 limit		: /* empty */
 			{
 				$$ = Limit{Limit: -1, Streamlimit: -1}
@@ -320,6 +584,41 @@ limit		: /* empty */
 			}
 			;
 
+/* the documents a metadata query returns */
+page		: /* empty */
+			{
+				$$ = Page{}
+			}
+			| LIMIT NUMBER
+			{
+				num, err := strconv.ParseInt($2, 10, 64)
+                if err != nil || num < 0 {
+				    sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse limit \"%v\"", $2))
+                }
+				$$ = Page{Limit: num}
+			}
+			| LIMIT NUMBER OFFSET NUMBER
+			{
+				limit_num, err := strconv.ParseInt($2, 10, 64)
+                if err != nil || limit_num < 0 {
+				    sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse limit \"%v\"", $2))
+                }
+				offset_num, err := strconv.ParseInt($4, 10, 64)
+                if err != nil || offset_num < 0 {
+				    sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse offset \"%v\"", $4))
+                }
+				$$ = Page{Limit: limit_num, Offset: offset_num}
+			}
+			| OFFSET NUMBER
+			{
+				num, err := strconv.ParseInt($2, 10, 64)
+                if err != nil || num < 0 {
+				    sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse offset \"%v\"", $2))
+                }
+				$$ = Page{Offset: num}
+			}
+			;
+
 timeconv    : /* empty */
             {
                 $$ = common.UOT_MS
@@ -359,6 +658,26 @@ whereTerm : lvalue LIKE qstring
 			{
 				$$ = common.Dict{fixMongoKey($1): common.Dict{"$neq": $3}}
 			}
+          | lvalue LT number
+            {
+				$$ = common.Dict{fixMongoKey($1): common.Dict{"$lt": $3}}
+            }
+          | lvalue LTE number
+            {
+				$$ = common.Dict{fixMongoKey($1): common.Dict{"$lte": $3}}
+            }
+          | lvalue GT number
+            {
+				$$ = common.Dict{fixMongoKey($1): common.Dict{"$gt": $3}}
+            }
+          | lvalue GTE number
+            {
+				$$ = common.Dict{fixMongoKey($1): common.Dict{"$gte": $3}}
+            }
+          | lvalue BETWEEN number AND number
+            {
+				$$ = common.Dict{fixMongoKey($1): common.Dict{"$gte": $3, "$lte": $5}}
+            }
 		  | HAS lvalue
 			{
 				$$ = common.Dict{fixMongoKey($2): common.Dict{"$exists": true}}
@@ -369,7 +688,7 @@ whereTerm : lvalue LIKE qstring
             }
           | valueListBrack NOT IN lvalue
             {
-                $$ = common.Dict{fixMongoKey($3): common.Dict{"$not": common.Dict{"$in": $1}}}
+                $$ = common.Dict{fixMongoKey($4): common.Dict{"$not": common.Dict{"$in": $1}}}
             }
           | LPAREN whereTerm RPAREN
             {
@@ -377,6 +696,16 @@ whereTerm : lvalue LIKE qstring
             }
 		  ;
 
+number    : NUMBER
+          {
+            num, err := strconv.ParseFloat($1, 64)
+            if err != nil {
+                sqlex.(*sqLex).Error(fmt.Sprintf("Could not parse number \"%v\" (%v)", $1, err.Error()))
+            }
+            $$ = num
+          }
+          ;
+
 qstring   : QSTRING
           {
             $$ = $1[1:len($1)-1]
@@ -421,7 +750,8 @@ var supported_formats = []string{"1/2/2006",
                                  "1-2-2006 03:04:05 PM MST",
                                  "1/2/2006 15:04:05 MST",
                                  "1-2-2006 15:04:05 MST",
-                                 "2006-1-2 15:04:05 MST"}
+                                 "2006-1-2 15:04:05 MST",
+                                 "2006-1-2"}
 type List []string
 
 func (qt QueryType) String() string {
@@ -435,6 +765,8 @@ func (qt QueryType) String() string {
 		ret = "set"
 	case DATA_TYPE:
 		ret = "data"
+	case APPLY_TYPE:
+		ret = "apply"
 	}
 	return ret
 }
@@ -450,6 +782,23 @@ type query struct {
 	where	  common.Dict
 	// are we querying distinct values?
 	distinct  bool
+	// only report what a SET or DELETE would change
+	dryRun    bool
+	// report how the query is evaluated
+	explain   bool
+	// tag whose values group the streams of a data query
+	groupBy   string
+	// order of the documents or streams
+	orderBy   *common.OrderBy
+	// time of the metadata the query is evaluated over, if not zero
+	asOf      _time.Time
+	// arithmetic expression of a data query over its inputs
+	expression string
+	inputs     map[string]common.Dict
+	// operators of an APPLY query, innermost first
+	operators []common.DataFunction
+	// the documents a metadata query returns
+	page      Page
 	// list of tags to target for deletion, selection
 	Contents  []string
 }
@@ -478,6 +827,16 @@ type sqLex struct {
     // all keys that we encounter. Used for republish concerns
     _keys    map[string]struct{}
     keys    []string
+    // values bound to the $1, $2, ... parameters of a prepared query
+    params  []boundParam
+    // the n of the last token if it is the parameter $n, else 0, and of the
+    // token the first error was found at
+    param    int
+    errParam int
+    // whether the query refers to the current time
+    now     bool
+    // time zone of the times in the query, or nil for local time
+    location *_time.Location
 }
 
 func NewSQLex(s string) *sqLex {
@@ -487,29 +846,48 @@ func NewSQLex(s string) *sqLex {
 			{Token: SELECT, Pattern: "select"},
             {Token: APPLY, Pattern: "apply"},
 			{Token: DELETE, Pattern: "delete"},
+			{Token: DESC, Pattern: "desc\\b"},
 			{Token: DISTINCT, Pattern: "distinct"},
+			{Token: DRYRUN, Pattern: "dry\\s+run"},
+			{Token: EXPLAIN, Pattern: "explain\\b"},
+			{Token: GROUPBY, Pattern: "group\\s+by"},
+			{Token: ORDERBY, Pattern: "order\\s+by"},
 			{Token: STATISTICAL, Pattern: "statistical"},
 			{Token: STATISTICS, Pattern: "statistics"},
 			{Token: WINDOW, Pattern: "window"},
 			{Token: LIMIT, Pattern: "limit"},
+			{Token: OFFSET, Pattern: "offset\\b"},
 			{Token: STREAMLIMIT, Pattern: "streamlimit"},
+			{Token: STARTOF, Pattern: "start\\s+of\\b"},
 			{Token: ALL, Pattern: "\\*"},
 			{Token: NOW, Pattern: "now"},
+			{Token: TODAY, Pattern: "today\\b"},
+			{Token: LAST, Pattern: "last\\b"},
 			{Token: SET, Pattern: "set"},
 			{Token: BEFORE, Pattern: "before"},
+			{Token: BETWEEN, Pattern: "between\\b"},
+			{Token: RESAMPLE, Pattern: "resample\\b"},
+			{Token: FILL, Pattern: "fill\\b"},
 			{Token: AFTER, Pattern: "after"},
 			{Token: COMMA, Pattern: ","},
 			{Token: AND, Pattern: "and"},
+			{Token: ASEXPR, Pattern: "as\\s+expr"},
+			{Token: ASOF, Pattern: "as\\s+of\\b"},
+			{Token: ASC, Pattern: "asc\\b"},
 			{Token: AS, Pattern: "as"},
 			{Token: TO, Pattern: "to"},
 			{Token: DATA, Pattern: "data"},
+			{Token: WITH, Pattern: "with\\b"},
 			{Token: OR, Pattern: "or"},
-			{Token: IN, Pattern: "in"},
+			{Token: IN, Pattern: "in\\b"},
 			{Token: HAS, Pattern: "has"},
 			{Token: NOT, Pattern: "not"},
 			{Token: NEQ, Pattern: "!="},
 			{Token: EQ, Pattern: "="},
-			{Token: LEFTPIPE, Pattern: "<"},
+			{Token: LTE, Pattern: "<="},
+			{Token: LT, Pattern: "<"},
+			{Token: GTE, Pattern: ">="},
+			{Token: GT, Pattern: ">"},
 			{Token: LPAREN, Pattern: "\\("},
 			{Token: RPAREN, Pattern: "\\)"},
 			{Token: LBRACK, Pattern: "\\["},
@@ -534,13 +912,39 @@ func (sq *sqLex) Lex(lval *sqSymType) int {
 	}
 	lval.str = string(r.Value)
     sq.tokens = append(sq.tokens, lval.str)
+    sq.param = 0
+    // bound values are substituted as a whole token, so they are never
+    // scanned and cannot change the structure of the query
+    if index, isParam := paramIndex(lval.str); isParam && r.Token == LVALUE && sq.params != nil && index <= len(sq.params) {
+        sq.param = index
+        lval.str = sq.params[index-1].str
+        return sq.params[index-1].token
+    }
 	return int(r.Token)
 }
 
 func (sq *sqLex) Error(s string) {
+    if sq.error == nil {
+        sq.errParam = sq.param
+    }
     sq.error = fmt.Errorf(s)
 }
 
+// the current time in the time zone of the query. Queries that refer to it
+// are not cached
+func (sq *sqLex) currentTime() _time.Time {
+    sq.now = true
+    return _time.Now().In(sq.timeLocation())
+}
+
+// the time zone of the times in the query
+func (sq *sqLex) timeLocation() *_time.Location {
+    if sq.location == nil {
+        return _time.Local
+    }
+    return sq.location
+}
+
 func readline(fi *bufio.Reader) (string, bool) {
 	fmt.Printf("smap> ")
 	s, err := fi.ReadString('\n')
@@ -16,6 +16,10 @@ type DataQuery struct {
 	IsWindow      bool
 	Width         uint64
 	PointWidth    uint64
+	// functions wrapped around the data clause, innermost first
+	Functions []common.DataFunction
+	// if not nil, readings are resampled onto a regular grid
+	Resample *common.Resample
 }
 
 type Limit struct {
@@ -23,6 +27,12 @@ type Limit struct {
 	Streamlimit int64
 }
 
+// the documents a metadata query returns. A Limit of 0 returns all of them
+type Page struct {
+	Limit  int64
+	Offset int64
+}
+
 type DataQueryType uint
 
 const (
@@ -0,0 +1,858 @@
+package archiver
+
+// in-memory provider for metadata store
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jf87/giles2/common"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// memoryStore keeps every metadata document in memory, shaped the same way
+// Mongo would store it (nested documents under Metadata, Properties and
+// Actuator), and evaluates the where clauses produced by the query language
+// itself. If a snapshot file is configured, the documents are loaded from it
+// on startup and periodically written back.
+type memoryStore struct {
+	// metadata documents in insertion order
+	docs []bson.M
+	// uuid -> position in docs
+	index map[common.UUID]int
+	// user documents, as found in the "users" collection in Mongo
+	users []bson.M
+	// kind -> named definitions, sorted by name
+	definitions map[string][]bson.M
+	// versions of the documents in the order they were saved
+	history []metadataVersion
+	// uuid -> position of the last version in history
+	lastVersion map[common.UUID]int
+
+	snapshot string
+	dirty    bool
+	// closed to stop writing snapshots periodically
+	stop chan struct{}
+	sync.RWMutex
+}
+
+type memoryConfig struct {
+	// path to the snapshot file. If empty, nothing is persisted
+	snapshot string
+	// how often the snapshot is written if there were changes
+	interval time.Duration
+}
+
+// the on-disk layout of the snapshot file
+type memorySnapshot struct {
+	Metadata    []bson.M
+	Users       []bson.M
+	Definitions map[string][]bson.M
+	History     []metadataVersion
+}
+
+func newMemoryStore(c *memoryConfig) *memoryStore {
+	m := &memoryStore{
+		index:       make(map[common.UUID]int),
+		definitions: make(map[string][]bson.M),
+		lastVersion: make(map[common.UUID]int),
+		snapshot:    c.snapshot,
+		stop:        make(chan struct{}),
+	}
+	if m.snapshot == "" {
+		log.Notice("Using in-memory metadata store without snapshots")
+		return m
+	}
+	log.Noticef("Using in-memory metadata store with snapshot %v", m.snapshot)
+	if err := m.load(); err != nil {
+		log.Fatalf("Could not load metadata snapshot (%v)", err)
+	}
+	if c.interval > 0 {
+		go func() {
+			ticker := time.NewTicker(c.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := m.save(); err != nil {
+						log.Errorf("Could not save metadata snapshot (%v)", err)
+					}
+				case <-m.stop:
+					return
+				}
+			}
+		}()
+	}
+	return m
+}
+
+// stops the periodic snapshots and writes any changes made since the last
+// one, so that nothing is lost on shutdown
+func (m *memoryStore) Close() error {
+	m.Lock()
+	select {
+	case <-m.stop:
+		m.Unlock()
+		return nil
+	default:
+		close(m.stop)
+	}
+	m.Unlock()
+	if m.snapshot == "" {
+		return nil
+	}
+	return m.save()
+}
+
+// loads the documents from the snapshot file, if it exists
+func (m *memoryStore) load() error {
+	bytes, err := ioutil.ReadFile(m.snapshot)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var snapshot memorySnapshot
+	if err = bson.Unmarshal(bytes, &snapshot); err != nil {
+		return errors.Wrapf(err, "Could not decode %v", m.snapshot)
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.users = snapshot.Users
+	if snapshot.Definitions != nil {
+		m.definitions = snapshot.Definitions
+	}
+	m.history = snapshot.History
+	m.lastVersion = make(map[common.UUID]int)
+	for i, version := range m.history {
+		m.lastVersion[version.UUID] = i
+	}
+	m.docs = m.docs[:0]
+	m.index = make(map[common.UUID]int)
+	for _, doc := range snapshot.Metadata {
+		if uuid, ok := doc["uuid"].(string); ok {
+			m.index[common.UUID(uuid)] = len(m.docs)
+			m.docs = append(m.docs, doc)
+		}
+	}
+	// snapshots from before the history was kept
+	if len(m.history) == 0 && len(m.docs) > 0 {
+		for uuid, idx := range m.index {
+			m.lastVersion[uuid] = len(m.history)
+			m.history = append(m.history, metadataVersion{UUID: uuid, Time: seededVersionTime, Document: copyDoc(m.docs[idx])})
+		}
+		m.dirty = true
+		log.Noticef("Recorded the first version of %d metadata documents", len(m.docs))
+	}
+	log.Noticef("Loaded %d metadata documents from %v", len(m.docs), m.snapshot)
+	return nil
+}
+
+// writes the documents to the snapshot file if anything changed since the last save
+func (m *memoryStore) save() error {
+	m.Lock()
+	if !m.dirty {
+		m.Unlock()
+		return nil
+	}
+	bytes, err := bson.Marshal(memorySnapshot{Metadata: m.docs, Users: m.users, Definitions: m.definitions, History: m.history})
+	m.dirty = false
+	m.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := m.snapshot + ".tmp"
+	if err = ioutil.WriteFile(tmp, bytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.snapshot)
+}
+
+// returns the document for the uuid. Caller must hold the lock
+func (m *memoryStore) getDoc(uuid common.UUID) (bson.M, error) {
+	if idx, found := m.index[uuid]; found {
+		return m.docs[idx], nil
+	}
+	return nil, fmt.Errorf("no stream named %v", uuid)
+}
+
+// calls f for each document matching the where clause. Caller must hold the lock
+func (m *memoryStore) forEachMatch(where bson.M, f func(doc bson.M)) {
+	for _, doc := range m.docs {
+		if matchesWhere(doc, where) {
+			f(doc)
+		}
+	}
+}
+
+func (m *memoryStore) GetUnitOfTime(ctx context.Context, uuid common.UUID) (common.UnitOfTime, error) {
+	if err := ctx.Err(); err != nil {
+		return common.UOT_S, err
+	}
+	m.RLock()
+	defer m.RUnlock()
+	doc, err := m.getDoc(uuid)
+	if err != nil {
+		return common.UOT_S, err
+	}
+	if val, found := lookupPath(doc, "Properties.UnitofTime"); found {
+		if num, ok := common.NumericValue(val); ok && num != 0 {
+			return common.UnitOfTime(num), nil
+		}
+	}
+	return common.UOT_S, nil
+}
+
+func (m *memoryStore) GetStreamType(ctx context.Context, uuid common.UUID) (common.StreamType, error) {
+	if err := ctx.Err(); err != nil {
+		return common.NUMERIC_STREAM, err
+	}
+	m.RLock()
+	defer m.RUnlock()
+	doc, err := m.getDoc(uuid)
+	if err != nil {
+		return common.NUMERIC_STREAM, err
+	}
+	if val, found := lookupPath(doc, "Properties.StreamType"); found {
+		if num, ok := common.NumericValue(val); ok && num != 0 {
+			return common.StreamType(num), nil
+		}
+	}
+	return common.NUMERIC_STREAM, nil
+}
+
+func (m *memoryStore) GetUnitOfMeasure(ctx context.Context, uuid common.UUID) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	m.RLock()
+	defer m.RUnlock()
+	doc, err := m.getDoc(uuid)
+	if err != nil {
+		return "", err
+	}
+	if val, found := lookupPath(doc, "Properties.UnitofMeasure"); found {
+		if uom, ok := val.(string); ok {
+			return uom, nil
+		}
+	}
+	return "", nil
+}
+
+// Retrieves all tags in the provided list that match the provided where clause.
+func (m *memoryStore) GetTags(ctx context.Context, tags []string, where bson.M) (common.SmapMessageList, error) {
+	res, _, err := m.GetTagsPage(ctx, tags, where, nil, 0, 0)
+	return res, err
+}
+
+// without an order, pages are taken in insertion order. Documents are
+// matched in memory, so a query is only given up on before it starts
+func (m *memoryStore) GetTagsPage(ctx context.Context, tags []string, where bson.M, order *common.OrderBy, offset, limit int) (common.SmapMessageList, bool, error) {
+	var (
+		x       []bson.M
+		matched []bson.M
+		more    bool
+	)
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	m.RLock()
+	m.forEachMatch(where, func(doc bson.M) {
+		matched = append(matched, doc)
+	})
+	if order != nil {
+		sortDocs(matched, order)
+	}
+	if offset > len(matched) {
+		offset = len(matched)
+	}
+	matched = matched[offset:]
+	if limit > 0 && len(matched) > limit {
+		matched, more = matched[:limit], true
+	}
+	for _, doc := range matched {
+		if len(tags) == 0 { // select all
+			x = append(x, copyDoc(doc))
+			continue
+		}
+		selected := bson.M{}
+		for _, tag := range tags {
+			tag = common.FixMongoKey(tag)
+			if val, found := lookupPath(doc, tag); found {
+				setPath(selected, tag, copyValue(val))
+			}
+		}
+		// trim down empty rows
+		if len(selected) != 0 {
+			x = append(x, selected)
+		}
+	}
+	m.RUnlock()
+	return common.SmapMessageListFromBson(x), more, nil
+}
+
+func (m *memoryStore) GetDistinct(ctx context.Context, tag string, where bson.M) (common.DistinctResult, error) {
+	var (
+		result   = common.DistinctResult{}
+		seen     = make(map[string]struct{})
+		fixedTag = common.FixMongoKey(tag)
+	)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.RLock()
+	m.forEachMatch(where, func(doc bson.M) {
+		val, found := lookupPath(doc, fixedTag)
+		if !found {
+			return
+		}
+		// like Mongo, array values contribute each of their elements
+		values := []interface{}{val}
+		if list, isList := toList(val); isList {
+			values = list
+		}
+		for _, v := range values {
+			str, ok := v.(string)
+			if !ok {
+				str = fmt.Sprintf("%v", v)
+			}
+			if _, found := seen[str]; !found {
+				seen[str] = struct{}{}
+				result = append(result, str)
+			}
+		}
+	})
+	m.RUnlock()
+	sort.Strings(result)
+	return result, nil
+}
+
+func (m *memoryStore) GetUUIDs(ctx context.Context, where bson.M) ([]common.UUID, error) {
+	var results = []common.UUID{}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.RLock()
+	m.forEachMatch(where, func(doc bson.M) {
+		if uuid, ok := doc["uuid"].(string); ok {
+			results = append(results, common.UUID(uuid))
+		}
+	})
+	m.RUnlock()
+	return results, nil
+}
+
+func (m *memoryStore) GetDefinitions(ctx context.Context, kind string, result interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.RLock()
+	defer m.RUnlock()
+	if len(m.definitions[kind]) == 0 {
+		return nil
+	}
+	// a round trip through BSON decodes the documents the same way Mongo's
+	// would be
+	bytes, err := bson.Marshal(bson.M{"definitions": m.definitions[kind]})
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		Definitions bson.Raw
+	}
+	if err = bson.Unmarshal(bytes, &doc); err != nil {
+		return err
+	}
+	return doc.Definitions.Unmarshal(result)
+}
+
+func (m *memoryStore) SaveDefinition(kind, name string, definition interface{}) error {
+	var doc bson.M
+	if bytes, err := bson.Marshal(definition); err != nil {
+		return err
+	} else if err = bson.Unmarshal(bytes, &doc); err != nil {
+		return err
+	}
+	doc["name"] = name
+	m.Lock()
+	defer m.Unlock()
+	definitions := m.definitions[kind]
+	idx := sort.Search(len(definitions), func(i int) bool { return definitions[i]["name"].(string) >= name })
+	if idx < len(definitions) && definitions[idx]["name"] == name {
+		definitions[idx] = doc
+	} else {
+		definitions = append(definitions, nil)
+		copy(definitions[idx+1:], definitions[idx:])
+		definitions[idx] = doc
+	}
+	m.definitions[kind] = definitions
+	m.dirty = true
+	return nil
+}
+
+func (m *memoryStore) RemoveDefinition(kind, name string) error {
+	m.Lock()
+	defer m.Unlock()
+	for i, doc := range m.definitions[kind] {
+		if doc["name"] == name {
+			m.definitions[kind] = append(m.definitions[kind][:i], m.definitions[kind][i+1:]...)
+			m.dirty = true
+			return nil
+		}
+	}
+	return fmt.Errorf("No %v definition named %v", kind, name)
+}
+
+func (m *memoryStore) RecordVersions(uuids []common.UUID, writer string, time uint64) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.lastVersion == nil {
+		m.lastVersion = make(map[common.UUID]int)
+	}
+	for _, uuid := range uuids {
+		var doc bson.M
+		if idx, found := m.index[uuid]; found {
+			doc = m.docs[idx]
+		}
+		last, hasVersion := m.lastVersion[uuid]
+		switch {
+		case doc == nil && (!hasVersion || m.history[last].Removed):
+			continue
+		case doc != nil && hasVersion && reflect.DeepEqual(doc, m.history[last].Document):
+			continue
+		}
+		version := metadataVersion{UUID: uuid, Time: time, Writer: writer, Removed: doc == nil}
+		if doc != nil {
+			version.Document = copyDoc(doc)
+		}
+		m.lastVersion[uuid] = len(m.history)
+		m.history = append(m.history, version)
+		m.dirty = true
+	}
+	return nil
+}
+
+func (m *memoryStore) AsOf(ctx context.Context, time uint64, where bson.M) (MetadataStore, error) {
+	var (
+		versions []metadataVersion
+		position = make(map[common.UUID]int)
+	)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.RLock()
+	for _, version := range m.history {
+		if version.Time > time {
+			continue
+		}
+		if i, found := position[version.UUID]; found {
+			if version.Time >= versions[i].Time {
+				versions[i] = version
+			}
+			continue
+		}
+		position[version.UUID] = len(versions)
+		versions = append(versions, version)
+	}
+	var docs []bson.M
+	for _, version := range versions {
+		if !version.Removed && matchesWhere(version.Document, where) {
+			docs = append(docs, copyDoc(version.Document))
+		}
+	}
+	m.RUnlock()
+	return historicalStore(docs), nil
+}
+
+func (m *memoryStore) GetUser(where bson.M) (string, error) {
+	var x []bson.M
+	m.RLock()
+	for _, user := range m.users {
+		if matchesWhere(user, where) {
+			x = append(x, user)
+		}
+	}
+	m.RUnlock()
+	if len(x) == 1 {
+		if where["_id"] == x[0]["_id"] {
+			if str, ok := x[0]["password"].(string); ok {
+				return str, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("User not found")
+}
+
+func (m *memoryStore) GetPermissions(user string) ([]string, error) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, doc := range m.users {
+		if doc["_id"] != user {
+			continue
+		}
+		var permissions []string
+		if list, ok := doc["permissions"].([]interface{}); ok {
+			for _, p := range list {
+				if s, ok := p.(string); ok {
+					permissions = append(permissions, s)
+				}
+			}
+		}
+		return permissions, nil
+	}
+	return nil, fmt.Errorf("User not found")
+}
+
+func (m *memoryStore) SaveTags(msg *common.SmapMessage) (bool, error) {
+	if msg == nil {
+		return false, fmt.Errorf("Message is null")
+	}
+	m.Lock()
+	defer m.Unlock()
+	idx, found := m.index[msg.UUID]
+	if found && !msg.HasMetadata() {
+		return false, nil
+	}
+	var before bson.M
+	if found {
+		before = copyDoc(m.docs[idx])
+	} else {
+		idx = len(m.docs)
+		m.docs = append(m.docs, bson.M{})
+		m.index[msg.UUID] = idx
+	}
+	for k, v := range msg.ToBson() {
+		setPath(m.docs[idx], k, storedValue(v))
+	}
+	changed := !found || !reflect.DeepEqual(before, m.docs[idx])
+	m.dirty = m.dirty || changed
+	return changed, nil
+}
+
+func (m *memoryStore) UpdateDocs(updates, where bson.M) (int, error) {
+	var updated int
+	m.Lock()
+	m.forEachMatch(where, func(doc bson.M) {
+		for k, v := range updates {
+			setPath(doc, k, storedValue(v))
+		}
+		updated += 1
+	})
+	m.dirty = m.dirty || updated > 0
+	m.Unlock()
+	log.Infof("Updated %v records", updated)
+	return updated, nil
+}
+
+func (m *memoryStore) RemoveTags(tags []string, where bson.M) (int, error) {
+	var updated int
+	m.Lock()
+	m.forEachMatch(where, func(doc bson.M) {
+		for _, tag := range tags {
+			unsetPath(doc, common.FixMongoKey(tag))
+		}
+		updated += 1
+	})
+	m.dirty = m.dirty || updated > 0
+	m.Unlock()
+	log.Infof("Updated %v records", updated)
+	return updated, nil
+}
+
+func (m *memoryStore) RemoveDocs(where bson.M) (int, error) {
+	var removed int
+	m.Lock()
+	kept := m.docs[:0]
+	m.index = make(map[common.UUID]int)
+	for _, doc := range m.docs {
+		if matchesWhere(doc, where) {
+			removed += 1
+			continue
+		}
+		if uuid, ok := doc["uuid"].(string); ok {
+			m.index[common.UUID(uuid)] = len(kept)
+		}
+		kept = append(kept, doc)
+	}
+	m.docs = kept
+	m.dirty = m.dirty || removed > 0
+	m.Unlock()
+	log.Infof("Removed %v records", removed)
+	return removed, nil
+}
+
+// Evaluates a where clause as generated by the query language against a
+// document. The supported operators are the ones the grammar emits: $and,
+// $or, $regex, $in, $not, $exists, $ne, $neq, $lt, $lte, $gt and $gte. Any
+// other key is compared for equality against the (dot-separated) path in the
+// document.
+func matchesWhere(doc bson.M, where bson.M) bool {
+	for key, cond := range where {
+		switch key {
+		case "$and":
+			clauses, _ := toList(cond)
+			for _, clause := range clauses {
+				if sub, ok := toMap(clause); !ok || !matchesWhere(doc, sub) {
+					return false
+				}
+			}
+		case "$or":
+			clauses, _ := toList(cond)
+			matched := false
+			for _, clause := range clauses {
+				if sub, ok := toMap(clause); ok && matchesWhere(doc, sub) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		default:
+			val, found := lookupPath(doc, key)
+			if !matchesCondition(val, found, cond) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// evaluates a single field condition, which is either a literal value or a
+// document of operators
+func matchesCondition(val interface{}, found bool, cond interface{}) bool {
+	ops, isMap := toMap(cond)
+	if !isMap || !isOperatorDoc(ops) {
+		return found && valueEquals(val, cond)
+	}
+	for op, arg := range ops {
+		switch op {
+		case "$regex":
+			pattern, ok := arg.(string)
+			if !ok {
+				return false
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil || !found || !anyValue(val, func(v interface{}) bool {
+				str, isString := v.(string)
+				return isString && re.MatchString(str)
+			}) {
+				return false
+			}
+		case "$in":
+			list, _ := toList(arg)
+			matched := false
+			for _, candidate := range list {
+				if found && valueEquals(val, candidate) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		case "$not":
+			if matchesCondition(val, found, arg) {
+				return false
+			}
+		case "$exists":
+			if exists, ok := arg.(bool); ok && exists != found {
+				return false
+			}
+		case "$ne", "$neq":
+			if matchesCondition(val, found, arg) {
+				return false
+			}
+		case "$lt", "$lte", "$gt", "$gte":
+			bound, ok := common.NumericValue(arg)
+			if !ok || !found || !anyValue(val, func(v interface{}) bool {
+				num, isNumeric := common.NumericValue(v)
+				return isNumeric && compareNumbers(op, num, bound)
+			}) {
+				return false
+			}
+		default:
+			log.Warningf("Unsupported operator %v in where clause", op)
+			return false
+		}
+	}
+	return true
+}
+
+func compareNumbers(op string, num, bound float64) bool {
+	switch op {
+	case "$lt":
+		return num < bound
+	case "$lte":
+		return num <= bound
+	case "$gt":
+		return num > bound
+	case "$gte":
+		return num >= bound
+	}
+	return false
+}
+
+func isOperatorDoc(m bson.M) bool {
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return len(m) > 0
+}
+
+// returns true if f holds for the value or, if the value is a list, for any
+// of its elements
+func anyValue(val interface{}, f func(interface{}) bool) bool {
+	if list, isList := toList(val); isList {
+		for _, v := range list {
+			if f(v) {
+				return true
+			}
+		}
+		return false
+	}
+	return f(val)
+}
+
+// compares a stored value against a value from a query. Numbers compare by
+// value regardless of their Go type, and lists match if any element matches
+func valueEquals(val, target interface{}) bool {
+	if reflect.DeepEqual(val, target) {
+		return true
+	}
+	return anyValue(val, func(v interface{}) bool {
+		if a, ok := common.NumericValue(v); ok {
+			b, ok := common.NumericValue(target)
+			return ok && a == b
+		}
+		return reflect.DeepEqual(v, target)
+	})
+}
+
+// the query language builds maps of several named types (common.Dict,
+// bson.M), so we normalize them here
+func toMap(val interface{}) (bson.M, bool) {
+	switch m := val.(type) {
+	case bson.M:
+		return m, true
+	case common.Dict:
+		return bson.M(m), true
+	case map[string]interface{}:
+		return bson.M(m), true
+	}
+	return nil, false
+}
+
+func toList(val interface{}) ([]interface{}, bool) {
+	if list, ok := val.([]interface{}); ok {
+		return list, true
+	}
+	v := reflect.ValueOf(val)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	list := make([]interface{}, v.Len())
+	for i := range list {
+		list[i] = v.Index(i).Interface()
+	}
+	return list, true
+}
+
+// converts a value into the shape it would have after a round trip through
+// Mongo, so that stored documents only contain bson.M and []interface{}
+func storedValue(val interface{}) interface{} {
+	if uuid, ok := val.(common.UUID); ok {
+		return string(uuid)
+	}
+	if m, ok := toMap(val); ok {
+		ret := bson.M{}
+		for k, v := range m {
+			ret[k] = storedValue(v)
+		}
+		return ret
+	}
+	if list, ok := toList(val); ok {
+		ret := make([]interface{}, len(list))
+		for i, v := range list {
+			ret[i] = storedValue(v)
+		}
+		return ret
+	}
+	return val
+}
+
+func copyDoc(doc bson.M) bson.M {
+	return copyValue(doc).(bson.M)
+}
+
+func copyValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case bson.M:
+		ret := make(bson.M, len(v))
+		for k, vv := range v {
+			ret[k] = copyValue(vv)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, vv := range v {
+			ret[i] = copyValue(vv)
+		}
+		return ret
+	}
+	return val
+}
+
+// follows a dot-separated path through nested documents
+func lookupPath(doc bson.M, path string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, piece := range strings.Split(path, ".") {
+		m, ok := toMap(cur)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[piece]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// sets the value at a dot-separated path, creating intermediate documents
+func setPath(doc bson.M, path string, val interface{}) {
+	pieces := strings.Split(path, ".")
+	cur := doc
+	for _, piece := range pieces[:len(pieces)-1] {
+		next, ok := toMap(cur[piece])
+		if !ok {
+			next = bson.M{}
+			cur[piece] = next
+		}
+		cur = next
+	}
+	cur[pieces[len(pieces)-1]] = val
+}
+
+// removes the value at a dot-separated path
+func unsetPath(doc bson.M, path string) {
+	pieces := strings.Split(path, ".")
+	cur := doc
+	for _, piece := range pieces[:len(pieces)-1] {
+		next, ok := toMap(cur[piece])
+		if !ok {
+			return
+		}
+		cur = next
+	}
+	delete(cur, pieces[len(pieces)-1])
+}
@@ -0,0 +1,152 @@
+package archiver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/archiver/internal/querylang"
+	"github.com/jf87/giles2/common"
+)
+
+func newTestMemoryStore() (*memoryStore, []common.UUID) {
+	m := newMemoryStore(&memoryConfig{})
+	uuids := []common.UUID{common.NewUUID(), common.NewUUID(), common.NewUUID()}
+	m.SaveTags(&common.SmapMessage{UUID: uuids[0], Path: "/a", Metadata: common.Dict{"Type": "Sensor", "Room": "410"},
+		Properties: &common.SmapProperties{UnitOfTime: common.UOT_MS, UnitOfMeasure: "F", StreamType: common.NUMERIC_STREAM}})
+	m.SaveTags(&common.SmapMessage{UUID: uuids[1], Path: "/b", Metadata: common.Dict{"Type": "Setpoint", "Room": "410"}})
+	m.SaveTags(&common.SmapMessage{UUID: uuids[2], Path: "/c", Metadata: common.Dict{"Type": "Sensor", "Point|Name": "temp"}})
+	return m, uuids
+}
+
+func sortedUUIDs(uuids []common.UUID) []string {
+	ret := make([]string, len(uuids))
+	for i, uu := range uuids {
+		ret[i] = string(uu)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestMemoryStoreWhere(t *testing.T) {
+	m, uuids := newTestMemoryStore()
+	qp := querylang.NewQueryProcessor(0, time.UTC)
+	for _, test := range []struct {
+		where   string
+		matches []common.UUID
+	}{
+		{"Metadata/Type = 'Sensor'", []common.UUID{uuids[0], uuids[2]}},
+		{"Metadata/Type != 'Sensor'", []common.UUID{uuids[1]}},
+		{"Metadata/Type like 'Set.*'", []common.UUID{uuids[1]}},
+		{"has Metadata/Room", []common.UUID{uuids[0], uuids[1]}},
+		{"Metadata/Point/Name = 'temp'", []common.UUID{uuids[2]}},
+		{"Metadata/Type = 'Sensor' and Metadata/Room = '410'", []common.UUID{uuids[0]}},
+		{"Metadata/Type = 'Setpoint' or Path = '/c'", []common.UUID{uuids[1], uuids[2]}},
+		{"not Metadata/Type = 'Sensor'", []common.UUID{uuids[1]}},
+		{"['/a', '/b'] in Path", []common.UUID{uuids[0], uuids[1]}},
+		{"['/a', '/b'] not in Path", []common.UUID{uuids[2]}},
+		{"Metadata/Room > 400", []common.UUID{uuids[0], uuids[1]}},
+		{"Metadata/Room >= 410.5", []common.UUID{}},
+		{"Metadata/Room <= 410", []common.UUID{uuids[0], uuids[1]}},
+		{"Metadata/Room < 400", []common.UUID{}},
+		{"Metadata/Room between 400 and 410", []common.UUID{uuids[0], uuids[1]}},
+		{"Metadata/Type > 0", []common.UUID{}},
+		{"uuid = '" + string(uuids[1]) + "'", []common.UUID{uuids[1]}},
+	} {
+		parsed := qp.Parse("select * where " + test.where)
+		if parsed.Err != nil {
+			t.Errorf("Could not parse %v (%v)", test.where, parsed.Err)
+			continue
+		}
+		found, _ := m.GetUUIDs(context.Background(), parsed.Where.ToBson())
+		if !reflect.DeepEqual(sortedUUIDs(found), sortedUUIDs(test.matches)) {
+			t.Errorf("Where %v should match %v but matched %v", test.where, test.matches, found)
+		}
+	}
+
+	// numbers compare the same way as numeric strings
+	room := common.NewUUID()
+	m.SaveTags(&common.SmapMessage{UUID: room, Path: "/d", Metadata: common.Dict{"Room": 412}})
+	parsed := qp.Parse("select * where Metadata/Room > 410")
+	if found, _ := m.GetUUIDs(context.Background(), parsed.Where.ToBson()); len(found) != 1 || found[0] != room {
+		t.Errorf("Expected only %v, got %v", room, found)
+	}
+}
+
+func TestMemoryStoreNotIn(t *testing.T) {
+	m, uuids := newTestMemoryStore()
+	where := common.Dict{"Path": common.Dict{"$not": common.Dict{"$in": querylang.List{"/a", "/b"}}}}
+	found, _ := m.GetUUIDs(context.Background(), where.ToBson())
+	if len(found) != 1 || found[0] != uuids[2] {
+		t.Errorf("Expected only %v, got %v", uuids[2], found)
+	}
+}
+
+func TestMemoryStoreTags(t *testing.T) {
+	m, uuids := newTestMemoryStore()
+	if uot, _ := m.GetUnitOfTime(context.Background(), uuids[0]); uot != common.UOT_MS {
+		t.Errorf("UnitOfTime should be %v, was %v", common.UOT_MS, uot)
+	}
+	if uom, _ := m.GetUnitOfMeasure(context.Background(), uuids[0]); uom != "F" {
+		t.Errorf("UnitOfMeasure should be F, was %v", uom)
+	}
+
+	res, _ := m.GetTags(context.Background(), []string{"Metadata.Room"}, common.Dict{"Metadata.Type": "Sensor"}.ToBson())
+	if len(res) != 1 || res[0].Metadata["Room"] != "410" {
+		t.Errorf("Expected one document with Room 410, got %v", res)
+	}
+
+	distinct, _ := m.GetDistinct(context.Background(), "Metadata.Type", nil)
+	if !reflect.DeepEqual(distinct, common.DistinctResult{"Sensor", "Setpoint"}) {
+		t.Errorf("Bad distinct result %v", distinct)
+	}
+
+	m.UpdateDocs(common.Dict{"Metadata.Floor": "4"}.ToBson(), common.Dict{"Metadata.Room": "410"}.ToBson())
+	if found, _ := m.GetUUIDs(context.Background(), common.Dict{"Metadata.Floor": "4"}.ToBson()); len(found) != 2 {
+		t.Errorf("Expected 2 updated documents, got %v", found)
+	}
+	m.RemoveTags([]string{"Metadata.Floor"}, common.Dict{"uuid": string(uuids[0])}.ToBson())
+	if found, _ := m.GetUUIDs(context.Background(), common.Dict{"Metadata.Floor": "4"}.ToBson()); len(found) != 1 {
+		t.Errorf("Expected 1 document with Floor, got %v", found)
+	}
+	// tags with dots in their name are stored with | instead
+	m.RemoveTags([]string{"Metadata.Point.Name"}, common.Dict{"uuid": string(uuids[2])}.ToBson())
+	if found, _ := m.GetUUIDs(context.Background(), common.Dict{"Metadata.Point|Name": common.Dict{"$exists": true}}.ToBson()); len(found) != 0 {
+		t.Errorf("Expected Point.Name to be removed, got %v", found)
+	}
+	m.RemoveDocs(common.Dict{"Metadata.Type": "Sensor"}.ToBson())
+	if found, _ := m.GetUUIDs(context.Background(), nil); len(found) != 1 || found[0] != uuids[1] {
+		t.Errorf("Expected only %v to remain, got %v", uuids[1], found)
+	}
+}
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "giles-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := &memoryConfig{snapshot: filepath.Join(dir, "metadata.bson")}
+	m := newMemoryStore(config)
+	uuid := common.NewUUID()
+	m.SaveTags(&common.SmapMessage{UUID: uuid, Path: "/a", Metadata: common.Dict{"Type": "Sensor"},
+		Properties: &common.SmapProperties{UnitOfTime: common.UOT_NS}})
+	// closing writes the snapshot
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := newMemoryStore(config)
+	found, _ := reopened.GetUUIDs(context.Background(), common.Dict{"Metadata.Type": "Sensor"}.ToBson())
+	if len(found) != 1 || found[0] != uuid {
+		t.Errorf("Expected %v after reload, got %v", uuid, found)
+	}
+	if uot, _ := reopened.GetUnitOfTime(context.Background(), uuid); uot != common.UOT_NS {
+		t.Errorf("UnitOfTime should be %v after reload, was %v", common.UOT_NS, uot)
+	}
+}
@@ -1,26 +1,58 @@
 package archiver
 
 import (
+	"context"
+
 	"github.com/jf87/giles2/common"
 	"gopkg.in/mgo.v2/bson"
 )
 
+// Reads take the context of the query they serve and give up with its error
+// once it is done. As with TimeseriesStore, writes (SaveTags, UpdateDocs,
+// RemoveTags, RemoveDocs, SaveDefinition, RemoveDefinition and
+// RecordVersions) are never abandoned halfway, so they take no context; the
+// archiver checks the context of a query before it starts changing anything
 type MetadataStore interface {
-	GetUnitOfTime(uuid common.UUID) (common.UnitOfTime, error)
-	GetStreamType(uuid common.UUID) (common.StreamType, error)
-	GetUnitOfMeasure(uuid common.UUID) (string, error)
+	// the properties of a stream
+	GetUnitOfTime(ctx context.Context, uuid common.UUID) (common.UnitOfTime, error)
+	GetStreamType(ctx context.Context, uuid common.UUID) (common.StreamType, error)
+	GetUnitOfMeasure(ctx context.Context, uuid common.UUID) (string, error)
 
-	GetTags(tags []string, where bson.M) (common.SmapMessageList, error)
-	GetDistinct(tag string, where bson.M) (common.DistinctResult, error)
-	GetUUIDs(where bson.M) ([]common.UUID, error)
+	GetTags(ctx context.Context, tags []string, where bson.M) (common.SmapMessageList, error)
+	// like GetTags, but sorts the matching documents by order (if not nil,
+	// see sortDocs), skips the first offset of them and returns at most
+	// limit (all if limit is 0). Pages come in a stable order. Also reports
+	// whether more documents match after the page
+	GetTagsPage(ctx context.Context, tags []string, where bson.M, order *common.OrderBy, offset, limit int) (common.SmapMessageList, bool, error)
+	GetDistinct(ctx context.Context, tag string, where bson.M) (common.DistinctResult, error)
+	GetUUIDs(ctx context.Context, where bson.M) ([]common.UUID, error)
 
 	GetUser(where bson.M) (string, error)
+	// returns the permissions in the user's document, e.g. "delete"
+	GetPermissions(user string) ([]string, error)
+
+	// returns true if the document was added or changed
+	SaveTags(msg *common.SmapMessage) (bool, error)
 
-	SaveTags(msg *common.SmapMessage) error
+	// these return the number of documents that were updated or removed
+	UpdateDocs(updates, where bson.M) (int, error)
+	RemoveTags(tags []string, where bson.M) (int, error)
+	RemoveDocs(where bson.M) (int, error)
 
-	UpdateDocs(updates, where bson.M) error
+	// named definitions (retention rules, rollups and virtual streams) are
+	// kept alongside the metadata, one collection per kind, see
+	// definitions.go. Decodes all definitions of the kind, sorted by name,
+	// into result, which points to a slice
+	GetDefinitions(ctx context.Context, kind string, result interface{}) error
+	// adds the definition, or replaces the one with the same name
+	SaveDefinition(kind, name string, definition interface{}) error
+	RemoveDefinition(kind, name string) error
 
-	//TODO: add feedback on how many docs changed/removed/etc. This requires a specialized struct
-	RemoveTags(tags []string, where bson.M) error
-	RemoveDocs(where bson.M) error
+	// saves a version of the documents of the given streams at the given
+	// time (in nanoseconds) if they changed since their last version, see
+	// history.go
+	RecordVersions(uuids []common.UUID, writer string, time uint64) error
+	// returns a store with the most recent version at the given time (in
+	// nanoseconds) of each document that matches the where clause
+	AsOf(ctx context.Context, time uint64, where bson.M) (MetadataStore, error)
 }
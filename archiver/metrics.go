@@ -16,6 +16,10 @@ func (m *metric) Mark(num uint64) {
 	atomic.AddUint64(&m.value, num)
 }
 
+func (m *metric) Set(num uint64) {
+	atomic.StoreUint64(&m.value, num)
+}
+
 func (m *metric) Get() uint64 {
 	return atomic.LoadUint64(&m.value)
 }
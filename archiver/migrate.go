@@ -0,0 +1,361 @@
+package archiver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"time"
+
+	"github.com/jf87/giles2/archiver/internal/querylang"
+	"github.com/jf87/giles2/common"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A migration copies streams from the stores of one configuration to the
+// stores of another: first the metadata documents of each matching stream,
+// then its readings, one window of time at a time. After each window the
+// progress is written to a checkpoint file, so a migration that is
+// interrupted picks up where it left off when it is started again with the
+// same arguments.
+//
+// The verification pass compares the number of readings of each stream on
+// both sides using statistical queries, so the readings do not have to be
+// transferred a second time.
+//
+// Readings of object streams are not copied.
+
+// MigrateConfig describes a migration (see Migrate)
+type MigrateConfig struct {
+	// the TimeseriesStore and MetadataStore of these configurations are
+	// the source and destination of the migration
+	Source      *Config
+	Destination *Config
+	// where clause selecting the streams to copy, e.g. "Metadata/Site = 'Soda'".
+	// All streams are copied if this is empty
+	Where string
+	// copy readings in [Start, End). End defaults to now
+	Start uint64
+	End   uint64
+	// how much time is copied per request
+	Window time.Duration
+	// file that records the progress of the migration. If empty, an
+	// interrupted migration starts over
+	Checkpoint string
+	// compare the number of readings on both sides after copying
+	Verify bool
+}
+
+type migrateCheckpoint struct {
+	Where string
+	Start uint64
+	End   uint64
+	// readings before this time have been copied
+	Progress map[common.UUID]uint64
+	// streams that have been copied completely
+	Done map[common.UUID]bool
+}
+
+type migration struct {
+	srcMd      MetadataStore
+	srcTs      TimeseriesStore
+	dstMd      MetadataStore
+	dstTs      TimeseriesStore
+	where      bson.M
+	start      uint64
+	end        uint64
+	window     uint64
+	checkpoint *migrateCheckpoint
+	path       string
+	verify     bool
+}
+
+// Copies the streams matching the where clause from the source configuration
+// to the destination configuration. Will Fatal out of the program if either
+// set of stores cannot be reached
+func Migrate(c *MigrateConfig) error {
+	srcMd := newMetadataStore(*c.Source.Archiver.MetadataStore, c.Source)
+	srcTs := newTimeseriesStore(*c.Source.Archiver.TimeseriesStore, c.Source, srcMd)
+	dstMd := newMetadataStore(*c.Destination.Archiver.MetadataStore, c.Destination)
+	dstTs := newTimeseriesStore(*c.Destination.Archiver.TimeseriesStore, c.Destination, dstMd)
+	m, err := newMigration(c, srcMd, srcTs, dstMd, dstTs)
+	if err != nil {
+		return err
+	}
+	return m.run()
+}
+
+func newMigration(c *MigrateConfig, srcMd MetadataStore, srcTs TimeseriesStore, dstMd MetadataStore, dstTs TimeseriesStore) (*migration, error) {
+	var err error
+	m := &migration{
+		srcMd:  srcMd,
+		srcTs:  srcTs,
+		dstMd:  dstMd,
+		dstTs:  dstTs,
+		start:  c.Start,
+		end:    c.End,
+		window: uint64(c.Window.Nanoseconds()),
+		path:   c.Checkpoint,
+		verify: c.Verify,
+	}
+	if m.window == 0 {
+		return nil, fmt.Errorf("Migration window has to be positive")
+	}
+
+	if c.Where != "" {
+		parsed := querylang.NewQueryProcessor(0, time.Local).Parse("select uuid where " + c.Where)
+		if parsed.Err != nil {
+			return nil, fmt.Errorf("Error (%v) in where clause \"%v\" (error at %v)", parsed.Err, c.Where, parsed.ErrPos)
+		}
+		m.where = parsed.Where.ToBson()
+	}
+
+	// make sure that Start/End are both in nanoseconds
+	if m.start, err = common.ConvertTime(m.start, common.GuessTimeUnit(m.start), common.UOT_NS); err != nil {
+		return nil, err
+	}
+	if m.end, err = common.ConvertTime(m.end, common.GuessTimeUnit(m.end), common.UOT_NS); err != nil {
+		return nil, err
+	}
+
+	if err = m.loadCheckpoint(c.Where); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reads the checkpoint file if there is one. An open ended migration keeps
+// the end time it was started with, so resuming it does not copy readings that
+// arrived in the meantime
+func (m *migration) loadCheckpoint(where string) error {
+	m.checkpoint = &migrateCheckpoint{
+		Where:    where,
+		Start:    m.start,
+		End:      m.end,
+		Progress: make(map[common.UUID]uint64),
+		Done:     make(map[common.UUID]bool),
+	}
+	if m.path != "" {
+		bytes, err := ioutil.ReadFile(m.path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Could not read checkpoint %v", m.path)
+		} else if err == nil {
+			var saved migrateCheckpoint
+			if err = json.Unmarshal(bytes, &saved); err != nil {
+				return errors.Wrapf(err, "Could not decode checkpoint %v", m.path)
+			}
+			if m.end == 0 {
+				m.end = saved.End
+				m.checkpoint.End = saved.End
+			}
+			if saved.Where != where || saved.Start != m.start || saved.End != m.end {
+				return fmt.Errorf("Checkpoint %v belongs to a different migration (where \"%v\" from %v to %v)", m.path, saved.Where, saved.Start, saved.End)
+			}
+			if saved.Progress != nil {
+				m.checkpoint.Progress = saved.Progress
+			}
+			if saved.Done != nil {
+				m.checkpoint.Done = saved.Done
+			}
+			log.Noticef("Resuming migration from %v: %d streams done", m.path, len(m.checkpoint.Done))
+		}
+	}
+	if m.end == 0 {
+		m.end = common.GetNow(common.UOT_NS)
+		m.checkpoint.End = m.end
+	}
+	return nil
+}
+
+func (m *migration) saveCheckpoint() error {
+	if m.path == "" {
+		return nil
+	}
+	bytes, err := json.Marshal(m.checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, bytes, 0644); err != nil {
+		return errors.Wrapf(err, "Could not write checkpoint %v", tmp)
+	}
+	return os.Rename(tmp, m.path)
+}
+
+func (m *migration) run() error {
+	uuids, err := m.srcMd.GetUUIDs(context.Background(), m.where)
+	if err != nil {
+		return errors.Wrap(err, "Could not list streams")
+	}
+	log.Noticef("Migrating %d streams", len(uuids))
+	for i, uuid := range uuids {
+		if m.checkpoint.Done[uuid] {
+			continue
+		}
+		if err = m.copyStream(uuid); err != nil {
+			return errors.Wrapf(err, "Could not migrate %v", uuid)
+		}
+		m.checkpoint.Done[uuid] = true
+		delete(m.checkpoint.Progress, uuid)
+		if err = m.saveCheckpoint(); err != nil {
+			return err
+		}
+		log.Infof("Migrated %v (%d/%d)", uuid, i+1, len(uuids))
+	}
+	log.Noticef("Copied %d streams", len(uuids))
+	if m.verify {
+		return m.verifyStreams(uuids)
+	}
+	return nil
+}
+
+func (m *migration) copyStream(uuid common.UUID) error {
+	docs, err := m.srcMd.GetTags(context.Background(), nil, bson.M{"uuid": string(uuid)})
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if _, err = m.dstMd.SaveTags(doc); err != nil {
+			return err
+		}
+	}
+
+	if st, err := m.srcMd.GetStreamType(context.Background(), uuid); err != nil {
+		return err
+	} else if st == common.OBJECT_STREAM {
+		log.Warningf("Not copying readings of object stream %v", uuid)
+		return nil
+	}
+
+	first, last, found, err := m.bounds(uuid)
+	if err != nil || !found {
+		return err
+	}
+	from := first
+	if done, found := m.checkpoint.Progress[uuid]; found && done > from {
+		from = done
+	}
+	for from <= last {
+		// the last window must not copy readings after the end time
+		to := from + m.window
+		if to > m.end {
+			to = m.end
+		}
+		res, err := m.srcTs.GetData(context.Background(), []common.UUID{uuid}, from, to)
+		if err != nil {
+			return err
+		}
+		if len(res) > 0 && len(res[0].Readings) > 0 {
+			msg := &common.SmapMessage{UUID: uuid, Readings: make([]common.Reading, len(res[0].Readings))}
+			for i, rdg := range res[0].Readings {
+				msg.Readings[i] = rdg
+			}
+			if err = m.dstTs.AddMessage(msg); err != nil {
+				return err
+			}
+		}
+		m.checkpoint.Progress[uuid] = to
+		if err = m.saveCheckpoint(); err != nil {
+			return err
+		}
+		from = to
+	}
+	return nil
+}
+
+// returns the times of the first and last reading of the stream in the
+// source store within the migration's time range
+func (m *migration) bounds(uuid common.UUID) (first, last uint64, found bool, err error) {
+	next, err := m.srcTs.Next(context.Background(), []common.UUID{uuid}, m.start)
+	if err != nil || len(next) == 0 || len(next[0].Readings) == 0 {
+		return
+	}
+	prev, err := m.srcTs.Prev(context.Background(), []common.UUID{uuid}, m.end)
+	if err != nil || len(prev) == 0 || len(prev[0].Readings) == 0 {
+		return
+	}
+	first, last = next[0].Readings[0].Time, prev[0].Readings[0].Time
+	found = first < m.end && first <= last
+	return
+}
+
+func (m *migration) verifyStreams(uuids []common.UUID) error {
+	var mismatched int
+	for _, uuid := range uuids {
+		if st, err := m.srcMd.GetStreamType(context.Background(), uuid); err != nil {
+			return err
+		} else if st == common.OBJECT_STREAM {
+			continue
+		}
+		first, last, found, err := m.bounds(uuid)
+		if err != nil {
+			return err
+		} else if !found {
+			continue
+		}
+		srcCount, err := countReadings(context.Background(), m.srcTs, uuid, first, last+1, bits.Len64(m.window)-1)
+		if err != nil {
+			return errors.Wrapf(err, "Could not count readings of %v in source", uuid)
+		}
+		dstCount, err := countReadings(context.Background(), m.dstTs, uuid, first, last+1, bits.Len64(m.window)-1)
+		if err != nil {
+			return errors.Wrapf(err, "Could not count readings of %v in destination", uuid)
+		}
+		if srcCount != dstCount {
+			log.Errorf("Stream %v has %d readings in source but %d in destination", uuid, srcCount, dstCount)
+			mismatched += 1
+		}
+	}
+	if mismatched > 0 {
+		return fmt.Errorf("%d of %d streams have different reading counts", mismatched, len(uuids))
+	}
+	log.Noticef("Verified %d streams", len(uuids))
+	return nil
+}
+
+// Counts the readings of the stream in [start, end) with a statistical query.
+// Statistical windows are aligned to multiples of 2^pw, so the partial
+// windows at either end are counted from the raw readings instead
+func countReadings(ctx context.Context, store TimeseriesStore, uuid common.UUID, start, end uint64, pw int) (uint64, error) {
+	var (
+		width        = uint64(1) << uint(pw)
+		alignedStart = (start + width - 1) / width * width
+		alignedEnd   = end / width * width
+		count        uint64
+	)
+	if alignedStart >= alignedEnd {
+		return countRawReadings(ctx, store, uuid, start, end)
+	}
+	stats, err := store.StatisticalData(ctx, []common.UUID{uuid}, pw, alignedStart, alignedEnd)
+	if err != nil {
+		return 0, err
+	}
+	for _, resp := range stats {
+		for _, rdg := range resp.Readings {
+			count += rdg.Count
+		}
+	}
+	head, err := countRawReadings(ctx, store, uuid, start, alignedStart)
+	if err != nil {
+		return 0, err
+	}
+	tail, err := countRawReadings(ctx, store, uuid, alignedEnd, end)
+	if err != nil {
+		return 0, err
+	}
+	return count + head + tail, nil
+}
+
+func countRawReadings(ctx context.Context, store TimeseriesStore, uuid common.UUID, start, end uint64) (uint64, error) {
+	if start >= end {
+		return 0, nil
+	}
+	res, err := store.GetData(ctx, []common.UUID{uuid}, start, end)
+	if err != nil || len(res) == 0 {
+		return 0, err
+	}
+	return uint64(len(res[0].Readings)), nil
+}
@@ -0,0 +1,105 @@
+package archiver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestMigrate(t *testing.T) {
+	srcTs, cleanupSrc := newTestEmbeddedDB(t)
+	defer cleanupSrc()
+	dstTs, cleanupDst := newTestEmbeddedDB(t)
+	defer cleanupDst()
+	dir, err := ioutil.TempDir("", "giles-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcMd, dstMd := newMemoryStore(&memoryConfig{}), newMemoryStore(&memoryConfig{})
+	base := uint64(1451606400000000000)
+	copied, skipped := common.NewUUID(), common.NewUUID()
+	for _, uuid := range []common.UUID{copied, skipped} {
+		site := "Soda"
+		if uuid == skipped {
+			site = "Cory"
+		}
+		srcMd.SaveTags(&common.SmapMessage{UUID: uuid, Path: "/" + site, Metadata: common.Dict{"Site": site},
+			Properties: &common.SmapProperties{UnitOfTime: common.UOT_NS, StreamType: common.NUMERIC_STREAM}})
+		srcTs.AddMessage(embeddedTestMessage(uuid, base, base+uint64(time.Hour), base+uint64(49*time.Hour)))
+	}
+
+	config := &MigrateConfig{
+		Where:      "Metadata/Site = 'Soda'",
+		Window:     24 * time.Hour,
+		Checkpoint: filepath.Join(dir, "checkpoint.json"),
+		Verify:     true,
+	}
+	m, err := newMigration(config, srcMd, srcTs, dstMd, dstTs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, _ := dstMd.GetUUIDs(context.Background(), nil); len(found) != 1 || found[0] != copied {
+		t.Errorf("Expected only %v in destination metadata, got %v", copied, found)
+	}
+	if res, _ := dstTs.GetData(context.Background(), []common.UUID{copied}, 0, base+uint64(50*time.Hour)); len(res[0].Readings) != 3 {
+		t.Errorf("Expected 3 copied readings, got %v", res[0].Readings)
+	}
+
+	// a second run resumes from the checkpoint and has nothing left to copy
+	resumed, err := newMigration(config, srcMd, srcTs, dstMd, dstTs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed.checkpoint.Done[copied] || resumed.end != m.end {
+		t.Errorf("Checkpoint was not restored: %+v", resumed.checkpoint)
+	}
+
+	// verification notices readings that are missing in the destination
+	dstTs.DeleteData([]common.UUID{copied}, base, base+1)
+	if err = resumed.verifyStreams([]common.UUID{copied}); err == nil {
+		t.Error("Verification should fail after deleting a reading in the destination")
+	}
+}
+
+func TestMigrateEnd(t *testing.T) {
+	srcTs, cleanupSrc := newTestEmbeddedDB(t)
+	defer cleanupSrc()
+	dstTs, cleanupDst := newTestEmbeddedDB(t)
+	defer cleanupDst()
+
+	srcMd, dstMd := newMemoryStore(&memoryConfig{}), newMemoryStore(&memoryConfig{})
+	base := uint64(1451606400000000000)
+	uuid := common.NewUUID()
+	srcMd.SaveTags(&common.SmapMessage{UUID: uuid, Path: "/sensor", Metadata: common.Dict{"Site": "Soda"},
+		Properties: &common.SmapProperties{UnitOfTime: common.UOT_NS, StreamType: common.NUMERIC_STREAM}})
+	// the reading at 35h is after End, but inside the window that starts at 24h
+	srcTs.AddMessage(embeddedTestMessage(uuid, base, base+uint64(25*time.Hour), base+uint64(35*time.Hour)))
+
+	config := &MigrateConfig{
+		Where:  "Metadata/Site = 'Soda'",
+		Start:  base,
+		End:    base + uint64(30*time.Hour),
+		Window: 24 * time.Hour,
+	}
+	m, err := newMigration(config, srcMd, srcTs, dstMd, dstTs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.run(); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := dstTs.GetData(context.Background(), []common.UUID{uuid}, 0, base+uint64(50*time.Hour)); len(res[0].Readings) != 2 {
+		t.Errorf("Expected only the 2 readings before End to be copied, got %v", res[0].Readings)
+	}
+}
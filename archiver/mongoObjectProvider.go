@@ -0,0 +1,148 @@
+package archiver
+
+// mongo provider for object store
+import (
+	"context"
+
+	"github.com/jf87/giles2/common"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mongoObjectStore keeps one document per object reading in the "objects"
+// collection of the archiver database:
+//
+//	{uuid: <uuid>, time: <nanoseconds>, value: <object>}
+type mongoObjectStore struct {
+	session *mgo.Session
+	objects *mgo.Collection
+}
+
+type mongoObject struct {
+	UUID  string      `bson:"uuid"`
+	Time  int64       `bson:"time"`
+	Value interface{} `bson:"value"`
+}
+
+func newMongoObjectStore(c *mongoConfig) *mongoObjectStore {
+	var err error
+	m := &mongoObjectStore{}
+	log.Noticef("Connecting to MongoDB for objects at %v...", c.address.String())
+	m.session, err = mgo.Dial(c.address.String())
+	if err != nil {
+		// a nil *mongoObjectStore would not be a nil ObjectStore
+		log.Fatalf("Could not connect to MongoDB: %v", err)
+	}
+	log.Notice("...connected!")
+	m.objects = m.session.DB("archiver").C("objects")
+
+	index := mgo.Index{
+		Key:    []string{"uuid", "time"},
+		Unique: true,
+	}
+	if err = m.objects.EnsureIndex(index); err != nil {
+		log.Fatalf("Could not create index on objects.uuid,time (%v)", err)
+	}
+	return m
+}
+
+func (m *mongoObjectStore) AddObjects(msg *common.SmapMessage) error {
+	if len(msg.Readings) == 0 {
+		return nil
+	}
+	bulk := m.objects.Bulk()
+	bulk.Unordered()
+	for _, rdg := range msg.Readings {
+		if !rdg.IsObject() {
+			continue
+		}
+		rdg.ConvertTime(common.UOT_NS)
+		selector := bson.M{"uuid": string(msg.UUID), "time": int64(rdg.GetTime())}
+		bulk.Upsert(selector, bson.M{"$set": bson.M{"value": rdg.GetValue()}})
+	}
+	_, err := bulk.Run()
+	return err
+}
+
+func (m *mongoObjectStore) queryNearestObject(ctx context.Context, uuids []common.UUID, ref uint64, backwards bool) ([]common.SmapObjectResponse, error) {
+	var ret = make([]common.SmapObjectResponse, len(uuids))
+	for i, uu := range uuids {
+		var (
+			docs  []mongoObject
+			where = bson.M{"uuid": string(uu), "time": bson.M{"$gte": int64(ref)}}
+			order = "time"
+		)
+		if backwards {
+			where["time"], order = bson.M{"$lt": int64(ref)}, "-time"
+		}
+		query, err := findWithContext(ctx, m.objects, where)
+		if err != nil {
+			return ret, err
+		}
+		if err := query.Sort(order).Limit(1).All(&docs); err != nil {
+			return ret, err
+		}
+		ret[i] = objectResponseFromMongo(uu, docs)
+	}
+	return ret, nil
+}
+
+func (m *mongoObjectStore) PrevObjects(ctx context.Context, uuids []common.UUID, ref uint64) ([]common.SmapObjectResponse, error) {
+	return m.queryNearestObject(ctx, uuids, ref, true)
+}
+
+func (m *mongoObjectStore) NextObjects(ctx context.Context, uuids []common.UUID, ref uint64) ([]common.SmapObjectResponse, error) {
+	return m.queryNearestObject(ctx, uuids, ref, false)
+}
+
+func (m *mongoObjectStore) GetObjects(ctx context.Context, uuids []common.UUID, start, end uint64) ([]common.SmapObjectResponse, error) {
+	var ret = make([]common.SmapObjectResponse, len(uuids))
+	for i, uu := range uuids {
+		var docs []mongoObject
+		where := bson.M{"uuid": string(uu), "time": bson.M{"$gte": int64(start), "$lt": int64(end)}}
+		query, err := findWithContext(ctx, m.objects, where)
+		if err != nil {
+			return ret, err
+		}
+		if err := query.Sort("time").All(&docs); err != nil {
+			return ret, err
+		}
+		ret[i] = objectResponseFromMongo(uu, docs)
+	}
+	return ret, nil
+}
+
+func (m *mongoObjectStore) CountObjects(ctx context.Context, uuids []common.UUID, start, end uint64) (uint64, error) {
+	ids := make([]string, len(uuids))
+	for i, uu := range uuids {
+		ids[i] = string(uu)
+	}
+	where := bson.M{"uuid": bson.M{"$in": ids}, "time": bson.M{"$gte": int64(start), "$lt": int64(end)}}
+	query, err := findWithContext(ctx, m.objects, where)
+	if err != nil {
+		return 0, err
+	}
+	count, err := query.Count()
+	return uint64(count), err
+}
+
+func (m *mongoObjectStore) DeleteObjects(uuids []common.UUID, start, end uint64) error {
+	for _, uu := range uuids {
+		where := bson.M{"uuid": string(uu), "time": bson.M{"$gte": int64(start), "$lt": int64(end)}}
+		if _, err := m.objects.RemoveAll(where); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func objectResponseFromMongo(uuid common.UUID, docs []mongoObject) common.SmapObjectResponse {
+	var sr = common.SmapObjectResponse{
+		UUID:     uuid,
+		Readings: make([]*common.SmapObjectReading, len(docs)),
+	}
+	for i, doc := range docs {
+		sr.Readings[i] = &common.SmapObjectReading{Time: uint64(doc.Time), UoT: common.UOT_NS, Value: doc.Value}
+	}
+	return sr
+}
@@ -2,8 +2,10 @@ package archiver
 
 // mongo provider for metadata store
 import (
+	"context"
 	"fmt"
 	"net"
+	"sort"
 	"sync/atomic"
 	"time"
 
@@ -21,6 +23,7 @@ type mongoStore struct {
 	db       *mgo.Database
 	metadata *mgo.Collection
 	users    *mgo.Collection
+	history  *mgo.Collection
 
 	pool *mongoConnectionPool
 
@@ -33,6 +36,8 @@ type mongoStore struct {
 	stCache *ccache.Cache
 	// UUID cache
 	uuidCache *ccache.Cache
+	// digest of the last version of each document
+	versionCache *ccache.Cache
 	// expiry time for cache entries before they are automatically purged
 	cacheExpiry time.Duration
 }
@@ -47,17 +52,18 @@ func newMongoStore(c *mongoConfig) *mongoStore {
 	log.Noticef("Connecting to MongoDB at %v...", c.address.String())
 	m.session, err = mgo.Dial(c.address.String())
 	if err != nil {
-		log.Criticalf("Could not connect to MongoDB: %v", err)
-		return nil
+		log.Fatalf("Could not connect to MongoDB: %v", err)
 	}
 	log.Notice("...connected!")
 	// fetch/create collections and db reference
 	m.db = m.session.DB("archiver")
 	m.metadata = m.db.C("metadata")
 	m.users = m.db.C("users")
+	m.history = m.db.C("history")
 
 	// add indexes. This will fail Fatal
 	m.addIndexes()
+	m.seedHistory()
 
 	m.pool = newMongoConnectionPool(m.session, m.metadata, 20)
 
@@ -66,6 +72,7 @@ func newMongoStore(c *mongoConfig) *mongoStore {
 	m.uomCache = ccache.New(ccache.Configure().MaxSize(1000).ItemsToPrune(50))
 	m.stCache = ccache.New(ccache.Configure().MaxSize(1000).ItemsToPrune(50))
 	m.uuidCache = ccache.New(ccache.Configure().MaxSize(1000).ItemsToPrune(50))
+	m.versionCache = ccache.New(ccache.Configure().MaxSize(1000).ItemsToPrune(50))
 	m.cacheExpiry = 10 * time.Minute
 	return m
 }
@@ -111,16 +118,85 @@ func (m *mongoStore) addIndexes() {
 	if err != nil {
 		log.Fatalf("Could not create index on metadata.properties.streamtype (%v)", err)
 	}
+
+	index.Key = []string{"name"}
+	index.Unique = true
+	for _, kind := range append(definitionKinds, rollupWatermarks) {
+		err = m.db.C(kind).EnsureIndex(index)
+		if err != nil {
+			log.Fatalf("Could not create index on %v.name (%v)", kind, err)
+		}
+	}
+
+	index.Key = []string{"uuid", "time"}
+	index.Unique = false
+	err = m.history.EnsureIndex(index)
+	if err != nil {
+		log.Fatalf("Could not create index on history.uuid, history.time (%v)", err)
+	}
+
+	index.Key = []string{"time"}
+	err = m.history.EnsureIndex(index)
+	if err != nil {
+		log.Fatalf("Could not create index on history.time (%v)", err)
+	}
 }
 
-func (m *mongoStore) GetUnitOfTime(uuid common.UUID) (common.UnitOfTime, error) {
+// When the history collection is first created, every existing document is
+// recorded with a first version, so that AS OF queries find them
+func (m *mongoStore) seedHistory() {
+	count, err := m.history.Count()
+	if err != nil {
+		log.Fatalf("Could not count the versions in history (%v)", err)
+	}
+	if count > 0 {
+		return
+	}
+	var (
+		versions []interface{}
+		seeded   int
+		doc      bson.M
+	)
+	insert := func() {
+		if err := m.history.Insert(versions...); err != nil {
+			log.Fatalf("Could not record the first version of the metadata documents (%v)", err)
+		}
+		seeded += len(versions)
+		versions = versions[:0]
+	}
+	iter := m.metadata.Find(nil).Select(ignoreDefault).Iter()
+	for iter.Next(&doc) {
+		if uuid, ok := doc["uuid"].(string); ok {
+			versions = append(versions, metadataVersion{UUID: common.UUID(uuid), Time: seededVersionTime, Document: doc})
+		}
+		if len(versions) == 1000 {
+			insert()
+		}
+		doc = nil
+	}
+	if err = iter.Close(); err != nil {
+		log.Fatalf("Could not read the metadata documents (%v)", err)
+	}
+	if len(versions) > 0 {
+		insert()
+	}
+	if seeded > 0 {
+		log.Noticef("Recorded the first version of %d metadata documents", seeded)
+	}
+}
+
+func (m *mongoStore) GetUnitOfTime(ctx context.Context, uuid common.UUID) (common.UnitOfTime, error) {
 	item, err := m.uotCache.Fetch(string(uuid), m.cacheExpiry, func() (uot interface{}, err error) {
 		var (
 			res interface{}
 			c   int
 		)
 		uot = common.UOT_S
-		query := m.metadata.Find(bson.M{"uuid": uuid}).Select(bson.M{"Properties.UnitofTime": 1})
+		query, err := findWithContext(ctx, m.metadata, bson.M{"uuid": uuid})
+		if err != nil {
+			return
+		}
+		query = query.Select(bson.M{"Properties.UnitofTime": 1})
 		if c, err = query.Count(); err != nil {
 			return
 		} else if c == 0 {
@@ -153,14 +229,18 @@ func (m *mongoStore) GetUnitOfTime(uuid common.UUID) (common.UnitOfTime, error)
 	return common.UOT_S, err
 }
 
-func (m *mongoStore) GetStreamType(uuid common.UUID) (common.StreamType, error) {
+func (m *mongoStore) GetStreamType(ctx context.Context, uuid common.UUID) (common.StreamType, error) {
 	item, err := m.stCache.Fetch(string(uuid), m.cacheExpiry, func() (entry interface{}, err error) {
 		var (
 			res interface{}
 			c   int
 		)
 		entry = common.NUMERIC_STREAM
-		query := m.metadata.Find(bson.M{"uuid": uuid}).Select(bson.M{"Properties.StreamType": 1})
+		query, err := findWithContext(ctx, m.metadata, bson.M{"uuid": uuid})
+		if err != nil {
+			return
+		}
+		query = query.Select(bson.M{"Properties.StreamType": 1})
 		if c, err = query.Count(); err != nil {
 			return
 		} else if c == 0 {
@@ -169,8 +249,10 @@ func (m *mongoStore) GetStreamType(uuid common.UUID) (common.StreamType, error)
 		}
 		err = query.One(&res)
 		if props, found := res.(bson.M)["Properties"]; found {
-			if entry, found := props.(bson.M)["StreamType"]; found {
-				entry = common.StreamType(entry.(int))
+			if st, found := props.(bson.M)["StreamType"]; found {
+				if stInt, isInt := st.(int); isInt && stInt != 0 {
+					entry = common.StreamType(stInt)
+				}
 			}
 		}
 		return
@@ -181,14 +263,18 @@ func (m *mongoStore) GetStreamType(uuid common.UUID) (common.StreamType, error)
 	return common.NUMERIC_STREAM, err
 }
 
-func (m *mongoStore) GetUnitOfMeasure(uuid common.UUID) (string, error) {
+func (m *mongoStore) GetUnitOfMeasure(ctx context.Context, uuid common.UUID) (string, error) {
 	item, err := m.uomCache.Fetch(string(uuid), m.cacheExpiry, func() (entry interface{}, err error) {
 		var (
 			res interface{}
 			c   int
 		)
 		entry = ""
-		query := m.metadata.Find(bson.M{"uuid": uuid}).Select(bson.M{"Properties.UnitofMeasure": 1})
+		query, err := findWithContext(ctx, m.metadata, bson.M{"uuid": uuid})
+		if err != nil {
+			return
+		}
+		query = query.Select(bson.M{"Properties.UnitofMeasure": 1})
 		if c, err = query.Count(); err != nil {
 			return
 		} else if c == 0 {
@@ -208,20 +294,21 @@ func (m *mongoStore) GetUnitOfMeasure(uuid common.UUID) (string, error) {
 }
 
 // Retrieves all tags in the provided list that match the provided where clause.
-func (m *mongoStore) GetTags(tags []string, where bson.M) (common.SmapMessageList, error) {
+func (m *mongoStore) GetTags(ctx context.Context, tags []string, where bson.M) (common.SmapMessageList, error) {
+	res, _, err := m.GetTagsPage(ctx, tags, where, nil, 0, 0)
+	return res, err
+}
+
+func (m *mongoStore) GetTagsPage(ctx context.Context, tags []string, where bson.M, order *common.OrderBy, offset, limit int) (common.SmapMessageList, bool, error) {
 	var (
-		staged      *mgo.Query
-		selectTags  bson.M
-		whereClause bson.M
-		x           []bson.M
+		selectTags bson.M
+		filter     = mongoFilter(where)
+		x          []bson.M
 	)
-	if len(where) != 0 {
-		whereClause = make(bson.M)
-		for wk, wv := range where {
-			whereClause[common.FixMongoKey(wk)] = wv
-		}
+	staged, err := findWithContext(ctx, m.metadata, filter)
+	if err != nil {
+		return nil, false, err
 	}
-	staged = m.metadata.Find(whereClause)
 	if len(tags) == 0 { // select all
 		selectTags = bson.M{"_id": 0, "_api": 0}
 	} else {
@@ -230,7 +317,22 @@ func (m *mongoStore) GetTags(tags []string, where bson.M) (common.SmapMessageLis
 			selectTags[common.FixMongoKey(tag)] = 1
 		}
 	}
-	err := staged.Select(selectTags).All(&x)
+	if order != nil {
+		return m.getOrderedTags(ctx, filter, selectTags, order, offset, limit)
+	}
+	// pages are taken in order of the uuid
+	if offset > 0 || limit > 0 {
+		staged = staged.Sort("uuid").Skip(offset)
+	}
+	// one more document tells whether there is another page
+	if limit > 0 {
+		staged = staged.Limit(limit + 1)
+	}
+	err = staged.Select(selectTags).All(&x)
+	more := limit > 0 && len(x) > limit
+	if more {
+		x = x[:limit]
+	}
 	// trim down empty rows
 	filtered := x[:0]
 	for _, doc := range x {
@@ -238,37 +340,111 @@ func (m *mongoStore) GetTags(tags []string, where bson.M) (common.SmapMessageLis
 			filtered = append(filtered, doc)
 		}
 	}
-	return common.SmapMessageListFromBson(filtered), err
+	return common.SmapMessageListFromBson(filtered), more, err
+}
+
+// Mongo cannot sort numeric strings by their value, so only the uuid and the
+// tag of the matching documents are fetched and sorted, followed by the
+// selected tags of the documents on the page
+func (m *mongoStore) getOrderedTags(ctx context.Context, filter, selectTags bson.M, order *common.OrderBy, offset, limit int) (common.SmapMessageList, bool, error) {
+	var (
+		keys []bson.M
+		x    []bson.M
+		key  = common.FixMongoKey(order.Tag)
+	)
+	query, err := findWithContext(ctx, m.metadata, filter)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := query.Select(bson.M{"_id": 0, "uuid": 1, key: 1}).All(&keys); err != nil {
+		return nil, false, err
+	}
+	sortDocs(keys, order)
+	if offset > len(keys) {
+		offset = len(keys)
+	}
+	keys = keys[offset:]
+	more := limit > 0 && len(keys) > limit
+	if more {
+		keys = keys[:limit]
+	}
+
+	var (
+		uuids    = make([]interface{}, len(keys))
+		position = make(map[interface{}]int, len(keys))
+	)
+	for i, doc := range keys {
+		uuids[i] = doc["uuid"]
+		position[doc["uuid"]] = i
+	}
+	// the uuid puts the documents back in order, even if it is not selected
+	_, selectAll := selectTags["_api"]
+	_, selectUUID := selectTags["uuid"]
+	if !selectAll && !selectUUID {
+		selectTags["uuid"] = 1
+	}
+	if query, err = findWithContext(ctx, m.metadata, bson.M{"uuid": bson.M{"$in": uuids}}); err != nil {
+		return nil, false, err
+	}
+	err = query.Select(selectTags).All(&x)
+	var ordered = make([]bson.M, len(keys))
+	for _, doc := range x {
+		i, found := position[doc["uuid"]]
+		if !found {
+			continue
+		}
+		if !selectAll && !selectUUID {
+			delete(doc, "uuid")
+		}
+		ordered[i] = doc
+	}
+	// trim down empty rows
+	filtered := ordered[:0]
+	for _, doc := range ordered {
+		if len(doc) != 0 {
+			filtered = append(filtered, doc)
+		}
+	}
+	return common.SmapMessageListFromBson(filtered), more, err
 }
 
-func (m *mongoStore) GetDistinct(tag string, where bson.M) (common.DistinctResult, error) {
+func (m *mongoStore) GetDistinct(ctx context.Context, tag string, where bson.M) (common.DistinctResult, error) {
+	var values []interface{}
+	query, err := findWithContext(ctx, m.metadata, mongoFilter(where))
+	if err != nil {
+		return nil, err
+	}
+	if err = query.Distinct(common.FixMongoKey(tag), &values); err != nil {
+		return nil, err
+	}
+	// numbers are formatted like the memory store does, so that e.g. the
+	// number 4 and the string "4" are one value
 	var (
-		result      common.DistinctResult
-		whereClause bson.M
-		fixedTag    = common.FixMongoKey(tag)
+		result = common.DistinctResult{}
+		seen   = make(map[string]struct{})
 	)
-	if len(where) != 0 {
-		whereClause = make(bson.M)
-		for wk, wv := range where {
-			whereClause[common.FixMongoKey(wk)] = wv
+	for _, v := range values {
+		str, ok := v.(string)
+		if !ok {
+			str = fmt.Sprintf("%v", v)
+		}
+		if _, found := seen[str]; !found {
+			seen[str] = struct{}{}
+			result = append(result, str)
 		}
 	}
-	err := m.metadata.Find(where).Distinct(fixedTag, &result)
-	return result, err
+	return result, nil
 }
 
-func (m *mongoStore) GetUUIDs(where bson.M) ([]common.UUID, error) {
+func (m *mongoStore) GetUUIDs(ctx context.Context, where bson.M) ([]common.UUID, error) {
 	var results []common.UUID
 	var x []bson.M
-	var whereClause bson.M
-	if len(where) != 0 {
-		whereClause = make(bson.M)
-		for wk, wv := range where {
-			whereClause[common.FixMongoKey(wk)] = wv
-		}
-	}
 	selectClause := bson.M{"_id": 0, "uuid": 1}
-	err := m.metadata.Find(where).Select(selectClause).All(&x)
+	query, err := findWithContext(ctx, m.metadata, mongoFilter(where))
+	if err != nil {
+		return nil, err
+	}
+	err = query.Select(selectClause).All(&x)
 	results = make([]common.UUID, len(x))
 	for i, doc := range x {
 		results[i] = common.UUID(doc["uuid"].(string))
@@ -276,16 +452,17 @@ func (m *mongoStore) GetUUIDs(where bson.M) ([]common.UUID, error) {
 	return results, err
 }
 
-func (m *mongoStore) SaveTags(msg *common.SmapMessage) error {
+func (m *mongoStore) SaveTags(msg *common.SmapMessage) (bool, error) {
 	if msg == nil {
-		return fmt.Errorf("Message is null")
+		return false, fmt.Errorf("Message is null")
 	}
 	// if the message has no metadata and is already in cache, then skip writing
 	if !msg.HasMetadata() && m.uuidCache.Get(string(msg.UUID)) != nil {
-		return nil
+		return false, nil
 	}
 	// save to the metadata database
-	_, err := m.metadata.Upsert(bson.M{"uuid": msg.UUID}, bson.M{"$set": msg.ToBson()})
+	info, err := m.metadata.Upsert(bson.M{"uuid": msg.UUID}, bson.M{"$set": msg.ToBson()})
+	changed := err == nil && info != nil && (info.Updated > 0 || info.UpsertedId != nil)
 	// and save to the uuid cache
 	m.uuidCache.Set(string(msg.UUID), struct{}{}, m.cacheExpiry)
 	if msg.Properties != nil && msg.Properties.UnitOfTime != 0 {
@@ -294,9 +471,114 @@ func (m *mongoStore) SaveTags(msg *common.SmapMessage) error {
 	if msg.Properties != nil && msg.Properties.UnitOfMeasure != "" {
 		m.uomCache.Set(string(msg.UUID), msg.Properties.UnitOfMeasure, m.cacheExpiry)
 	}
+	if msg.Properties != nil && msg.Properties.StreamType != 0 {
+		m.stCache.Set(string(msg.UUID), msg.Properties.StreamType, m.cacheExpiry)
+	}
+	return changed, err
+}
+
+func (m *mongoStore) GetDefinitions(ctx context.Context, kind string, result interface{}) error {
+	query, err := findWithContext(ctx, m.db.C(kind), nil)
+	if err != nil {
+		return err
+	}
+	return query.Select(bson.M{"_id": 0}).Sort("name").All(result)
+}
+
+func (m *mongoStore) SaveDefinition(kind, name string, definition interface{}) error {
+	_, err := m.db.C(kind).Upsert(bson.M{"name": name}, definition)
+	return err
+}
+
+func (m *mongoStore) RemoveDefinition(kind, name string) error {
+	err := m.db.C(kind).Remove(bson.M{"name": name})
+	if err == mgo.ErrNotFound {
+		return fmt.Errorf("No %v definition named %v", kind, name)
+	}
 	return err
 }
 
+func (m *mongoStore) RecordVersions(uuids []common.UUID, writer string, time uint64) error {
+	var (
+		docs     []bson.M
+		versions []interface{}
+		byUUID   = make(map[common.UUID]bson.M, len(uuids))
+	)
+	if err := m.metadata.Find(bson.M{"uuid": bson.M{"$in": uuids}}).Select(ignoreDefault).All(&docs); err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if uuid, ok := doc["uuid"].(string); ok {
+			byUUID[common.UUID(uuid)] = doc
+		}
+	}
+	for _, uuid := range uuids {
+		doc, found := byUUID[uuid]
+		// removed documents have an empty digest
+		var digest string
+		if found {
+			digest = docDigest(doc)
+		}
+		last, err := m.lastDigest(uuid)
+		if err != nil {
+			return err
+		}
+		if digest == last {
+			continue
+		}
+		versions = append(versions, metadataVersion{UUID: uuid, Time: time, Writer: writer, Removed: !found, Document: doc})
+		m.versionCache.Set(string(uuid), digest, m.cacheExpiry)
+	}
+	if len(versions) == 0 {
+		return nil
+	}
+	return m.history.Insert(versions...)
+}
+
+// returns the digest of the last version of the document, or an empty
+// string if it has none or was removed
+func (m *mongoStore) lastDigest(uuid common.UUID) (string, error) {
+	item, err := m.versionCache.Fetch(string(uuid), m.cacheExpiry, func() (interface{}, error) {
+		var version metadataVersion
+		err := m.history.Find(bson.M{"uuid": uuid}).Sort("-time").One(&version)
+		if err == mgo.ErrNotFound || (err == nil && version.Removed) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		return docDigest(version.Document), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return item.Value().(string), nil
+}
+
+// Aggregations cannot be given a time limit, so the context is only checked
+// before the history is read. The where clause is evaluated by Mongo over the
+// documents of the latest versions
+func (m *mongoStore) AsOf(ctx context.Context, time uint64, where bson.M) (MetadataStore, error) {
+	var docs []bson.M
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pipeline := []bson.M{
+		{"$match": bson.M{"time": bson.M{"$lte": time}}},
+		{"$sort": bson.D{{Name: "uuid", Value: 1}, {Name: "time", Value: 1}}},
+		{"$group": bson.M{"_id": "$uuid", "version": bson.M{"$last": "$$ROOT"}}},
+		{"$match": bson.M{"version.removed": bson.M{"$ne": true}}},
+		{"$replaceRoot": bson.M{"newRoot": "$version.doc"}},
+	}
+	if filter := mongoFilter(where); filter != nil {
+		pipeline = append(pipeline, bson.M{"$match": filter})
+	}
+	pipeline = append(pipeline, bson.M{"$sort": bson.M{"uuid": 1}})
+	if err := m.history.Pipe(pipeline).AllowDiskUse().All(&docs); err != nil {
+		return nil, err
+	}
+	return historicalStore(docs), nil
+}
+
 func (m *mongoStore) GetUser(where bson.M) (string, error) {
 	var x []bson.M
 	err := m.users.Find(where).All(&x)
@@ -314,29 +596,164 @@ func (m *mongoStore) GetUser(where bson.M) (string, error) {
 	return "", err
 }
 
-func (m *mongoStore) UpdateDocs(updates, where bson.M) error {
-	//TODO: loop through matched UUIDs
-	info, updateErr := m.metadata.UpdateAll(where, bson.M{"$set": updates})
+func (m *mongoStore) GetPermissions(user string) ([]string, error) {
+	var doc struct {
+		Permissions []string `bson:"permissions"`
+	}
+	if err := m.users.Find(bson.M{"_id": user}).One(&doc); err == mgo.ErrNotFound {
+		return nil, fmt.Errorf("User not found")
+	} else if err != nil {
+		return nil, err
+	}
+	return doc.Permissions, nil
+}
+
+func (m *mongoStore) UpdateDocs(updates, where bson.M) (int, error) {
+	info, updateErr := m.metadata.UpdateAll(coerceComparisons(where), bson.M{"$set": updates})
+	if updateErr != nil {
+		return 0, updateErr
+	}
 	log.Infof("Updated %v records", info.Updated)
-	return updateErr
+	return info.Updated, nil
 }
 
-func (m *mongoStore) RemoveTags(tags []string, where bson.M) error {
-	//TODO: loop through matched UUIDs
+func (m *mongoStore) RemoveTags(tags []string, where bson.M) (int, error) {
 	updates := bson.M{}
 	for _, tag := range tags {
-		updates[tag] = 1
+		updates[common.FixMongoKey(tag)] = 1
+	}
+	info, updateErr := m.metadata.UpdateAll(coerceComparisons(where), bson.M{"$unset": updates})
+	if updateErr != nil {
+		return 0, updateErr
 	}
-	info, updateErr := m.metadata.UpdateAll(where, bson.M{"$unset": updates})
 	log.Infof("Updated %v records", info.Updated)
-	return updateErr
+	return info.Updated, nil
 }
 
-func (m *mongoStore) RemoveDocs(where bson.M) error {
-	//TODO: loop through matched UUIDs
-	ci, removeErr := m.metadata.RemoveAll(where)
+func (m *mongoStore) RemoveDocs(where bson.M) (int, error) {
+	ci, removeErr := m.metadata.RemoveAll(coerceComparisons(where))
+	if removeErr != nil {
+		return 0, removeErr
+	}
 	log.Infof("Removed %v records", ci.Removed)
-	return removeErr
+	return ci.Removed, nil
+}
+
+// starts a query over the collection that Mongo gives up on once the deadline
+// of the context passes. Fails if the context is done already
+func findWithContext(ctx context.Context, collection *mgo.Collection, filter interface{}) (*mgo.Query, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	query := collection.Find(filter)
+	if deadline, ok := ctx.Deadline(); ok {
+		// a time limit of 0 would mean no limit at all
+		remaining := time.Until(deadline)
+		if remaining < time.Millisecond {
+			remaining = time.Millisecond
+		}
+		query.SetMaxTime(remaining)
+	}
+	return query, nil
+}
+
+// returns the filter Mongo evaluates for a where clause
+func mongoFilter(where bson.M) bson.M {
+	if len(where) == 0 {
+		return nil
+	}
+	var whereClause = make(bson.M)
+	for wk, wv := range where {
+		whereClause[common.FixMongoKey(wk)] = wv
+	}
+	return coerceComparisons(whereClause)
+}
+
+// Mongo only compares values of the same type, so {"Metadata.Floor": {"$gt": 3}}
+// does not match the numeric string "4". Each comparison is rewritten to match
+// numbers directly, which can use an index, or numeric strings through an
+// $expr that converts them to numbers like common.NumericValue (Mongo 4.0 or
+// later)
+func coerceComparisons(where bson.M) bson.M {
+	if len(where) == 0 {
+		return where
+	}
+	var (
+		ret     = bson.M{}
+		coerced []interface{}
+	)
+	for key, cond := range where {
+		if key == "$and" || key == "$or" || key == "$nor" {
+			ret[key] = coerceClauses(cond)
+			continue
+		}
+		ops, isMap := toMap(cond)
+		if !isMap || !isComparison(ops) {
+			ret[key] = cond
+			continue
+		}
+		coerced = append(coerced, bson.M{"$or": []interface{}{
+			bson.M{key: ops},
+			bson.M{key: bson.M{"$regex": common.NumericPattern}, "$expr": comparisonExpr(key, ops)},
+		}})
+	}
+	if len(coerced) > 0 {
+		if clauses, ok := ret["$and"].([]interface{}); ok {
+			coerced = append(clauses, coerced...)
+		}
+		ret["$and"] = coerced
+	}
+	return ret
+}
+
+func coerceClauses(clauses interface{}) interface{} {
+	list, ok := toList(clauses)
+	if !ok {
+		return clauses
+	}
+	ret := make([]interface{}, len(list))
+	for i, clause := range list {
+		if sub, isMap := toMap(clause); isMap {
+			ret[i] = coerceComparisons(sub)
+		} else {
+			ret[i] = clause
+		}
+	}
+	return ret
+}
+
+var numericComparisons = map[string]bool{"$lt": true, "$lte": true, "$gt": true, "$gte": true}
+
+// true if the condition only consists of comparisons against numbers
+func isComparison(ops bson.M) bool {
+	for op, arg := range ops {
+		if !numericComparisons[op] {
+			return false
+		}
+		if _, isNumeric := common.NumericValue(arg); !isNumeric {
+			return false
+		}
+	}
+	return len(ops) > 0
+}
+
+// returns an aggregation expression that is true if the string at the
+// (dot-separated) key is a number that satisfies all the comparisons. Values
+// that are not strings holding a number convert to null, which never matches
+func comparisonExpr(key string, ops bson.M) bson.M {
+	str := bson.M{"$convert": bson.M{"input": "$" + key, "to": "string", "onError": nil, "onNull": nil}}
+	num := bson.M{"$convert": bson.M{"input": bson.M{"$trim": bson.M{"input": str}}, "to": "double", "onError": nil, "onNull": nil}}
+	conditions := []interface{}{bson.M{"$ne": []interface{}{num, nil}}}
+	var sorted []string
+	for op := range ops {
+		sorted = append(sorted, op)
+	}
+	sort.Strings(sorted)
+	for _, op := range sorted {
+		bound, _ := common.NumericValue(ops[op])
+		conditions = append(conditions, bson.M{op: []interface{}{num, bound}})
+	}
+	return bson.M{"$and": conditions}
 }
 
 type mongoSession struct {
@@ -1,6 +1,7 @@
 package archiver
 
 import (
+	"context"
 	"flag"
 	"github.com/jf87/giles2/common"
 	"gopkg.in/mgo.v2/bson"
@@ -100,7 +101,7 @@ func BenchmarkGetUnitOfTime(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		ms.GetUnitOfTime(msg.UUID)
+		ms.GetUnitOfTime(context.Background(), msg.UUID)
 	}
 }
 
@@ -119,7 +120,7 @@ func BenchmarkGetUnitOfTimeParallel(b *testing.B) {
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			ms.GetUnitOfTime(msg.UUID)
+			ms.GetUnitOfTime(context.Background(), msg.UUID)
 		}
 	})
 }
@@ -136,7 +137,7 @@ func TestGetUnitOfTime(t *testing.T) {
 	}
 	ms.SaveTags(msg)
 
-	uot, err := ms.GetUnitOfTime(msg.UUID)
+	uot, err := ms.GetUnitOfTime(context.Background(), msg.UUID)
 	if err != nil {
 		t.Errorf("Err getting uot for %v (%v)", msg, err)
 	}
@@ -157,7 +158,7 @@ func TestGetStreamType(t *testing.T) {
 	}
 	ms.SaveTags(msg)
 
-	st, err := ms.GetStreamType(msg.UUID)
+	st, err := ms.GetStreamType(context.Background(), msg.UUID)
 	if err != nil {
 		t.Errorf("Err getting StreamType for %v (%v)", msg, err)
 	}
@@ -178,7 +179,7 @@ func TestGetUnitOfMeasure(t *testing.T) {
 	}
 	ms.SaveTags(msg)
 
-	uom, err := ms.GetUnitOfMeasure(msg.UUID)
+	uom, err := ms.GetUnitOfMeasure(context.Background(), msg.UUID)
 	if err != nil {
 		t.Errorf("Err getting UnitofMeasure for %v (%v)", msg, err)
 	}
@@ -210,7 +211,7 @@ func TestGetTags(t *testing.T) {
 		},
 	} {
 		ms.SaveTags(test.msg)
-		res, err := ms.GetTags(test.tags, test.where)
+		res, err := ms.GetTags(context.Background(), test.tags, test.where)
 		if err != nil {
 			t.Errorf("Err during GetTags (%v) \n%v", err, test)
 		}
@@ -235,7 +236,7 @@ func BenchmarkGetTags(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		ms.GetTags(tags, where)
+		ms.GetTags(context.Background(), tags, where)
 	}
 }
 
@@ -255,7 +256,7 @@ func BenchmarkGetTagsParallel(b *testing.B) {
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			ms.GetTags(tags, where)
+			ms.GetTags(context.Background(), tags, where)
 		}
 	})
 }
@@ -277,7 +278,7 @@ func TestGetDistinct(t *testing.T) {
 			[]string{"Value1", "Value2"},
 		},
 	} {
-		res, err := ms.GetDistinct(test.tag, test.where)
+		res, err := ms.GetDistinct(context.Background(), test.tag, test.where)
 		if err != nil {
 			t.Errorf("Err during GetDistinct (%v) \n%v", err, test)
 		}
@@ -296,7 +297,7 @@ func TestGetUUIDs(t *testing.T) {
 	ms.SaveTags(msg1)
 	ms.SaveTags(msg2)
 
-	results, err := ms.GetUUIDs(bson.M{"Metadata.Shared": string(commonUUID)})
+	results, err := ms.GetUUIDs(context.Background(), bson.M{"Metadata.Shared": string(commonUUID)})
 
 	if err != nil {
 		t.Errorf("Error running GetUUIDs (%v)", err)
@@ -314,3 +315,69 @@ func TestGetUUIDs(t *testing.T) {
 
 	}
 }
+
+func TestGetUUIDsNumericComparison(t *testing.T) {
+	site := string(common.NewUUID())
+	floors := map[common.UUID]interface{}{
+		common.NewUUID(): "4",
+		common.NewUUID(): 5,
+		common.NewUUID(): " 10 ",
+		common.NewUUID(): "2",
+		common.NewUUID(): "fourth",
+	}
+	var expected = make(map[common.UUID]bool)
+	for uuid, floor := range floors {
+		ms.SaveTags(&common.SmapMessage{Path: "/" + string(uuid), UUID: uuid, Metadata: common.Dict{"Site": site, "Floor": floor}})
+		if n, ok := common.NumericValue(floor); ok && n > 3 {
+			expected[uuid] = true
+		}
+	}
+
+	results, err := ms.GetUUIDs(context.Background(), bson.M{"Metadata.Site": site, "Metadata.Floor": bson.M{"$gt": 3}})
+	if err != nil {
+		t.Fatalf("Error running GetUUIDs (%v)", err)
+	}
+	if len(results) != len(expected) {
+		t.Errorf("Expected %d streams above floor 3, got %v", len(expected), results)
+	}
+	for _, uuid := range results {
+		if !expected[uuid] {
+			t.Errorf("Stream %v on floor %v should not match", uuid, floors[uuid])
+		}
+	}
+}
+
+func TestGetDistinctNumeric(t *testing.T) {
+	site := string(common.NewUUID())
+	for _, floor := range []interface{}{4, "4", 10.5} {
+		uuid := common.NewUUID()
+		ms.SaveTags(&common.SmapMessage{Path: "/" + string(uuid), UUID: uuid, Metadata: common.Dict{"Site": site, "Floor": floor}})
+	}
+	res, err := ms.GetDistinct(context.Background(), "Metadata.Floor", bson.M{"Metadata.Site": site})
+	if err != nil {
+		t.Fatalf("Err during GetDistinct (%v)", err)
+	}
+	if len(res) != 2 {
+		t.Errorf("Expected the floors 4 and 10.5, got %v", res)
+	}
+}
+
+func TestAsOfWhere(t *testing.T) {
+	site := string(common.NewUUID())
+	var uuids []common.UUID
+	for _, floor := range []interface{}{4, "5", 2} {
+		uuid := common.NewUUID()
+		uuids = append(uuids, uuid)
+		ms.SaveTags(&common.SmapMessage{Path: "/" + string(uuid), UUID: uuid, Metadata: common.Dict{"Site": site, "Floor": floor}})
+	}
+	if err := ms.RecordVersions(uuids, "", 100); err != nil {
+		t.Fatalf("Error recording versions (%v)", err)
+	}
+	md, err := ms.AsOf(context.Background(), 100, bson.M{"Metadata.Site": site, "Metadata.Floor": bson.M{"$gt": 3}})
+	if err != nil {
+		t.Fatalf("Error reading the history (%v)", err)
+	}
+	if found, _ := md.GetUUIDs(context.Background(), nil); len(found) != 2 {
+		t.Errorf("Expected the streams above floor 3, got %v", found)
+	}
+}
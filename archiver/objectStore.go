@@ -0,0 +1,34 @@
+package archiver
+
+import (
+	"context"
+
+	"github.com/jf87/giles2/common"
+)
+
+// ObjectStore persists readings of object streams (StreamType OBJECT_STREAM),
+// whose values are arbitrary strings or JSON documents rather than numbers.
+// All times are in nanoseconds. As with TimeseriesStore, only reads take
+// the context of their query; deletes are never abandoned halfway.
+type ObjectStore interface {
+	// saves all object readings in the message
+	AddObjects(msg *common.SmapMessage) error
+
+	// list of UUIDs, reference time in nanoseconds
+	// Retrieves the object before the reference time for the given streams.
+	PrevObjects(context.Context, []common.UUID, uint64) ([]common.SmapObjectResponse, error)
+
+	// list of UUIDs, reference time in nanoseconds
+	// Retrieves the object after the reference time for the given streams.
+	NextObjects(context.Context, []common.UUID, uint64) ([]common.SmapObjectResponse, error)
+
+	// uuids, start time, end time (both in nanoseconds)
+	GetObjects(ctx context.Context, uuids []common.UUID, start uint64, end uint64) ([]common.SmapObjectResponse, error)
+
+	// uuids, start time, end time (both in nanoseconds)
+	// Counts the objects of all the streams, without fetching them
+	CountObjects(ctx context.Context, uuids []common.UUID, start uint64, end uint64) (uint64, error)
+
+	// delete objects
+	DeleteObjects(uuids []common.UUID, start uint64, end uint64) error
+}
@@ -0,0 +1,331 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/jf87/giles2/common"
+)
+
+// APPLY queries pass the raw readings of each stream through a chain of
+// operators, in the spirit of the sMAP operators, e.g.
+//
+//	apply units < window(15min, max) < clip(0, 100) to data in (now -1d, now) where Metadata/Type = 'Meter'
+//
+// As in sMAP, "a < b" applies a to the output of b, so the readings above are
+// clipped first, then windowed and finally converted to canonical units.
+// Operators are created by name from the factories registered with
+// RegisterOperator; the built-in ones are
+//
+//	window(width[, method])	one reading per window, combined with sum, avg,
+//				mean, min, max or count (default mean)
+//	subsample(width)	the first reading of each window
+//	units			converts to canonical units, e.g. W to kW
+//	scale(x)		multiplies by x
+//	offset(x)		adds x
+//	clip(lo, hi)		limits the values to [lo, hi]
+//	missing			removes missing (NaN) values
+
+// The readings of a single stream as they pass through the operators of an
+// APPLY query. Timestamps are in nanoseconds, and Begin/End is the time range
+// of the query
+type OperatorStream struct {
+	UUID          common.UUID
+	UnitOfMeasure string
+	Begin         uint64
+	End           uint64
+	Readings      []*common.SmapNumberReading
+}
+
+// An Operator is one stage of an APPLY query. It can change the readings of
+// the stream as well as its unit of measure
+type Operator interface {
+	Apply(stream *OperatorStream) error
+}
+
+// Creates an operator from the arguments given in the query, e.g. ["0",
+// "100"] for clip(0, 100) or ["15min"] for window(15min)
+type OperatorFactory func(args []string) (Operator, error)
+
+// OperatorFunc turns a function into an Operator
+type OperatorFunc func(stream *OperatorStream) error
+
+func (f OperatorFunc) Apply(stream *OperatorStream) error {
+	return f(stream)
+}
+
+var (
+	operatorLock sync.RWMutex
+	operators    = map[string]OperatorFactory{
+		"window":    newWindowOperator,
+		"subsample": newSubsampleOperator,
+		"units":     newUnitsOperator,
+		"scale":     newScaleOperator,
+		"offset":    newOffsetOperator,
+		"clip":      newClipOperator,
+		"missing":   newMissingOperator,
+	}
+)
+
+// Makes an operator available to APPLY queries under the given name,
+// replacing any operator of the same name
+func RegisterOperator(name string, factory OperatorFactory) {
+	operatorLock.Lock()
+	defer operatorLock.Unlock()
+	operators[name] = factory
+}
+
+// creates the operators of an APPLY query, innermost first
+func newOperators(calls []common.DataFunction) ([]Operator, error) {
+	operatorLock.RLock()
+	defer operatorLock.RUnlock()
+	var ret = make([]Operator, len(calls))
+	for i, call := range calls {
+		factory, found := operators[call.Name]
+		if !found {
+			return nil, fmt.Errorf("Unknown operator %v", call.Name)
+		}
+		op, err := factory(call.Args)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid operator %v (%v)", call.Name, err)
+		}
+		ret[i] = op
+	}
+	return ret, nil
+}
+
+// selects the raw data for the matching streams within the range given by
+// Begin/End and passes each stream through the operators in params.Operators
+func (a *Archiver) ApplyOperators(ctx context.Context, params *common.DataParams) (result common.SmapMessageList, err error) {
+	if params.IsStatistical || params.IsWindow || len(params.Functions) > 0 {
+		return result, fmt.Errorf("APPLY works on raw data, use the window operator instead")
+	}
+	ops, err := newOperators(params.Operators)
+	if err != nil {
+		return
+	}
+	if err = a.prepareDataParams(ctx, params); err != nil {
+		return
+	}
+	// switch order so its consistent
+	if params.End < params.Begin {
+		params.Begin, params.End = params.End, params.Begin
+	}
+	// operators are only defined for numeric streams
+	numeric, _, err := a.splitByStreamType(ctx, params.UUIDs)
+	if err != nil {
+		return
+	}
+	readings, err := a.getData(ctx, numeric, params)
+	if err != nil {
+		return
+	}
+
+	var units = make(map[common.UUID]string)
+	for i, resp := range readings {
+		stream := &OperatorStream{UUID: resp.UUID, Begin: params.Begin, End: params.End, Readings: resp.Readings}
+		if stream.UnitOfMeasure, err = a.mdStore.GetUnitOfMeasure(ctx, resp.UUID); err != nil {
+			return
+		}
+		original := stream.UnitOfMeasure
+		for _, op := range ops {
+			if err = op.Apply(stream); err != nil {
+				return
+			}
+		}
+		readings[i].Readings = stream.Readings
+		if stream.UnitOfMeasure != original {
+			units[resp.UUID] = stream.UnitOfMeasure
+		}
+	}
+
+	result = a.packResults(params, readings)
+	// report the new unit of measure of streams the operators converted
+	for _, msg := range result {
+		if unit, found := units[msg.UUID]; found {
+			msg.Properties = &common.SmapProperties{UnitOfMeasure: unit}
+		}
+	}
+	return
+}
+
+// parses the arguments of an operator as numbers
+func numberArgs(args []string, count int) ([]float64, error) {
+	if len(args) != count {
+		return nil, fmt.Errorf("expected %d arguments, got %d", count, len(args))
+	}
+	var ret = make([]float64, count)
+	for i, arg := range args {
+		num, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v is not a number", arg)
+		}
+		ret[i] = num
+	}
+	return ret, nil
+}
+
+// parses an operator argument such as 15min as a width in nanoseconds
+func widthArg(arg string) (uint64, error) {
+	dur, err := common.ParseDuration(arg)
+	if err != nil {
+		return 0, err
+	}
+	if dur <= 0 {
+		return 0, fmt.Errorf("width %v has to be positive", arg)
+	}
+	return uint64(dur.Nanoseconds()), nil
+}
+
+// applies fn to the value of every reading
+func mapValues(fn func(float64) float64) Operator {
+	return OperatorFunc(func(stream *OperatorStream) error {
+		for _, rdg := range stream.Readings {
+			rdg.Value = fn(rdg.Value)
+		}
+		return nil
+	})
+}
+
+// groups the readings into windows of the given width starting at Begin, and
+// replaces each window by the reading that pick returns
+func windowOperator(width uint64, pick func(start uint64, readings []*common.SmapNumberReading) *common.SmapNumberReading) Operator {
+	return OperatorFunc(func(stream *OperatorStream) error {
+		var (
+			ret         = []*common.SmapNumberReading{}
+			first       int
+			windowStart uint64
+		)
+		for i, rdg := range stream.Readings {
+			start := rdg.Time - (rdg.Time-stream.Begin)%width
+			if i > 0 && start != windowStart {
+				ret = append(ret, pick(windowStart, stream.Readings[first:i]))
+				first = i
+			}
+			windowStart = start
+		}
+		if len(stream.Readings) > 0 {
+			ret = append(ret, pick(windowStart, stream.Readings[first:]))
+		}
+		stream.Readings = ret
+		return nil
+	})
+}
+
+func newWindowOperator(args []string) (Operator, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("expected a width and an optional method")
+	}
+	width, err := widthArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	method := "mean"
+	if len(args) == 2 {
+		method = args[1]
+	}
+	aggregate, found := aggregates[method]
+	if !found {
+		return nil, fmt.Errorf("unknown method %v", method)
+	}
+	return windowOperator(width, func(start uint64, readings []*common.SmapNumberReading) *common.SmapNumberReading {
+		var values = make([]float64, len(readings))
+		for i, rdg := range readings {
+			values[i] = rdg.Value
+		}
+		return &common.SmapNumberReading{Time: start, UoT: common.UOT_NS, Value: aggregate(values)}
+	}), nil
+}
+
+func newSubsampleOperator(args []string) (Operator, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected a width")
+	}
+	width, err := widthArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return windowOperator(width, func(start uint64, readings []*common.SmapNumberReading) *common.SmapNumberReading {
+		return readings[0]
+	}), nil
+}
+
+type unitConversion struct {
+	unit    string
+	convert func(float64) float64
+}
+
+// the canonical unit for each unit the units operator converts
+var unitConversions = map[string]unitConversion{
+	"W":     {"kW", func(v float64) float64 { return v / 1000 }},
+	"Watts": {"kW", func(v float64) float64 { return v / 1000 }},
+	"Wh":    {"kWh", func(v float64) float64 { return v / 1000 }},
+	"MW":    {"kW", func(v float64) float64 { return v * 1000 }},
+	"MWh":   {"kWh", func(v float64) float64 { return v * 1000 }},
+	"F":     {"C", func(v float64) float64 { return (v - 32) * 5 / 9 }},
+	"°F":    {"C", func(v float64) float64 { return (v - 32) * 5 / 9 }},
+	"K":     {"C", func(v float64) float64 { return v - 273.15 }},
+}
+
+func newUnitsOperator(args []string) (Operator, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("expected no arguments")
+	}
+	return OperatorFunc(func(stream *OperatorStream) error {
+		conversion, found := unitConversions[stream.UnitOfMeasure]
+		if !found {
+			return nil
+		}
+		for _, rdg := range stream.Readings {
+			rdg.Value = conversion.convert(rdg.Value)
+		}
+		stream.UnitOfMeasure = conversion.unit
+		return nil
+	}), nil
+}
+
+func newScaleOperator(args []string) (Operator, error) {
+	nums, err := numberArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return mapValues(func(v float64) float64 { return v * nums[0] }), nil
+}
+
+func newOffsetOperator(args []string) (Operator, error) {
+	nums, err := numberArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return mapValues(func(v float64) float64 { return v + nums[0] }), nil
+}
+
+func newClipOperator(args []string) (Operator, error) {
+	nums, err := numberArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	if nums[0] > nums[1] {
+		return nil, fmt.Errorf("lower bound %v is above upper bound %v", nums[0], nums[1])
+	}
+	return mapValues(func(v float64) float64 { return math.Max(nums[0], math.Min(nums[1], v)) }), nil
+}
+
+func newMissingOperator(args []string) (Operator, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("expected no arguments")
+	}
+	return OperatorFunc(func(stream *OperatorStream) error {
+		var ret = []*common.SmapNumberReading{}
+		for _, rdg := range stream.Readings {
+			if !math.IsNaN(rdg.Value) {
+				ret = append(ret, rdg)
+			}
+		}
+		stream.Readings = ret
+		return nil
+	}), nil
+}
@@ -0,0 +1,63 @@
+package archiver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestApplyQueries(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	base, minute := uint64(1451606400000000000), uint64(time.Minute)
+	msg := &common.SmapMessage{UUID: common.NewUUID(), Path: "/meter", Metadata: common.Dict{"Type": "Meter"},
+		Properties: &common.SmapProperties{UnitOfMeasure: "W", UnitOfTime: common.UOT_NS, StreamType: common.NUMERIC_STREAM}}
+	for i, value := range []float64{1000, 3000, -500, 8000, 2000, 4000} {
+		msg.Readings = append(msg.Readings, &common.SmapNumberReading{Time: base + uint64(i)*5*minute, UoT: common.UOT_NS, Value: value})
+	}
+	if err := a.AddData(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// registered operators can be used like the built-in ones
+	RegisterOperator("double", func(args []string) (Operator, error) {
+		return mapValues(func(v float64) float64 { return 2 * v }), nil
+	})
+
+	for _, test := range []struct {
+		query  string
+		times  []uint64
+		values []float64
+		unit   string
+	}{
+		{"apply scale(2) < offset(-1000) to data in (1451606400, 1451608200) as ns where Metadata/Type = 'Meter'",
+			[]uint64{0, 5, 10, 15, 20, 25}, []float64{0, 4000, -3000, 14000, 2000, 6000}, ""},
+		{"apply clip(0, 5000) to data in (1451606400, 1451608200) as ns where Metadata/Type = 'Meter'",
+			[]uint64{0, 5, 10, 15, 20, 25}, []float64{1000, 3000, 0, 5000, 2000, 4000}, ""},
+		{"apply window(15min, max) < clip(0, 5000) to data in (1451606400, 1451608200) as ns where Metadata/Type = 'Meter'",
+			[]uint64{0, 15}, []float64{3000, 5000}, ""},
+		{"apply units < window(15min, sum) to data in (1451606400, 1451608200) as ns where Metadata/Type = 'Meter'",
+			[]uint64{0, 15}, []float64{3.5, 14}, "kW"},
+		{"apply subsample(10min) to data in (1451606400, 1451608200) as ns where Metadata/Type = 'Meter'",
+			[]uint64{0, 10, 20}, []float64{1000, -500, 2000}, ""},
+		{"apply double < missing to data in (1451606400, 1451607000) resample(5min, none) fill(null) as ns where Metadata/Type = 'Meter'",
+			[]uint64{0, 5}, []float64{2000, 6000}, ""},
+	} {
+		series := checkSeries(t, a, test.query, base, test.times, test.values)
+		if series != nil && test.unit != "" && (series.Properties == nil || series.Properties.UnitOfMeasure != test.unit) {
+			t.Errorf("%v: expected unit %v, got %+v", test.query, test.unit, series.Properties)
+		}
+	}
+
+	for _, query := range []string{
+		"apply median to data in (1451606400, 1451608200) where Metadata/Type = 'Meter'",
+		"apply clip(5000, 0) to data in (1451606400, 1451608200) where Metadata/Type = 'Meter'",
+		"apply window(15min, median) to data in (1451606400, 1451608200) where Metadata/Type = 'Meter'",
+	} {
+		if _, err := a.HandleQuery(context.Background(), query); err == nil {
+			t.Errorf("%v: should be rejected", query)
+		}
+	}
+}
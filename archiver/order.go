@@ -0,0 +1,77 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jf87/giles2/common"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ORDER BY sorts the documents of a metadata query, or selects the streams of
+// a data query in order, by the value of a tag:
+//
+//	select data in (now -1h, now) streamlimit 10 where Metadata/Type = 'Meter' order by Metadata/Floor desc
+//
+// returns the 10 streams on the highest floors. As in where clauses, numeric
+// strings are compared by their value, so the order is computed here rather
+// than by Mongo. Streams without the tag come last, and streams with the same
+// value are ordered by their UUID.
+
+// compares two tag values: numbers before other values, then by value
+func compareTagValues(x, y interface{}) int {
+	xnum, xIsNum := common.NumericValue(x)
+	ynum, yIsNum := common.NumericValue(y)
+	switch {
+	case xIsNum && yIsNum:
+		if xnum < ynum {
+			return -1
+		} else if xnum > ynum {
+			return 1
+		}
+		return 0
+	case xIsNum:
+		return -1
+	case yIsNum:
+		return 1
+	}
+	xstr, ystr := fmt.Sprintf("%v", x), fmt.Sprintf("%v", y)
+	if xstr < ystr {
+		return -1
+	} else if xstr > ystr {
+		return 1
+	}
+	return 0
+}
+
+// sorts metadata documents by the tag of the order
+func sortDocs(docs []bson.M, order *common.OrderBy) {
+	var key = common.FixMongoKey(order.Tag)
+	sort.SliceStable(docs, func(i, j int) bool {
+		x, xFound := lookupPath(docs[i], key)
+		y, yFound := lookupPath(docs[j], key)
+		if xFound != yFound {
+			return xFound
+		}
+		if xFound {
+			if cmp := compareTagValues(x, y); cmp != 0 {
+				return (cmp < 0) != order.Descending
+			}
+		}
+		return fmt.Sprintf("%v", docs[i]["uuid"]) < fmt.Sprintf("%v", docs[j]["uuid"])
+	})
+}
+
+// returns the streams matching the where clause in the given order
+func orderedUUIDs(ctx context.Context, md MetadataStore, where common.Dict, order *common.OrderBy) ([]common.UUID, error) {
+	res, _, err := md.GetTagsPage(ctx, []string{"uuid"}, where.ToBson(), order, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	var uuids = make([]common.UUID, 0, len(res))
+	for _, msg := range res {
+		uuids = append(uuids, msg.UUID)
+	}
+	return uuids, nil
+}
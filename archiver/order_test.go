@@ -0,0 +1,63 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestOrderBy(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	base := uint64(1451606400000000000)
+	// floors are numeric strings, and one room has no floor
+	var rooms = make(map[string]common.UUID)
+	for i, floor := range []string{"2", "10", "", "1"} {
+		msg := &common.SmapMessage{UUID: common.NewUUID(), Path: fmt.Sprintf("/room%d", i), Metadata: common.Dict{"Type": "Room"},
+			Readings: []common.Reading{&common.SmapNumberReading{Time: base, UoT: common.UOT_NS, Value: float64(i)}}}
+		if floor != "" {
+			msg.Metadata["Floor"] = floor
+		}
+		if err := a.AddData(msg); err != nil {
+			t.Fatal(err)
+		}
+		rooms[floor] = msg.UUID
+	}
+
+	for _, test := range []struct {
+		query  string
+		floors []string
+	}{
+		{"select uuid where Metadata/Type = 'Room' order by Metadata/Floor", []string{"1", "2", "10", ""}},
+		{"select uuid where Metadata/Type = 'Room' order by Metadata/Floor asc limit 2 offset 1", []string{"2", "10"}},
+		{"select uuid where Metadata/Type = 'Room' order by Metadata/Floor desc", []string{"10", "2", "1", ""}},
+		{"select Metadata/Floor where Metadata/Type = 'Room' order by Metadata/Floor desc", []string{"10", "2", "1"}},
+		{"select data in (1451606400, 1451606500) streamlimit 2 where Metadata/Type = 'Room' order by Metadata/Floor desc", []string{"10", "2"}},
+	} {
+		res, err := a.HandleQuery(context.Background(), test.query)
+		if err != nil {
+			t.Errorf("%v: %v", test.query, err)
+			continue
+		}
+		if page, truncated := res.(common.ResultPage); truncated {
+			res = page.Results
+		}
+		result := res.(common.SmapMessageList)
+		if len(result) != len(test.floors) {
+			t.Errorf("%v: expected %d results, got %v", test.query, len(test.floors), result)
+			continue
+		}
+		for i, msg := range result {
+			if msg.UUID == "" {
+				// only the floor was selected
+				if floor := msg.Metadata["Floor"]; floor != test.floors[i] {
+					t.Errorf("%v: expected floor %v at %d, got %v", test.query, test.floors[i], i, floor)
+				}
+			} else if msg.UUID != rooms[test.floors[i]] {
+				t.Errorf("%v: expected the room on floor %q at %d, got %v", test.query, test.floors[i], i, msg.UUID)
+			}
+		}
+	}
+}
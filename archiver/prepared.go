@@ -0,0 +1,46 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+// Queries that clients send over and over with different values can be
+// prepared once, with $1, $2, ... parameters in place of the values:
+//
+//	select data before now where uuid = $1
+//
+// and then evaluated with values bound to the parameters. The values are
+// strings or numbers and are substituted as literals, so unlike values
+// pasted into the text of a query, they cannot change what the query does.
+// Queries are checked when they are prepared. Prepared queries are kept in
+// memory until giles restarts, or until too many other queries have been
+// prepared or evaluated since.
+
+// Registers a query with parameters, which is then evaluated by HandlePrepared
+func (a *Archiver) Prepare(querystring string) (common.PreparedQuery, error) {
+	return a.qp.Prepare(querystring)
+}
+
+// Evaluates the prepared query with the given values bound to its parameters
+func (a *Archiver) HandlePrepared(ctx context.Context, id string, params []interface{}) (QueryResult, error) {
+	return a.HandlePreparedBy(ctx, id, params, "")
+}
+
+// Same as HandlePrepared, but records the writer with any change the query
+// makes to the metadata
+func (a *Archiver) HandlePreparedBy(ctx context.Context, id string, params []interface{}, writer string) (QueryResult, error) {
+	start := time.Now()
+	parsed, err := a.qp.ParsePrepared(id, params)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Err != nil {
+		return nil, fmt.Errorf("Error (%v) in prepared query \"%v\" (error at %v)", parsed.Err, parsed.Querystring, parsed.ErrPos)
+	}
+	parsed.Writer = writer
+	return a.evaluateQuery(traceQuery(ctx, parsed, start), parsed)
+}
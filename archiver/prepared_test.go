@@ -0,0 +1,54 @@
+package archiver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestPreparedQueries(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	base := uint64(1451606400000000000)
+	meter := &common.SmapMessage{UUID: common.NewUUID(), Path: "/meter", Metadata: common.Dict{"Type": "Meter"},
+		Readings: []common.Reading{
+			&common.SmapNumberReading{Time: base, UoT: common.UOT_NS, Value: 1},
+			&common.SmapNumberReading{Time: base + 1000000000, UoT: common.UOT_NS, Value: 2},
+		}}
+	if err := a.AddData(meter); err != nil {
+		t.Fatal(err)
+	}
+
+	prepared, err := a.Prepare("select data in (1451606400, 1451606500) limit $2 where uuid = $1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prepared.Parameters != 2 {
+		t.Fatalf("Expected 2 parameters, got %+v", prepared)
+	}
+	if res, err := a.HandlePrepared(context.Background(), prepared.ID, []interface{}{"x' or uuid != 'y", 1}); err != nil || len(res.(common.SmapMessageList)) != 0 {
+		t.Errorf("Expected the value to only be compared to the uuid, got %v (%v)", res, err)
+	}
+
+	// the cursor of a page continues the prepared query with the same values
+	res, err := a.HandlePrepared(context.Background(), prepared.ID, []interface{}{string(meter.UUID), 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, ok := res.(common.ResultPage)
+	if !ok || len(page.Results) != 1 || len(page.Results[0].Readings) != 1 {
+		t.Fatalf("Expected a page with the first reading, got %v", res)
+	}
+	res, err = a.HandleCursor(context.Background(), page.Next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next, ok := res.(common.SmapMessageList); !ok || len(next) != 1 || next[0].Readings[0].GetValue() != float64(2) {
+		t.Errorf("Expected the second reading, got %v", res)
+	}
+
+	if _, err := a.HandlePrepared(context.Background(), prepared.ID, []interface{}{string(meter.UUID)}); err == nil {
+		t.Error("Expected an error for a missing parameter")
+	}
+}
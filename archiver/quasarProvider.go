@@ -2,6 +2,7 @@ package archiver
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"sync"
@@ -111,11 +112,16 @@ func (q *quasarDB) AddMessage(msg *common.SmapMessage) error {
 	return nil
 }
 
-func (quasar *quasarDB) queryNearestValue(uuids []common.UUID, start uint64, backwards bool) ([]common.SmapNumbersResponse, error) {
+func (quasar *quasarDB) queryNearestValue(ctx context.Context, uuids []common.UUID, start uint64, backwards bool) ([]common.SmapNumbersResponse, error) {
 	var ret = make([]common.SmapNumbersResponse, len(uuids))
 	conn := quasar.connpool.Get()
 	defer quasar.connpool.Put(conn)
 	for i, uu := range uuids {
+		// requests are answered in order on the connection, so a cancelled
+		// query stops between streams rather than in the middle of a response
+		if err := ctx.Err(); err != nil {
+			return ret, err
+		}
 		seg := capn.NewBuffer(nil)
 		req := qsr.NewRootRequest(seg)
 		qnv := qsr.NewCmdQueryNearestValue(seg)
@@ -138,19 +144,22 @@ func (quasar *quasarDB) queryNearestValue(uuids []common.UUID, start uint64, bac
 	return ret, nil
 }
 
-func (q *quasarDB) Prev(uuids []common.UUID, start uint64) ([]common.SmapNumbersResponse, error) {
-	return q.queryNearestValue(uuids, start, true)
+func (q *quasarDB) Prev(ctx context.Context, uuids []common.UUID, start uint64) ([]common.SmapNumbersResponse, error) {
+	return q.queryNearestValue(ctx, uuids, start, true)
 }
 
-func (q *quasarDB) Next(uuids []common.UUID, start uint64) ([]common.SmapNumbersResponse, error) {
-	return q.queryNearestValue(uuids, start, false)
+func (q *quasarDB) Next(ctx context.Context, uuids []common.UUID, start uint64) ([]common.SmapNumbersResponse, error) {
+	return q.queryNearestValue(ctx, uuids, start, false)
 }
 
-func (q *quasarDB) GetData(uuids []common.UUID, start uint64, end uint64) ([]common.SmapNumbersResponse, error) {
+func (q *quasarDB) GetData(ctx context.Context, uuids []common.UUID, start uint64, end uint64) ([]common.SmapNumbersResponse, error) {
 	var ret = make([]common.SmapNumbersResponse, len(uuids))
 	conn := q.connpool.Get()
 	defer q.connpool.Put(conn)
 	for i, uu := range uuids {
+		if err := ctx.Err(); err != nil {
+			return ret, err
+		}
 		seg := capn.NewBuffer(nil)
 		req := qsr.NewRootRequest(seg)
 		qnv := qsr.NewCmdQueryStandardValues(seg)
@@ -173,11 +182,30 @@ func (q *quasarDB) GetData(uuids []common.UUID, start uint64, end uint64) ([]com
 	return ret, nil
 }
 
-func (q *quasarDB) StatisticalData(uuids []common.UUID, pointWidth int, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
+// quasar always returns the whole range, which is cut to the limit afterwards
+func (q *quasarDB) GetDataPage(ctx context.Context, uuids []common.UUID, starts []uint64, end uint64, limit int) ([]common.SmapNumbersResponse, error) {
+	var ret = make([]common.SmapNumbersResponse, len(uuids))
+	for i, uu := range uuids {
+		sr, err := q.GetData(ctx, []common.UUID{uu}, starts[i], end)
+		if err != nil {
+			return ret, err
+		}
+		ret[i] = sr[0]
+		if limit > 0 && len(ret[i].Readings) > limit {
+			ret[i].Readings = ret[i].Readings[:limit]
+		}
+	}
+	return ret, nil
+}
+
+func (q *quasarDB) StatisticalData(ctx context.Context, uuids []common.UUID, pointWidth int, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
 	var ret = make([]common.StatisticalNumbersResponse, len(uuids))
 	conn := q.connpool.Get()
 	defer q.connpool.Put(conn)
 	for i, uu := range uuids {
+		if err := ctx.Err(); err != nil {
+			return ret, err
+		}
 		seg := capn.NewBuffer(nil)
 		req := qsr.NewRootRequest(seg)
 		query := qsr.NewCmdQueryStatisticalValues(seg)
@@ -202,11 +230,14 @@ func (q *quasarDB) StatisticalData(uuids []common.UUID, pointWidth int, start, e
 }
 
 //TODO: fix?
-func (q *quasarDB) WindowData(uuids []common.UUID, pointWidth, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
+func (q *quasarDB) WindowData(ctx context.Context, uuids []common.UUID, pointWidth, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
 	var ret = make([]common.StatisticalNumbersResponse, len(uuids))
 	conn := q.connpool.Get()
 	defer q.connpool.Put(conn)
 	for i, uu := range uuids {
+		if err := ctx.Err(); err != nil {
+			return ret, err
+		}
 		seg := capn.NewBuffer(nil)
 		req := qsr.NewRootRequest(seg)
 		query := qsr.NewCmdQueryStatisticalValues(seg)
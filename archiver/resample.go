@@ -0,0 +1,137 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/jf87/giles2/common"
+)
+
+// Resampling returns the readings of each stream on a regular grid starting
+// at the beginning of the time range, e.g.
+//
+//	select data in (now -1h, now) resample(1min, linear) fill(previous) where Metadata/Type = 'Meter'
+//
+// returns one reading per minute. The method decides the value at each point:
+// previous holds the most recent reading (also from before the time range),
+// linear interpolates between the readings around the point and none takes
+// the mean of the readings until the next point. Points without a value are
+// left out unless fill gives a number, null or the previous point.
+
+// the most points a single stream is resampled to
+const maxResamplePoints = 1000000
+
+// fetches the readings of the numeric streams within the range given by
+// Begin/End and resamples them if the query asks for it
+func (a *Archiver) getData(ctx context.Context, uuids []common.UUID, params *common.DataParams) ([]common.SmapNumbersResponse, error) {
+	readings, err := a.getRawData(ctx, uuids, params.Begin, params.End)
+	if err != nil || params.Resample == nil || len(uuids) == 0 {
+		return readings, err
+	}
+	var resample = params.Resample
+	if resample.Width == 0 {
+		return readings, fmt.Errorf("Resample width has to be positive")
+	}
+	if points := (params.End - params.Begin) / resample.Width; points > maxResamplePoints {
+		return readings, fmt.Errorf("Resampling to %v points per stream exceeds the limit of %v", points, maxResamplePoints)
+	}
+
+	// previous and linear need the readings just outside of the range
+	var before, after = map[common.UUID]*common.SmapNumberReading{}, map[common.UUID]*common.SmapNumberReading{}
+	if resample.Method != common.RESAMPLE_NONE {
+		prev, err := a.prevData(ctx, uuids, params.Begin)
+		if err != nil {
+			return readings, err
+		}
+		for _, resp := range prev {
+			if len(resp.Readings) > 0 {
+				before[resp.UUID] = resp.Readings[0]
+			}
+		}
+	}
+	if resample.Method == common.RESAMPLE_LINEAR {
+		next, err := a.nextData(ctx, uuids, params.End)
+		if err != nil {
+			return readings, err
+		}
+		for _, resp := range next {
+			if len(resp.Readings) > 0 {
+				after[resp.UUID] = resp.Readings[0]
+			}
+		}
+	}
+
+	for i, resp := range readings {
+		readings[i].Readings = resampleSeries(resp.Readings, before[resp.UUID], after[resp.UUID], params.Begin, params.End, resample)
+	}
+	return readings, nil
+}
+
+// Returns a reading at every Begin + k*Width before End. before and after are
+// the readings immediately outside of the range, if any
+func resampleSeries(readings []*common.SmapNumberReading, before, after *common.SmapNumberReading, begin, end uint64, resample *common.Resample) []*common.SmapNumberReading {
+	var (
+		ret = []*common.SmapNumberReading{}
+		// index of the first reading after the current point
+		next int
+	)
+	for t := begin; t < end; t += resample.Width {
+		var (
+			value float64
+			found bool
+		)
+		switch resample.Method {
+		case common.RESAMPLE_PREVIOUS, common.RESAMPLE_LINEAR:
+			for next < len(readings) && readings[next].Time <= t {
+				next += 1
+			}
+			var prev, following = before, after
+			if next > 0 {
+				prev = readings[next-1]
+			}
+			if next < len(readings) {
+				following = readings[next]
+			}
+			switch {
+			case prev == nil:
+			case resample.Method == common.RESAMPLE_PREVIOUS || prev.Time == t:
+				value, found = prev.Value, true
+			case following != nil:
+				fraction := float64(t-prev.Time) / float64(following.Time-prev.Time)
+				value, found = prev.Value+fraction*(following.Value-prev.Value), true
+			}
+		case common.RESAMPLE_NONE:
+			var sum, count float64
+			for next < len(readings) && readings[next].Time < t+resample.Width {
+				sum += readings[next].Value
+				count += 1
+				next += 1
+			}
+			if count > 0 {
+				value, found = sum/count, true
+			}
+		}
+
+		if !found {
+			switch resample.Fill {
+			case common.FILL_VALUE:
+				value, found = resample.FillValue, true
+			case common.FILL_NULL:
+				value, found = math.NaN(), true
+			case common.FILL_PREVIOUS:
+				if len(ret) > 0 {
+					value, found = ret[len(ret)-1].Value, true
+				}
+			}
+		}
+		if found {
+			ret = append(ret, &common.SmapNumberReading{Time: t, UoT: common.UOT_NS, Value: value})
+		}
+		// avoid wrapping around at the end of the time range
+		if t > math.MaxUint64-resample.Width {
+			break
+		}
+	}
+	return ret
+}
@@ -0,0 +1,64 @@
+package archiver
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestResampleQueries(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	base, minute := uint64(1451606400000000000), uint64(time.Minute)
+	// readings before the range, at 1min and 2min, then a gap until after the range
+	msg := &common.SmapMessage{UUID: common.NewUUID(), Path: "/meter", Metadata: common.Dict{"Type": "Meter"}}
+	for _, rdg := range []struct {
+		time  uint64
+		value float64
+	}{{base - minute, 0}, {base + minute, 2}, {base + 2*minute, 4}, {base + 6*minute, 12}} {
+		msg.Readings = append(msg.Readings, &common.SmapNumberReading{Time: rdg.time, UoT: common.UOT_NS, Value: rdg.value})
+	}
+	if err := a.AddData(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	nan := math.NaN()
+	for _, test := range []struct {
+		query  string
+		times  []uint64
+		values []float64
+	}{
+		{"select data in (1451606400, 1451606640) resample(1min, previous) as ns where Metadata/Type = 'Meter'",
+			[]uint64{0, 1, 2, 3}, []float64{0, 2, 4, 4}},
+		{"select data in (1451606400, 1451606640) resample(1min, linear) as ns where Metadata/Type = 'Meter'",
+			[]uint64{0, 1, 2, 3}, []float64{1, 2, 4, 6}},
+		{"select data in (1451606400, 1451606640) resample(1min, none) as ns where Metadata/Type = 'Meter'",
+			[]uint64{1, 2}, []float64{2, 4}},
+		{"select data in (1451606400, 1451606640) resample(1min, none) fill(-1) as ns where Metadata/Type = 'Meter'",
+			[]uint64{0, 1, 2, 3}, []float64{-1, 2, 4, -1}},
+		{"select data in (1451606400, 1451606640) resample(1min, none) fill(previous) as ns where Metadata/Type = 'Meter'",
+			[]uint64{1, 2, 3}, []float64{2, 4, 4}},
+		{"select data in (1451606400, 1451606640) resample(1min, none) fill(null) as ns where Metadata/Type = 'Meter'",
+			[]uint64{0, 1, 2, 3}, []float64{nan, 2, 4, nan}},
+	} {
+		checkSeries(t, a, test.query, base, test.times, test.values)
+	}
+
+	// missing values are null in JSON
+	if b, err := json.Marshal(&common.SmapNumberReading{Time: base, Value: nan}); err != nil || string(b) != "[1451606400000000000,null]" {
+		t.Errorf("Expected a null value, got %s (%v)", b, err)
+	}
+
+	for _, query := range []string{
+		"select data in (1451606400, 1451606640) resample(1min, cubic) where Metadata/Type = 'Meter'",
+		"select data in (1451606400, 1451606640) resample(1min, none) fill(next) where Metadata/Type = 'Meter'",
+	} {
+		if _, err := a.HandleQuery(context.Background(), query); err == nil {
+			t.Errorf("%v: should be rejected", query)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+// Retention rules are stored in the metadata store and applied periodically:
+// for every rule, the where clause is evaluated against the metadata and
+// readings older than the rule's Keep duration are deleted from the matching
+// streams. If several rules match a stream, the shortest one wins simply by
+// deleting the most.
+
+// returns all retention rules
+func (a *Archiver) GetRetentionRules(ctx context.Context) (common.RetentionRules, error) {
+	rules := common.RetentionRules{}
+	err := a.mdStore.GetDefinitions(ctx, retentionDefinitions, &rules)
+	return rules, err
+}
+
+// checks and saves the rule, replacing any rule with the same name. Rules
+// delete readings, so the writer needs the same permission as for a DELETE
+// query
+func (a *Archiver) SaveRetentionRule(rule common.RetentionRule, writer string) error {
+	if err := a.checkDeletePermission(writer); err != nil {
+		return err
+	}
+	if rule.Name == "" {
+		return fmt.Errorf("Retention rule needs a name")
+	}
+	if keep, err := common.ParseDuration(rule.Keep); err != nil {
+		return err
+	} else if keep <= 0 {
+		return fmt.Errorf("Retention rule %v has to keep data for a positive duration", rule.Name)
+	}
+	if _, err := a.retentionWhere(rule); err != nil {
+		return err
+	}
+	return a.mdStore.SaveDefinition(retentionDefinitions, rule.Name, rule)
+}
+
+func (a *Archiver) RemoveRetentionRule(name string) error {
+	return a.mdStore.RemoveDefinition(retentionDefinitions, name)
+}
+
+func (a *Archiver) retentionWhere(rule common.RetentionRule) (common.Dict, error) {
+	parsed := a.qp.Parse("select uuid where " + rule.Where)
+	if parsed.Err != nil {
+		return nil, fmt.Errorf("Error (%v) in where clause of retention rule %v (error at %v)", parsed.Err, rule.Name, parsed.ErrPos)
+	}
+	return parsed.Where, nil
+}
+
+func (a *Archiver) startRetention(interval time.Duration) {
+	log.Noticef("Applying retention rules every %v", interval)
+	go func() {
+		for range time.Tick(interval) {
+			if err := a.applyRetention(); err != nil {
+				log.Errorf("Could not apply retention rules (%v)", err)
+			}
+		}
+	}()
+}
+
+// deletes the readings that have expired under each retention rule. Nothing
+// is deleted unless AllowDelete is set, even if rules were saved while it was
+func (a *Archiver) applyRetention() error {
+	// retention is applied in the background, so it is never given up on
+	ctx := context.Background()
+	rules, err := a.GetRetentionRules(ctx)
+	if err != nil {
+		return err
+	}
+	if len(rules) > 0 && !a.Config.Archiver.AllowDelete {
+		log.Warningf("Skipping %d retention rules, deleting is not allowed (see AllowDelete in the [Archiver] configuration)", len(rules))
+		return nil
+	}
+	now := common.GetNow(common.UOT_NS)
+	for _, rule := range rules {
+		keep, err := common.ParseDuration(rule.Keep)
+		if err != nil {
+			log.Errorf("Skipping retention rule %v (%v)", rule.Name, err)
+			continue
+		}
+		where, err := a.retentionWhere(rule)
+		if err != nil {
+			log.Errorf("Skipping retention rule %v (%v)", rule.Name, err)
+			continue
+		}
+		if uint64(keep.Nanoseconds()) >= now {
+			continue
+		}
+		params := &common.DataParams{
+			Where: where,
+			Begin: 0,
+			End:   now - uint64(keep.Nanoseconds()),
+		}
+		removed, err := a.DeleteData(ctx, params)
+		if err != nil {
+			return fmt.Errorf("Could not apply retention rule %v (%v)", rule.Name, err)
+		}
+		log.Infof("Retention rule %v removed readings before %v from %d streams", rule.Name, time.Unix(0, int64(params.End)), len(removed.UUIDs))
+	}
+	return nil
+}
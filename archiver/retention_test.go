@@ -0,0 +1,145 @@
+package archiver
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/archiver/internal/querylang"
+	"github.com/jf87/giles2/common"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// returns an archiver backed by the in-memory metadata store and the
+// embedded timeseries store
+func newTestArchiver(t *testing.T) (*Archiver, func()) {
+	db, cleanup := newTestEmbeddedDB(t)
+	a := &Archiver{
+		mdStore: newMemoryStore(&memoryConfig{}),
+		tsStore: db,
+		qp:      querylang.NewQueryProcessor(100, time.UTC),
+		metrics: make(metricMap),
+		Config:  &Config{},
+	}
+	a.metrics.addMetric("adds")
+	a.broker = NewBroker(a)
+	return a, cleanup
+}
+
+// runs the query and checks that it returns one series with the given values.
+// Unless times is nil, the readings must also be at the given times, in
+// minutes after base. NaN matches NaN. Returns the series, or nil if the
+// query failed
+func checkSeries(t *testing.T, a *Archiver, query string, base uint64, times []uint64, values []float64) *common.SmapMessage {
+	res, err := a.HandleQuery(context.Background(), query)
+	if err != nil {
+		t.Errorf("%v: %v", query, err)
+		return nil
+	}
+	result := res.(common.SmapMessageList)
+	if len(result) != 1 || len(result[0].Readings) != len(values) {
+		t.Errorf("%v: expected one series of %d readings, got %v", query, len(values), result)
+		return nil
+	}
+	for i, rdg := range result[0].Readings {
+		value := rdg.(*common.SmapNumberReading).Value
+		if times != nil && rdg.GetTime() != base+times[i]*uint64(time.Minute) {
+			t.Errorf("%v: expected %v at %v, got %v at %v", query, values[i], base+times[i]*uint64(time.Minute), value, rdg.GetTime())
+		} else if value != values[i] && !(math.IsNaN(value) && math.IsNaN(values[i])) {
+			t.Errorf("%v: expected %v, got %v at %v", query, values[i], value, rdg.GetTime())
+		}
+	}
+	return result[0]
+}
+
+func TestRetention(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	now := common.GetNow(common.UOT_NS)
+	old, recent := now-uint64(100*24*time.Hour), now-uint64(time.Hour)
+	soda, cory := common.NewUUID(), common.NewUUID()
+	for uuid, building := range map[common.UUID]string{soda: "Soda", cory: "Cory"} {
+		msg := embeddedTestMessage(uuid, old, recent)
+		msg.Path = "/" + building
+		msg.Metadata = common.Dict{"Building": building}
+		if err := a.AddData(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a.Config.Archiver.AllowDelete = true
+	for _, bad := range []common.RetentionRule{
+		{Name: "", Where: "Metadata/Building = 'Soda'", Keep: "90d"},
+		{Name: "soda", Where: "Metadata/Building = 'Soda'", Keep: "90 fortnights"},
+		{Name: "soda", Where: "Metadata/Building = ", Keep: "90d"},
+	} {
+		if err := a.SaveRetentionRule(bad, "test"); err == nil {
+			t.Errorf("Rule %+v should be rejected", bad)
+		}
+	}
+	if err := a.SaveRetentionRule(common.RetentionRule{Name: "soda", Where: "Metadata/Building = 'Soda'", Keep: "90d"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if rules, _ := a.GetRetentionRules(context.Background()); len(rules) != 1 || rules[0].Keep != "90d" {
+		t.Errorf("Expected the saved rule, got %v", rules)
+	}
+
+	if err := a.applyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	for uuid, count := range map[common.UUID]int{soda: 1, cory: 2} {
+		if res, _ := a.tsStore.GetData(context.Background(), []common.UUID{uuid}, 0, now); len(res[0].Readings) != count {
+			t.Errorf("Expected %d readings left in %v, got %v", count, uuid, res[0].Readings)
+		}
+	}
+
+	if err := a.RemoveRetentionRule("soda"); err != nil {
+		t.Fatal(err)
+	}
+	if rules, _ := a.GetRetentionRules(context.Background()); len(rules) != 0 {
+		t.Errorf("Expected no rules, got %v", rules)
+	}
+}
+
+func TestRetentionNeedsDelete(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	now := common.GetNow(common.UOT_NS)
+	uuid := common.NewUUID()
+	msg := embeddedTestMessage(uuid, now-uint64(100*24*time.Hour), now-uint64(time.Hour))
+	msg.Metadata = common.Dict{"Building": "Soda"}
+	if err := a.AddData(msg); err != nil {
+		t.Fatal(err)
+	}
+	rule := common.RetentionRule{Name: "all", Where: "Metadata/Building = 'Soda'", Keep: "1s"}
+
+	if err := a.SaveRetentionRule(rule, "test"); err == nil {
+		t.Error("Saving a retention rule should fail unless deleting is allowed")
+	}
+	if err := a.SaveDefinition(retentionDefinitions, []byte(`{"Name": "all", "Where": "Metadata/Building = 'Soda'", "Keep": "1s"}`), "test"); err == nil {
+		t.Error("Saving a retention rule through the admin API should fail unless deleting is allowed")
+	}
+
+	a.Config.Archiver.AllowDelete = true
+	a.Config.Authentication.Enabled = true
+	a.mdStore.(*memoryStore).users = []bson.M{
+		{"_id": "alice", "password": "x", "permissions": []interface{}{"delete"}},
+		{"_id": "bob", "password": "x", "permissions": []interface{}{}},
+	}
+	if err := a.SaveRetentionRule(rule, "bob"); err == nil {
+		t.Error("Saving a retention rule should fail without the delete permission")
+	}
+	if err := a.SaveRetentionRule(rule, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a rule saved while deleting was allowed is not applied once it is not
+	a.Config.Archiver.AllowDelete = false
+	if err := a.applyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := a.tsStore.GetData(context.Background(), []common.UUID{uuid}, 0, now); len(res[0].Readings) != 2 {
+		t.Errorf("Expected no readings to be removed, got %v", res[0].Readings)
+	}
+}
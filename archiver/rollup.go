@@ -0,0 +1,388 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+// Rollups continuously downsample streams. For every rollup definition and
+// every numeric stream matching its where clause, a background job computes
+// the min, mean, max and count of each window of the rollup's width and
+// writes them to four derived streams. The UUIDs of the derived streams are
+// generated from the source UUID and the rollup name (see rollupUUID), so
+// they can be found without a metadata lookup. Their metadata links them back
+// to the source stream:
+//
+//	Metadata/Rollup/Source, Metadata/Rollup/Name,
+//	Metadata/Rollup/Width, Metadata/Rollup/Statistic
+//
+// Only complete windows are written, and each window is computed once, so
+// readings that arrive after their window has been rolled up are not
+// reflected in the rollup. How far each source stream has been rolled up is
+// kept as a watermark alongside the rollup definitions, so that streams which
+// stopped reporting are not scanned again on every run.
+//
+// Window queries whose width is a multiple of a rollup's width, and whose
+// start is aligned to it, are answered from the derived streams as far as the
+// rollup has been computed, and from the raw readings for the remainder.
+
+var rollupStatistics = []string{"min", "mean", "max", "count"}
+
+// number of windows computed per request to the timeseries store
+const rollupBatch = 1000
+
+// watermarks are stored as named definitions, but are not managed through
+// the admin API
+const rollupWatermarks = "rollupwatermarks"
+
+// how far a rollup has been computed for one source stream
+type rollupWatermark struct {
+	// rollup name and source UUID, see watermarkName
+	Name string `bson:"name"`
+	// windows before this time (in nanoseconds) have been computed
+	Time uint64 `bson:"time"`
+}
+
+func watermarkName(rollup string, source common.UUID) string {
+	return rollup + "/" + string(source)
+}
+
+// returns the UUID of the stream holding the given statistic of the rollup
+// of the source stream
+func rollupUUID(source common.UUID, rollup, statistic string) common.UUID {
+	return common.NewDerivedUUID(source, "rollup/"+rollup+"/"+statistic)
+}
+
+// returns all rollup definitions
+func (a *Archiver) GetRollups(ctx context.Context) (common.Rollups, error) {
+	rollups := common.Rollups{}
+	err := a.mdStore.GetDefinitions(ctx, rollupDefinitions, &rollups)
+	return rollups, err
+}
+
+// checks and saves the rollup, replacing any rollup with the same name
+func (a *Archiver) SaveRollup(rollup common.Rollup) error {
+	if rollup.Name == "" {
+		return fmt.Errorf("Rollup needs a name")
+	}
+	if width, err := common.ParseDuration(rollup.Width); err != nil {
+		return err
+	} else if width <= 0 {
+		return fmt.Errorf("Rollup %v needs a positive width", rollup.Name)
+	}
+	if _, err := a.rollupWhere(rollup); err != nil {
+		return err
+	}
+	return a.mdStore.SaveDefinition(rollupDefinitions, rollup.Name, rollup)
+}
+
+func (a *Archiver) RemoveRollup(name string) error {
+	return a.mdStore.RemoveDefinition(rollupDefinitions, name)
+}
+
+func (a *Archiver) rollupWhere(rollup common.Rollup) (common.Dict, error) {
+	parsed := a.qp.Parse("select uuid where " + rollup.Where)
+	if parsed.Err != nil {
+		return nil, fmt.Errorf("Error (%v) in where clause of rollup %v (error at %v)", parsed.Err, rollup.Name, parsed.ErrPos)
+	}
+	// derived streams are never rolled up themselves
+	notDerived := common.Dict{"Metadata.Rollup|Source": common.Dict{"$exists": false}}
+	return common.Dict{"$and": []common.Dict{parsed.Where, notDerived}}, nil
+}
+
+func (a *Archiver) startRollups(interval time.Duration) {
+	log.Noticef("Computing rollups every %v", interval)
+	go func() {
+		for range time.Tick(interval) {
+			if err := a.applyRollups(); err != nil {
+				log.Errorf("Could not compute rollups (%v)", err)
+			}
+		}
+	}()
+}
+
+// computes all complete windows that have not been rolled up yet
+func (a *Archiver) applyRollups() error {
+	// rollups are computed in the background, so they are never given up on
+	ctx := context.Background()
+	rollups, err := a.GetRollups(ctx)
+	if err != nil {
+		return err
+	}
+	var saved []rollupWatermark
+	if err = a.mdStore.GetDefinitions(ctx, rollupWatermarks, &saved); err != nil {
+		return err
+	}
+	watermarks := make(map[string]uint64, len(saved))
+	for _, watermark := range saved {
+		watermarks[watermark.Name] = watermark.Time
+	}
+	now := common.GetNow(common.UOT_NS)
+	for _, rollup := range rollups {
+		width, err := common.ParseDuration(rollup.Width)
+		if err != nil || width <= 0 {
+			log.Errorf("Skipping rollup %v (bad width %v)", rollup.Name, rollup.Width)
+			continue
+		}
+		where, err := a.rollupWhere(rollup)
+		if err != nil {
+			log.Errorf("Skipping rollup %v (%v)", rollup.Name, err)
+			continue
+		}
+		uuids, err := a.mdStore.GetUUIDs(ctx, where.ToBson())
+		if err != nil {
+			return err
+		}
+		numeric, _, err := a.splitByStreamType(ctx, uuids)
+		if err != nil {
+			return err
+		}
+		for _, uuid := range numeric {
+			name := watermarkName(rollup.Name, uuid)
+			done, err := a.rollupStream(ctx, rollup, uint64(width.Nanoseconds()), uuid, watermarks[name], now)
+			if err != nil {
+				log.Errorf("Could not compute rollup %v of %v (%v)", rollup.Name, uuid, err)
+			}
+			if done > watermarks[name] {
+				if err = a.mdStore.SaveDefinition(rollupWatermarks, name, rollupWatermark{Name: name, Time: done}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// computes the windows of the source stream from the watermark until now,
+// and returns the new watermark. Windows before the returned time have been
+// written even if there is an error
+func (a *Archiver) rollupStream(ctx context.Context, rollup common.Rollup, width uint64, source common.UUID, watermark, now uint64) (uint64, error) {
+	start := watermark
+	if start == 0 {
+		// without a watermark, pick up after the last window that was
+		// written. The count stream is written last, so its last window
+		// is complete in all derived streams
+		last, err := a.tsStore.Prev(ctx, []common.UUID{rollupUUID(source, rollup.Name, "count")}, now)
+		if err != nil {
+			return 0, err
+		}
+		if len(last) > 0 && len(last[0].Readings) > 0 {
+			start = last[0].Readings[0].Time + width
+		} else {
+			first, err := a.tsStore.Next(ctx, []common.UUID{source}, 0)
+			if err != nil {
+				return 0, err
+			}
+			if len(first) == 0 || len(first[0].Readings) == 0 {
+				return 0, nil
+			}
+			start = first[0].Readings[0].Time - first[0].Readings[0].Time%width
+			if err = a.saveRollupMetadata(ctx, rollup, source); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	end := now - now%width
+	for start < end {
+		batchEnd := start + rollupBatch*width
+		if batchEnd > end {
+			batchEnd = end
+		}
+		windows, err := a.tsStore.WindowData(ctx, []common.UUID{source}, width, start, batchEnd)
+		if err != nil {
+			return start, err
+		}
+		if len(windows) > 0 && len(windows[0].Readings) > 0 {
+			if err = a.writeRollupWindows(rollup, source, windows[0].Readings); err != nil {
+				return start, err
+			}
+		}
+		start = batchEnd
+	}
+	return start, nil
+}
+
+func (a *Archiver) writeRollupWindows(rollup common.Rollup, source common.UUID, windows []*common.StatisticalNumberReading) error {
+	for _, stat := range rollupStatistics {
+		msg := &common.SmapMessage{UUID: rollupUUID(source, rollup.Name, stat), Readings: make([]common.Reading, len(windows))}
+		for i, window := range windows {
+			var value float64
+			switch stat {
+			case "min":
+				value = window.Min
+			case "mean":
+				value = window.Mean
+			case "max":
+				value = window.Max
+			case "count":
+				value = float64(window.Count)
+			}
+			msg.Readings[i] = &common.SmapNumberReading{Time: window.Time, UoT: common.UOT_NS, Value: value}
+		}
+		if err := a.tsStore.AddMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saves the metadata of the derived streams, which links them to the source
+func (a *Archiver) saveRollupMetadata(ctx context.Context, rollup common.Rollup, source common.UUID) error {
+	uom, err := a.mdStore.GetUnitOfMeasure(ctx, source)
+	if err != nil {
+		return err
+	}
+	for _, stat := range rollupStatistics {
+		unit := uom
+		if stat == "count" {
+			unit = "count"
+		}
+		msg := &common.SmapMessage{
+			UUID: rollupUUID(source, rollup.Name, stat),
+			Path: "/rollup/" + rollup.Name + "/" + string(source) + "/" + stat,
+			Metadata: common.Dict{
+				"Rollup|Source":    string(source),
+				"Rollup|Name":      rollup.Name,
+				"Rollup|Width":     rollup.Width,
+				"Rollup|Statistic": stat,
+			},
+			Properties: &common.SmapProperties{UnitOfTime: common.UOT_NS, UnitOfMeasure: unit, StreamType: common.NUMERIC_STREAM},
+		}
+		if _, err = a.mdStore.SaveTags(msg); err != nil {
+			return err
+		}
+		if err = a.recordVersions([]common.UUID{msg.UUID}, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type rollupWidth struct {
+	name  string
+	width uint64
+}
+
+// Answers a window query, using rollups where possible
+func (a *Archiver) windowData(ctx context.Context, uuids []common.UUID, width, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
+	rollups, err := a.GetRollups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var usable []rollupWidth
+	for _, rollup := range rollups {
+		w, err := common.ParseDuration(rollup.Width)
+		if err != nil || w <= 0 {
+			continue
+		}
+		rw := uint64(w.Nanoseconds())
+		if width%rw == 0 && start%rw == 0 {
+			usable = append(usable, rollupWidth{rollup.Name, rw})
+		}
+	}
+	if len(usable) == 0 {
+		return a.tsStore.WindowData(ctx, uuids, width, start, end)
+	}
+	// coarser rollups need fewer readings to be merged
+	sort.Slice(usable, func(i, j int) bool { return usable[i].width > usable[j].width })
+
+	var ret = make([]common.StatisticalNumbersResponse, len(uuids))
+	for i, uuid := range uuids {
+		if ret[i], err = a.windowDataFromRollups(ctx, uuid, usable, width, start, end); err != nil {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
+
+func (a *Archiver) windowDataFromRollups(ctx context.Context, uuid common.UUID, usable []rollupWidth, width, start, end uint64) (common.StatisticalNumbersResponse, error) {
+	for _, rollup := range usable {
+		last, err := a.tsStore.Prev(ctx, []common.UUID{rollupUUID(uuid, rollup.name, "count")}, end)
+		if err != nil {
+			return common.StatisticalNumbersResponse{}, err
+		}
+		if len(last) == 0 || len(last[0].Readings) == 0 {
+			continue
+		}
+		// the rollup has been computed up to here
+		computed := last[0].Readings[0].Time + rollup.width
+		if computed > end {
+			computed = end
+		}
+		split := start + (computed-start)/width*width
+		if computed <= start || split <= start {
+			continue
+		}
+		resp, ok, err := a.mergeRollup(ctx, uuid, rollup, width, start, split)
+		if err != nil {
+			return resp, err
+		} else if !ok {
+			continue
+		}
+		if split < end {
+			rest, err := a.tsStore.WindowData(ctx, []common.UUID{uuid}, width, split, end)
+			if err != nil {
+				return resp, err
+			}
+			if len(rest) > 0 {
+				resp.Readings = append(resp.Readings, rest[0].Readings...)
+			}
+		}
+		return resp, nil
+	}
+	res, err := a.tsStore.WindowData(ctx, []common.UUID{uuid}, width, start, end)
+	if err != nil || len(res) == 0 {
+		return common.StatisticalNumbersResponse{UUID: uuid}, err
+	}
+	return res[0], nil
+}
+
+// combines the rollup's windows in [start, end) into windows of the given
+// width. Returns false if the derived streams do not line up, e.g. because
+// computing the rollup was interrupted
+func (a *Archiver) mergeRollup(ctx context.Context, uuid common.UUID, rollup rollupWidth, width, start, end uint64) (common.StatisticalNumbersResponse, bool, error) {
+	var (
+		resp  = common.StatisticalNumbersResponse{UUID: uuid, Readings: []*common.StatisticalNumberReading{}}
+		stats = make(map[string][]*common.SmapNumberReading)
+		cur   *common.StatisticalNumberReading
+	)
+	for _, stat := range rollupStatistics {
+		data, err := a.tsStore.GetData(ctx, []common.UUID{rollupUUID(uuid, rollup.name, stat)}, start, end)
+		if err != nil {
+			return resp, false, err
+		}
+		if len(data) > 0 {
+			stats[stat] = data[0].Readings
+		}
+	}
+	counts := stats["count"]
+	for _, stat := range rollupStatistics {
+		if len(stats[stat]) != len(counts) {
+			return resp, false, nil
+		}
+	}
+	for i, count := range counts {
+		windowStart := start + ((count.Time-start)/width)*width
+		if cur == nil || cur.Time != windowStart {
+			if cur != nil {
+				cur.Mean /= float64(cur.Count)
+			}
+			cur = &common.StatisticalNumberReading{Time: windowStart, Min: stats["min"][i].Value, Max: stats["max"][i].Value, UoT: common.UOT_NS}
+			resp.Readings = append(resp.Readings, cur)
+		}
+		cur.Count += uint64(count.Value)
+		cur.Mean += stats["mean"][i].Value * count.Value
+		cur.Min = math.Min(cur.Min, stats["min"][i].Value)
+		cur.Max = math.Max(cur.Max, stats["max"][i].Value)
+	}
+	if cur != nil {
+		cur.Mean /= float64(cur.Count)
+	}
+	return resp, true, nil
+}
@@ -0,0 +1,109 @@
+package archiver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestRollup(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	base := uint64(1451606400000000000)
+	minute := uint64(time.Minute)
+	source := common.NewUUID()
+	msg := &common.SmapMessage{UUID: source, Path: "/temp", Metadata: common.Dict{"Building": "Soda"}}
+	// one reading per minute for 2 hours, valued by the minute
+	for i := uint64(0); i < 120; i++ {
+		msg.Readings = append(msg.Readings, &common.SmapNumberReading{Time: base + i*minute, UoT: common.UOT_NS, Value: float64(i)})
+	}
+	if err := a.AddData(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SaveRollup(common.Rollup{Name: "soda15", Where: "Metadata/Building = 'Soda'", Width: "15min"}); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := a.tsStore.WindowData(context.Background(), []common.UUID{source}, 60*minute, base, base+120*minute)
+
+	if err := a.applyRollups(); err != nil {
+		t.Fatal(err)
+	}
+	counts, _ := a.tsStore.GetData(context.Background(), []common.UUID{rollupUUID(source, "soda15", "count")}, base, base+120*minute)
+	if len(counts[0].Readings) != 8 || counts[0].Readings[0].Value != 15 {
+		t.Errorf("Expected 8 windows of 15 readings, got %v", counts[0].Readings)
+	}
+	// derived streams are linked to the source, and are not rolled up themselves
+	if derived, _ := a.mdStore.GetUUIDs(context.Background(), common.Dict{"Metadata.Rollup|Source": string(source)}.ToBson()); len(derived) != 4 {
+		t.Errorf("Expected 4 derived streams, got %v", derived)
+	}
+	if err := a.applyRollups(); err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := a.mdStore.GetUUIDs(context.Background(), nil); len(all) != 5 {
+		t.Errorf("Expected the source and 4 derived streams, got %d streams", len(all))
+	}
+
+	// with the raw readings gone, hourly windows can only come from the rollup
+	a.tsStore.DeleteData([]common.UUID{source}, base, base+120*minute)
+	res, err := a.windowData(context.Background(), []common.UUID{source}, 60*minute, base, base+120*minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res[0].Readings, expected[0].Readings) {
+		for i, rdg := range res[0].Readings {
+			t.Logf("got %+v expected %+v", rdg, expected[0].Readings[i])
+		}
+		t.Error("Windows from rollup differ from windows over raw readings")
+	}
+
+	// widths that are not a multiple of the rollup width use the raw readings
+	if res, _ = a.windowData(context.Background(), []common.UUID{source}, 10*minute, base, base+120*minute); len(res[0].Readings) != 0 {
+		t.Errorf("Expected no windows from deleted raw readings, got %v", res[0].Readings)
+	}
+}
+
+// counts the window queries
+type windowCountingStore struct {
+	TimeseriesStore
+	windows int
+}
+
+func (w *windowCountingStore) WindowData(ctx context.Context, uuids []common.UUID, width, start, end uint64) ([]common.StatisticalNumbersResponse, error) {
+	w.windows++
+	return w.TimeseriesStore.WindowData(ctx, uuids, width, start, end)
+}
+
+func TestRollupIdleStream(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	store := &windowCountingStore{TimeseriesStore: a.tsStore}
+	a.tsStore = store
+	// the stream stopped reporting a day ago
+	last := common.GetNow(common.UOT_NS) - uint64(24*time.Hour)
+	source := common.NewUUID()
+	msg := embeddedTestMessage(source, last-uint64(time.Hour), last)
+	msg.Path = "/temp"
+	msg.Metadata = common.Dict{"Building": "Soda"}
+	if err := a.AddData(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SaveRollup(common.Rollup{Name: "soda1h", Where: "Metadata/Building = 'Soda'", Width: "1h"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.applyRollups(); err != nil {
+		t.Fatal(err)
+	}
+	if store.windows == 0 {
+		t.Fatal("Expected the first run to compute windows")
+	}
+	store.windows = 0
+	if err := a.applyRollups(); err != nil {
+		t.Fatal(err)
+	}
+	if store.windows != 0 {
+		t.Errorf("Expected the idle stream not to be scanned again, got %d window queries", store.windows)
+	}
+}
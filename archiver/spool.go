@@ -0,0 +1,363 @@
+package archiver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jf87/giles2/common"
+	uuidlib "github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The spool is a write-ahead buffer in front of the timeseries store. When
+// the store rejects a write (e.g. because BtrDB is restarting) the readings
+// are appended to a log file on local disk instead of being dropped, and a
+// background goroutine replays the log into the store, oldest entry first,
+// once it accepts writes again. While there is a backlog, new writes are
+// appended to the log too, so that readings reach the store in the order
+// they arrived.
+//
+// The log is a sequence of BSON documents (see spoolEntry). The offset of the
+// first entry that has not been replayed is kept in a second file so that a
+// restart picks up where the replay left off. The offset is not synced after
+// every entry, so after a crash a few entries may be replayed twice; this is
+// harmless because the stores keep a single value per timestamp. Both files
+// are truncated whenever the backlog drains. An entry that cannot be read is
+// skipped: the replay picks up again at the next entry that can be read, and
+// the skipped entry is logged and counted as lost.
+
+const (
+	spoolLogFile    = "spool.log"
+	spoolOffsetFile = "spool.offset"
+)
+
+var SpoolFullErr = errors.New("Spool is full")
+
+type spoolConfig struct {
+	dir      string
+	maxBytes int64
+	retry    time.Duration
+	metrics  metricMap
+}
+
+type spoolEntry struct {
+	UUID   string    `bson:"u"`
+	Times  []int64   `bson:"t"`
+	Values []float64 `bson:"v"`
+}
+
+func (e *spoolEntry) message() *common.SmapMessage {
+	msg := &common.SmapMessage{UUID: common.UUID(e.UUID), Readings: make([]common.Reading, len(e.Times))}
+	for i := range e.Times {
+		msg.Readings[i] = &common.SmapNumberReading{Time: uint64(e.Times[i]), UoT: common.UOT_NS, Value: e.Values[i]}
+	}
+	return msg
+}
+
+// spoolStore wraps a TimeseriesStore. Only AddMessage goes through the
+// spool; all queries are passed to the wrapped store unchanged.
+type spoolStore struct {
+	TimeseriesStore
+	log      *os.File
+	offsetf  *os.File
+	offset   int64
+	size     int64
+	maxBytes int64
+	retry    time.Duration
+	metrics  metricMap
+	// closed to stop the replay
+	stop chan struct{}
+	sync.RWMutex
+}
+
+func newSpoolStore(store TimeseriesStore, c *spoolConfig) *spoolStore {
+	var err error
+	s := &spoolStore{
+		TimeseriesStore: store,
+		maxBytes:        c.maxBytes,
+		retry:           c.retry,
+		metrics:         c.metrics,
+		stop:            make(chan struct{}),
+	}
+	s.metrics.addMetric("spooled")
+	s.metrics.addMetric("replayed")
+	s.metrics.addMetric("spoolDepth")
+	s.metrics.addMetric("spoolBytes")
+	s.metrics.addMetric("spoolLost")
+
+	log.Noticef("Using write-ahead spool at %v", c.dir)
+	if err = os.MkdirAll(c.dir, 0755); err != nil {
+		log.Fatalf("Could not create spool directory %v (%v)", c.dir, err)
+	}
+	if s.log, err = os.OpenFile(filepath.Join(c.dir, spoolLogFile), os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		log.Fatalf("Could not open spool log (%v)", err)
+	}
+	if s.offsetf, err = os.OpenFile(filepath.Join(c.dir, spoolOffsetFile), os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		log.Fatalf("Could not open spool offset (%v)", err)
+	}
+	if err = s.recover(); err != nil {
+		log.Fatalf("Could not read spool (%v)", err)
+	}
+	if s.offset < s.size {
+		log.Warningf("Spool has a backlog of %d entries (%d bytes) to replay", s.metrics["spoolDepth"].Get(), s.size-s.offset)
+	}
+
+	go s.replayLoop()
+	return s
+}
+
+// reads the offset and counts the entries left in the log. A partial entry
+// at the end of the log is left over from an interrupted write and is removed
+func (s *spoolStore) recover() error {
+	info, err := s.log.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = info.Size()
+
+	var buf = make([]byte, 8)
+	if _, err = s.offsetf.ReadAt(buf, 0); err == nil {
+		s.offset = int64(binary.LittleEndian.Uint64(buf))
+	} else if err != io.EOF {
+		return err
+	}
+	if s.offset > s.size {
+		log.Warningf("Spool offset %d is past the end of the log, replaying from the start", s.offset)
+		s.offset = 0
+	}
+
+	var depth uint64
+	for pos := s.offset; pos < s.size; {
+		_, n, err := s.readEntry(pos)
+		if err != nil {
+			next := s.nextEntry(pos)
+			if next == s.size {
+				log.Warningf("Truncating spool at %d (%v)", pos, err)
+				s.size = pos
+				if err = s.log.Truncate(pos); err != nil {
+					return err
+				}
+				break
+			}
+			// entries follow, so this one is skipped by the replay
+			log.Warningf("Bad spool entry at %d will be skipped (%v)", pos, err)
+			n = next - pos
+		}
+		pos += n
+		depth += 1
+	}
+	s.metrics["spoolDepth"].Set(depth)
+	s.metrics["spoolBytes"].Set(uint64(s.size - s.offset))
+	return nil
+}
+
+// returns the entry starting at the given position in the log and its length
+func (s *spoolStore) readEntry(pos int64) (entry spoolEntry, n int64, err error) {
+	var length = make([]byte, 4)
+	if _, err = s.log.ReadAt(length, pos); err != nil {
+		return
+	}
+	n = int64(binary.LittleEndian.Uint32(length))
+	if n < 5 || pos+n > s.size {
+		err = fmt.Errorf("Bad entry length %d", n)
+		return
+	}
+	doc := make([]byte, n)
+	if _, err = s.log.ReadAt(doc, pos); err != nil {
+		return
+	}
+	if err = bson.Unmarshal(doc, &entry); err != nil {
+		return
+	}
+	if uuidlib.Parse(entry.UUID) == nil || len(entry.Times) != len(entry.Values) {
+		err = fmt.Errorf("Bad entry for stream %q with %d times and %d values", entry.UUID, len(entry.Times), len(entry.Values))
+	}
+	return
+}
+
+// returns the position of the first entry after pos that can be read, or the
+// end of the log if there is none. There are no markers between the entries,
+// so every position is tried
+func (s *spoolStore) nextEntry(pos int64) int64 {
+	for pos++; pos+5 <= s.size; pos++ {
+		if _, _, err := s.readEntry(pos); err == nil {
+			return pos
+		}
+	}
+	return s.size
+}
+
+func (s *spoolStore) saveOffset() error {
+	var buf = make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(s.offset))
+	_, err := s.offsetf.WriteAt(buf, 0)
+	return err
+}
+
+// Writes the message to the wrapped store if there is no backlog, else (or if
+// the store returns an error) appends it to the spool. Returns an error only if
+// the message could not be spooled either.
+func (s *spoolStore) AddMessage(msg *common.SmapMessage) error {
+	s.RLock()
+	if s.offset == s.size {
+		err := s.TimeseriesStore.AddMessage(msg)
+		s.RUnlock()
+		if err == nil {
+			return nil
+		}
+		log.Warningf("Timeseries store rejected readings for %v, spooling them (%v)", msg.UUID, err)
+	} else {
+		s.RUnlock()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	return s.append(msg)
+}
+
+// Caller must hold the write lock
+func (s *spoolStore) append(msg *common.SmapMessage) error {
+	entry := spoolEntry{
+		UUID:   string(msg.UUID),
+		Times:  make([]int64, len(msg.Readings)),
+		Values: make([]float64, len(msg.Readings)),
+	}
+	for i, rdg := range msg.Readings {
+		rdg.ConvertTime(common.UOT_NS)
+		num, ok := rdg.GetValue().(float64)
+		if !ok {
+			return fmt.Errorf("Bad number in message %v %v", msg.UUID, rdg)
+		}
+		entry.Times[i] = int64(rdg.GetTime())
+		entry.Values[i] = num
+	}
+	doc, err := bson.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if s.maxBytes > 0 && s.size+int64(len(doc)) > s.maxBytes {
+		return errors.Wrapf(SpoolFullErr, "Dropping %d readings for %v", len(msg.Readings), msg.UUID)
+	}
+	if _, err = s.log.WriteAt(doc, s.size); err != nil {
+		return errors.Wrap(err, "Could not write to spool")
+	}
+	if err = s.log.Sync(); err != nil {
+		return errors.Wrap(err, "Could not sync spool")
+	}
+	s.size += int64(len(doc))
+	s.metrics["spooled"].Mark(1)
+	s.metrics["spoolDepth"].Mark(1)
+	s.metrics["spoolBytes"].Set(uint64(s.size - s.offset))
+	return nil
+}
+
+func (s *spoolStore) replayLoop() {
+	ticker := time.NewTicker(s.retry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.replay(); err != nil {
+				log.Warningf("Could not replay spool, retrying in %v (%v)", s.retry, err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// stops the replay, closes the log and then the store; the backlog is
+// replayed after the next start
+func (s *spoolStore) Close() error {
+	close(s.stop)
+	s.Lock()
+	defer s.Unlock()
+	if err := s.saveOffset(); err != nil {
+		return err
+	}
+	if err := s.offsetf.Close(); err != nil {
+		return err
+	}
+	if err := s.log.Close(); err != nil {
+		return err
+	}
+	if closer, ok := s.TimeseriesStore.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// replays entries from the spool until it is empty or the store returns an
+// error. The lock is held for one entry at a time so that incoming writes
+// can still be appended while a long backlog drains
+func (s *spoolStore) replay() error {
+	for {
+		if done, err := s.replayOne(); done || err != nil {
+			return err
+		}
+	}
+}
+
+func (s *spoolStore) replayOne() (done bool, err error) {
+	// most of the time there is nothing to replay, and writes should not
+	// wait for the write lock then
+	s.RLock()
+	idle := s.size == 0
+	s.RUnlock()
+	if idle {
+		return true, nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.offset == s.size {
+		if s.size > 0 {
+			// backlog has drained, so start over with an empty log
+			if err = s.log.Truncate(0); err != nil {
+				return true, err
+			}
+			s.offset, s.size = 0, 0
+			if err = s.saveOffset(); err != nil {
+				return true, err
+			}
+			s.metrics["spoolDepth"].Set(0)
+			log.Notice("Spool backlog has been replayed")
+		}
+		return true, nil
+	}
+	entry, n, err := s.readEntry(s.offset)
+	if err != nil {
+		// skip to the next entry that can be read, so that the entries
+		// after the bad one are still replayed
+		next := s.nextEntry(s.offset)
+		log.Errorf("Lost the spooled readings of the bad entry at %d, skipping %d bytes (%v)", s.offset, next-s.offset, err)
+		s.metrics["spoolLost"].Mark(1)
+		if depth := s.metrics["spoolDepth"].Get(); depth > 0 {
+			s.metrics["spoolDepth"].Set(depth - 1)
+		}
+		s.offset = next
+		s.metrics["spoolBytes"].Set(uint64(s.size - s.offset))
+		// otherwise the bad entry is replayed again after a restart
+		if err = s.saveOffset(); err != nil {
+			return true, err
+		}
+		return false, nil
+	}
+	if err = s.TimeseriesStore.AddMessage(entry.message()); err != nil {
+		return true, err
+	}
+	s.offset += n
+	if err = s.saveOffset(); err != nil {
+		return true, err
+	}
+	s.metrics["replayed"].Mark(1)
+	s.metrics["spoolDepth"].Set(s.metrics["spoolDepth"].Get() - 1)
+	s.metrics["spoolBytes"].Set(uint64(s.size - s.offset))
+	return false, nil
+}
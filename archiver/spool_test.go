@@ -0,0 +1,139 @@
+package archiver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+// a timeseries store that can be told to reject writes
+type flakyStore struct {
+	*embeddedDB
+	down bool
+}
+
+func (f *flakyStore) AddMessage(msg *common.SmapMessage) error {
+	if f.down {
+		return errors.New("store is down")
+	}
+	return f.embeddedDB.AddMessage(msg)
+}
+
+func TestSpoolReplay(t *testing.T) {
+	db, cleanup := newTestEmbeddedDB(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "giles-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &flakyStore{embeddedDB: db, down: true}
+	config := &spoolConfig{dir: dir, retry: time.Hour, metrics: make(metricMap)}
+	spool := newSpoolStore(store, config)
+	uuid := common.NewUUID()
+	base := uint64(1451606400000000000)
+
+	if err = spool.AddMessage(embeddedTestMessage(uuid, base)); err != nil {
+		t.Fatal(err)
+	}
+	store.down = false
+	// there is a backlog, so this has to be spooled behind the first message
+	if err = spool.AddMessage(embeddedTestMessage(uuid, base+10)); err != nil {
+		t.Fatal(err)
+	}
+	if depth := config.metrics["spoolDepth"].Get(); depth != 2 {
+		t.Errorf("Spool depth should be 2, was %d", depth)
+	}
+	if res, _ := db.GetData(context.Background(), []common.UUID{uuid}, base, base+20); len(res[0].Readings) != 0 {
+		t.Errorf("Readings should not reach the store before replay, got %v", res[0].Readings)
+	}
+
+	// a reopened spool picks up the backlog
+	reopened := newSpoolStore(store, &spoolConfig{dir: dir, retry: time.Hour, metrics: make(metricMap)})
+	if err = reopened.replay(); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := db.GetData(context.Background(), []common.UUID{uuid}, base, base+20); len(res[0].Readings) != 2 {
+		t.Errorf("Expected 2 readings after replay, got %v", res[0].Readings)
+	}
+	if reopened.size != 0 || reopened.metrics["spoolDepth"].Get() != 0 {
+		t.Errorf("Spool should be empty after replay (size %d)", reopened.size)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	db, cleanup := newTestEmbeddedDB(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "giles-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &flakyStore{embeddedDB: db, down: true}
+	spool := newSpoolStore(store, &spoolConfig{dir: dir, maxBytes: 150, retry: time.Hour, metrics: make(metricMap)})
+	uuid := common.NewUUID()
+	if err = spool.AddMessage(embeddedTestMessage(uuid, 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err = spool.AddMessage(embeddedTestMessage(uuid, 3, 4)); err == nil {
+		t.Error("Expected an error once the spool is full")
+	}
+}
+
+func TestSpoolSkipBadEntry(t *testing.T) {
+	db, cleanup := newTestEmbeddedDB(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "giles-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &flakyStore{embeddedDB: db, down: true}
+	spool := newSpoolStore(store, &spoolConfig{dir: dir, retry: time.Hour, metrics: make(metricMap)})
+	var (
+		uuids  = []common.UUID{common.NewUUID(), common.NewUUID(), common.NewUUID()}
+		starts []int64
+		base   = uint64(1451606400000000000)
+	)
+	for _, uuid := range uuids {
+		starts = append(starts, spool.size)
+		if err = spool.AddMessage(embeddedTestMessage(uuid, base)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the entry in the middle keeps its length, but its stream is not a
+	// UUID anymore (after the length, type, name "u" and string length)
+	if _, err = spool.log.WriteAt([]byte("zz"), starts[1]+11); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart does not truncate the log at the bad entry
+	reopened := newSpoolStore(store, &spoolConfig{dir: dir, retry: time.Hour, metrics: make(metricMap)})
+	if depth := reopened.metrics["spoolDepth"].Get(); depth != 3 {
+		t.Errorf("Expected 3 spooled entries, spool depth is %d", depth)
+	}
+	store.down = false
+	if err = reopened.replay(); err != nil {
+		t.Fatal(err)
+	}
+	for i, uuid := range uuids {
+		res, _ := db.GetData(context.Background(), []common.UUID{uuid}, base, base+1)
+		if expected := 1 - i%2; len(res) != 1 || len(res[0].Readings) != expected {
+			t.Errorf("Expected %d readings of entry %d, got %v", expected, i, res)
+		}
+	}
+	if lost := reopened.metrics["spoolLost"].Get(); lost != 1 {
+		t.Errorf("Expected 1 lost entry, got %d", lost)
+	}
+	if reopened.size != 0 || reopened.metrics["spoolDepth"].Get() != 0 {
+		t.Errorf("Spool should be empty after replay (size %d)", reopened.size)
+	}
+}
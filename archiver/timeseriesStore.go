@@ -1,32 +1,42 @@
 package archiver
 
 import (
+	"context"
+
 	"github.com/jf87/giles2/common"
 )
 
+// Reads take the context of the query they serve and give up with its error
+// once the query is cancelled or its deadline passes. Writes are never
+// abandoned halfway, so they take no context
 type TimeseriesStore interface {
 	AddMessage(msg *common.SmapMessage) error
 
 	// list of UUIDs, reference time in nanoseconds
 	// Retrieves data before the reference time for the given streams.
 	//TODO: what is the return type here?
-	Prev([]common.UUID, uint64) ([]common.SmapNumbersResponse, error)
+	Prev(context.Context, []common.UUID, uint64) ([]common.SmapNumbersResponse, error)
 
 	// list of UUIDs, reference time in nanoseconds
 	// Retrieves data after the reference time for the given streams.
 	//TODO: what is the return type here?
-	Next([]common.UUID, uint64) ([]common.SmapNumbersResponse, error)
+	Next(context.Context, []common.UUID, uint64) ([]common.SmapNumbersResponse, error)
 
 	// uuids, start time, end time (both in nanoseconds)
-	GetData(uuids []common.UUID, start uint64, end uint64) ([]common.SmapNumbersResponse, error)
+	GetData(ctx context.Context, uuids []common.UUID, start uint64, end uint64) ([]common.SmapNumbersResponse, error)
+
+	// like GetData, but each stream starts at its own time in starts, and
+	// only its first limit readings are returned if limit is positive
+	GetDataPage(ctx context.Context, uuids []common.UUID, starts []uint64, end uint64, limit int) ([]common.SmapNumbersResponse, error)
 
 	// pointWidth is the log of the number of records to aggregate
-	StatisticalData(uuids []common.UUID, pointWidth int, start, end uint64) ([]common.StatisticalNumbersResponse, error)
+	StatisticalData(ctx context.Context, uuids []common.UUID, pointWidth int, start, end uint64) ([]common.StatisticalNumbersResponse, error)
 
 	// width in nanoseconds
-	WindowData(uuids []common.UUID, width, start, end uint64) ([]common.StatisticalNumbersResponse, error)
+	WindowData(ctx context.Context, uuids []common.UUID, width, start, end uint64) ([]common.StatisticalNumbersResponse, error)
 
-	// delete data
+	// delete data. Like the other writes, it takes no context; DELETE
+	// queries check theirs before they start deleting
 	DeleteData(uuids []common.UUID, start uint64, end uint64) error
 
 	// returns true if the timestamp can be represented in the database
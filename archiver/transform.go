@@ -0,0 +1,179 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jf87/giles2/common"
+)
+
+// Transforms compute a new series from the readings of each stream, e.g.
+//
+//	select rate(data in (now -1d, now)) where Metadata/Type = 'Temperature'
+//	select sum(increase(data in (now -1d, now))) where Metadata/Type = 'Meter'
+//
+// delta returns the difference to the previous reading and rate the
+// difference per second. increase and counterrate do the same for counters:
+// they treat a decreasing value as a counter reset, assume the counter has
+// restarted at 0 and so return the new value as the increase. integral
+// returns the running integral over time in value-seconds (e.g. kWs from kW),
+// and cumsum the running sum of the readings. Transforms can be nested and
+// wrapped in an aggregate, which then combines the transformed series.
+
+type transformFunc func(readings []*common.SmapNumberReading) []*common.SmapNumberReading
+
+var transforms = map[string]transformFunc{
+	"delta":       differenceReadings(difference),
+	"rate":        rateReadings(difference),
+	"increase":    differenceReadings(counterIncrease),
+	"counterrate": rateReadings(counterIncrease),
+	"integral":    integrateReadings,
+	"cumsum":      sumReadings,
+}
+
+// the seconds between two nanosecond timestamps
+func secondsBetween(from, to uint64) float64 {
+	return float64(to-from) / 1e9
+}
+
+func difference(prev, cur float64) float64 {
+	return cur - prev
+}
+
+// the increase from prev to cur, assuming that counters restart at 0
+func counterIncrease(prev, cur float64) float64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// returns a transform that computes diff between each reading and the
+// previous one
+func differenceReadings(diff func(prev, cur float64) float64) transformFunc {
+	return func(readings []*common.SmapNumberReading) []*common.SmapNumberReading {
+		var ret = []*common.SmapNumberReading{}
+		for i := 1; i < len(readings); i++ {
+			ret = append(ret, &common.SmapNumberReading{Time: readings[i].Time, UoT: common.UOT_NS, Value: diff(readings[i-1].Value, readings[i].Value)})
+		}
+		return ret
+	}
+}
+
+// returns a transform that computes diff between each reading and the
+// previous one per second
+func rateReadings(diff func(prev, cur float64) float64) transformFunc {
+	return func(readings []*common.SmapNumberReading) []*common.SmapNumberReading {
+		var ret = []*common.SmapNumberReading{}
+		for i := 1; i < len(readings); i++ {
+			seconds := secondsBetween(readings[i-1].Time, readings[i].Time)
+			if seconds <= 0 {
+				continue
+			}
+			ret = append(ret, &common.SmapNumberReading{Time: readings[i].Time, UoT: common.UOT_NS, Value: diff(readings[i-1].Value, readings[i].Value) / seconds})
+		}
+		return ret
+	}
+}
+
+// integrates with the trapezoidal rule, starting at 0 at the first reading
+func integrateReadings(readings []*common.SmapNumberReading) []*common.SmapNumberReading {
+	var (
+		ret   = []*common.SmapNumberReading{}
+		total float64
+	)
+	for i, rdg := range readings {
+		if i > 0 {
+			total += (readings[i-1].Value + rdg.Value) / 2 * secondsBetween(readings[i-1].Time, rdg.Time)
+		}
+		ret = append(ret, &common.SmapNumberReading{Time: rdg.Time, UoT: common.UOT_NS, Value: total})
+	}
+	return ret
+}
+
+func sumReadings(readings []*common.SmapNumberReading) []*common.SmapNumberReading {
+	var (
+		ret   = []*common.SmapNumberReading{}
+		total float64
+	)
+	for _, rdg := range readings {
+		total += rdg.Value
+		ret = append(ret, &common.SmapNumberReading{Time: rdg.Time, UoT: common.UOT_NS, Value: total})
+	}
+	return ret
+}
+
+// Returns the transforms to apply to each stream, innermost first. Every
+// function has to be a transform
+func lookupTransforms(functions []common.DataFunction) ([]transformFunc, error) {
+	var ret = make([]transformFunc, 0, len(functions))
+	for i, fn := range functions {
+		transform, found := transforms[fn.Name]
+		if found && len(fn.Args) > 0 {
+			return nil, fmt.Errorf("%v takes no arguments", fn.Name)
+		}
+		if found {
+			ret = append(ret, transform)
+			continue
+		}
+		if _, isAggregate := aggregates[fn.Name]; isAggregate && i+1 < len(functions) {
+			return nil, fmt.Errorf("Cannot apply %v to the result of %v", functions[i+1].Name, fn.Name)
+		}
+		return nil, fmt.Errorf("Unknown function %v", fn.Name)
+	}
+	return ret, nil
+}
+
+func applyTransforms(fns []transformFunc, readings []*common.SmapNumberReading) []*common.SmapNumberReading {
+	for _, fn := range fns {
+		readings = fn(readings)
+	}
+	return readings
+}
+
+// selects data for the matching streams within the range given by Begin/End
+// and applies the transforms in params.Functions to every stream
+func (a *Archiver) SelectTransformedData(ctx context.Context, params *common.DataParams) (result common.SmapMessageList, err error) {
+	fns, err := lookupTransforms(params.Functions)
+	if err != nil {
+		return
+	}
+	if err = a.prepareDataParams(ctx, params); err != nil {
+		return
+	}
+	// switch order so its consistent
+	if params.End < params.Begin {
+		params.Begin, params.End = params.End, params.Begin
+	}
+	// transforms are only defined for numeric streams
+	numeric, _, err := a.splitByStreamType(ctx, params.UUIDs)
+	if err != nil {
+		return
+	}
+	readings, err := a.numericSeries(ctx, numeric, params, "")
+	if err != nil {
+		return
+	}
+	for i := range readings {
+		readings[i].Readings = applyTransforms(fns, readings[i].Readings)
+	}
+	return a.packResults(params, readings), nil
+}
+
+// Fetches the readings of the numeric streams within the range given by
+// Begin/End. Windows are reduced to the value picked by windowSeries for the
+// named function
+func (a *Archiver) numericSeries(ctx context.Context, uuids []common.UUID, params *common.DataParams, name string) ([]common.SmapNumbersResponse, error) {
+	if !params.IsStatistical && !params.IsWindow {
+		return a.getData(ctx, uuids, params)
+	}
+	stats, err := a.statisticalData(ctx, uuids, params)
+	if err != nil {
+		return nil, err
+	}
+	var readings = make([]common.SmapNumbersResponse, len(stats))
+	for i, series := range windowSeries(name, stats) {
+		readings[i] = common.SmapNumbersResponse{UUID: stats[i].UUID, Readings: series}
+	}
+	return readings, nil
+}
@@ -0,0 +1,70 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestTransformQueries(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	base, minute := uint64(1451606400000000000), uint64(time.Minute)
+	// two cumulative meters reporting every minute, the first one is reset
+	// after its third reading
+	for i, values := range [][]float64{{10, 40, 100, 20, 50}, {0, 60, 120, 180, 240}} {
+		msg := &common.SmapMessage{UUID: common.NewUUID(), Path: fmt.Sprintf("/meter%d", i), Metadata: common.Dict{"Type": "Meter"}}
+		for j, value := range values {
+			msg.Readings = append(msg.Readings, &common.SmapNumberReading{Time: base + uint64(j)*minute, UoT: common.UOT_NS, Value: value})
+		}
+		if err := a.AddData(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		query  string
+		values [][]float64
+	}{
+		// only increase and counterrate treat the drop as a counter reset
+		{"select delta(data in (1451606400, 1451606700)) where Path = '/meter0'", [][]float64{{30, 60, -80, 30}}},
+		{"select increase(data in (1451606400, 1451606700)) where Path = '/meter0'", [][]float64{{30, 60, 20, 30}}},
+		{"select rate(data in (1451606400, 1451606700)) where Path = '/meter0'", [][]float64{{0.5, 1, -80.0 / 60, 0.5}}},
+		{"select counterrate(data in (1451606400, 1451606700)) where Path = '/meter0'", [][]float64{{0.5, 1, 20.0 / 60, 0.5}}},
+		{"select rate(data) in (1451606400, 1451606700) where Path = '/meter1'", [][]float64{{1, 1, 1, 1}}},
+		{"select cumsum(data in (1451606400, 1451606700)) where Path = '/meter0'", [][]float64{{10, 50, 150, 170, 220}}},
+		{"select integral(rate(data in (1451606400, 1451606700))) where Path = '/meter1'", [][]float64{{0, 60, 120, 180}}},
+		{"select sum(increase(data in (1451606400, 1451606700))) where Metadata/Type = 'Meter'", [][]float64{{90, 120, 80, 90}}},
+		// the data limit applies to the transformed readings
+		{"select increase(data in (1451606400, 1451606700) limit 2) where Metadata/Type = 'Meter'", [][]float64{{30, 60}, {60, 60}}},
+	} {
+		res, err := a.HandleQuery(context.Background(), test.query)
+		if err != nil {
+			t.Errorf("%v: %v", test.query, err)
+			continue
+		}
+		result := res.(common.SmapMessageList)
+		if len(result) != len(test.values) {
+			t.Errorf("%v: expected %d series, got %v", test.query, len(test.values), result)
+			continue
+		}
+		for i, msg := range result {
+			if len(msg.Readings) != len(test.values[i]) {
+				t.Errorf("%v: expected %v, got %v", test.query, test.values[i], msg.Readings)
+				continue
+			}
+			for j, rdg := range msg.Readings {
+				if value := rdg.(*common.SmapNumberReading).Value; value != test.values[i][j] {
+					t.Errorf("%v: expected %v, got %v at %v", test.query, test.values[i][j], value, rdg.GetTime())
+				}
+			}
+		}
+	}
+
+	if _, err := a.HandleQuery(context.Background(), "select delta(sum(data in (1451606400, 1451606700))) where Metadata/Type = 'Meter'"); err == nil {
+		t.Error("Transforms of aggregates should be rejected")
+	}
+}
@@ -0,0 +1,578 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+// Expressions compute a stream from other streams with +, -, *, / and
+// parentheses, e.g.
+//
+//	select data in (now -1d, now) as expr("a - b") with a = uuid '...', b = where Metadata/Type = 'Load'
+//
+// Each input is the sum of the streams matched by its where clause. The inputs
+// are aligned on the timestamps of all of their readings, and at each
+// timestamp every input contributes its most recent reading, the same way
+// aggregates combine streams. Points where an input has no reading yet, or
+// where the expression is undefined (e.g. a division by zero), are left out.
+//
+// An expression can be saved as a named virtual stream (see
+// SaveVirtualStream). Virtual streams get a UUID and metadata like any other
+// stream:
+//
+//	Metadata/Virtual/Name, Metadata/Virtual/Expression
+//
+// and their data, including data before/after a time and statistical and
+// window queries, is computed from their inputs.
+// Inputs never include virtual streams, so virtual streams cannot be defined
+// in terms of each other.
+
+// returns the UUID of the virtual stream with the given name
+func virtualUUID(name string) common.UUID {
+	return common.NewDerivedUUID("", "virtual/"+name)
+}
+
+// a parsed arithmetic expression
+type expression struct {
+	root ast.Expr
+	// the inputs used in the expression
+	inputs []string
+}
+
+func parseExpression(src string) (*expression, error) {
+	root, err := parser.ParseExpr(src)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse expression \"%v\" (%v)", src, err)
+	}
+	var (
+		inputs = make(map[string]bool)
+		bad    ast.Node
+	)
+	ast.Inspect(root, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case nil, *ast.ParenExpr:
+		case *ast.Ident:
+			inputs[n.Name] = true
+		case *ast.BasicLit:
+			if n.Kind != token.INT && n.Kind != token.FLOAT {
+				bad = n
+			}
+		case *ast.BinaryExpr:
+			if n.Op != token.ADD && n.Op != token.SUB && n.Op != token.MUL && n.Op != token.QUO {
+				bad = n
+			}
+		case *ast.UnaryExpr:
+			if n.Op != token.ADD && n.Op != token.SUB {
+				bad = n
+			}
+		default:
+			bad = n
+		}
+		return bad == nil
+	})
+	if bad != nil {
+		return nil, fmt.Errorf("Unsupported \"%v\" in expression \"%v\" (use numbers, inputs, +, -, *, / and parentheses)", src[bad.Pos()-1:bad.End()-1], src)
+	}
+	expr := &expression{root: root}
+	for input := range inputs {
+		expr.inputs = append(expr.inputs, input)
+	}
+	sort.Strings(expr.inputs)
+	return expr, nil
+}
+
+func (expr *expression) eval(values map[string]float64) float64 {
+	return evalNode(expr.root, values)
+}
+
+func evalNode(node ast.Expr, values map[string]float64) float64 {
+	switch n := node.(type) {
+	case *ast.ParenExpr:
+		return evalNode(n.X, values)
+	case *ast.Ident:
+		return values[n.Name]
+	case *ast.BasicLit:
+		num, _ := strconv.ParseFloat(n.Value, 64)
+		return num
+	case *ast.UnaryExpr:
+		if n.Op == token.SUB {
+			return -evalNode(n.X, values)
+		}
+		return evalNode(n.X, values)
+	case *ast.BinaryExpr:
+		x, y := evalNode(n.X, values), evalNode(n.Y, values)
+		switch n.Op {
+		case token.ADD:
+			return x + y
+		case token.SUB:
+			return x - y
+		case token.MUL:
+			return x * y
+		case token.QUO:
+			return x / y
+		}
+	}
+	return math.NaN()
+}
+
+// the where clause selecting the streams of an input of an expression.
+// Virtual streams are never inputs
+func inputWhere(where common.Dict) common.Dict {
+	notVirtual := common.Dict{"Metadata.Virtual|Name": common.Dict{"$exists": false}}
+	return common.Dict{"$and": []common.Dict{where, notVirtual}}
+}
+
+// returns the numeric streams of the named input
+func (a *Archiver) inputStreams(ctx context.Context, inputs map[string]common.Dict, name string) ([]common.UUID, error) {
+	where, found := inputs[name]
+	if !found {
+		return nil, fmt.Errorf("Unknown input %v in expression", name)
+	}
+	uuids, err := a.mdStore.GetUUIDs(ctx, inputWhere(where).ToBson())
+	if err != nil {
+		return nil, err
+	}
+	traceOf(ctx).resolved(len(uuids))
+	numeric, _, err := a.splitByStreamType(ctx, uuids)
+	return numeric, err
+}
+
+// evaluates the expression over the inputs within [begin, end)
+func (a *Archiver) evaluateExpression(ctx context.Context, expr *expression, inputs map[string]common.Dict, begin, end uint64) ([]*common.SmapNumberReading, error) {
+	var series = make([][]*common.SmapNumberReading, len(expr.inputs))
+	for i, name := range expr.inputs {
+		numeric, err := a.inputStreams(ctx, inputs, name)
+		if err != nil {
+			return nil, err
+		}
+		readings, err := a.tsStore.GetData(ctx, numeric, begin, end)
+		if err != nil {
+			return nil, err
+		}
+		var streams = make([][]*common.SmapNumberReading, len(readings))
+		for j, resp := range readings {
+			streams[j] = resp.Readings
+		}
+		series[i] = aggregateSeries(streams, true, sumValues)
+	}
+
+	var (
+		ret    = []*common.SmapNumberReading{}
+		next   = make([]int, len(series))
+		values = make(map[string]float64, len(series))
+	)
+	for {
+		var (
+			now   uint64
+			found bool
+		)
+		for i, readings := range series {
+			if next[i] < len(readings) && (!found || readings[next[i]].Time < now) {
+				now, found = readings[next[i]].Time, true
+			}
+		}
+		if !found {
+			return ret, nil
+		}
+		complete := true
+		for i, readings := range series {
+			for next[i] < len(readings) && readings[next[i]].Time <= now {
+				next[i] += 1
+			}
+			if next[i] == 0 {
+				complete = false
+				continue
+			}
+			values[expr.inputs[i]] = readings[next[i]-1].Value
+		}
+		if !complete {
+			continue
+		}
+		if value := expr.eval(values); !math.IsNaN(value) && !math.IsInf(value, 0) {
+			ret = append(ret, &common.SmapNumberReading{Time: now, UoT: common.UOT_NS, Value: value})
+		}
+	}
+}
+
+// selects the result of the expression in params.Expression within the range
+// given by Begin/End
+func (a *Archiver) SelectExpressionData(ctx context.Context, params *common.DataParams) (result common.SmapMessageList, err error) {
+	if params.IsStatistical || params.IsWindow || len(params.Functions) > 0 {
+		return result, fmt.Errorf("Expressions can only be evaluated over raw data")
+	}
+	expr, err := parseExpression(params.Expression)
+	if err != nil {
+		return
+	}
+	if err = a.prepareDataParams(ctx, params); err != nil {
+		return
+	}
+	// switch order so its consistent
+	if params.End < params.Begin {
+		params.Begin, params.End = params.End, params.Begin
+	}
+	readings, err := a.evaluateExpression(ctx, expr, params.Inputs, params.Begin, params.End)
+	if err != nil {
+		return
+	}
+	if params.Resample != nil {
+		readings = resampleSeries(readings, nil, nil, params.Begin, params.End, params.Resample)
+	}
+	result = a.packResults(params, []common.SmapNumbersResponse{{Readings: readings}})
+	for _, msg := range result {
+		msg.Metadata = common.Dict{"Expression": params.Expression}
+	}
+	return
+}
+
+// returns all virtual stream definitions
+func (a *Archiver) GetVirtualStreams(ctx context.Context) (common.VirtualStreams, error) {
+	virtual := common.VirtualStreams{}
+	err := a.mdStore.GetDefinitions(ctx, virtualDefinitions, &virtual)
+	return virtual, err
+}
+
+// checks and saves the virtual stream, replacing any virtual stream with the
+// same name, and saves the metadata of the stream
+func (a *Archiver) SaveVirtualStream(virtual common.VirtualStream) error {
+	if virtual.Name == "" {
+		return fmt.Errorf("Virtual stream needs a name")
+	}
+	expr, err := parseExpression(virtual.Expression)
+	if err != nil {
+		return err
+	}
+	inputs, err := a.virtualInputs(virtual)
+	if err != nil {
+		return err
+	}
+	for _, name := range expr.inputs {
+		if _, found := inputs[name]; !found {
+			return fmt.Errorf("Unknown input %v in expression of virtual stream %v", name, virtual.Name)
+		}
+	}
+	if err = a.mdStore.SaveDefinition(virtualDefinitions, virtual.Name, virtual); err != nil {
+		return err
+	}
+	a.clearVirtualStreams()
+	_, err = a.mdStore.SaveTags(&common.SmapMessage{
+		UUID: virtualUUID(virtual.Name),
+		Path: "/virtual/" + virtual.Name,
+		Metadata: common.Dict{
+			"Virtual|Name":       virtual.Name,
+			"Virtual|Expression": virtual.Expression,
+		},
+		Properties: &common.SmapProperties{UnitOfTime: common.UOT_NS, StreamType: common.NUMERIC_STREAM},
+	})
+	if err != nil {
+		return err
+	}
+	return a.recordVersions([]common.UUID{virtualUUID(virtual.Name)}, "")
+}
+
+// removes the virtual stream and its metadata
+func (a *Archiver) RemoveVirtualStream(name string) error {
+	if err := a.mdStore.RemoveDefinition(virtualDefinitions, name); err != nil {
+		return err
+	}
+	a.clearVirtualStreams()
+	if _, err := a.mdStore.RemoveDocs(common.Dict{"uuid": virtualUUID(name)}.ToBson()); err != nil {
+		return err
+	}
+	return a.recordVersions([]common.UUID{virtualUUID(name)}, "")
+}
+
+// parses the where clause of each input of the virtual stream
+func (a *Archiver) virtualInputs(virtual common.VirtualStream) (map[string]common.Dict, error) {
+	var inputs = make(map[string]common.Dict, len(virtual.Inputs))
+	for name, where := range virtual.Inputs {
+		parsed := a.qp.Parse("select uuid where " + where)
+		if parsed.Err != nil {
+			return nil, fmt.Errorf("Error (%v) in where clause of input %v of virtual stream %v (error at %v)", parsed.Err, name, virtual.Name, parsed.ErrPos)
+		}
+		inputs[name] = parsed.Where
+	}
+	return inputs, nil
+}
+
+// a virtual stream with its expression and inputs parsed
+type virtualStream struct {
+	definition common.VirtualStream
+	expr       *expression
+	inputs     map[string]common.Dict
+}
+
+// Virtual stream definitions are cached so that data queries do not have to
+// load them every time. Saving or removing a virtual stream clears the cache;
+// definitions changed through another archiver are picked up after
+// virtualCacheTTL
+const virtualCacheTTL = time.Minute
+
+type virtualCache struct {
+	sync.Mutex
+	// by UUID, nil until loaded
+	streams map[common.UUID]*virtualStream
+	loaded  time.Time
+}
+
+// returns the virtual streams by UUID
+func (a *Archiver) virtualStreams(ctx context.Context) (map[common.UUID]*virtualStream, error) {
+	a.virtual.Lock()
+	defer a.virtual.Unlock()
+	if a.virtual.streams != nil && time.Since(a.virtual.loaded) < virtualCacheTTL {
+		return a.virtual.streams, nil
+	}
+	definitions, err := a.GetVirtualStreams(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var streams = make(map[common.UUID]*virtualStream, len(definitions))
+	for _, definition := range definitions {
+		expr, err := parseExpression(definition.Expression)
+		if err != nil {
+			return nil, err
+		}
+		inputs, err := a.virtualInputs(definition)
+		if err != nil {
+			return nil, err
+		}
+		streams[virtualUUID(definition.Name)] = &virtualStream{definition: definition, expr: expr, inputs: inputs}
+	}
+	a.virtual.streams, a.virtual.loaded = streams, time.Now()
+	return streams, nil
+}
+
+func (a *Archiver) clearVirtualStreams() {
+	a.virtual.Lock()
+	a.virtual.streams = nil
+	a.virtual.Unlock()
+}
+
+// splits the uuids into the stored streams and the virtual streams among them
+func (a *Archiver) splitVirtual(ctx context.Context, uuids []common.UUID) (stored []common.UUID, virtual map[common.UUID]*virtualStream, err error) {
+	streams, err := a.virtualStreams(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	virtual = make(map[common.UUID]*virtualStream)
+	for _, uuid := range uuids {
+		if vs, found := streams[uuid]; found {
+			virtual[uuid] = vs
+		} else {
+			stored = append(stored, uuid)
+		}
+	}
+	return
+}
+
+// Fetches the readings of the stored streams among the uuids and computes the
+// readings of the virtual streams, keeping the order of the uuids
+func (a *Archiver) withVirtual(ctx context.Context, uuids []common.UUID, fetch func([]common.UUID) ([]common.SmapNumbersResponse, error), compute func(*virtualStream) ([]*common.SmapNumberReading, error)) ([]common.SmapNumbersResponse, error) {
+	stored, virtual, err := a.splitVirtual(ctx, uuids)
+	if err != nil {
+		return nil, err
+	}
+	if len(virtual) == 0 {
+		return fetch(uuids)
+	}
+	readings, err := fetch(stored)
+	if err != nil {
+		return readings, err
+	}
+	var byUUID = make(map[common.UUID]common.SmapNumbersResponse, len(readings))
+	for _, resp := range readings {
+		byUUID[resp.UUID] = resp
+	}
+	var ret = make([]common.SmapNumbersResponse, 0, len(uuids))
+	for _, uuid := range uuids {
+		vs, found := virtual[uuid]
+		if !found {
+			if resp, found := byUUID[uuid]; found {
+				ret = append(ret, resp)
+			}
+			continue
+		}
+		computed, err := compute(vs)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, common.SmapNumbersResponse{UUID: uuid, Readings: computed})
+	}
+	return ret, nil
+}
+
+// Fetches the readings of the numeric streams within [begin, end). Readings
+// of virtual streams are computed from their inputs
+func (a *Archiver) getRawData(ctx context.Context, uuids []common.UUID, begin, end uint64) ([]common.SmapNumbersResponse, error) {
+	return a.withVirtual(ctx, uuids, func(stored []common.UUID) ([]common.SmapNumbersResponse, error) {
+		return a.tsStore.GetData(ctx, stored, begin, end)
+	}, func(vs *virtualStream) ([]*common.SmapNumberReading, error) {
+		return a.evaluateExpression(ctx, vs.expr, vs.inputs, begin, end)
+	})
+}
+
+// Fetches the last reading of each numeric stream before ref. The reading of
+// a virtual stream is its value at the last reading of any of its inputs
+func (a *Archiver) prevData(ctx context.Context, uuids []common.UUID, ref uint64) ([]common.SmapNumbersResponse, error) {
+	return a.withVirtual(ctx, uuids, func(stored []common.UUID) ([]common.SmapNumbersResponse, error) {
+		return a.tsStore.Prev(ctx, stored, ref)
+	}, func(vs *virtualStream) ([]*common.SmapNumberReading, error) {
+		return a.evaluateBefore(ctx, vs, ref)
+	})
+}
+
+// Fetches the first reading of each numeric stream at or after ref. The
+// reading of a virtual stream is its value at the first reading of any of its
+// inputs
+func (a *Archiver) nextData(ctx context.Context, uuids []common.UUID, ref uint64) ([]common.SmapNumbersResponse, error) {
+	return a.withVirtual(ctx, uuids, func(stored []common.UUID) ([]common.SmapNumbersResponse, error) {
+		return a.tsStore.Next(ctx, stored, ref)
+	}, func(vs *virtualStream) ([]*common.SmapNumberReading, error) {
+		// find the first reading of any input, then evaluate up to it
+		var (
+			first uint64
+			found bool
+		)
+		for _, name := range vs.expr.inputs {
+			uuids, err := a.inputStreams(ctx, vs.inputs, name)
+			if err != nil {
+				return nil, err
+			}
+			next, err := a.tsStore.Next(ctx, uuids, ref)
+			if err != nil {
+				return nil, err
+			}
+			for _, resp := range next {
+				for _, rdg := range resp.Readings {
+					if !found || rdg.Time < first {
+						first, found = rdg.Time, true
+					}
+				}
+			}
+		}
+		if !found {
+			return []*common.SmapNumberReading{}, nil
+		}
+		return a.evaluateBefore(ctx, vs, first+1)
+	})
+}
+
+// evaluates the virtual stream at the last reading of any of its inputs
+// before ref, with every input contributing its most recent reading. Returns
+// no reading if an input has none or the expression is undefined there
+func (a *Archiver) evaluateBefore(ctx context.Context, vs *virtualStream, ref uint64) ([]*common.SmapNumberReading, error) {
+	var (
+		ret    = []*common.SmapNumberReading{}
+		values = make(map[string]float64, len(vs.expr.inputs))
+		last   uint64
+	)
+	for _, name := range vs.expr.inputs {
+		uuids, err := a.inputStreams(ctx, vs.inputs, name)
+		if err != nil {
+			return nil, err
+		}
+		prev, err := a.tsStore.Prev(ctx, uuids, ref)
+		if err != nil {
+			return nil, err
+		}
+		var found bool
+		for _, resp := range prev {
+			for _, rdg := range resp.Readings {
+				values[name] += rdg.Value
+				if rdg.Time > last {
+					last = rdg.Time
+				}
+				found = true
+			}
+		}
+		if !found {
+			return ret, nil
+		}
+	}
+	if value := vs.expr.eval(values); !math.IsNaN(value) && !math.IsInf(value, 0) {
+		ret = append(ret, &common.SmapNumberReading{Time: last, UoT: common.UOT_NS, Value: value})
+	}
+	return ret, nil
+}
+
+// Answers statistical and window queries over the numeric streams within the
+// range given by Begin/End. The windows of virtual streams are computed from
+// their readings
+func (a *Archiver) statisticalData(ctx context.Context, uuids []common.UUID, params *common.DataParams) ([]common.StatisticalNumbersResponse, error) {
+	stored, virtual, err := a.splitVirtual(ctx, uuids)
+	if err != nil {
+		return nil, err
+	}
+	fetch := func(uuids []common.UUID) ([]common.StatisticalNumbersResponse, error) {
+		if params.IsStatistical {
+			return a.tsStore.StatisticalData(ctx, uuids, params.PointWidth, params.Begin, params.End)
+		}
+		return a.windowData(ctx, uuids, params.Width, params.Begin, params.End)
+	}
+	if len(virtual) == 0 {
+		return fetch(uuids)
+	}
+	stats, err := fetch(stored)
+	if err != nil {
+		return stats, err
+	}
+	// statistical windows are aligned to multiples of 2^pointWidth
+	var start, width = params.Begin, params.Width
+	if params.IsStatistical {
+		if params.PointWidth < 0 || params.PointWidth > 62 {
+			return nil, fmt.Errorf("Invalid point width %v", params.PointWidth)
+		}
+		width = uint64(1) << uint(params.PointWidth)
+		start -= start % width
+	}
+	if width == 0 {
+		return nil, fmt.Errorf("Invalid window width %v", width)
+	}
+	var byUUID = make(map[common.UUID]common.StatisticalNumbersResponse, len(stats))
+	for _, resp := range stats {
+		byUUID[resp.UUID] = resp
+	}
+	var ret = make([]common.StatisticalNumbersResponse, 0, len(uuids))
+	for _, uuid := range uuids {
+		vs, found := virtual[uuid]
+		if !found {
+			if resp, found := byUUID[uuid]; found {
+				ret = append(ret, resp)
+			}
+			continue
+		}
+		readings, err := a.evaluateExpression(ctx, vs.expr, vs.inputs, start, params.End)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, common.StatisticalNumbersResponse{UUID: uuid, Readings: statisticalWindows(readings, start, width)})
+	}
+	return ret, nil
+}
+
+// computes count/min/mean/max over consecutive windows of width nanoseconds
+// beginning at start. Windows without readings are omitted
+func statisticalWindows(readings []*common.SmapNumberReading, start, width uint64) []*common.StatisticalNumberReading {
+	var ret = []*common.StatisticalNumberReading{}
+	for _, window := range windowReadings(readings, start, width) {
+		stat := &common.StatisticalNumberReading{Time: window.time, UoT: common.UOT_NS, Count: uint64(len(window.values)), Min: window.values[0], Max: window.values[0]}
+		for _, value := range window.values {
+			stat.Mean += value
+			stat.Min = math.Min(stat.Min, value)
+			stat.Max = math.Max(stat.Max, value)
+		}
+		stat.Mean /= float64(stat.Count)
+		ret = append(ret, stat)
+	}
+	return ret
+}
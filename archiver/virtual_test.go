@@ -0,0 +1,94 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jf87/giles2/common"
+)
+
+func TestExpressionQueries(t *testing.T) {
+	a, cleanup := newTestArchiver(t)
+	defer cleanup()
+	base, minute := uint64(1451606400000000000), uint64(time.Minute)
+	solar := common.NewUUID()
+	// the solar panel reports every two minutes, the two loads every minute
+	for i, stream := range []struct {
+		uuid   common.UUID
+		kind   string
+		times  []uint64
+		values []float64
+	}{
+		{solar, "Solar", []uint64{0, 2}, []float64{10, 20}},
+		{common.NewUUID(), "Load", []uint64{0, 1, 2, 3}, []float64{1, 2, 3, 4}},
+		{common.NewUUID(), "Load", []uint64{1, 2}, []float64{5, 5}},
+	} {
+		msg := &common.SmapMessage{UUID: stream.uuid, Path: fmt.Sprintf("/stream%d", i), Metadata: common.Dict{"Type": stream.kind}}
+		for j, t := range stream.times {
+			msg.Readings = append(msg.Readings, &common.SmapNumberReading{Time: base + t*minute, UoT: common.UOT_NS, Value: stream.values[j]})
+		}
+		if err := a.AddData(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(query string, values []float64) {
+		checkSeries(t, a, query, base, nil, values)
+	}
+
+	// the loads are summed, and every input holds its most recent reading
+	check(fmt.Sprintf(`select data in (1451606400, 1451606700) as expr("a - b") with a = uuid '%v', b = where Metadata/Type = 'Load'`, solar),
+		[]float64{9, 3, 12, 11})
+	check(`select data in (1451606400, 1451606700) as expr("(a + b) * 2 / 4") with a = where Metadata/Type = 'Solar', b = where Metadata/Type = 'Load'`,
+		[]float64{5.5, 8.5, 14, 14.5})
+
+	// saved expressions behave like any other stream
+	net := common.VirtualStream{Name: "net", Expression: "a - b", Inputs: map[string]string{"a": "Metadata/Type = 'Solar'", "b": "Metadata/Type = 'Load'"}}
+	if err := a.SaveVirtualStream(net); err != nil {
+		t.Fatal(err)
+	}
+	check(fmt.Sprintf("select data in (1451606400, 1451606700) where uuid = '%v'", virtualUUID("net")), []float64{9, 3, 12, 11})
+	check("select max(data in (1451606400, 1451606700)) where Metadata/Virtual/Name = 'net'", []float64{9, 3, 12, 11})
+	checkSeries(t, a, "select data before 1451606580 as ns where Metadata/Virtual/Name = 'net'", base, []uint64{2}, []float64{12})
+	checkSeries(t, a, "select data after 1451606460 as ns where Metadata/Virtual/Name = 'net'", base, []uint64{1}, []float64{3})
+	check("select max(window(2min) data in (1451606400, 1451606700)) where Metadata/Virtual/Name = 'net'", []float64{9, 12})
+	res, err := a.HandleQuery(context.Background(), "select statistical(37) data in (1451606400, 1451606700) where Metadata/Virtual/Name = 'net'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := res.(common.SmapMessageList); len(result) != 1 {
+		t.Errorf("Expected statistical data for the virtual stream, got %v", result)
+	} else {
+		var count uint64
+		for _, rdg := range result[0].Readings {
+			count += rdg.(*common.StatisticalNumberReading).Count
+		}
+		if count != 4 {
+			t.Errorf("Expected the statistical data to cover the 4 readings of the virtual stream, got %v", result[0].Readings)
+		}
+	}
+	// saving the virtual stream again replaces the cached definition
+	net.Expression = "b - a"
+	if err := a.SaveVirtualStream(net); err != nil {
+		t.Fatal(err)
+	}
+	check(fmt.Sprintf("select data in (1451606400, 1451606700) where uuid = '%v'", virtualUUID("net")), []float64{-9, -3, -12, -11})
+	if err := a.RemoveVirtualStream("net"); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := a.mdStore.GetUUIDs(context.Background(), common.Dict{"uuid": virtualUUID("net")}.ToBson()); len(found) != 0 {
+		t.Errorf("Expected the metadata of the removed virtual stream to be gone, got %v", found)
+	}
+
+	for _, virtual := range []common.VirtualStream{
+		{Name: "bad", Expression: "a - c", Inputs: map[string]string{"a": "Metadata/Type = 'Solar'"}},
+		{Name: "bad", Expression: "sqrt(a)", Inputs: map[string]string{"a": "Metadata/Type = 'Solar'"}},
+		{Name: "bad", Expression: "a", Inputs: map[string]string{"a": "Metadata/Type ="}},
+	} {
+		if err := a.SaveVirtualStream(virtual); err == nil {
+			t.Errorf("%+v should be rejected", virtual)
+		}
+	}
+}
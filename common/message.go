@@ -60,6 +60,9 @@ type SmapMessage struct {
 	Actuator   Dict            `json:",omitempty" msgpack:",omitempty"`
 	Metadata   Dict            `json:",omitempty" msgpack:",omitempty"`
 	Readings   []Reading       `json:",omitempty" msgpack:",omitempty"`
+	// the tag and value of the group this series belongs to, for results
+	// of GROUP BY queries
+	Group Dict `json:",omitempty" msgpack:",omitempty"`
 }
 
 // will insert a key string e.g. "Metadata.KeyName" and value e.g. "Value"
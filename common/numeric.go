@@ -0,0 +1,40 @@
+package common
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Metadata values are usually strings, even if they hold a number (e.g.
+// Metadata/Floor = "4"), so the numeric comparisons in where clauses (<, <=,
+// >, >=, between) accept numbers as well as strings that hold a decimal
+// number. Every metadata store has to coerce values the same way; stores that
+// cannot call NumericValue (e.g. the filters evaluated by Mongo) should
+// match strings against NumericPattern.
+const NumericPattern = `^\s*[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?\s*$`
+
+var numericRegexp = regexp.MustCompile(NumericPattern)
+
+// Returns the value of a number or numeric string, and false for anything
+// else
+func NumericValue(val interface{}) (float64, bool) {
+	if str, ok := val.(string); ok {
+		if !numericRegexp.MatchString(str) {
+			return 0, false
+		}
+		num, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		return num, err == nil
+	}
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
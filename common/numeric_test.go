@@ -0,0 +1,31 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestNumericValue(t *testing.T) {
+	for _, test := range []struct {
+		val     interface{}
+		num     float64
+		numeric bool
+	}{
+		{4, 4, true},
+		{uint8(4), 4, true},
+		{4.5, 4.5, true},
+		{"4", 4, true},
+		{" -4.5 ", -4.5, true},
+		{".5", 0.5, true},
+		{"1e3", 1000, true},
+		{"", 0, false},
+		{"4th", 0, false},
+		{"Inf", 0, false},
+		{"0x10", 0, false},
+		{true, 0, false},
+		{nil, 0, false},
+	} {
+		if num, numeric := NumericValue(test.val); num != test.num || numeric != test.numeric {
+			t.Errorf("NumericValue(%#v) should be (%v, %v) but was (%v, %v)", test.val, test.num, test.numeric, num, numeric)
+		}
+	}
+}
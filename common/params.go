@@ -15,6 +15,27 @@ type QueryParams interface {
 type TagParams struct {
 	Tags  []string
 	Where Dict
+	// for DELETE: only report what would be removed
+	DryRun bool
+	// for SELECT: return at most Limit documents (all of them if 0),
+	// skipping the first Offset
+	Limit  int
+	Offset int
+	// for SELECT: if not nil, the order of the documents
+	OrderBy *OrderBy
+	// for SELECT: the time (in nanoseconds) of the metadata to select
+	// from, or 0 for the current metadata
+	AsOf uint64
+	// for DELETE: who removes the tags, recorded in the metadata history
+	Writer string
+}
+
+// Orders documents or streams by the value of a tag. Numbers (also numeric
+// strings) come before other values and are compared by value; documents
+// without the tag always come last
+type OrderBy struct {
+	Tag        string
+	Descending bool
 }
 
 func (params TagParams) Dump() string {
@@ -29,6 +50,9 @@ func (params TagParams) Dump() string {
 type DistinctParams struct {
 	Tag   string
 	Where Dict
+	// the time (in nanoseconds) of the metadata to select from, or 0 for
+	// the current metadata
+	AsOf uint64
 }
 
 func (params DistinctParams) Dump() string {
@@ -40,6 +64,10 @@ func (params DistinctParams) Dump() string {
 type SetParams struct {
 	Set   Dict
 	Where Dict
+	// only report what would be changed
+	DryRun bool
+	// who changes the tags, recorded in the metadata history
+	Writer string
 }
 
 func (params SetParams) Dump() string {
@@ -59,6 +87,17 @@ type DataParams struct {
 	UUIDs []UUID
 	// restrict the number of streams returned
 	StreamLimit int
+	// skip this many streams, in order of their UUID
+	StreamOffset int
+	// if not nil, only the streams in the map are selected, and each
+	// of them from the given time (in nanoseconds) on
+	Resume map[UUID]uint64
+	// if not nil, the order in which streams are selected, before
+	// StreamOffset and StreamLimit are applied
+	OrderBy *OrderBy
+	// if not 0, the streams are selected by their metadata at this time
+	// (in nanoseconds)
+	AsOf uint64
 	// restrict the number of data points per stream returned.
 	// Defaults to the most recent
 	DataLimit int
@@ -76,6 +115,57 @@ type DataParams struct {
 	IsWindow bool
 	// we interpret this as nanoseconds
 	Width uint64
+	// for DELETE: only report what would be removed
+	DryRun bool
+	// functions applied to the readings, innermost first,
+	// e.g. sum(data in ...)
+	Functions []DataFunction
+	// if set, the query is evaluated separately for the streams sharing
+	// each value of this tag
+	GroupBy string
+	// if not nil, readings are resampled onto a regular grid
+	Resample *Resample
+	// the operators of an APPLY query, innermost first
+	Operators []DataFunction
+	// if set, the query returns this arithmetic expression (e.g. "a - b")
+	// evaluated over the streams matched by the where clause of each input
+	Expression string
+	Inputs     map[string]Dict
+}
+
+// Resampling returns one reading at every multiple of Width after the start
+// of the time range
+type Resample struct {
+	// nanoseconds between readings
+	Width uint64
+	// how the value at each point of the grid is computed:
+	// - previous: the most recent reading
+	// - linear: interpolated between the readings before and after
+	// - none: the mean of the readings until the next point
+	Method string
+	// what to do with points that have no value:
+	// - empty: leave them out
+	// - value: use FillValue
+	// - null: a reading with a null (NaN) value
+	// - previous: the value of the point before
+	Fill      string
+	FillValue float64
+}
+
+const (
+	RESAMPLE_PREVIOUS = "previous"
+	RESAMPLE_LINEAR   = "linear"
+	RESAMPLE_NONE     = "none"
+
+	FILL_VALUE    = "value"
+	FILL_NULL     = "null"
+	FILL_PREVIOUS = "previous"
+)
+
+// a function applied to the result of a data query
+type DataFunction struct {
+	Name string
+	Args []string
 }
 
 func (params DataParams) Dump() string {
@@ -3,6 +3,7 @@ package common
 import (
 	"encoding/json"
 	"gopkg.in/vmihailenco/msgpack.v2"
+	"math"
 	"strconv"
 )
 
@@ -21,11 +22,15 @@ type SmapNumberReading struct {
 	// uint64 timestamp
 	Time uint64
 	UoT  UnitOfTime
-	// value associated with this timestamp
+	// value associated with this timestamp. NaN marks a missing value (e.g.
+	// from fill(null)) and is serialized as null in JSON
 	Value float64
 }
 
 func (s *SmapNumberReading) MarshalJSON() ([]byte, error) {
+	if math.IsNaN(s.Value) {
+		return json.Marshal([]interface{}{json.Number(strconv.FormatUint(s.Time, 10)), nil})
+	}
 	floatString := strconv.FormatFloat(s.Value, 'f', -1, 64)
 	timeString := strconv.FormatUint(s.Time, 10)
 	return json.Marshal([]json.Number{json.Number(timeString), json.Number(floatString)})
@@ -154,6 +159,72 @@ func (s *StatisticalNumberReading) GetTime() uint64 {
 	return s.Time
 }
 
+// Reading implementation for the distribution of the readings within a
+// window: the values of the requested percentiles and/or a histogram
+type DistributionReading struct {
+	Time  uint64
+	UoT   UnitOfTime
+	Count uint64
+	// the requested percentiles (0-100) and their values
+	Percentiles []float64
+	Values      []float64
+	// the histogram bucket edges, and the number of readings in each bucket.
+	// Buckets[i] counts the readings in [Edges[i-1], Edges[i]); the first and
+	// last bucket are open-ended, so there is one more bucket than edges
+	Edges   []float64
+	Buckets []uint64
+}
+
+type distributionValue struct {
+	Count       uint64
+	Percentiles []float64 `json:",omitempty"`
+	Values      []float64 `json:",omitempty"`
+	Edges       []float64 `json:",omitempty"`
+	Buckets     []uint64  `json:",omitempty"`
+}
+
+func (s *DistributionReading) IsObject() bool {
+	return false
+}
+
+func (s *DistributionReading) IsStats() bool {
+	return false
+}
+
+func (s *DistributionReading) GetValue() interface{} {
+	return distributionValue{Count: s.Count, Percentiles: s.Percentiles, Values: s.Values, Edges: s.Edges, Buckets: s.Buckets}
+}
+
+func (s *DistributionReading) SetUOT(uot UnitOfTime) {
+	s.UoT = uot
+}
+
+func (s *DistributionReading) ConvertTime(to_uot UnitOfTime) (err error) {
+	guess := GuessTimeUnit(s.Time)
+	if to_uot != guess {
+		s.Time, err = convertTime(s.Time, guess, to_uot)
+		s.UoT = guess
+	}
+	return
+}
+
+func (s *DistributionReading) MarshalJSON() ([]byte, error) {
+	timeString := strconv.FormatUint(s.Time, 10)
+	return json.Marshal([]interface{}{json.Number(timeString), s.GetValue()})
+}
+
+func (s *DistributionReading) EncodeMsgpack(enc *msgpack.Encoder) error {
+	return enc.Encode(s.Time, s.Count, s.Percentiles, s.Values, s.Edges, s.Buckets)
+}
+
+func (s *DistributionReading) DecodeMsgpack(enc *msgpack.Decoder) error {
+	return enc.Decode(&s.Time, &s.Count, &s.Percentiles, &s.Values, &s.Edges, &s.Buckets)
+}
+
+func (s *DistributionReading) GetTime() uint64 {
+	return s.Time
+}
+
 type SmapNumbersResponse struct {
 	Readings []*SmapNumberReading
 	UUID     UUID `json:"uuid"`
@@ -0,0 +1,32 @@
+package common
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestDistributionReadingEncoding(t *testing.T) {
+	rdg := &DistributionReading{Time: 1451606400000000000, UoT: UOT_NS, Count: 4, Percentiles: []float64{50, 95}, Values: []float64{21, 23.5}}
+	bytes, err := json.Marshal(rdg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `[1451606400000000000,{"Count":4,"Percentiles":[50,95],"Values":[21,23.5]}]`; string(bytes) != expected {
+		t.Errorf("Expected JSON %v, got %s", expected, bytes)
+	}
+
+	rdg = &DistributionReading{Time: 1451606400000000000, Count: 4, Edges: []float64{20, 22}, Buckets: []uint64{1, 2, 1}}
+	if bytes, err = msgpack.Marshal(rdg); err != nil {
+		t.Fatal(err)
+	}
+	var decoded DistributionReading
+	if err = msgpack.Unmarshal(bytes, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rdg.Edges, decoded.Edges) || !reflect.DeepEqual(rdg.Buckets, decoded.Buckets) || decoded.Time != rdg.Time || decoded.Count != rdg.Count {
+		t.Errorf("Expected %+v after decoding msgpack, got %+v", rdg, decoded)
+	}
+}
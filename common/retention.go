@@ -0,0 +1,17 @@
+package common
+
+// RetentionRule removes readings older than Keep from every stream
+// matching the Where clause
+type RetentionRule struct {
+	// unique name of the rule
+	Name string `bson:"name"`
+	// where clause in the query language, e.g. "Metadata/Building = 'Soda'"
+	Where string `bson:"where"`
+	// how long readings are kept, e.g. "90d" or "12 hours"
+	Keep string `bson:"keep"`
+}
+
+type RetentionRules []RetentionRule
+
+func (rr RetentionRules) IsResult() {
+}
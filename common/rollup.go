@@ -0,0 +1,17 @@
+package common
+
+// Rollup continuously computes min/mean/max/count windows of Width for
+// every stream matching the Where clause, and stores them in derived streams
+type Rollup struct {
+	// unique name of the rollup
+	Name string `bson:"name"`
+	// where clause in the query language, e.g. "Metadata/Building = 'Soda'"
+	Where string `bson:"where"`
+	// width of the windows, e.g. "15min" or "1h"
+	Width string `bson:"width"`
+}
+
+type Rollups []Rollup
+
+func (r Rollups) IsResult() {
+}
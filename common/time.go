@@ -164,12 +164,101 @@ func ParseReltime(num, units string) (time.Duration, error) {
 		d *= time.Nanosecond
 	case "d", "day", "days":
 		d *= 24 * time.Hour
+	case "w", "wk", "week", "weeks":
+		d *= 7 * 24 * time.Hour
 	default:
-		err = fmt.Errorf("Invalid unit %v. Must be h,m,s,us,ms,ns,d", units)
+		err = fmt.Errorf("Invalid unit %v. Must be h,m,s,us,ms,ns,d,w", units)
 	}
 	return d, err
 }
 
+// A relative time in calendar months, which vary in length, and a duration
+type RelTime struct {
+	Months   int
+	Duration time.Duration
+}
+
+// Parses a relative time like ParseReltime, but also in months and years
+func ParseCalendarReltime(num, units string) (RelTime, error) {
+	var rel RelTime
+	switch units {
+	case "mo", "month", "months":
+		months, err := strconv.Atoi(num)
+		rel.Months = months
+		return rel, err
+	case "y", "yr", "year", "years":
+		years, err := strconv.Atoi(num)
+		rel.Months = 12 * years
+		return rel, err
+	}
+	d, err := ParseReltime(num, units)
+	if _, numErr := strconv.ParseInt(num, 10, 64); err != nil && numErr == nil {
+		err = fmt.Errorf("Invalid unit %v. Must be h,m,s,us,ms,ns,d,w,mo,y", units)
+	}
+	rel.Duration = d
+	return rel, err
+}
+
+func (r RelTime) Add(other RelTime) RelTime {
+	return RelTime{Months: r.Months + other.Months, Duration: AddDurations(r.Duration, other.Duration)}
+}
+
+// Adds the months in the time zone of t, and then the duration. Like
+// time.AddDate, months that overflow are normalized, so January 31 plus a
+// month is March 2 or 3
+func (r RelTime) AddTo(t time.Time) time.Time {
+	return t.AddDate(0, r.Months, 0).Add(r.Duration)
+}
+
+// Returns midnight at the start of the day, week (starting on Monday), month
+// or year containing t, in the time zone of t
+func StartOf(t time.Time, unit string) (time.Time, error) {
+	year, month, day := t.Date()
+	switch unit {
+	case "d", "day":
+	case "w", "wk", "week":
+		// days since Monday
+		day -= (int(t.Weekday()) + 6) % 7
+	case "mo", "month":
+		day = 1
+	case "y", "yr", "year":
+		month, day = time.January, 1
+	default:
+		return t, fmt.Errorf("Invalid unit %v. Must be day, week, month or year", unit)
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location()), nil
+}
+
+// Returns midnight on the last given weekday (e.g. "monday" or "mon") before
+// the day of t, in the time zone of t
+func LastWeekday(t time.Time, weekday string) (time.Time, error) {
+	var found = -1
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		name := strings.ToLower(wd.String())
+		if weekday == name || weekday == name[:3] {
+			found = int(wd)
+		}
+	}
+	if found < 0 {
+		return t, fmt.Errorf("Invalid weekday %v", weekday)
+	}
+	year, month, day := t.Date()
+	// 1 to 7 days back
+	day -= (int(t.Weekday())-found+6)%7 + 1
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location()), nil
+}
+
+// Parses a duration such as "90d", "12h" or "30 minutes" using the units
+// accepted by ParseReltime
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	split := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if split <= 0 {
+		return 0, fmt.Errorf("Invalid duration %v. Must be a number followed by h,m,s,us,ms,ns,d,w", s)
+	}
+	return ParseReltime(s[:split], strings.TrimSpace(s[split:]))
+}
+
 // Takes 2 durations and returns the result of them added together
 func AddDurations(d1, d2 time.Duration) time.Duration {
 	d1nano := d1.Nanoseconds()
@@ -0,0 +1,86 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		duration time.Duration
+		valid    bool
+	}{
+		{"90d", 90 * 24 * time.Hour, true},
+		{"2w", 14 * 24 * time.Hour, true},
+		{"12 hours", 12 * time.Hour, true},
+		{" 30min", 30 * time.Minute, true},
+		{"d", 0, false},
+		{"10", 0, false},
+		{"10 fortnights", 0, false},
+	} {
+		d, err := ParseDuration(test.input)
+		if test.valid && (err != nil || d != test.duration) {
+			t.Errorf("%v should parse to %v, got %v (%v)", test.input, test.duration, d, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%v should not parse, got %v", test.input, d)
+		}
+	}
+}
+
+func TestCalendarTimes(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	// a Wednesday
+	now := time.Date(2016, time.March, 30, 15, 4, 5, 0, berlin)
+	for _, test := range []struct {
+		unit  string
+		start time.Time
+	}{
+		{"day", time.Date(2016, time.March, 30, 0, 0, 0, 0, berlin)},
+		{"week", time.Date(2016, time.March, 28, 0, 0, 0, 0, berlin)},
+		{"month", time.Date(2016, time.March, 1, 0, 0, 0, 0, berlin)},
+		{"year", time.Date(2016, time.January, 1, 0, 0, 0, 0, berlin)},
+	} {
+		if start, err := StartOf(now, test.unit); err != nil || !start.Equal(test.start) {
+			t.Errorf("start of %v should be %v, got %v (%v)", test.unit, test.start, start, err)
+		}
+	}
+	for _, test := range []struct {
+		weekday string
+		last    time.Time
+	}{
+		{"tuesday", time.Date(2016, time.March, 29, 0, 0, 0, 0, berlin)},
+		{"wed", time.Date(2016, time.March, 23, 0, 0, 0, 0, berlin)},
+		{"thursday", time.Date(2016, time.March, 24, 0, 0, 0, 0, berlin)},
+	} {
+		if last, err := LastWeekday(now, test.weekday); err != nil || !last.Equal(test.last) {
+			t.Errorf("last %v should be %v, got %v (%v)", test.weekday, test.last, last, err)
+		}
+	}
+	if _, err := StartOf(now, "fortnight"); err == nil {
+		t.Error("start of fortnight should not parse")
+	}
+	if _, err := LastWeekday(now, "someday"); err == nil {
+		t.Error("last someday should not parse")
+	}
+
+	// the previous month, across the change to summer time
+	begin, _ := StartOf(now, "month")
+	rel, err := ParseCalendarReltime("-1", "month")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous := rel.AddTo(begin); !previous.Equal(time.Date(2016, time.February, 1, 0, 0, 0, 0, berlin)) {
+		t.Errorf("a month before %v should be February 1, got %v", begin, previous)
+	}
+	rel, err = ParseCalendarReltime("1", "y")
+	if err != nil || rel.Add(RelTime{Duration: time.Hour}).AddTo(begin) != time.Date(2017, time.March, 1, 1, 0, 0, 0, berlin) {
+		t.Errorf("a year and an hour after %v should be March 1 2017, 1am, got %v (%v)", begin, rel.AddTo(begin), err)
+	}
+	if _, err := ParseCalendarReltime("1", "fortnight"); err == nil {
+		t.Error("1 fortnight should not parse")
+	}
+}
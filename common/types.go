@@ -17,11 +17,78 @@ func NewUUID() UUID {
 	return UUID(uuid.NewV4().String())
 }
 
+// generates a v5 UUID that is always the same for the given UUID and name,
+// e.g. for a stream that is derived from another stream
+func NewDerivedUUID(from UUID, name string) UUID {
+	return UUID(uuid.NewV5(uuid.NamespaceOID, string(from)+"/"+name).String())
+}
+
 type DistinctResult []string
 
 func (dr DistinctResult) IsResult() {
 }
 
+// what a SET or DELETE query changed, or would change if it is a dry run
+type ChangeResult struct {
+	DryRun bool
+	// streams matching the where clause
+	UUIDs []UUID
+	// number of metadata documents updated or removed
+	Documents int
+	// number of readings DELETE removed, or a dry run would remove
+	Readings uint64
+}
+
+func (cr ChangeResult) IsResult() {
+}
+
+// one page of a truncated result. Next is the cursor that continues the
+// query where this page stopped
+type ResultPage struct {
+	Results SmapMessageList `json:"results"`
+	Next    string          `json:"next"`
+}
+
+func (rp ResultPage) IsResult() {
+}
+
+// how a query is evaluated, as reported by EXPLAIN
+type Explanation struct {
+	// the parsed query
+	Query interface{} `json:"query"`
+	// the filter Mongo evaluates for the where clause, or for each input
+	// of an expression
+	Filter bson.M            `json:"filter,omitempty"`
+	Inputs map[string]bson.M `json:"inputs,omitempty"`
+	// number of streams (or documents, for metadata queries) the where
+	// clause resolved to
+	UUIDs int `json:"uuids"`
+	// the store methods that fetched the data of a data query, in the order
+	// they were first called
+	Methods []string `json:"methods,omitempty"`
+	// how long each phase of the query took, in order
+	Timings []PhaseTiming `json:"timings"`
+}
+
+func (e Explanation) IsResult() {
+}
+
+type PhaseTiming struct {
+	Phase    string `json:"phase"`
+	Duration string `json:"duration"`
+}
+
+// A query with $1, $2, ... parameters that is evaluated with values bound
+// to them
+type PreparedQuery struct {
+	ID         string `json:"id"`
+	Query      string `json:"query"`
+	Parameters int    `json:"parameters"`
+}
+
+func (p PreparedQuery) IsResult() {
+}
+
 // a flat map for storing key-value pairs
 type Dict map[string]interface{}
 
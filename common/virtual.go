@@ -0,0 +1,19 @@
+package common
+
+// VirtualStream is a named stream whose readings are computed from other
+// streams when it is queried. It has a UUID and metadata like any other
+// stream, so it can be selected in data queries
+type VirtualStream struct {
+	// unique name of the virtual stream
+	Name string `bson:"name"`
+	// arithmetic expression over the inputs, e.g. "a - b"
+	Expression string `bson:"expression"`
+	// where clause in the query language selecting the streams of each
+	// input, e.g. {"a": "uuid = '...'", "b": "Metadata/Type = 'Load'"}
+	Inputs map[string]string `bson:"inputs"`
+}
+
+type VirtualStreams []VirtualStream
+
+func (v VirtualStreams) IsResult() {
+}
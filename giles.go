@@ -36,6 +36,10 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
 
 	signals := make(chan os.Signal, 1)
 	done := make(chan bool)
@@ -109,4 +113,5 @@ func main() {
 	}
 
 	<-done
+	a.Close()
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/jf87/giles2/archiver"
+)
+
+// Runs "giles migrate", which copies streams from the stores of one
+// configuration file to the stores of another, e.g.
+//
+//	giles migrate -from old.cfg -to new.cfg -where "Metadata/Site = 'Soda'"
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "giles.cfg", "Configuration file of the stores to copy from")
+	to := flags.String("to", "", "Configuration file of the stores to copy to")
+	where := flags.String("where", "", "Where clause selecting the streams to copy (default all streams)")
+	start := flags.Uint64("start", 0, "Copy readings at or after this time (s, ms, us or ns since the epoch)")
+	end := flags.Uint64("end", 0, "Copy readings before this time (default now)")
+	window := flags.Duration("window", 24*time.Hour, "Amount of time copied per request")
+	checkpoint := flags.String("checkpoint", "giles-migrate.json", "File that records progress so an interrupted migration can be resumed")
+	verify := flags.Bool("verify", true, "Compare the number of readings on both sides after copying")
+	flags.Parse(args)
+
+	// LoadConfig falls back to ./giles.cfg, which must not happen silently here
+	for _, file := range []string{*from, *to} {
+		if file == "" {
+			log.Fatal("migrate needs a source (-from) and destination (-to) configuration file")
+		} else if _, err := os.Stat(file); err != nil {
+			log.Fatalf("Could not read configuration file %v (%v)", file, err)
+		}
+	}
+
+	config := &archiver.MigrateConfig{
+		Source:      archiver.LoadConfig(*from),
+		Destination: archiver.LoadConfig(*to),
+		Where:       *where,
+		Start:       *start,
+		End:         *end,
+		Window:      *window,
+		Checkpoint:  *checkpoint,
+		Verify:      *verify,
+	}
+	if err := archiver.Migrate(config); err != nil {
+		log.Fatal(err)
+	}
+	log.Notice("Migration finished")
+}
@@ -18,6 +18,9 @@ const (
 	GilesStatisticsPIDString            = "2.0.8.6"
 	GilesQueryListResultPIDString       = "2.0.8.7"
 	GilesQueryErrorPIDString            = "2.0.8.9"
+	GilesQueryPageResultPIDString       = "2.0.8.10"
+	GilesQueryChangeResultPIDString     = "2.0.8.11"
+	GilesQueryExplanationPIDString      = "2.0.8.12"
 )
 
 var (
@@ -30,11 +33,17 @@ var (
 	GilesQueryMetadataResultPID   = bw.FromDotForm(GilesQueryMetadataResultPIDString)
 	GilesQueryTimeseriesResultPID = bw.FromDotForm(GilesQueryTimeseriesResultPIDString)
 	GilesArchiveRequestPID        = bw.FromDotForm(GilesArchiveRequestPIDString)
+	GilesQueryPageResultPID       = bw.FromDotForm(GilesQueryPageResultPIDString)
+	GilesQueryChangeResultPID     = bw.FromDotForm(GilesQueryChangeResultPIDString)
+	GilesQueryExplanationPID      = bw.FromDotForm(GilesQueryExplanationPIDString)
 )
 
 type KeyValueQuery struct {
 	Query string
 	Nonce uint32
+	// instead of a query, the cursor of a QueryPageResult to get the next
+	// page of a truncated result
+	Next string `msgpack:",omitempty"`
 }
 
 func (msg KeyValueQuery) ToMsgPackBW() (po bw.PayloadObject) {
@@ -71,6 +80,46 @@ func (msg QueryListResult) Dump() string {
 	}
 }
 
+// sent after the metadata and timeseries of a truncated result. Next is the
+// cursor that continues the query
+type QueryPageResult struct {
+	Nonce uint32
+	Next  string
+}
+
+func (msg QueryPageResult) ToMsgPackBW() (po bw.PayloadObject) {
+	po, _ = bw.CreateMsgPackPayloadObject(GilesQueryPageResultPID, msg)
+	return
+}
+
+// the result of SET and DELETE queries
+type QueryChangeResult struct {
+	Nonce  uint32
+	DryRun bool
+	// streams matching the where clause
+	UUIDs []string
+	// number of metadata documents updated or removed
+	Documents int
+	// number of readings removed, or a dry run would remove
+	Readings uint64
+}
+
+func (msg QueryChangeResult) ToMsgPackBW() (po bw.PayloadObject) {
+	po, _ = bw.CreateMsgPackPayloadObject(GilesQueryChangeResultPID, msg)
+	return
+}
+
+// the result of EXPLAIN queries, as the same JSON the HTTP API returns
+type QueryExplanation struct {
+	Nonce       uint32
+	Explanation string
+}
+
+func (msg QueryExplanation) ToMsgPackBW() (po bw.PayloadObject) {
+	po, _ = bw.CreateMsgPackPayloadObject(GilesQueryExplanationPID, msg)
+	return
+}
+
 type QueryMetadataResult struct {
 	Nonce uint32
 	Data  []KeyValueMetadata
@@ -93,6 +142,8 @@ type QueryTimeseriesResult struct {
 	Nonce uint32
 	Data  []Timeseries
 	Stats []Statistics
+	// results of percentile and histogram queries
+	Distributions []Distributions `msgpack:",omitempty"`
 }
 
 func (msg QueryTimeseriesResult) ToMsgPackBW() (po bw.PayloadObject) {
@@ -108,6 +159,9 @@ func (msg QueryTimeseriesResult) Dump() string {
 	for _, ts := range msg.Stats {
 		res += ts.Dump()
 	}
+	for _, ts := range msg.Distributions {
+		res += ts.Dump()
+	}
 	return res
 }
 
@@ -147,6 +201,8 @@ type Timeseries struct {
 	Path   string
 	Times  []uint64
 	Values []float64
+	// set for the results of GROUP BY queries
+	Group map[string]interface{} `msgpack:",omitempty"`
 }
 
 func (msg Timeseries) ToMsgPackBW() (po bw.PayloadObject) {
@@ -182,6 +238,8 @@ type Statistics struct {
 	Min   []float64
 	Mean  []float64
 	Max   []float64
+	// set for the results of GROUP BY queries
+	Group map[string]interface{} `msgpack:",omitempty"`
 }
 
 func (msg Statistics) ToMsgPackBW() (po bw.PayloadObject) {
@@ -210,6 +268,43 @@ func (msg Statistics) Dump() string {
 	}
 }
 
+// The percentiles or histogram of each window. Percentiles and Edges are the
+// same for every window
+type Distributions struct {
+	UUID        string
+	Times       []uint64
+	Count       []uint64
+	Percentiles []float64   `msgpack:",omitempty"`
+	Values      [][]float64 `msgpack:",omitempty"`
+	Edges       []float64   `msgpack:",omitempty"`
+	Buckets     [][]uint64  `msgpack:",omitempty"`
+	// set for the results of GROUP BY queries
+	Group map[string]interface{} `msgpack:",omitempty"`
+}
+
+func (msg Distributions) ToReadings() []common.Reading {
+	var res = make([]common.Reading, len(msg.Times))
+	for idx, time := range msg.Times {
+		rdg := &common.DistributionReading{Time: time, UoT: common.GuessTimeUnit(time), Count: msg.Count[idx], Percentiles: msg.Percentiles, Edges: msg.Edges}
+		if idx < len(msg.Values) {
+			rdg.Values = msg.Values[idx]
+		}
+		if idx < len(msg.Buckets) {
+			rdg.Buckets = msg.Buckets[idx]
+		}
+		res[idx] = rdg
+	}
+	return res
+}
+
+func (msg Distributions) Dump() string {
+	if bytes, err := json.MarshalIndent(map[string]interface{}{"UUID": msg.UUID, "Timeseries": msg.ToReadings()}, "", "  "); err != nil {
+		return fmt.Sprintf("%+v", msg)
+	} else {
+		return string(bytes)
+	}
+}
+
 type BWavable interface {
 	ToMsgPackBW() bw.PayloadObject
 }
@@ -1,9 +1,9 @@
 package bosswave
 
 import (
+	"context"
 	"fmt"
 	giles "github.com/jf87/giles2/archiver"
-	"github.com/jf87/giles2/common"
 	"github.com/jf87/giles2/plugins/bosswave/util"
 	"github.com/jf87/giles2/plugins/bosswave/views"
 	"github.com/op/go-logging"
@@ -137,7 +137,15 @@ func (bwh *BOSSWaveHandler) listenQueries(msg *bw.SimpleMessage) {
 	signalURI = fmt.Sprintf("%s,queries", fromVK[:len(fromVK)-1])
 
 	log.Infof("Got query %+v", query)
-	res, err := bwh.a.HandleQuery(query.Query)
+	var (
+		res giles.QueryResult
+		err error
+	)
+	if query.Next != "" {
+		res, err = bwh.a.HandleCursor(context.Background(), query.Next)
+	} else {
+		res, err = bwh.a.HandleQuery(context.Background(), query.Query)
+	}
 	if err != nil {
 		msg := QueryError{
 			Query: query.Query,
@@ -149,21 +157,10 @@ func (bwh *BOSSWaveHandler) listenQueries(msg *bw.SimpleMessage) {
 		if err := bwh.iface.PublishSignal(signalURI, po); err != nil {
 			log.Error(errors.Wrap(err, "Error sending response"))
 		}
+		return
 	}
 
-	var reply []bw.PayloadObject
-
-	switch t := res.(type) {
-	case common.SmapMessageList:
-		log.Debug("smap messages list")
-		pos := POsFromSmapMessageList(query.Nonce, t)
-		reply = append(reply, pos...)
-	case common.DistinctResult:
-		log.Debug("distinct list")
-		reply = append(reply, POFromDistinctResult(query.Nonce, t))
-	default:
-		log.Debug("type %T", res)
-	}
+	reply := POsFromQueryResult(query.Nonce, res)
 	log.Debugf("Reply on %s: %d", bwh.iface.SignalURI(signalURI), len(reply))
 
 	if err := bwh.iface.PublishSignal(signalURI, reply...); err != nil {
@@ -209,19 +206,8 @@ func (bwh *BOSSWaveHandler) StartSubscriber(vk string, query KeyValueQuery) *gil
 
 	go func(bws *BWSubscriber) {
 		for val := range bws.subscription.C {
-			var reply []bw.PayloadObject
 			log.Debugf("subscription got val %+v", val)
-			switch t := val.(type) {
-			case common.SmapMessageList:
-				log.Debugf("smap messages list %+v", t)
-				pos := POsFromSmapMessageList(query.Nonce, t)
-				reply = append(reply, pos...)
-			case common.DistinctResult:
-				log.Debugf("distinct list %+v", t)
-				reply = append(reply, POFromDistinctResult(query.Nonce, t))
-			default:
-				log.Debug("type %T", val)
-			}
+			reply := POsFromQueryResult(query.Nonce, val)
 			if err := bwh.iface.PublishSignal(bws.allURI, reply...); err != nil {
 				log.Error(errors.Wrap(err, "Could not publish reply"))
 			}
@@ -1,10 +1,51 @@
 package bosswave
 
 import (
+	"encoding/json"
+	giles "github.com/jf87/giles2/archiver"
 	"github.com/jf87/giles2/common"
 	bw "gopkg.in/immesys/bw2bind.v5"
 )
 
+// returns the payload objects that answer the query with the nonce
+func POsFromQueryResult(nonce uint32, res giles.QueryResult) []bw.PayloadObject {
+	switch t := res.(type) {
+	case common.SmapMessageList:
+		log.Debug("smap messages list")
+		return POsFromSmapMessageList(nonce, t)
+	case common.DistinctResult:
+		log.Debug("distinct list")
+		return []bw.PayloadObject{POFromDistinctResult(nonce, t)}
+	case common.ResultPage:
+		log.Debug("result page")
+		page := QueryPageResult{Nonce: nonce, Next: t.Next}
+		return append(POsFromSmapMessageList(nonce, t.Results), page.ToMsgPackBW())
+	case common.ChangeResult:
+		log.Debug("change result")
+		change := QueryChangeResult{
+			Nonce:     nonce,
+			DryRun:    t.DryRun,
+			UUIDs:     make([]string, len(t.UUIDs)),
+			Documents: t.Documents,
+			Readings:  t.Readings,
+		}
+		for i, uuid := range t.UUIDs {
+			change.UUIDs[i] = string(uuid)
+		}
+		return []bw.PayloadObject{change.ToMsgPackBW()}
+	case common.Explanation:
+		log.Debug("explanation")
+		bytes, err := json.Marshal(t)
+		if err != nil {
+			log.Errorf("Could not convert explanation to JSON (%v)", err)
+			return nil
+		}
+		return []bw.PayloadObject{QueryExplanation{Nonce: nonce, Explanation: string(bytes)}.ToMsgPackBW()}
+	}
+	log.Errorf("Cannot reply with a result of type %T", res)
+	return nil
+}
+
 func POFromDistinctResult(nonce uint32, msg common.DistinctResult) bw.PayloadObject {
 	res := QueryListResult{
 		Nonce: nonce,
@@ -28,10 +69,14 @@ func POsFromSmapMessageList(nonce uint32, list common.SmapMessageList) []bw.Payl
 		if len(msg.Metadata) > 0 || msg.Properties != nil {
 			mdRes.Data = append(mdRes.Data, ExtractMetadataToBW(msg))
 		}
-		if len(msg.Readings) > 0 && !msg.Readings[0].IsStats() {
-			tsRes.Data = append(tsRes.Data, ExtractTimeseriesToBW(msg))
+		if len(msg.Readings) == 0 {
+			continue
 		}
-		if len(msg.Readings) > 0 && msg.Readings[0].IsStats() {
+		if _, ok := msg.Readings[0].(*common.DistributionReading); ok {
+			tsRes.Distributions = append(tsRes.Distributions, ExtractDistributionsToBW(msg))
+		} else if !msg.Readings[0].IsStats() {
+			tsRes.Data = append(tsRes.Data, ExtractTimeseriesToBW(msg))
+		} else {
 			tsRes.Stats = append(tsRes.Stats, ExtractStatisticsToBW(msg))
 		}
 	}
@@ -57,6 +102,7 @@ func ExtractTimeseriesToBW(msg *common.SmapMessage) Timeseries {
 		UUID:   string(msg.UUID),
 		Times:  make([]uint64, len(msg.Readings)),
 		Values: make([]float64, len(msg.Readings)),
+		Group:  msg.Group,
 	}
 	for i, rdg := range msg.Readings {
 		if !rdg.IsObject() && !rdg.IsStats() {
@@ -76,6 +122,7 @@ func ExtractStatisticsToBW(msg *common.SmapMessage) Statistics {
 		Min:   make([]float64, len(msg.Readings)),
 		Mean:  make([]float64, len(msg.Readings)),
 		Max:   make([]float64, len(msg.Readings)),
+		Group: msg.Group,
 	}
 	for i, rdg := range msg.Readings {
 		if rdg.IsStats() {
@@ -89,3 +136,26 @@ func ExtractStatisticsToBW(msg *common.SmapMessage) Statistics {
 	}
 	return stats
 }
+
+func ExtractDistributionsToBW(msg *common.SmapMessage) Distributions {
+	dists := Distributions{
+		UUID:  string(msg.UUID),
+		Times: make([]uint64, len(msg.Readings)),
+		Count: make([]uint64, len(msg.Readings)),
+		Group: msg.Group,
+	}
+	for i, rdg := range msg.Readings {
+		if d, ok := rdg.(*common.DistributionReading); ok {
+			dists.Times[i] = d.Time
+			dists.Count[i] = d.Count
+			dists.Percentiles, dists.Edges = d.Percentiles, d.Edges
+			if len(d.Percentiles) > 0 {
+				dists.Values = append(dists.Values, d.Values)
+			}
+			if len(d.Edges) > 0 {
+				dists.Buckets = append(dists.Buckets, d.Buckets)
+			}
+		}
+	}
+	return dists
+}
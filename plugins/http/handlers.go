@@ -26,6 +26,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -74,9 +75,14 @@ func NewHTTPHandler(a *giles.Archiver) *HTTPHandler {
 	//r.POST("/api/query", h.handleSingleQuery)
 	//r.POST("/api/query/:key", basicAuth(h.handleSingleQuery, a))
 	r.POST("/api/query", basicAuth(h.handleSingleQuery, a))
+	r.POST("/api/prepare", basicAuth(h.handlePrepare, a))
+	r.POST("/api/prepared/:id", basicAuth(h.handlePrepared, a))
 	r.POST("/republish", basicAuth(h.handleRepublisher, a))
 	//r.POST("/republish/:key", basicAuth(h.handleRepublisher, a))
 	r.POST("/subscribe", h.handleSubscriber)
+	r.GET("/admin/:kind", basicAuth(h.handleListDefinitions, a))
+	r.POST("/admin/:kind", basicAuth(h.handleSaveDefinition, a))
+	r.DELETE("/admin/:kind/:name", basicAuth(h.handleRemoveDefinition, a))
 	//r.POST("/subscribe/:key", h.handleSubscriber)
 	return h
 }
@@ -166,13 +172,30 @@ func (h *HTTPHandler) handleAdd(rw http.ResponseWriter, req *http.Request, ps ht
 		return
 	}
 
+	// with ?flush=true, only respond once the readings have been written to
+	// the timeseries store, even if writes are coalesced
+	var (
+		waitFlush = req.URL.Query().Get("flush") == "true"
+		acks      []<-chan error
+	)
 	messages.CollapseToTimeseries()
 	for _, msg := range messages {
-		if addErr := h.a.AddData(msg); addErr != nil {
+		flushed, addErr := h.a.AddDataFlushedBy(msg, h.writer(req))
+		if addErr != nil {
 			rw.WriteHeader(500)
 			rw.Write([]byte(addErr.Error()))
 			return
 		}
+		acks = append(acks, flushed)
+	}
+	if waitFlush {
+		for _, flushed := range acks {
+			if flushErr := <-flushed; flushErr != nil {
+				rw.WriteHeader(500)
+				rw.Write([]byte(flushErr.Error()))
+				return
+			}
+		}
 	}
 
 	rw.WriteHeader(200)
@@ -187,6 +210,43 @@ func (h *HTTPHandler) handleSingleQuery(rw http.ResponseWriter, req *http.Reques
 
 	defer req.Body.Close()
 
+	var res giles.QueryResult
+	// the next page of a truncated result is fetched with the cursor
+	// returned alongside the previous page
+	if cursor := req.URL.Query().Get("cursor"); cursor != "" {
+		res, err = h.a.HandleCursorBy(req.Context(), cursor, h.writer(req))
+	} else {
+		if req.ContentLength > 1024 {
+			log.Errorf("HUGE query string with length %v. Aborting!", req.ContentLength)
+			rw.WriteHeader(500)
+			rw.Write([]byte("Your query is too big"))
+			return
+		}
+
+		querybuffer := make([]byte, req.ContentLength)
+		_, err = req.Body.Read(querybuffer)
+		res, err = h.a.HandleQueryBy(req.Context(), string(querybuffer), h.writer(req))
+	}
+	if err != nil {
+		log.Errorf("Error evaluating query: %v", err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	writer := json.NewEncoder(rw)
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = writer.Encode(res)
+	if err != nil {
+		log.Errorf("Error converting query results to JSON: %v", err)
+	}
+}
+
+// expects a query with $1, $2, ... parameters, and responds with the ID that
+// evaluates it, like {"id": "1f3a5c0e9b2d4a68", "query": "select data before now where uuid = $1;", "parameters": 1}
+func (h *HTTPHandler) handlePrepare(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
 	if req.ContentLength > 1024 {
 		log.Errorf("HUGE query string with length %v. Aborting!", req.ContentLength)
 		rw.WriteHeader(500)
@@ -194,19 +254,48 @@ func (h *HTTPHandler) handleSingleQuery(rw http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	querybuffer := make([]byte, req.ContentLength)
-	_, err = req.Body.Read(querybuffer)
-	res, err := h.a.HandleQuery(string(querybuffer))
+	querybuffer, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		log.Errorf("Error evaluating query: %v", err)
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	prepared, err := h.a.Prepare(string(querybuffer))
+	if err != nil {
+		log.Errorf("Error preparing query: %v", err)
 		rw.WriteHeader(500)
 		rw.Write([]byte(err.Error()))
 		return
 	}
-	writer := json.NewEncoder(rw)
 	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
-	err = writer.Encode(res)
+	if err = json.NewEncoder(rw).Encode(prepared); err != nil {
+		log.Errorf("Error converting prepared query to JSON: %v", err)
+	}
+}
+
+// expects the values of the parameters of the prepared query, like
+// ["d24325e6-1d7d-11e2-ad69-a7c2fa8dba61"]
+func (h *HTTPHandler) handlePrepared(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var params []interface{}
+	defer req.Body.Close()
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	decoder := json.NewDecoder(req.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&params); err != nil && err != io.EOF {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	res, err := h.a.HandlePreparedBy(req.Context(), ps.ByName("id"), params, h.writer(req))
 	if err != nil {
+		log.Errorf("Error evaluating prepared query: %v", err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err = json.NewEncoder(rw).Encode(res); err != nil {
 		log.Errorf("Error converting query results to JSON: %v", err)
 	}
 }
@@ -269,6 +358,71 @@ func (h *HTTPHandler) handleRepublisher(rw http.ResponseWriter, req *http.Reques
 	h.a.HandleNewSubscriber(subscription, "select * where "+string(querybuffer))
 }
 
+// lists the named definitions of a kind: /admin/retention, /admin/rollups or
+// /admin/virtual
+func (h *HTTPHandler) handleListDefinitions(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	kind := ps.ByName("kind")
+	if !giles.IsDefinitionKind(kind) {
+		rw.WriteHeader(404)
+		return
+	}
+	definitions, err := h.a.ListDefinitions(req.Context(), kind)
+	if err != nil {
+		log.Errorf("Error fetching %v definitions: %v", kind, err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err = json.NewEncoder(rw).Encode(definitions); err != nil {
+		log.Errorf("Error converting %v definitions to JSON: %v", kind, err)
+	}
+}
+
+// expects a definition of the kind, e.g.
+// retention: {"Name": "soda", "Where": "Metadata/Building = 'Soda'", "Keep": "90d"}
+// rollups: {"Name": "soda15", "Where": "Metadata/Building = 'Soda'", "Width": "15min"}
+// virtual: {"Name": "net", "Expression": "a - b", "Inputs": {"a": "Metadata/Type = 'Solar'", "b": "Metadata/Type = 'Load'"}}
+func (h *HTTPHandler) handleSaveDefinition(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	kind := ps.ByName("kind")
+	if !giles.IsDefinitionKind(kind) {
+		rw.WriteHeader(404)
+		return
+	}
+	defer req.Body.Close()
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if err = h.a.SaveDefinition(kind, data, h.writer(req)); err != nil {
+		log.Errorf("Error saving %v definition: %v", kind, err)
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+}
+
+func (h *HTTPHandler) handleRemoveDefinition(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if err := h.a.RemoveDefinition(ps.ByName("kind"), ps.ByName("name")); err != nil {
+		rw.WriteHeader(404)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+}
+
+// who sent the request, as recorded in the metadata history: the user if
+// requests are authenticated, otherwise the address of the client
+func (h *HTTPHandler) writer(req *http.Request) string {
+	if user, _, ok := req.BasicAuth(); ok && h.a.Config.Authentication.Enabled {
+		return user
+	}
+	return req.RemoteAddr
+}
+
 func handleJSON(r io.Reader) (decoded common.TieredSmapMessage, err error) {
 	decoder := json.NewDecoder(r)
 	decoder.UseNumber()
@@ -2,9 +2,12 @@
 package tcpjson
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"strconv"
@@ -108,7 +111,7 @@ func (tcp *TCPJSONHandler) handleAdd(conn net.Conn) {
 	}
 	messages.CollapseToTimeseries()
 	for _, msg := range messages {
-		if addErr := tcp.a.AddData(msg); addErr != nil {
+		if _, addErr := tcp.a.AddDataFlushedBy(msg, conn.RemoteAddr().String()); addErr != nil {
 			log.Errorf("Error handling JSON: %v", err)
 			tcp.errors <- err
 			conn.Close()
@@ -139,7 +142,34 @@ func (tcp *TCPJSONHandler) handleQuery(conn net.Conn) {
 		tcp.errors <- err
 		return
 	}
-	res, err := tcp.a.HandleQuery(string(querybuffer))
+	var (
+		res     giles.QueryResult
+		request struct {
+			Next    string        `json:"next"`
+			Prepare string        `json:"prepare"`
+			Execute string        `json:"execute"`
+			Params  []interface{} `json:"params"`
+		}
+		ctx, cancel = closedContext(conn)
+	)
+	defer cancel()
+	// instead of a query, clients can send
+	//   {"next": cursor} for the next page of a truncated result,
+	//   {"prepare": query} to prepare a query with $1, $2, ... parameters and
+	//   {"execute": id, "params": [...]} to evaluate a prepared query
+	decoder := json.NewDecoder(bytes.NewReader(bytes.TrimRight(querybuffer[:n], "\x00\r\n ")))
+	decoder.UseNumber()
+	isRequest := decoder.Decode(&request) == nil
+	switch {
+	case isRequest && request.Next != "":
+		res, err = tcp.a.HandleCursorBy(ctx, request.Next, conn.RemoteAddr().String())
+	case isRequest && request.Prepare != "":
+		res, err = tcp.a.Prepare(request.Prepare)
+	case isRequest && request.Execute != "":
+		res, err = tcp.a.HandlePreparedBy(ctx, request.Execute, request.Params, conn.RemoteAddr().String())
+	default:
+		res, err = tcp.a.HandleQueryBy(ctx, string(querybuffer), conn.RemoteAddr().String())
+	}
 	if err != nil {
 		log.Errorf("Error evaluating query: %v", err)
 		tcp.errors <- err
@@ -152,6 +182,21 @@ func (tcp *TCPJSONHandler) handleQuery(conn net.Conn) {
 	}
 }
 
+// returns a context that is cancelled once the connection fails, e.g. when the
+// client resets it, so that its query is given up on. A client that only
+// closes its side of the connection after sending its query (EOF) still gets
+// the results. Anything the client sends after its query is ignored
+func closedContext(conn net.Conn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// io.Copy reports EOF as a nil error
+		if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+			cancel()
+		}
+	}()
+	return ctx, cancel
+}
+
 func (tcp *TCPJSONHandler) listenSubscribe() {
 	for {
 		conn, err := tcp.subscribeConn.Accept()